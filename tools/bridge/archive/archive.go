@@ -0,0 +1,268 @@
+// Package archive keeps the bridge's inbound events and outbound sends
+// for /history and /archive/search: the newest records in memory with a
+// full-text index, and every record in an optional JSONL file that
+// retention compacts.
+package archive
+
+import (
+	"bufio"
+	"encoding/json"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/Tennen/Paimon/tools/bridge/config"
+)
+
+// Record is one inbound event or outbound send kept in the archive.
+type Record struct {
+	ID        int64     `json:"id"`
+	Kind      string    `json:"kind"`
+	Time      time.Time `json:"time"`
+	SessionID string    `json:"sessionId,omitempty"`
+	FromUser  string    `json:"fromUser,omitempty"`
+	ToUser    string    `json:"toUser,omitempty"`
+	AgentID   string    `json:"agentId,omitempty"`
+	MsgType   string    `json:"msgType,omitempty"`
+	Text      string    `json:"text,omitempty"`
+	MsgID     string    `json:"msgId,omitempty"`
+	Requester string    `json:"requester,omitempty"`
+	ErrCode   int       `json:"errcode,omitempty"`
+	Error     string    `json:"error,omitempty"`
+
+	// FullText is the untruncated content for session transcripts.
+	FullText string `json:"-"`
+}
+
+// Archive keeps the most recent records in memory and, when a file is
+// configured, appends every record to it as a JSON line.
+type Archive struct {
+	mu      sync.Mutex
+	records []Record
+	maxLen  int
+	nextID  int64
+	file    *os.File
+
+	// index maps each search term to the IDs of in-memory records containing
+	// it and how often it occurs there.
+	index map[string]map[int64]int
+}
+
+// Filter selects archive records; zero fields match everything.
+type Filter struct {
+	Kind      string
+	SessionID string
+	ToUser    string
+	Requester string
+	MsgType   string
+	Text      string
+	Since     time.Time
+	Until     time.Time
+	Limit     int
+}
+
+// New returns an in-memory archive holding up to maxLen records, or
+// config.DefaultArchiveRecords when maxLen is not positive.
+func New(maxLen int) *Archive {
+	if maxLen <= 0 {
+		maxLen = config.DefaultArchiveRecords
+	}
+	return &Archive{maxLen: maxLen, nextID: 1, index: make(map[string]map[int64]int)}
+}
+
+// Open loads the tail of an existing archive file and keeps it open for
+// appending. An empty path keeps the archive in memory only.
+func (a *Archive) Open(path string) error {
+	if path == "" {
+		return nil
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+		return err
+	}
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_RDWR|os.O_APPEND, 0o600)
+	if err != nil {
+		return err
+	}
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	for scanner.Scan() {
+		var rec Record
+		if err := json.Unmarshal(scanner.Bytes(), &rec); err != nil {
+			continue
+		}
+		a.storeLocked(rec)
+		if rec.ID >= a.nextID {
+			a.nextID = rec.ID + 1
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		_ = f.Close()
+		return err
+	}
+	a.file = f
+	return nil
+}
+
+// Close closes the archive file. Records appended afterwards are kept in
+// memory only, and Append returns the write error.
+func (a *Archive) Close() error {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if a.file == nil {
+		return nil
+	}
+	return a.file.Close()
+}
+
+func (a *Archive) Append(rec Record) error {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	return a.appendLocked(rec)
+}
+
+// appendLocked assigns the next ID to rec and stores it, reporting a failed
+// file write. The caller holds a.mu.
+func (a *Archive) appendLocked(rec Record) error {
+	rec.ID = a.nextID
+	a.nextID++
+	if rec.Time.IsZero() {
+		rec.Time = time.Now().UTC()
+	}
+	a.storeLocked(rec)
+	if a.file != nil {
+		line, err := json.Marshal(rec)
+		if err == nil {
+			_, err = a.file.Write(append(line, '\n'))
+		}
+		if err != nil {
+			slog.Error("archive write failed", "err", err)
+			return err
+		}
+	}
+	return nil
+}
+
+// storeLocked keeps rec in memory and in the search index, evicting the
+// oldest record beyond maxLen. The caller holds a.mu.
+func (a *Archive) storeLocked(rec Record) {
+	a.records = append(a.records, rec)
+	for _, term := range searchTerms(rec.Text) {
+		postings := a.index[term]
+		if postings == nil {
+			postings = make(map[int64]int)
+			a.index[term] = postings
+		}
+		postings[rec.ID]++
+	}
+	for len(a.records) > a.maxLen {
+		a.unindexLocked(a.records[0])
+		a.records = a.records[1:]
+	}
+}
+
+// unindexLocked removes rec from the search index. The caller holds a.mu.
+func (a *Archive) unindexLocked(rec Record) {
+	for _, term := range searchTerms(rec.Text) {
+		delete(a.index[term], rec.ID)
+		if len(a.index[term]) == 0 {
+			delete(a.index, term)
+		}
+	}
+}
+
+func (a *Archive) LastID() int64 {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	return a.nextID - 1
+}
+
+// FindMsgID returns the newest outbound record WeCom gave msgID, if it is
+// still in memory.
+func (a *Archive) FindMsgID(msgID string) (Record, bool) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	for i := len(a.records) - 1; i >= 0; i-- {
+		if rec := a.records[i]; rec.Kind == "outbound" && rec.MsgID == msgID {
+			return rec, true
+		}
+	}
+	return Record{}, false
+}
+
+// After returns up to limit records with an ID greater than id, oldest first.
+func (a *Archive) After(id int64, limit int) []Record {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	idx := sort.Search(len(a.records), func(i int) bool { return a.records[i].ID > id })
+	end := idx + limit
+	if end > len(a.records) {
+		end = len(a.records)
+	}
+	return append([]Record(nil), a.records[idx:end]...)
+}
+
+// Insert stores a replicated record under its original ID.
+func (a *Archive) Insert(rec Record) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if rec.ID < a.nextID {
+		return
+	}
+	a.nextID = rec.ID
+	a.appendLocked(rec)
+}
+
+// Search returns matching records, newest first.
+func (a *Archive) Search(f Filter) []Record {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	out := make([]Record, 0)
+	text := strings.ToLower(f.Text)
+	for i := len(a.records) - 1; i >= 0; i-- {
+		rec := a.records[i]
+		if f.Kind != "" && rec.Kind != f.Kind {
+			continue
+		}
+		if f.SessionID != "" && rec.SessionID != f.SessionID {
+			continue
+		}
+		if f.ToUser != "" && !containsFold(strings.FieldsFunc(rec.ToUser, func(r rune) bool { return r == '|' || r == ' ' }), f.ToUser) {
+			continue
+		}
+		if f.Requester != "" && rec.Requester != f.Requester {
+			continue
+		}
+		if f.MsgType != "" && !strings.EqualFold(rec.MsgType, f.MsgType) {
+			continue
+		}
+		if text != "" && !strings.Contains(strings.ToLower(rec.Text), text) {
+			continue
+		}
+		if !f.Since.IsZero() && rec.Time.Before(f.Since) {
+			continue
+		}
+		if !f.Until.IsZero() && rec.Time.After(f.Until) {
+			continue
+		}
+		out = append(out, rec)
+		if f.Limit > 0 && len(out) >= f.Limit {
+			break
+		}
+	}
+	return out
+}
+
+func containsFold(values []string, target string) bool {
+	for _, v := range values {
+		if strings.EqualFold(strings.TrimSpace(v), target) {
+			return true
+		}
+	}
+	return false
+}
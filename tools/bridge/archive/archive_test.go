@@ -0,0 +1,70 @@
+package archive
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/Tennen/Paimon/tools/bridge/config"
+)
+
+func TestFullTextSearch(t *testing.T) {
+	a := New(10)
+	a.Append(Record{Kind: "inbound", Text: "deploy finished"})
+	a.Append(Record{Kind: "inbound", Text: "部署完成 deploy deploy"})
+	a.Append(Record{Kind: "outbound", Text: "部署失败"})
+
+	hits, total := a.FullTextSearch("deploy", Filter{}, 0)
+	if total != 2 || hits[0].ID != 2 || hits[0].Score != 2 {
+		t.Fatalf("%d hits %+v", total, hits)
+	}
+	// CJK text is matched by bigrams, so 部署 finds both Chinese records.
+	hits, total = a.FullTextSearch("部署", Filter{Kind: "inbound"}, 0)
+	if total != 1 || hits[0].Highlight != "<em>部署</em>完成 deploy deploy" {
+		t.Fatalf("%d hits %+v", total, hits)
+	}
+	if hits, total = a.FullTextSearch("部署", Filter{Limit: 1}, 1); total != 2 || len(hits) != 1 || hits[0].ID != 2 {
+		t.Fatalf("%d hits %+v", total, hits)
+	}
+	if got := highlightText("a<b> Deploy", "deploy"); got != "a&lt;b&gt; <em>Deploy</em>" {
+		t.Fatal(got)
+	}
+}
+
+func TestCompact(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "archive.jsonl")
+	a := New(100)
+	if err := a.Open(path); err != nil {
+		t.Fatal(err)
+	}
+	old := time.Now().Add(-48 * time.Hour)
+	a.Append(Record{Kind: "inbound", MsgType: "image", Time: old, Text: "old image"})
+	a.Append(Record{Kind: "inbound", MsgType: "text", SessionID: "vip", Time: old, Text: "vip old"})
+	a.Append(Record{Kind: "inbound", MsgType: "text", Text: "new text"})
+
+	// Rules exempt the vip session from the policy's age limit.
+	p := &config.RetentionPolicy{MaxAgePeriod: 24 * time.Hour, Rules: []config.RetentionRule{{Sessions: []string{"vip"}}}}
+	removed, reclaimed, err := a.Compact(p, time.Now())
+	if err != nil || removed != 1 || reclaimed <= 0 {
+		t.Fatal(removed, reclaimed, err)
+	}
+	if hits, _ := a.FullTextSearch("image", Filter{}, 0); len(hits) != 0 {
+		t.Fatal("compacted record still indexed")
+	}
+	a.Append(Record{Kind: "inbound", Text: "after"})
+	raw, _ := os.ReadFile(path)
+	if strings.Count(string(raw), "\n") != 3 || strings.Contains(string(raw), "old image") {
+		t.Fatal(string(raw))
+	}
+
+	// A reopened archive continues the ID sequence.
+	b := New(100)
+	if err := b.Open(path); err != nil {
+		t.Fatal(err)
+	}
+	if len(b.Search(Filter{})) != 3 || b.LastID() != 4 {
+		t.Fatal(b.Search(Filter{}), b.LastID())
+	}
+}
@@ -0,0 +1,159 @@
+package archive
+
+import (
+	"bufio"
+	"encoding/json"
+	"io"
+	"os"
+	"time"
+
+	"github.com/Tennen/Paimon/tools/bridge/config"
+)
+
+// Compact removes the records p expires and, when the archive file is larger
+// than p.MaxMB, its oldest remaining records. Appends wait while the file is
+// rewritten. It returns the number of records removed and the bytes
+// reclaimed on disk.
+func (a *Archive) Compact(p *config.RetentionPolicy, now time.Time) (int, int64, error) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	removed, reclaimed := 0, int64(0)
+	var firstKept int64
+	if a.file != nil {
+		var err error
+		if removed, reclaimed, firstKept, err = a.compactFileLocked(p, now); err != nil {
+			return 0, 0, err
+		}
+	}
+	kept := make([]Record, 0, len(a.records))
+	for _, rec := range a.records {
+		if rec.ID < firstKept || expired(p, rec, now) {
+			a.unindexLocked(rec)
+			if a.file == nil {
+				removed++
+			}
+			continue
+		}
+		kept = append(kept, rec)
+	}
+	a.records = kept
+	return removed, reclaimed, nil
+}
+
+// compactFileLocked rewrites the archive file without expired records and
+// trims the oldest ones beyond p.MaxMB. It returns the lines removed, the
+// bytes reclaimed and the ID of the oldest record kept by the size limit.
+// The caller holds a.mu.
+func (a *Archive) compactFileLocked(p *config.RetentionPolicy, now time.Time) (int, int64, int64, error) {
+	if _, err := a.file.Seek(0, io.SeekStart); err != nil {
+		return 0, 0, 0, err
+	}
+	// First pass: size of each line, negative when the line expires.
+	sizes := make([]int64, 0)
+	var total, keptBytes int64
+	scanner := bufio.NewScanner(a.file)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	for scanner.Scan() {
+		n := int64(len(scanner.Bytes()) + 1)
+		total += n
+		var rec Record
+		if err := json.Unmarshal(scanner.Bytes(), &rec); err != nil || expired(p, rec, now) {
+			sizes = append(sizes, -n)
+			continue
+		}
+		sizes = append(sizes, n)
+		keptBytes += n
+	}
+	if err := scanner.Err(); err != nil {
+		return 0, 0, 0, err
+	}
+	if limit := int64(p.MaxMB) << 20; limit > 0 {
+		for i := 0; i < len(sizes) && keptBytes > limit; i++ {
+			if sizes[i] > 0 {
+				keptBytes -= sizes[i]
+				sizes[i] = -sizes[i]
+			}
+		}
+	}
+	if keptBytes == total {
+		return 0, 0, 0, nil
+	}
+
+	// Second pass: copy the kept lines to a temporary file and swap it in.
+	if _, err := a.file.Seek(0, io.SeekStart); err != nil {
+		return 0, 0, 0, err
+	}
+	path := a.file.Name()
+	tmp, err := os.OpenFile(path+".tmp", os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0o600)
+	if err != nil {
+		return 0, 0, 0, err
+	}
+	w := bufio.NewWriter(tmp)
+	removed := 0
+	firstKept := a.nextID
+	scanner = bufio.NewScanner(a.file)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	for i := 0; scanner.Scan() && i < len(sizes); i++ {
+		if sizes[i] < 0 {
+			removed++
+			continue
+		}
+		if firstKept == a.nextID {
+			var rec Record
+			_ = json.Unmarshal(scanner.Bytes(), &rec)
+			firstKept = rec.ID
+		}
+		_, _ = w.Write(scanner.Bytes())
+		_ = w.WriteByte('\n')
+	}
+	err = scanner.Err()
+	if err == nil {
+		err = w.Flush()
+	}
+	if err == nil {
+		err = tmp.Sync()
+	}
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Rename(path+".tmp", path)
+	}
+	if err != nil {
+		_ = os.Remove(path + ".tmp")
+		return 0, 0, 0, err
+	}
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_RDWR|os.O_APPEND, 0o600)
+	if err != nil {
+		return 0, 0, 0, err
+	}
+	_ = a.file.Close()
+	a.file = f
+	return removed, total - keptBytes, firstKept, nil
+}
+
+// expired reports whether the policy's age limit, or that of the
+// first rule matching rec, has passed.
+func expired(p *config.RetentionPolicy, rec Record, now time.Time) bool {
+	maxAge := p.MaxAgePeriod
+	for _, rule := range p.Rules {
+		if ruleMatches(rule, rec) {
+			maxAge = rule.MaxAgePeriod
+			break
+		}
+	}
+	return maxAge > 0 && now.Sub(rec.Time) > maxAge
+}
+
+func ruleMatches(rule config.RetentionRule, rec Record) bool {
+	if len(rule.MsgTypes) > 0 && !containsFold(rule.MsgTypes, rec.MsgType) {
+		return false
+	}
+	if len(rule.Sessions) > 0 && !containsFold(rule.Sessions, rec.SessionID) {
+		return false
+	}
+	if len(rule.Kinds) > 0 && !containsFold(rule.Kinds, rec.Kind) {
+		return false
+	}
+	return true
+}
@@ -0,0 +1,174 @@
+package archive
+
+import (
+	"html"
+	"sort"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+)
+
+// Hit is one full-text search result.
+type Hit struct {
+	Record
+	Score     int    `json:"score"`
+	Highlight string `json:"highlight"`
+}
+
+// FullTextSearch returns records whose text contains every term of query,
+// best matches first, after applying the filter's other fields. It also
+// returns the total number of matches before offset/limit.
+func (a *Archive) FullTextSearch(query string, f Filter, offset int) ([]Hit, int) {
+	terms := searchTerms(query)
+	if len(terms) == 0 {
+		return []Hit{}, 0
+	}
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	sort.Slice(terms, func(i, j int) bool { return len(a.index[terms[i]]) < len(a.index[terms[j]]) })
+	scores := make(map[int64]int)
+	for id, tf := range a.index[terms[0]] {
+		scores[id] = tf
+	}
+	for _, term := range terms[1:] {
+		postings := a.index[term]
+		for id := range scores {
+			if tf, ok := postings[id]; ok {
+				scores[id] += tf
+			} else {
+				delete(scores, id)
+			}
+		}
+	}
+
+	hits := make([]Hit, 0, len(scores))
+	for id, score := range scores {
+		idx := sort.Search(len(a.records), func(i int) bool { return a.records[i].ID >= id })
+		if idx >= len(a.records) || a.records[idx].ID != id {
+			continue
+		}
+		rec := a.records[idx]
+		if (f.Kind != "" && rec.Kind != f.Kind) || (f.SessionID != "" && rec.SessionID != f.SessionID) ||
+			(!f.Since.IsZero() && rec.Time.Before(f.Since)) || (!f.Until.IsZero() && rec.Time.After(f.Until)) {
+			continue
+		}
+		hits = append(hits, Hit{Record: rec, Score: score})
+	}
+	sort.Slice(hits, func(i, j int) bool {
+		if hits[i].Score != hits[j].Score {
+			return hits[i].Score > hits[j].Score
+		}
+		return hits[i].ID > hits[j].ID
+	})
+	total := len(hits)
+	if offset >= total {
+		return []Hit{}, total
+	}
+	hits = hits[offset:]
+	if f.Limit > 0 && len(hits) > f.Limit {
+		hits = hits[:f.Limit]
+	}
+	for i := range hits {
+		hits[i].Highlight = highlightText(hits[i].Text, query)
+	}
+	return hits, total
+}
+
+// isCJK reports whether r belongs to a script written without spaces, which
+// is indexed as character bigrams.
+func isCJK(r rune) bool {
+	return unicode.In(r, unicode.Han, unicode.Hiragana, unicode.Katakana, unicode.Hangul)
+}
+
+// searchSegments splits text into lowercased runs of letters/digits and runs
+// of CJK characters.
+func searchSegments(text string) []string {
+	segments := make([]string, 0)
+	var cur []rune
+	curCJK := false
+	flush := func() {
+		if len(cur) > 0 {
+			segments = append(segments, string(cur))
+			cur = cur[:0]
+		}
+	}
+	for _, r := range strings.ToLower(text) {
+		switch {
+		case isCJK(r):
+			if !curCJK {
+				flush()
+			}
+			curCJK = true
+			cur = append(cur, r)
+		case unicode.IsLetter(r) || unicode.IsDigit(r):
+			if curCJK {
+				flush()
+			}
+			curCJK = false
+			cur = append(cur, r)
+		default:
+			flush()
+		}
+	}
+	flush()
+	return segments
+}
+
+// searchTerms tokenizes text for the index and for queries: whole words for
+// alphabetic scripts, and bigrams for CJK runs (a lone CJK character is its
+// own term).
+func searchTerms(text string) []string {
+	terms := make([]string, 0)
+	for _, seg := range searchSegments(text) {
+		runes := []rune(seg)
+		if !isCJK(runes[0]) || len(runes) == 1 {
+			terms = append(terms, seg)
+			continue
+		}
+		for i := 0; i+1 < len(runes); i++ {
+			terms = append(terms, string(runes[i:i+2]))
+		}
+	}
+	return terms
+}
+
+// highlightText HTML-escapes text and wraps each occurrence of a query
+// segment in <em>…</em>.
+func highlightText(text, query string) string {
+	lower := strings.ToLower(text)
+	if len(lower) != len(text) {
+		lower = text
+	}
+	marks := make([]bool, len(text))
+	for _, seg := range searchSegments(query) {
+		for start := 0; ; {
+			i := strings.Index(lower[start:], seg)
+			if i < 0 {
+				break
+			}
+			for j := start + i; j < start+i+len(seg); j++ {
+				marks[j] = true
+			}
+			start += i + len(seg)
+		}
+	}
+	var b strings.Builder
+	open := false
+	for i := 0; i < len(text); {
+		_, size := utf8.DecodeRuneInString(text[i:])
+		if marks[i] != open {
+			if open {
+				b.WriteString("</em>")
+			} else {
+				b.WriteString("<em>")
+			}
+			open = marks[i]
+		}
+		b.WriteString(html.EscapeString(text[i : i+size]))
+		i += size
+	}
+	if open {
+		b.WriteString("</em>")
+	}
+	return b.String()
+}
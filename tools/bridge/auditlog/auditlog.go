@@ -0,0 +1,127 @@
+// Package auditlog records who called the bridge's /proxy API, what each
+// call targeted and how WeCom answered, for GET /admin/audit.
+package auditlog
+
+import (
+	"bufio"
+	"encoding/json"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"slices"
+	"sync"
+	"time"
+)
+
+// Entry records one /proxy call: who made it, what it targeted and how
+// WeCom answered. Message content and credentials are never recorded.
+type Entry struct {
+	ID         int64     `json:"id"`
+	Time       time.Time `json:"time"`
+	RequestID  string    `json:"requestId,omitempty"`
+	Identity   string    `json:"identity"`
+	Method     string    `json:"method"`
+	Endpoint   string    `json:"endpoint"`
+	Status     int       `json:"status"`
+	AgentID    string    `json:"agentId,omitempty"`
+	ToUser     string    `json:"toUser,omitempty"`
+	ToParty    string    `json:"toParty,omitempty"`
+	ToTag      string    `json:"toTag,omitempty"`
+	ChatID     string    `json:"chatId,omitempty"`
+	MsgType    string    `json:"msgType,omitempty"`
+	ErrCode    *int      `json:"errcode,omitempty"`
+	GRPCStatus int       `json:"grpcStatus,omitempty"`
+	Error      string    `json:"error,omitempty"`
+	DurationMS int64     `json:"durationMs"`
+}
+
+// Log appends every entry to a file that is never rewritten and keeps
+// the newest maxLen in memory for queries.
+type Log struct {
+	mu      sync.Mutex
+	entries []Entry
+	maxLen  int
+	nextID  int64
+	file    *os.File
+}
+
+// New returns an in-memory log keeping the newest maxLen entries.
+func New(maxLen int) *Log {
+	return &Log{maxLen: maxLen, nextID: 1}
+}
+
+// Open loads the newest entries of an existing audit file and keeps it open
+// for appending. An empty path keeps the log in memory only.
+func (l *Log) Open(path string) error {
+	if path == "" {
+		return nil
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+		return err
+	}
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_RDWR|os.O_APPEND, 0o600)
+	if err != nil {
+		return err
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	for scanner.Scan() {
+		var entry Entry
+		if err := json.Unmarshal(scanner.Bytes(), &entry); err != nil {
+			continue
+		}
+		l.storeLocked(entry)
+		if entry.ID >= l.nextID {
+			l.nextID = entry.ID + 1
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		_ = f.Close()
+		return err
+	}
+	l.file = f
+	return nil
+}
+
+// Append assigns entry the next ID and time and writes it. A failed write is
+// only logged: the call it records has already been answered.
+func (l *Log) Append(entry Entry) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	entry.ID = l.nextID
+	l.nextID++
+	entry.Time = time.Now().UTC()
+	l.storeLocked(entry)
+	if l.file == nil {
+		return
+	}
+	line, err := json.Marshal(entry)
+	if err == nil {
+		_, err = l.file.Write(append(line, '\n'))
+	}
+	if err != nil {
+		slog.Error("audit log write failed", "err", err)
+	}
+}
+
+func (l *Log) storeLocked(entry Entry) {
+	l.entries = append(l.entries, entry)
+	if len(l.entries) > l.maxLen {
+		l.entries = slices.Delete(l.entries, 0, len(l.entries)-l.maxLen)
+	}
+}
+
+// Recent returns up to limit in-memory entries matching keep, newest first.
+func (l *Log) Recent(keep func(Entry) bool, limit int) []Entry {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	out := make([]Entry, 0)
+	for i := len(l.entries) - 1; i >= 0 && len(out) < limit; i-- {
+		if keep(l.entries[i]) {
+			out = append(out, l.entries[i])
+		}
+	}
+	return out
+}
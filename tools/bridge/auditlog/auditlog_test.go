@@ -0,0 +1,35 @@
+package auditlog
+
+import (
+	"path/filepath"
+	"testing"
+)
+
+func TestReopen(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "audit.jsonl")
+	l := New(2)
+	if err := l.Open(path); err != nil {
+		t.Fatal(err)
+	}
+	for _, identity := range []string{"a", "b", "c"} {
+		l.Append(Entry{Identity: identity, Endpoint: "/proxy/send"})
+	}
+	// Only the newest maxLen entries stay in memory.
+	all := func(Entry) bool { return true }
+	if got := l.Recent(all, 10); len(got) != 2 || got[0].Identity != "c" || got[1].Identity != "b" {
+		t.Fatalf("%+v", got)
+	}
+
+	again := New(10)
+	if err := again.Open(path); err != nil {
+		t.Fatal(err)
+	}
+	got := again.Recent(func(e Entry) bool { return e.Identity != "b" }, 10)
+	if len(got) != 2 || got[0].ID != 3 || got[1].ID != 1 || got[0].Time.IsZero() {
+		t.Fatalf("%+v", got)
+	}
+	again.Append(Entry{Identity: "d"})
+	if got := again.Recent(all, 1); got[0].ID != 4 {
+		t.Fatalf("%+v", got)
+	}
+}
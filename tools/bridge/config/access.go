@@ -0,0 +1,156 @@
+package config
+
+import (
+	"fmt"
+	"math"
+	"net/netip"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// KFSecretKey is the AgentSecrets key of WECOM_KF_SECRET, which gets its
+// own token manager.
+const KFSecretKey = "kf"
+
+// Scopes a token from the config file's tokens section can carry. The
+// bridge token holds all of them.
+const (
+	ScopeStreamRead  = "stream:read"
+	ScopeProxySend   = "proxy:send"
+	ScopeProxyMedia  = "proxy:media"
+	ScopeProxyApp    = "proxy:app"
+	ScopeMetricsRead = "metrics:read"
+	ScopeAdmin       = "admin"
+)
+
+// KnownScopes lists every scope a token may be given.
+var KnownScopes = []string{ScopeStreamRead, ScopeProxySend, ScopeProxyMedia, ScopeProxyApp, ScopeMetricsRead, ScopeAdmin}
+
+// Token is a named bearer token limited to some endpoints, so a
+// logging consumer can read /stream without being able to send.
+type Token struct {
+	Name   string   `json:"name"`
+	Token  string   `json:"token"`
+	Scopes []string `json:"scopes"`
+}
+
+// Allows reports whether the token carries scope.
+func (t Token) Allows(scope string) bool {
+	return slices.Contains(t.Scopes, scope)
+}
+
+// APIRoute allows /proxy/api/{path} to reach cgi-bin/{path}. Path is exact
+// or ends in "/*" for every path below it. Calls use the managed token of
+// AgentID's app (the WECOM_CORP_SECRET app when empty) and are limited to
+// RatePerMinute per route; zero means unlimited.
+type APIRoute struct {
+	Path          string   `json:"path"`
+	Methods       []string `json:"methods"`
+	RatePerMinute int      `json:"ratePerMinute"`
+	AgentID       string   `json:"agentId"`
+}
+
+// Matches reports whether the route allows method on path.
+func (route APIRoute) Matches(method, path string) bool {
+	if prefix, ok := strings.CutSuffix(route.Path, "/*"); ok {
+		if !strings.HasPrefix(path, prefix+"/") {
+			return false
+		}
+	} else if path != route.Path {
+		return false
+	}
+	return slices.Contains(route.Methods, method)
+}
+
+// ValidAPIPath reports whether p is a plausible cgi-bin path: lower-case
+// letters, digits, "_" and "/" separated segments, without "." segments.
+func ValidAPIPath(p string) bool {
+	if p == "" || strings.HasPrefix(p, "/") || strings.HasSuffix(p, "/") || strings.Contains(p, "//") {
+		return false
+	}
+	for _, c := range p {
+		if !(c >= 'a' && c <= 'z' || c >= '0' && c <= '9' || c == '_' || c == '/') {
+			return false
+		}
+	}
+	return true
+}
+
+// RateClasses are the endpoint classes BRIDGE_RATE_LIMITS can limit.
+var RateClasses = []string{"send", "media", "stream"}
+
+// RateLimit is a token bucket: Rate requests per second on average, with up
+// to Burst at once.
+type RateLimit struct {
+	Rate  float64
+	Burst int
+}
+
+// ParseRateLimit parses "N/s", "N/m" or "N/h", optionally followed by
+// ":burst"; the burst defaults to N.
+func ParseRateLimit(v string) (RateLimit, error) {
+	v, burstText, hasBurst := strings.Cut(strings.TrimSpace(v), ":")
+	countText, unit, _ := strings.Cut(v, "/")
+	count, err := strconv.Atoi(strings.TrimSpace(countText))
+	if err != nil || count <= 0 {
+		return RateLimit{}, fmt.Errorf("invalid rate %q", v)
+	}
+	per := map[string]time.Duration{"s": time.Second, "m": time.Minute, "h": time.Hour}[strings.TrimSpace(unit)]
+	if per == 0 {
+		return RateLimit{}, fmt.Errorf("invalid unit %q", unit)
+	}
+	limit := RateLimit{Rate: float64(count) / per.Seconds(), Burst: count}
+	if hasBurst {
+		if limit.Burst, err = strconv.Atoi(strings.TrimSpace(burstText)); err != nil || limit.Burst <= 0 {
+			return RateLimit{}, fmt.Errorf("invalid burst %q", burstText)
+		}
+	}
+	return limit, nil
+}
+
+// String formats the limit like ParseRateLimit's input, preferring the
+// unit whose count equals the burst so the ":burst" suffix is left out.
+func (l RateLimit) String() string {
+	text := ""
+	for _, unit := range []struct {
+		name string
+		per  time.Duration
+	}{{"s", time.Second}, {"m", time.Minute}, {"h", time.Hour}} {
+		count := math.Round(l.Rate * unit.per.Seconds())
+		if count < 1 || math.Abs(count-l.Rate*unit.per.Seconds()) > 1e-6 {
+			continue
+		}
+		if int(count) == l.Burst {
+			return fmt.Sprintf("%d/%s", int(count), unit.name)
+		}
+		if text == "" {
+			text = fmt.Sprintf("%d/%s:%d", int(count), unit.name, l.Burst)
+		}
+	}
+	return text
+}
+
+// ParsePrefixes parses CIDRs and bare IPs, which stand for a single address.
+func ParsePrefixes(items []string) ([]netip.Prefix, error) {
+	var prefixes []netip.Prefix
+	for _, item := range items {
+		item = strings.TrimSpace(item)
+		if strings.Contains(item, "/") {
+			p, err := netip.ParsePrefix(item)
+			if err != nil {
+				return nil, err
+			}
+			prefixes = append(prefixes, p.Masked())
+			continue
+		}
+		addr, err := netip.ParseAddr(item)
+		if err != nil {
+			return nil, err
+		}
+		addr = addr.Unmap()
+		prefixes = append(prefixes, netip.PrefixFrom(addr, addr.BitLen()))
+	}
+	return prefixes, nil
+}
@@ -0,0 +1,55 @@
+package config
+
+import (
+	"strconv"
+	"strings"
+)
+
+// Callback modes, matching the message encryption options of the app's
+// receive settings.
+const (
+	CallbackSecure    = "secure"
+	CallbackCompat    = "compat"
+	CallbackPlaintext = "plaintext"
+)
+
+// ParseCallbackMode normalizes a callback mode setting; empty means secure.
+func ParseCallbackMode(v string) (string, bool) {
+	switch mode := strings.ToLower(strings.TrimSpace(v)); mode {
+	case "":
+		return CallbackSecure, true
+	case CallbackSecure, CallbackCompat, CallbackPlaintext:
+		return mode, true
+	}
+	return "", false
+}
+
+// ForAgent returns a copy of cfg that uses the named app's credentials for
+// callbacks, passive replies and welcome messages.
+func (cfg Config) ForAgent(name string) (Config, bool) {
+	for _, agent := range cfg.Agents {
+		if agent.Name != name {
+			continue
+		}
+		cfg.AgentName = agent.Name
+		cfg.WeComToken = agent.Token
+		cfg.WeComAESKey = agent.AESKey
+		cfg.WeComReceiveID = agent.ReceiveID
+		cfg.WeComCorpID = firstNonEmpty(agent.CorpID, cfg.WeComCorpID)
+		cfg.WeComCorpSecret = agent.CorpSecret
+		cfg.WeComAgentID = agent.AgentID
+		cfg.AgentIDNumber, _ = strconv.Atoi(agent.AgentID)
+		cfg.CallbackMode = firstNonEmpty(agent.CallbackMode, CallbackSecure)
+		return cfg, true
+	}
+	return cfg, false
+}
+
+func firstNonEmpty(values ...string) string {
+	for _, v := range values {
+		if strings.TrimSpace(v) != "" {
+			return v
+		}
+	}
+	return ""
+}
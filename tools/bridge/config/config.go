@@ -0,0 +1,306 @@
+// Package config loads the wecom-bridge configuration: Load reads the
+// environment, and LoadFile the JSON or YAML file named by
+// BRIDGE_CONFIG_FILE, whose server settings ApplyFileSettings exports as
+// environment defaults before Load runs.
+package config
+
+import (
+	"log/slog"
+	"net/netip"
+	"time"
+)
+
+// Defaults for settings whose environment variable is unset or invalid.
+const (
+	DefaultPort           = 8080
+	DefaultBufferSize     = 200
+	DefaultArchiveRecords = 10000
+)
+
+// Config is the bridge configuration, read once at startup by Load; the
+// rules, routes and schemas are re-read from the file on SIGHUP.
+type Config struct {
+	Port int
+	// GRPCPort serves the gRPC API of wecom-bridge.proto; 0 disables it.
+	GRPCPort         int
+	WeComToken       string
+	WeComAESKey      string
+	WeComReceiveID   string
+	BridgeToken      string
+	MessageBufferCap int
+
+	// CallbackMode is the app's message encryption setting: "secure"
+	// (default), "compat" or "plaintext".
+	CallbackMode string
+
+	// Per-recipient outbound quotas for /proxy/send; zero disables a window.
+	SendQuotaHourly    int
+	SendQuotaDaily     int
+	QuotaOverrideToken string
+
+	// Request rate limits per bridge token, keyed by endpoint class
+	// (send, media, stream); a class without an entry is not limited.
+	RateLimits map[string]RateLimit
+
+	// Inbound keyword/regex rules, topic routes and payload schemas loaded
+	// from BRIDGE_CONFIG_FILE.
+	Rules   []Rule
+	Routes  []Route
+	Schemas []Schema
+
+	// Hosts /proxy/media/forward may deliver to; empty disables forwarding.
+	MediaForwardAllowlist []string
+
+	// Networks /wecom accepts callbacks from, plus WeCom's published
+	// callback IPs with CallbackAllowlistAuto; neither disables the check.
+	// Requests from TrustedProxies are judged by X-Forwarded-For.
+	CallbackAllowlist        []netip.Prefix
+	CallbackAllowlistAuto    bool
+	CallbackAllowlistRefresh time.Duration
+	TrustedProxies           []netip.Prefix
+
+	// Batch media upload: concurrent uploads per request and request size cap.
+	MediaUploadConcurrency int
+	MediaBatchMaxBytes     int64
+
+	// Size cap for a streamed multipart upload to /proxy/media/upload.
+	MediaUploadMaxBytes int64
+
+	// Group robot sends allowed per key and minute, and how long a send
+	// over the limit may queue before it is refused.
+	RobotRatePerMinute int
+	RobotQueueMax      time.Duration
+
+	// Default upstream timeout per proxy endpoint and the cap on timeouts
+	// requested by callers.
+	ProxyTimeouts   map[string]time.Duration
+	ProxyTimeoutMax time.Duration
+
+	// Shared transport for all outgoing HTTP. HTTPProxy overrides the
+	// HTTP_PROXY/HTTPS_PROXY/NO_PROXY environment ("off" disables proxying);
+	// HTTPCAFile adds PEM certificates to the system roots.
+	HTTPProxy           string
+	HTTPMaxIdleConns    int
+	HTTPMaxConnsPerHost int
+	HTTPIdleTimeout     time.Duration
+	HTTPDialTimeout     time.Duration
+	HTTPCAFile          string
+
+	// Interceptors for outgoing qyapi requests configured in BRIDGE_CONFIG_FILE.
+	QyAPI *QyAPI
+
+	// Link extraction from text messages and optional unfurling of pages on
+	// allowlisted hosts.
+	LinkExtract   bool
+	LinkUnfurl    bool
+	LinkAllowlist []string
+	LinkTimeout   time.Duration
+
+	// Name lookups for external contact and customer group change events,
+	// cached for ContactEnrichTTL.
+	ContactEnrich    bool
+	ContactEnrichTTL time.Duration
+
+	// Callback deduplication window, shared through Redis when RedisURL is set.
+	DedupTTL time.Duration
+	RedisURL string
+
+	// FailureMode is "ack" (default: always answer success once parsed) or
+	// "retry" (answer 503 when persisting or broadcasting fails).
+	FailureMode string
+
+	// Optional zone for localized timestamps in the broadcast payload.
+	Timezone *time.Location
+
+	// Passive reply sent immediately for matching inbound messages.
+	AutoAckText     string
+	AutoAckMsgTypes []string
+	AutoAckSessions []string
+
+	// App credentials used when the bridge itself calls WeCom APIs, plus
+	// secrets of further apps keyed by agent ID.
+	WeComCorpID     string
+	WeComCorpSecret string
+	WeComAgentID    string
+	AgentSecrets    map[string]string
+	// AgentIDNumber is WeComAgentID as the integer message/send expects,
+	// parsed once at load; 0 when unset or invalid.
+	AgentIDNumber int
+
+	// BRIDGE_CONFIG_FILE, re-read on SIGHUP.
+	ConfigFile string
+
+	// Replay cursors of WeChat customer service accounts, per open_kfid.
+	KFCursorFile string
+
+	// Further self-built apps whose callbacks arrive on /wecom/{name}, and
+	// the name of the app a per-agent config copy serves ("" for the
+	// WECOM_* app).
+	Agents    []Agent
+	AgentName string
+
+	// Named bearer tokens limited to some scopes, from the config file.
+	Tokens []Token
+
+	// Other IM platforms whose callbacks arrive on /channels/{name}.
+	Channels []Channel
+
+	// cgi-bin paths /proxy/api/{path} may call, from the config file.
+	APIRoutes []APIRoute
+
+	Welcome *Welcome
+
+	// Admin API and on-disk state.
+	AdminToken   string
+	DataDir      string
+	TunablesFile string
+
+	// Message archive of inbound events and outbound sends.
+	ArchiveFile       string
+	ArchiveMaxRecords int
+
+	// Audit log of /proxy calls: appended to AuditFile, the newest
+	// AuditRecent entries kept in memory for GET /admin/audit.
+	AuditFile   string
+	AuditRecent int
+
+	// Inbound outbox: events are persisted here before WeCom is acknowledged.
+	OutboxFile string
+
+	// Asynchronous sends: at most SendQueueMax pending jobs, each tried up
+	// to SendQueueMaxAttempts times with backoff from SendQueueRetryBase to
+	// SendQueueRetryMax; finished jobs are reported for SendQueueKeep.
+	SendQueueFile        string
+	SendQueueMax         int
+	SendQueueMaxAttempts int
+	SendQueueRetryBase   time.Duration
+	SendQueueRetryMax    time.Duration
+	SendQueueKeep        time.Duration
+
+	// Persistent event buffer: EventStore is "memory" (default), "file" or
+	// "redis"; stored events are trimmed by age and size (events for redis)
+	// and replayed after restarts. The redis store is shared by replicas.
+	EventStore          string
+	EventStoreFile      string
+	EventStoreMaxAge    time.Duration
+	EventStoreMaxMB     int
+	EventStoreMaxEvents int
+	// MessagesRetention bounds how far back GET /messages looks.
+	MessagesRetention time.Duration
+
+	// Session transcripts: a session ends after SessionIdle without messages
+	// (0 disables transcripts) or on one of SessionCloseEvents, and its
+	// messages are emitted as one "transcript" event.
+	SessionIdle        time.Duration
+	SessionCloseEvents []string
+	SessionMaxMessages int
+	SessionArchive     bool
+
+	// On-disk cache of /proxy/media/get downloads keyed by media_id, with
+	// an optional age limit and size cap enforced on every write.
+	MediaCacheDir   string
+	MediaCacheTTL   time.Duration
+	MediaCacheMaxMB int
+
+	// Voice transcoding for media fetches with a format: FFmpegPath is the
+	// ffmpeg binary (empty disables it), run for at most TranscodeTimeout.
+	FFmpegPath       string
+	TranscodeTimeout time.Duration
+
+	// Retention policies for the archive and media cache from
+	// BRIDGE_CONFIG_FILE, applied by the background compactor.
+	Retention *Retention
+
+	// Push delivery of broadcast events to downstream webhooks.
+	WebhookURLs        []string
+	WebhookMode        string
+	WebhookBatchSize   int
+	WebhookBatchWindow time.Duration
+
+	// Webhook retries: up to WebhookMaxAttempts tries with exponential
+	// backoff from WebhookRetryBase to WebhookRetryMax; exhausted events go
+	// to WebhookDeadLetterFile.
+	WebhookMaxAttempts    int
+	WebhookRetryBase      time.Duration
+	WebhookRetryMax       time.Duration
+	WebhookDeadLetterFile string
+
+	// Callback worker pool: verified callbacks are queued for CallbackWorkers
+	// workers; the handler answers WeCom within CallbackTimeout.
+	CallbackWorkers int
+	CallbackQueue   int
+	CallbackTimeout time.Duration
+
+	// Serve HTTPS with this certificate and key when both are set.
+	TLSCertFile string
+	TLSKeyFile  string
+
+	// How long SIGTERM/SIGINT waits for requests and queued callbacks.
+	ShutdownTimeout time.Duration
+
+	// /ready: whether it fetches (cached) access tokens, and how long a
+	// result is reused across probes.
+	ReadyTokenCheck bool
+	ReadyCache      time.Duration
+
+	// Passive replies: how long a worker holds a callback open for a
+	// consumer to POST /reply/{msgId}. Zero answers immediately.
+	ReplyWait time.Duration
+
+	// Lifetime of single-use /stream tickets.
+	TicketTTL time.Duration
+
+	// Stream clients: a ": heartbeat" comment every StreamHeartbeat (0
+	// disables), StreamClientBuffer queued events per client, and what
+	// happens when that queue is full: "drop-newest", "drop-oldest" or
+	// "disconnect".
+	StreamHeartbeat    time.Duration
+	StreamClientBuffer int
+	StreamDropPolicy   string
+
+	// CORS for browser clients: CORSOrigins are exact origins, "*" or
+	// "https://*.example.com"; empty sends no CORS headers. CORSHeaders are
+	// the request headers preflights may ask for, cached for CORSMaxAge.
+	CORSOrigins []string
+	CORSHeaders []string
+	CORSMaxAge  time.Duration
+
+	// Token allowed to inject application events through /publish.
+	PublishToken string
+
+	// SigningSecret keys the HMAC-SHA256 signatures on webhook deliveries
+	// and /stream events; empty disables signing.
+	SigningSecret string
+
+	// Federation: this bridge's name and the upstream bridges it subscribes to.
+	BridgeName      string
+	Upstreams       []Upstream
+	FederationState string
+
+	// Replication: Mode is "primary" (default), "mirror" or "standby"; both
+	// follow PrimaryURL with ReplicationToken and serve read-only streams. A
+	// standby also copies the token cache and federation cursors and takes
+	// over when promoted, automatically once the primary has been unhealthy
+	// for FailoverAfter (0 = manual promotion only).
+	Mode             string
+	PrimaryURL       string
+	ReplicationToken string
+	FailoverAfter    time.Duration
+
+	// Log records: minimum level and "text" or "json".
+	LogLevel  slog.Level
+	LogFormat string
+}
+
+// Channel is an app on another IM platform whose messages join the
+// event stream. Type "feishu" is supported; APIBase defaults to
+// https://open.feishu.cn (https://open.larksuite.com for Lark).
+type Channel struct {
+	Name              string `json:"name"`
+	Type              string `json:"type"`
+	AppID             string `json:"appId"`
+	AppSecret         string `json:"appSecret"`
+	VerificationToken string `json:"verificationToken"`
+	EncryptKey        string `json:"encryptKey"`
+	APIBase           string `json:"apiBase"`
+}
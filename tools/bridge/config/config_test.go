@@ -0,0 +1,59 @@
+package config
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestLoadFileFormats(t *testing.T) {
+	dir := t.TempDir()
+	write := func(name, content string) string {
+		path := filepath.Join(dir, name)
+		if err := os.WriteFile(path, []byte(content), 0o600); err != nil {
+			t.Fatal(err)
+		}
+		return path
+	}
+	for _, path := range []string{
+		write("bridge.yaml", "port: 8443\nwebhooks:\n  urls: [https://a.example.com/hook]\n"),
+		write("bridge.json", `{"port": 8443, "webhooks": {"urls": ["https://a.example.com/hook"]}}`),
+	} {
+		fileCfg, err := LoadFile(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if fileCfg.Port != 8443 || fileCfg.Webhooks == nil || len(fileCfg.Webhooks.URLs) != 1 {
+			t.Fatalf("%s: %+v", path, fileCfg)
+		}
+	}
+	for path, want := range map[string]string{
+		write("bridge.toml", "port = 8443\n"): "TOML is not supported, use YAML (.yaml or .yml) or JSON",
+		write("port.yml", "port: \"8443\"\n"): `port: expected a number, got "8443"`,
+		write("anchor.yml", "a: &x 1\n"):      "yaml line 1: anchors, aliases and tags are not supported",
+	} {
+		if _, err := LoadFile(path); err == nil || !strings.HasSuffix(err.Error(), want) {
+			t.Errorf("%s: got %v, want %s", path, err, want)
+		}
+	}
+}
+
+func TestWelcomeCooldownDefault(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "bridge.json")
+	for cooldown, want := range map[string]time.Duration{"": 24 * time.Hour, "0s": 0, "1h": time.Hour} {
+		welcome, _ := json.Marshal(map[string]string{"text": "hi", "cooldown": cooldown})
+		if err := os.WriteFile(path, []byte(`{"welcome":`+string(welcome)+`}`), 0o600); err != nil {
+			t.Fatal(err)
+		}
+		fileCfg, err := LoadFile(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := fileCfg.Welcome.CooldownPeriod; got != want {
+			t.Errorf("%q: cooldown %v, want %v", cooldown, got, want)
+		}
+	}
+}
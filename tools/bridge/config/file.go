@@ -0,0 +1,286 @@
+package config
+
+import (
+	"net/url"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/Tennen/Paimon/tools/bridge/ruleexpr"
+)
+
+// File is the JSON document referenced by BRIDGE_CONFIG_FILE.
+type File struct {
+	// Server settings. Each one is only a default for its environment
+	// variable, which still wins when set.
+	Port       int              `json:"port"`
+	GRPCPort   int              `json:"grpcPort"`
+	BufferSize int              `json:"bufferSize"`
+	DataDir    string           `json:"dataDir"`
+	Auth       *AuthSettings    `json:"auth"`
+	WeCom      *WeComSettings   `json:"wecom"`
+	Webhooks   *WebhookSettings `json:"webhooks"`
+	TLS        *TLSSettings     `json:"tls"`
+	Log        *LogSettings     `json:"log"`
+
+	Rules     []Rule     `json:"rules"`
+	Routes    []Route    `json:"routes"`
+	Schemas   []Schema   `json:"schemas"`
+	QyAPI     *QyAPI     `json:"qyapi"`
+	Upstreams []Upstream `json:"upstreams"`
+	Welcome   *Welcome   `json:"welcome"`
+	Retention *Retention `json:"retention"`
+	Agents    []Agent    `json:"agents"`
+	Tokens    []Token    `json:"tokens"`
+	Channels  []Channel  `json:"channels"`
+	API       []APIRoute `json:"api"`
+}
+
+type AuthSettings struct {
+	BridgeToken      string `json:"bridgeToken"`
+	AdminToken       string `json:"adminToken"`
+	PublishToken     string `json:"publishToken"`
+	SigningSecret    string `json:"signingSecret"`
+	ReplicationToken string `json:"replicationToken"`
+}
+
+type WeComSettings struct {
+	Token        string `json:"token"`
+	AESKey       string `json:"aesKey"`
+	ReceiveID    string `json:"receiveId"`
+	CorpID       string `json:"corpId"`
+	CorpSecret   string `json:"corpSecret"`
+	AgentID      string `json:"agentId"`
+	CallbackMode string `json:"callbackMode"`
+
+	CallbackAllowlist     []string `json:"callbackAllowlist"`
+	CallbackAllowlistAuto bool     `json:"callbackAllowlistAuto"`
+}
+
+type WebhookSettings struct {
+	URLs        []string `json:"urls"`
+	Mode        string   `json:"mode"`
+	BatchSize   int      `json:"batchSize"`
+	BatchWindow string   `json:"batchWindow"`
+	MaxAttempts int      `json:"maxAttempts"`
+}
+
+type TLSSettings struct {
+	CertFile string `json:"certFile"`
+	KeyFile  string `json:"keyFile"`
+}
+
+type LogSettings struct {
+	Level  string `json:"level"`
+	Format string `json:"format"`
+}
+
+// envDefaults maps the file's server settings to the environment
+// variables they stand in for. String values may reference other
+// variables as ${NAME}.
+func (fc File) envDefaults() map[string]string {
+	env := make(map[string]string)
+	set := func(key, value string) {
+		if value = strings.TrimSpace(os.ExpandEnv(value)); value != "" {
+			env[key] = value
+		}
+	}
+	setInt := func(key string, value int) {
+		if value != 0 {
+			env[key] = strconv.Itoa(value)
+		}
+	}
+	setInt("PORT", fc.Port)
+	setInt("BRIDGE_GRPC_PORT", fc.GRPCPort)
+	setInt("BRIDGE_BUFFER_SIZE", fc.BufferSize)
+	set("BRIDGE_DATA_DIR", fc.DataDir)
+	if a := fc.Auth; a != nil {
+		set("WECOM_BRIDGE_TOKEN", a.BridgeToken)
+		set("BRIDGE_ADMIN_TOKEN", a.AdminToken)
+		set("BRIDGE_PUBLISH_TOKEN", a.PublishToken)
+		set("BRIDGE_SIGNING_SECRET", a.SigningSecret)
+		set("BRIDGE_REPLICATION_TOKEN", a.ReplicationToken)
+	}
+	if wc := fc.WeCom; wc != nil {
+		set("WECOM_TOKEN", wc.Token)
+		set("WECOM_AES_KEY", wc.AESKey)
+		set("WECOM_RECEIVE_ID", wc.ReceiveID)
+		set("WECOM_CORP_ID", wc.CorpID)
+		set("WECOM_CORP_SECRET", wc.CorpSecret)
+		set("WECOM_AGENT_ID", wc.AgentID)
+		set("WECOM_CALLBACK_MODE", wc.CallbackMode)
+		set("BRIDGE_CALLBACK_ALLOWLIST", strings.Join(wc.CallbackAllowlist, ","))
+		if wc.CallbackAllowlistAuto {
+			set("BRIDGE_CALLBACK_ALLOWLIST_AUTO", "true")
+		}
+	}
+	if wh := fc.Webhooks; wh != nil {
+		set("BRIDGE_WEBHOOK_URLS", strings.Join(wh.URLs, ","))
+		set("BRIDGE_WEBHOOK_MODE", wh.Mode)
+		setInt("BRIDGE_WEBHOOK_BATCH_SIZE", wh.BatchSize)
+		set("BRIDGE_WEBHOOK_BATCH_WINDOW", wh.BatchWindow)
+		setInt("BRIDGE_WEBHOOK_MAX_ATTEMPTS", wh.MaxAttempts)
+	}
+	if t := fc.TLS; t != nil {
+		set("BRIDGE_TLS_CERT_FILE", t.CertFile)
+		set("BRIDGE_TLS_KEY_FILE", t.KeyFile)
+	}
+	if l := fc.Log; l != nil {
+		set("LOG_LEVEL", l.Level)
+		set("LOG_FORMAT", l.Format)
+	}
+	return env
+}
+
+// ApplyFileSettings loads path and exports its server settings for every
+// environment variable that is not already set.
+func ApplyFileSettings(path string) error {
+	fileCfg, err := LoadFile(path)
+	if err != nil {
+		return err
+	}
+	for key, value := range fileCfg.envDefaults() {
+		if _, set := os.LookupEnv(key); !set {
+			_ = os.Setenv(key, value)
+		}
+	}
+	return nil
+}
+
+// Agent holds the credentials of one additional WeCom app. Values may
+// reference environment variables as ${NAME}.
+type Agent struct {
+	Name         string `json:"name"`
+	Token        string `json:"token"`
+	AESKey       string `json:"aesKey"`
+	ReceiveID    string `json:"receiveId"`
+	CorpID       string `json:"corpId"`
+	CorpSecret   string `json:"corpSecret"`
+	AgentID      string `json:"agentId"`
+	CallbackMode string `json:"callbackMode"`
+}
+
+// Welcome describes the message sent on subscribe/enter_agent events.
+// Text and card fields may use {{user}}, {{agentId}}, {{event}}, {{corpId}}
+// and {{date}} placeholders.
+type Welcome struct {
+	Events   []string     `json:"events"`
+	Text     string       `json:"text"`
+	Card     *WelcomeCard `json:"card"`
+	Cooldown string       `json:"cooldown"`
+
+	// CooldownPeriod is Cooldown parsed by LoadFile.
+	CooldownPeriod time.Duration `json:"-"`
+}
+
+// Retention bounds the archive and media cache. The compactor runs at
+// startup and then every Interval (default 1h).
+type Retention struct {
+	Interval string           `json:"interval"`
+	Archive  *RetentionPolicy `json:"archive"`
+	Media    *RetentionPolicy `json:"media"`
+
+	// IntervalPeriod is Interval parsed by LoadFile.
+	IntervalPeriod time.Duration `json:"-"`
+}
+
+// RetentionPolicy expires entries older than MaxAge, unless the first
+// matching rule says otherwise, and then drops the oldest entries until the
+// target fits in MaxMB. Zero values disable a limit.
+type RetentionPolicy struct {
+	MaxAge string          `json:"maxAge"`
+	MaxMB  int             `json:"maxMB"`
+	Rules  []RetentionRule `json:"rules"`
+
+	// MaxAgePeriod is MaxAge parsed by LoadFile.
+	MaxAgePeriod time.Duration `json:"-"`
+}
+
+// RetentionRule overrides the policy's MaxAge for archive records matching
+// every non-empty criterion; an empty MaxAge keeps them regardless of age.
+type RetentionRule struct {
+	MsgTypes []string `json:"msgTypes"`
+	Sessions []string `json:"sessions"`
+	Kinds    []string `json:"kinds"`
+	MaxAge   string   `json:"maxAge"`
+
+	// MaxAgePeriod is MaxAge parsed by LoadFile.
+	MaxAgePeriod time.Duration `json:"-"`
+}
+
+type WelcomeCard struct {
+	Title       string `json:"title"`
+	Description string `json:"description"`
+	URL         string `json:"url"`
+	ButtonText  string `json:"btntxt"`
+}
+
+// Rule tags, drops or changes inbound events whose content matches any
+// keyword (case-insensitive substring) or the regular expression pattern,
+// and whose payload satisfies the When expression. Set assigns payload
+// fields ("set"); Replace rewrites the text matched by pattern ("rewrite").
+type Rule struct {
+	Name     string            `json:"name"`
+	Keywords []string          `json:"keywords"`
+	Pattern  string            `json:"pattern"`
+	MsgTypes []string          `json:"msgTypes"`
+	When     string            `json:"when"`
+	Labels   []string          `json:"labels"`
+	Action   string            `json:"action"`
+	Set      map[string]string `json:"set"`
+	Replace  string            `json:"replace"`
+
+	// Regexp and Cond are Pattern and When compiled by LoadFile.
+	Regexp *regexp.Regexp `json:"-"`
+	Cond   ruleexpr.Expr  `json:"-"`
+}
+
+// Upstream is another bridge whose /stream is merged into this one.
+type Upstream struct {
+	Name   string   `json:"name"`
+	URL    string   `json:"url"`
+	Token  string   `json:"token"`
+	Topics []string `json:"topics"`
+}
+
+// Route assigns Topic to inbound events matching every non-empty
+// criterion.
+type Route struct {
+	Topic     string   `json:"topic"`
+	MsgTypes  []string `json:"msgTypes"`
+	Events    []string `json:"events"`
+	FromUsers []string `json:"fromUsers"`
+	AgentIDs  []string `json:"agentIds"`
+	Labels    []string `json:"labels"`
+	Pattern   string   `json:"pattern"`
+
+	// Regexp is Pattern compiled by LoadFile.
+	Regexp *regexp.Regexp `json:"-"`
+}
+
+// QyAPI configures the built-in interceptors for outgoing qyapi
+// requests: BaseURL replaces https://qyapi.weixin.qq.com (e.g. an egress
+// gateway), Headers are added to every request with ${VAR} expanded from the
+// environment, and Debug logs each request and a prefix of its response.
+type QyAPI struct {
+	BaseURL string            `json:"baseUrl"`
+	Headers map[string]string `json:"headers"`
+	Debug   bool              `json:"debug"`
+
+	// Base is BaseURL parsed by LoadFile.
+	Base *url.URL `json:"-"`
+}
+
+// Schema adapts broadcast payloads to one consumer's field names:
+// Drop removes fields, Rename maps old to new names and Add sets constants.
+// Clients select it with /stream?schema=name and Webhooks lists the webhook
+// URLs that receive it; a schema named "default" applies to everyone else.
+type Schema struct {
+	Name     string            `json:"name"`
+	Rename   map[string]string `json:"rename"`
+	Drop     []string          `json:"drop"`
+	Add      map[string]any    `json:"add"`
+	Webhooks []string          `json:"webhooks"`
+}
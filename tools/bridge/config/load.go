@@ -0,0 +1,397 @@
+package config
+
+import (
+	"fmt"
+	"log"
+	"log/slog"
+	"net/netip"
+	"net/url"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Load reads the configuration from the environment and, when
+// BRIDGE_CONFIG_FILE is set, the rules and sections of that file. Invalid
+// settings are fatal.
+func Load() Config {
+	port := getenvInt("PORT", DefaultPort)
+	bufferCap := getenvInt("BRIDGE_BUFFER_SIZE", DefaultBufferSize)
+	if bufferCap <= 0 {
+		bufferCap = DefaultBufferSize
+	}
+	cfg := Config{
+		Port:             port,
+		GRPCPort:         getenvInt("BRIDGE_GRPC_PORT", 0),
+		WeComToken:       strings.TrimSpace(os.Getenv("WECOM_TOKEN")),
+		WeComAESKey:      strings.TrimSpace(os.Getenv("WECOM_AES_KEY")),
+		WeComReceiveID:   strings.TrimSpace(os.Getenv("WECOM_RECEIVE_ID")),
+		BridgeToken:      strings.TrimSpace(os.Getenv("WECOM_BRIDGE_TOKEN")),
+		MessageBufferCap: bufferCap,
+
+		SendQuotaHourly:    getenvInt("BRIDGE_SEND_QUOTA_HOURLY", 0),
+		SendQuotaDaily:     getenvInt("BRIDGE_SEND_QUOTA_DAILY", 0),
+		QuotaOverrideToken: strings.TrimSpace(os.Getenv("BRIDGE_QUOTA_OVERRIDE_TOKEN")),
+
+		AutoAckText:     strings.TrimSpace(os.Getenv("BRIDGE_AUTO_ACK_TEXT")),
+		AutoAckMsgTypes: getenvList("BRIDGE_AUTO_ACK_MSG_TYPES", []string{"text", "image", "voice", "video", "file"}),
+		AutoAckSessions: getenvList("BRIDGE_AUTO_ACK_SESSIONS", nil),
+
+		WeComCorpID:     strings.TrimSpace(os.Getenv("WECOM_CORP_ID")),
+		WeComCorpSecret: strings.TrimSpace(os.Getenv("WECOM_CORP_SECRET")),
+		WeComAgentID:    strings.TrimSpace(os.Getenv("WECOM_AGENT_ID")),
+
+		AdminToken: strings.TrimSpace(os.Getenv("BRIDGE_ADMIN_TOKEN")),
+		DataDir:    strings.TrimSpace(os.Getenv("BRIDGE_DATA_DIR")),
+	}
+	cfg.AgentIDNumber, _ = strconv.Atoi(cfg.WeComAgentID)
+	cfg.AgentSecrets = make(map[string]string)
+	for _, item := range getenvList("BRIDGE_AGENT_SECRETS", nil) {
+		agentID, secret, ok := strings.Cut(item, "=")
+		if !ok || strings.TrimSpace(agentID) == "" || strings.TrimSpace(secret) == "" {
+			log.Fatalf("invalid BRIDGE_AGENT_SECRETS entry %q", item)
+		}
+		cfg.AgentSecrets[strings.TrimSpace(agentID)] = strings.TrimSpace(secret)
+	}
+	// The customer service secret gets its own token manager; without it the
+	// WECOM_CORP_SECRET app must have been granted the kf API.
+	if secret := strings.TrimSpace(os.Getenv("WECOM_KF_SECRET")); secret != "" {
+		cfg.AgentSecrets[KFSecretKey] = secret
+	}
+	cfg.KFCursorFile = dataPath(cfg, "BRIDGE_KF_CURSOR_FILE", "kf-cursors.json")
+	cfg.TunablesFile = dataPath(cfg, "BRIDGE_TUNABLES_FILE", "tunables.json")
+	cfg.ArchiveFile = dataPath(cfg, "BRIDGE_ARCHIVE_FILE", "archive.jsonl")
+	cfg.ArchiveMaxRecords = getenvInt("BRIDGE_ARCHIVE_MAX_RECORDS", DefaultArchiveRecords)
+	cfg.AuditFile = dataPath(cfg, "BRIDGE_AUDIT_FILE", "audit.jsonl")
+	cfg.AuditRecent = getenvInt("BRIDGE_AUDIT_RECENT", 1000)
+	if cfg.AuditRecent <= 0 {
+		log.Fatalf("invalid BRIDGE_AUDIT_RECENT")
+	}
+	cfg.OutboxFile = dataPath(cfg, "BRIDGE_OUTBOX_FILE", "outbox.jsonl")
+	cfg.SendQueueFile = dataPath(cfg, "BRIDGE_SEND_QUEUE_FILE", "sendqueue.jsonl")
+	cfg.SendQueueMax = getenvInt("BRIDGE_SEND_QUEUE_MAX", 10000)
+	cfg.SendQueueMaxAttempts = getenvInt("BRIDGE_SEND_QUEUE_MAX_ATTEMPTS", 8)
+	cfg.SendQueueRetryBase = getenvDuration("BRIDGE_SEND_QUEUE_RETRY_BASE", 5*time.Second)
+	cfg.SendQueueRetryMax = getenvDuration("BRIDGE_SEND_QUEUE_RETRY_MAX", 10*time.Minute)
+	cfg.SendQueueKeep = getenvDuration("BRIDGE_SEND_QUEUE_KEEP", 24*time.Hour)
+	if cfg.SendQueueMaxAttempts < 1 || cfg.SendQueueRetryBase <= 0 || cfg.SendQueueRetryMax < cfg.SendQueueRetryBase {
+		log.Fatalf("invalid BRIDGE_SEND_QUEUE_* settings (MAX_ATTEMPTS >= 1, 0 < RETRY_BASE <= RETRY_MAX)")
+	}
+	cfg.EventStore = strings.ToLower(strings.TrimSpace(os.Getenv("BRIDGE_EVENT_STORE")))
+	if cfg.EventStore == "" {
+		cfg.EventStore = "memory"
+	}
+	cfg.EventStoreFile = dataPath(cfg, "BRIDGE_EVENT_STORE_FILE", "events.jsonl")
+	cfg.EventStoreMaxAge = getenvDuration("BRIDGE_EVENT_STORE_MAX_AGE", 24*time.Hour)
+	cfg.EventStoreMaxMB = getenvInt("BRIDGE_EVENT_STORE_MAX_MB", 100)
+	cfg.EventStoreMaxEvents = getenvInt("BRIDGE_EVENT_STORE_MAX_EVENTS", 100000)
+	if cfg.EventStoreMaxEvents <= 0 {
+		log.Fatalf("invalid BRIDGE_EVENT_STORE_MAX_EVENTS")
+	}
+	cfg.MessagesRetention = getenvDuration("BRIDGE_MESSAGES_RETENTION", 24*time.Hour)
+	cfg.SessionIdle = getenvDuration("BRIDGE_SESSION_IDLE", 0)
+	cfg.SessionCloseEvents = getenvList("BRIDGE_SESSION_CLOSE_EVENTS", []string{"session_close"})
+	cfg.SessionMaxMessages = getenvInt("BRIDGE_SESSION_MAX_MESSAGES", 500)
+	if cfg.SessionMaxMessages <= 0 {
+		cfg.SessionMaxMessages = 500
+	}
+	cfg.SessionArchive = getenvBool("BRIDGE_SESSION_ARCHIVE", false)
+	cfg.MediaCacheDir = strings.TrimSpace(os.Getenv("BRIDGE_MEDIA_CACHE_DIR"))
+	cfg.MediaCacheTTL = getenvDuration("BRIDGE_MEDIA_CACHE_TTL", 0)
+	cfg.MediaCacheMaxMB = getenvInt("BRIDGE_MEDIA_CACHE_MAX_MB", 0)
+	cfg.FFmpegPath = strings.TrimSpace(os.Getenv("BRIDGE_FFMPEG_PATH"))
+	cfg.TranscodeTimeout = getenvDuration("BRIDGE_TRANSCODE_TIMEOUT", 30*time.Second)
+	cfg.WebhookURLs = getenvList("BRIDGE_WEBHOOK_URLS", nil)
+	cfg.WebhookMode = strings.ToLower(strings.TrimSpace(os.Getenv("BRIDGE_WEBHOOK_MODE")))
+	if cfg.WebhookMode != "batch" {
+		cfg.WebhookMode = "single"
+	}
+	cfg.WebhookBatchSize = getenvInt("BRIDGE_WEBHOOK_BATCH_SIZE", 50)
+	cfg.WebhookBatchWindow = getenvDuration("BRIDGE_WEBHOOK_BATCH_WINDOW", 2*time.Second)
+	cfg.WebhookMaxAttempts = getenvInt("BRIDGE_WEBHOOK_MAX_ATTEMPTS", 6)
+	if cfg.WebhookMaxAttempts <= 0 {
+		cfg.WebhookMaxAttempts = 1
+	}
+	cfg.WebhookRetryBase = getenvDuration("BRIDGE_WEBHOOK_RETRY_BASE", time.Second)
+	if cfg.WebhookRetryBase <= 0 {
+		cfg.WebhookRetryBase = time.Second
+	}
+	cfg.WebhookRetryMax = getenvDuration("BRIDGE_WEBHOOK_RETRY_MAX", 5*time.Minute)
+	cfg.WebhookDeadLetterFile = dataPath(cfg, "BRIDGE_WEBHOOK_DEAD_LETTER_FILE", "webhook-dead-letter.jsonl")
+	cfg.ProxyTimeouts = map[string]time.Duration{
+		"gettoken":      15 * time.Second,
+		"send":          20 * time.Second,
+		"menu":          20 * time.Second,
+		"agent":         20 * time.Second,
+		"kf":            20 * time.Second,
+		"robot":         20 * time.Second,
+		"media_upload":  30 * time.Second,
+		"media_get":     30 * time.Second,
+		"media_forward": 2 * time.Minute,
+		"api":           20 * time.Second,
+		"auth":          20 * time.Second,
+		"appchat":       20 * time.Second,
+		"contact":       5 * time.Second,
+	}
+	for _, item := range getenvList("BRIDGE_PROXY_TIMEOUTS", nil) {
+		name, value, _ := strings.Cut(item, "=")
+		d, err := time.ParseDuration(strings.TrimSpace(value))
+		if _, known := cfg.ProxyTimeouts[strings.TrimSpace(name)]; !known || err != nil || d <= 0 {
+			log.Fatalf("invalid BRIDGE_PROXY_TIMEOUTS entry %q", item)
+		}
+		cfg.ProxyTimeouts[strings.TrimSpace(name)] = d
+	}
+	cfg.MediaForwardAllowlist = getenvList("BRIDGE_MEDIA_FORWARD_ALLOWLIST", nil)
+	for key, dst := range map[string]*[]netip.Prefix{"BRIDGE_CALLBACK_ALLOWLIST": &cfg.CallbackAllowlist, "BRIDGE_TRUSTED_PROXIES": &cfg.TrustedProxies} {
+		prefixes, err := ParsePrefixes(getenvList(key, nil))
+		if err != nil {
+			log.Fatalf("invalid %s: %v", key, err)
+		}
+		*dst = prefixes
+	}
+	cfg.CallbackAllowlistAuto = getenvBool("BRIDGE_CALLBACK_ALLOWLIST_AUTO", false)
+	cfg.CallbackAllowlistRefresh = getenvDuration("BRIDGE_CALLBACK_ALLOWLIST_REFRESH", time.Hour)
+	if cfg.CallbackAllowlistRefresh <= 0 {
+		cfg.CallbackAllowlistRefresh = time.Hour
+	}
+	cfg.MediaUploadConcurrency = getenvInt("BRIDGE_MEDIA_UPLOAD_CONCURRENCY", 4)
+	if cfg.MediaUploadConcurrency <= 0 {
+		cfg.MediaUploadConcurrency = 4
+	}
+	cfg.MediaBatchMaxBytes = int64(getenvInt("BRIDGE_MEDIA_BATCH_MAX_MB", 50)) << 20
+	if cfg.MediaBatchMaxBytes <= 0 {
+		cfg.MediaBatchMaxBytes = 50 << 20
+	}
+	cfg.MediaUploadMaxBytes = int64(getenvInt("BRIDGE_MEDIA_UPLOAD_MAX_MB", 200)) << 20
+	cfg.RobotRatePerMinute = getenvInt("BRIDGE_ROBOT_RATE", 20)
+	if cfg.RobotRatePerMinute <= 0 {
+		cfg.RobotRatePerMinute = 20
+	}
+	cfg.RobotQueueMax = getenvDuration("BRIDGE_ROBOT_QUEUE_MAX", time.Minute)
+	if cfg.MediaUploadMaxBytes <= 0 {
+		cfg.MediaUploadMaxBytes = 200 << 20
+	}
+	cfg.ProxyTimeoutMax = getenvDuration("BRIDGE_PROXY_TIMEOUT_MAX", 60*time.Second)
+	cfg.RateLimits = make(map[string]RateLimit)
+	for _, item := range getenvList("BRIDGE_RATE_LIMITS", nil) {
+		class, value, _ := strings.Cut(item, "=")
+		class = strings.TrimSpace(class)
+		limit, err := ParseRateLimit(value)
+		if !slices.Contains(RateClasses, class) || err != nil {
+			log.Fatalf("invalid BRIDGE_RATE_LIMITS entry %q (class=N/s|m|h[:burst], classes %s)", item, strings.Join(RateClasses, ", "))
+		}
+		cfg.RateLimits[class] = limit
+	}
+	cfg.HTTPProxy = strings.TrimSpace(os.Getenv("BRIDGE_HTTP_PROXY"))
+	if cfg.HTTPProxy != "" && cfg.HTTPProxy != "off" {
+		if u, err := url.Parse(cfg.HTTPProxy); err != nil || u.Host == "" {
+			log.Fatalf("invalid BRIDGE_HTTP_PROXY %q (a proxy URL or off)", cfg.HTTPProxy)
+		}
+	}
+	cfg.HTTPMaxIdleConns = getenvInt("BRIDGE_HTTP_MAX_IDLE_CONNS", 100)
+	if cfg.HTTPMaxIdleConns <= 0 {
+		cfg.HTTPMaxIdleConns = 100
+	}
+	cfg.HTTPMaxConnsPerHost = getenvInt("BRIDGE_HTTP_MAX_CONNS_PER_HOST", 0)
+	cfg.HTTPIdleTimeout = getenvDuration("BRIDGE_HTTP_IDLE_TIMEOUT", 90*time.Second)
+	cfg.HTTPDialTimeout = getenvDuration("BRIDGE_HTTP_DIAL_TIMEOUT", 10*time.Second)
+	if cfg.HTTPDialTimeout <= 0 {
+		cfg.HTTPDialTimeout = 10 * time.Second
+	}
+	cfg.HTTPCAFile = strings.TrimSpace(os.Getenv("BRIDGE_HTTP_CA_FILE"))
+	cfg.DedupTTL = getenvDuration("BRIDGE_DEDUP_TTL", 10*time.Minute)
+	cfg.RedisURL = strings.TrimSpace(os.Getenv("BRIDGE_REDIS_URL"))
+	mode, ok := ParseCallbackMode(os.Getenv("WECOM_CALLBACK_MODE"))
+	if !ok {
+		log.Fatalf("invalid WECOM_CALLBACK_MODE %q (secure, compat or plaintext)", os.Getenv("WECOM_CALLBACK_MODE"))
+	}
+	cfg.CallbackMode = mode
+	cfg.FailureMode = strings.ToLower(strings.TrimSpace(os.Getenv("BRIDGE_FAILURE_MODE")))
+	if cfg.FailureMode != "retry" {
+		cfg.FailureMode = "ack"
+	}
+	cfg.LinkUnfurl = getenvBool("BRIDGE_LINK_UNFURL", false)
+	cfg.LinkExtract = getenvBool("BRIDGE_LINK_EXTRACT", false) || cfg.LinkUnfurl
+	cfg.LinkAllowlist = getenvList("BRIDGE_LINK_ALLOWLIST", nil)
+	cfg.LinkTimeout = getenvDuration("BRIDGE_LINK_TIMEOUT", 3*time.Second)
+	cfg.ContactEnrich = getenvBool("BRIDGE_CONTACT_ENRICH", true)
+	cfg.ContactEnrichTTL = getenvDuration("BRIDGE_CONTACT_ENRICH_TTL", 30*time.Minute)
+	if tz := strings.TrimSpace(os.Getenv("BRIDGE_TIMEZONE")); tz != "" {
+		loc, err := time.LoadLocation(tz)
+		if err != nil {
+			log.Fatalf("invalid BRIDGE_TIMEZONE: %v", err)
+		}
+		cfg.Timezone = loc
+	}
+	cfg.CallbackWorkers = getenvInt("BRIDGE_CALLBACK_WORKERS", 4)
+	if cfg.CallbackWorkers <= 0 {
+		cfg.CallbackWorkers = 4
+	}
+	cfg.CallbackQueue = getenvInt("BRIDGE_CALLBACK_QUEUE", 100)
+	if cfg.CallbackQueue <= 0 {
+		cfg.CallbackQueue = 100
+	}
+	cfg.CallbackTimeout = getenvDuration("BRIDGE_CALLBACK_TIMEOUT", 4*time.Second)
+	cfg.ShutdownTimeout = getenvDuration("BRIDGE_SHUTDOWN_TIMEOUT", 30*time.Second)
+	cfg.ReadyTokenCheck = getenvBool("BRIDGE_READY_TOKEN_CHECK", true)
+	cfg.ReadyCache = getenvDuration("BRIDGE_READY_CACHE", 30*time.Second)
+	cfg.TLSCertFile = strings.TrimSpace(firstNonEmpty(os.Getenv("BRIDGE_TLS_CERT_FILE"), os.Getenv("TLS_CERT")))
+	cfg.TLSKeyFile = strings.TrimSpace(firstNonEmpty(os.Getenv("BRIDGE_TLS_KEY_FILE"), os.Getenv("TLS_KEY")))
+	if err := cfg.LogLevel.UnmarshalText([]byte(firstNonEmpty(strings.TrimSpace(os.Getenv("LOG_LEVEL")), "info"))); err != nil {
+		log.Fatalf("invalid LOG_LEVEL %q (debug, info, warn or error)", os.Getenv("LOG_LEVEL"))
+	}
+	cfg.LogFormat = strings.ToLower(firstNonEmpty(strings.TrimSpace(os.Getenv("LOG_FORMAT")), "text"))
+	if cfg.LogFormat != "text" && cfg.LogFormat != "json" {
+		log.Fatalf("invalid LOG_FORMAT %q (text or json)", os.Getenv("LOG_FORMAT"))
+	}
+	if (cfg.TLSCertFile == "") != (cfg.TLSKeyFile == "") {
+		log.Fatalf("BRIDGE_TLS_CERT_FILE and BRIDGE_TLS_KEY_FILE must be set together")
+	}
+	cfg.ReplyWait = getenvDuration("BRIDGE_REPLY_WAIT", 0)
+	if limit := cfg.CallbackTimeout - 500*time.Millisecond; cfg.ReplyWait > 0 && cfg.ReplyWait > limit {
+		// Leave the handler time to encrypt and answer before it gives up.
+		slog.Warn("BRIDGE_REPLY_WAIT exceeds BRIDGE_CALLBACK_TIMEOUT", "reply_wait", cfg.ReplyWait.String(), "using", max(limit, 0).String())
+		cfg.ReplyWait = max(limit, 0)
+	}
+	cfg.TicketTTL = getenvDuration("BRIDGE_TICKET_TTL", 30*time.Second)
+	cfg.StreamHeartbeat = getenvDuration("BRIDGE_STREAM_HEARTBEAT", 15*time.Second)
+	cfg.StreamClientBuffer = getenvInt("BRIDGE_STREAM_CLIENT_BUFFER", 16)
+	if cfg.StreamClientBuffer < 1 {
+		log.Fatalf("invalid BRIDGE_STREAM_CLIENT_BUFFER %d (must be >= 1)", cfg.StreamClientBuffer)
+	}
+	cfg.StreamDropPolicy = strings.ToLower(strings.TrimSpace(os.Getenv("BRIDGE_STREAM_DROP_POLICY")))
+	switch cfg.StreamDropPolicy {
+	case "":
+		cfg.StreamDropPolicy = "drop-newest"
+	case "drop-newest", "drop-oldest", "disconnect":
+	default:
+		log.Fatalf("invalid BRIDGE_STREAM_DROP_POLICY %q (drop-newest, drop-oldest or disconnect)", cfg.StreamDropPolicy)
+	}
+	cfg.CORSOrigins = getenvList("BRIDGE_CORS_ORIGINS", nil)
+	for _, origin := range cfg.CORSOrigins {
+		if origin != "*" && !strings.HasPrefix(origin, "http://") && !strings.HasPrefix(origin, "https://") {
+			log.Fatalf("invalid BRIDGE_CORS_ORIGINS entry %q (\"*\" or an http(s):// origin)", origin)
+		}
+	}
+	cfg.CORSHeaders = getenvList("BRIDGE_CORS_HEADERS", []string{"Authorization", "Content-Type", "Last-Event-ID", "Idempotency-Key", "X-Request-Id"})
+	cfg.CORSMaxAge = getenvDuration("BRIDGE_CORS_MAX_AGE", 10*time.Minute)
+	cfg.PublishToken = strings.TrimSpace(os.Getenv("BRIDGE_PUBLISH_TOKEN"))
+	cfg.SigningSecret = strings.TrimSpace(os.Getenv("BRIDGE_SIGNING_SECRET"))
+	cfg.BridgeName = strings.TrimSpace(os.Getenv("BRIDGE_NAME"))
+	if cfg.BridgeName == "" {
+		cfg.BridgeName, _ = os.Hostname()
+	}
+	cfg.FederationState = dataPath(cfg, "BRIDGE_FEDERATION_STATE", "federation.json")
+	cfg.Mode = strings.ToLower(strings.TrimSpace(os.Getenv("BRIDGE_MODE")))
+	if cfg.Mode != "mirror" && cfg.Mode != "standby" {
+		cfg.Mode = "primary"
+	}
+	cfg.FailoverAfter = getenvDuration("BRIDGE_FAILOVER_AFTER", 0)
+	cfg.PrimaryURL = strings.TrimRight(strings.TrimSpace(os.Getenv("BRIDGE_PRIMARY_URL")), "/")
+	cfg.ReplicationToken = strings.TrimSpace(os.Getenv("BRIDGE_REPLICATION_TOKEN"))
+	if cfg.Mode != "primary" && (cfg.PrimaryURL == "" || cfg.ReplicationToken == "") {
+		log.Fatalf("%s mode requires BRIDGE_PRIMARY_URL and BRIDGE_REPLICATION_TOKEN", cfg.Mode)
+	}
+	cfg.ConfigFile = strings.TrimSpace(os.Getenv("BRIDGE_CONFIG_FILE"))
+	if cfg.ConfigFile != "" {
+		fileCfg, err := LoadFile(cfg.ConfigFile)
+		if err != nil {
+			log.Fatalf("config file error: %v", err)
+		}
+		cfg.Rules = fileCfg.Rules
+		cfg.Routes = fileCfg.Routes
+		cfg.Schemas = fileCfg.Schemas
+		cfg.QyAPI = fileCfg.QyAPI
+		cfg.Upstreams = fileCfg.Upstreams
+		cfg.Welcome = fileCfg.Welcome
+		cfg.Retention = fileCfg.Retention
+		cfg.Agents = fileCfg.Agents
+		cfg.Tokens = fileCfg.Tokens
+		cfg.Channels = fileCfg.Channels
+		cfg.APIRoutes = fileCfg.API
+	}
+	for _, agent := range cfg.Agents {
+		if agent.AgentID != "" && agent.CorpSecret != "" {
+			cfg.AgentSecrets[agent.AgentID] = agent.CorpSecret
+		}
+	}
+	return cfg
+}
+
+// parseRetentionAge accepts Go durations plus a "d" suffix for days; an
+// empty value means no age limit.
+func parseRetentionAge(v string) (time.Duration, error) {
+	v = strings.TrimSpace(v)
+	if v == "" {
+		return 0, nil
+	}
+	if days, ok := strings.CutSuffix(v, "d"); ok {
+		n, err := strconv.Atoi(days)
+		if err != nil || n <= 0 {
+			return 0, fmt.Errorf("invalid age %q", v)
+		}
+		return time.Duration(n) * 24 * time.Hour, nil
+	}
+	d, err := time.ParseDuration(v)
+	if err != nil || d <= 0 {
+		return 0, fmt.Errorf("invalid age %q", v)
+	}
+	return d, nil
+}
+
+func getenvInt(key string, fallback int) int {
+	if v := strings.TrimSpace(os.Getenv(key)); v != "" {
+		if n, err := strconv.Atoi(v); err == nil {
+			return n
+		}
+	}
+	return fallback
+}
+
+// dataPath resolves a state file location: an explicit env var wins, else the
+// file lives under BRIDGE_DATA_DIR; empty means the feature keeps no state.
+func dataPath(cfg Config, key, name string) string {
+	if v := strings.TrimSpace(os.Getenv(key)); v != "" {
+		return v
+	}
+	if cfg.DataDir == "" {
+		return ""
+	}
+	return filepath.Join(cfg.DataDir, name)
+}
+
+// getenvDuration reads a Go duration string such as "500ms" or "2s".
+func getenvDuration(key string, fallback time.Duration) time.Duration {
+	if v := strings.TrimSpace(os.Getenv(key)); v != "" {
+		if d, err := time.ParseDuration(v); err == nil {
+			return d
+		}
+	}
+	return fallback
+}
+
+// getenvList reads a comma-separated list, dropping empty entries.
+func getenvList(key string, fallback []string) []string {
+	v := strings.TrimSpace(os.Getenv(key))
+	if v == "" {
+		return fallback
+	}
+	items := make([]string, 0)
+	for _, item := range strings.Split(v, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			items = append(items, item)
+		}
+	}
+	return items
+}
+
+func getenvBool(key string, fallback bool) bool {
+	v, err := strconv.ParseBool(strings.TrimSpace(os.Getenv(key)))
+	if err != nil {
+		return fallback
+	}
+	return v
+}
@@ -0,0 +1,278 @@
+package config
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"reflect"
+	"regexp"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/Tennen/Paimon/tools/bridge/ruleexpr"
+	"github.com/Tennen/Paimon/tools/bridge/yamlconf"
+)
+
+// ruleReservedFields are payload fields set rules may not change.
+var ruleReservedFields = []string{"messageId", "sessionId", "labels", "topics", "replyable", "receivedAt", "receivedAtMs", "createTime", "createdAt"}
+
+// LoadFile reads and validates a JSON or YAML config file, compiling its
+// patterns and parsing its durations.
+func LoadFile(path string) (File, error) {
+	var fileCfg File
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return fileCfg, err
+	}
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".yaml", ".yml":
+		if data, err = yamlconf.Decode(data, reflect.TypeOf(fileCfg)); err != nil {
+			return fileCfg, fmt.Errorf("parse %s: %w", path, err)
+		}
+	case ".toml":
+		return fileCfg, fmt.Errorf("parse %s: TOML is not supported, use YAML (.yaml or .yml) or JSON", path)
+	}
+	if err := json.Unmarshal(data, &fileCfg); err != nil {
+		return fileCfg, fmt.Errorf("parse %s: %w", path, err)
+	}
+	if fileCfg.Port < 0 || fileCfg.Port > 65535 {
+		return fileCfg, fmt.Errorf("port %d out of range", fileCfg.Port)
+	}
+	if t := fileCfg.TLS; t != nil && (t.CertFile == "") != (t.KeyFile == "") {
+		return fileCfg, errors.New("tls: certFile and keyFile must be set together")
+	}
+	for i := range fileCfg.Rules {
+		rule := &fileCfg.Rules[i]
+		if rule.Name == "" {
+			rule.Name = fmt.Sprintf("rule-%d", i+1)
+		}
+		rule.Action = strings.ToLower(strings.TrimSpace(rule.Action))
+		if rule.Action == "" {
+			rule.Action = "tag"
+		}
+		if rule.Action != "tag" && rule.Action != "drop" && rule.Action != "set" && rule.Action != "rewrite" {
+			return fileCfg, fmt.Errorf("rule %s: unknown action %q", rule.Name, rule.Action)
+		}
+		if rule.Pattern != "" {
+			re, err := regexp.Compile(rule.Pattern)
+			if err != nil {
+				return fileCfg, fmt.Errorf("rule %s: %w", rule.Name, err)
+			}
+			rule.Regexp = re
+		}
+		if rule.When != "" {
+			expr, err := ruleexpr.Compile(rule.When)
+			if err != nil {
+				return fileCfg, fmt.Errorf("rule %s: when: %w", rule.Name, err)
+			}
+			rule.Cond = expr
+		}
+		if rule.Regexp == nil && len(rule.Keywords) == 0 && rule.Cond == nil {
+			return fileCfg, fmt.Errorf("rule %s: keywords, pattern or when required", rule.Name)
+		}
+		if rule.Action == "set" && len(rule.Set) == 0 {
+			return fileCfg, fmt.Errorf("rule %s: set requires fields", rule.Name)
+		}
+		for name := range rule.Set {
+			if name == "" || slices.Contains(ruleReservedFields, name) {
+				return fileCfg, fmt.Errorf("rule %s: field %q cannot be set", rule.Name, name)
+			}
+		}
+		if rule.Action == "rewrite" && rule.Regexp == nil {
+			return fileCfg, fmt.Errorf("rule %s: rewrite requires pattern", rule.Name)
+		}
+	}
+	for i := range fileCfg.Routes {
+		route := &fileCfg.Routes[i]
+		route.Topic = strings.TrimSpace(route.Topic)
+		if route.Topic == "" {
+			return fileCfg, fmt.Errorf("route %d: topic required", i+1)
+		}
+		if route.Pattern != "" {
+			re, err := regexp.Compile(route.Pattern)
+			if err != nil {
+				return fileCfg, fmt.Errorf("route %s: %w", route.Topic, err)
+			}
+			route.Regexp = re
+		}
+	}
+	seenSchemas := make(map[string]bool)
+	for i := range fileCfg.Schemas {
+		schema := &fileCfg.Schemas[i]
+		schema.Name = strings.TrimSpace(schema.Name)
+		if schema.Name == "" {
+			return fileCfg, fmt.Errorf("schema %d: name required", i+1)
+		}
+		if seenSchemas[schema.Name] {
+			return fileCfg, fmt.Errorf("schema %s: duplicate name", schema.Name)
+		}
+		seenSchemas[schema.Name] = true
+		for from, to := range schema.Rename {
+			if strings.TrimSpace(to) == "" {
+				return fileCfg, fmt.Errorf("schema %s: empty rename target for %s", schema.Name, from)
+			}
+		}
+	}
+	if qc := fileCfg.QyAPI; qc != nil && qc.BaseURL != "" {
+		base, err := url.Parse(strings.TrimRight(qc.BaseURL, "/"))
+		if err != nil || base.Scheme == "" || base.Host == "" {
+			return fileCfg, fmt.Errorf("qyapi baseUrl %q: absolute URL required", qc.BaseURL)
+		}
+		qc.Base = base
+	}
+	for i := range fileCfg.Upstreams {
+		up := &fileCfg.Upstreams[i]
+		if up.URL == "" {
+			return fileCfg, fmt.Errorf("upstream %d: url required", i+1)
+		}
+		if up.Name == "" {
+			up.Name = up.URL
+		}
+		up.URL = strings.TrimRight(up.URL, "/")
+	}
+	if wc := fileCfg.Welcome; wc != nil {
+		if wc.Text == "" && wc.Card == nil {
+			return fileCfg, errors.New("welcome: text or card required")
+		}
+		if len(wc.Events) == 0 {
+			wc.Events = []string{"subscribe", "enter_agent"}
+		}
+		wc.CooldownPeriod = 24 * time.Hour
+		if wc.Cooldown != "" {
+			d, err := time.ParseDuration(wc.Cooldown)
+			if err != nil {
+				return fileCfg, fmt.Errorf("welcome cooldown: %w", err)
+			}
+			wc.CooldownPeriod = d
+		}
+	}
+	if rc := fileCfg.Retention; rc != nil {
+		rc.IntervalPeriod = time.Hour
+		if rc.Interval != "" {
+			d, err := time.ParseDuration(rc.Interval)
+			if err != nil || d <= 0 {
+				return fileCfg, fmt.Errorf("retention interval %q: positive duration required", rc.Interval)
+			}
+			rc.IntervalPeriod = d
+		}
+		for name, policy := range map[string]*RetentionPolicy{"archive": rc.Archive, "media": rc.Media} {
+			if policy == nil {
+				continue
+			}
+			var err error
+			if policy.MaxAgePeriod, err = parseRetentionAge(policy.MaxAge); err != nil {
+				return fileCfg, fmt.Errorf("retention %s maxAge: %w", name, err)
+			}
+			if name == "media" && len(policy.Rules) > 0 {
+				return fileCfg, errors.New("retention media: rules apply to the archive only")
+			}
+			for i := range policy.Rules {
+				rule := &policy.Rules[i]
+				if rule.MaxAgePeriod, err = parseRetentionAge(rule.MaxAge); err != nil {
+					return fileCfg, fmt.Errorf("retention %s rule %d maxAge: %w", name, i+1, err)
+				}
+			}
+		}
+	}
+	seenAgents := map[string]bool{"default": true}
+	for i := range fileCfg.Agents {
+		agent := &fileCfg.Agents[i]
+		for _, field := range []*string{&agent.Token, &agent.AESKey, &agent.ReceiveID, &agent.CorpID, &agent.CorpSecret, &agent.AgentID} {
+			*field = strings.TrimSpace(os.ExpandEnv(*field))
+		}
+		agent.Name = strings.TrimSpace(agent.Name)
+		if agent.Name == "" || strings.Contains(agent.Name, "/") {
+			return fileCfg, fmt.Errorf("agent %d: name required (no slashes)", i+1)
+		}
+		if seenAgents[agent.Name] {
+			return fileCfg, fmt.Errorf("agent %s: duplicate or reserved name", agent.Name)
+		}
+		seenAgents[agent.Name] = true
+		mode, ok := ParseCallbackMode(agent.CallbackMode)
+		if !ok {
+			return fileCfg, fmt.Errorf("agent %s: callbackMode must be secure, compat or plaintext", agent.Name)
+		}
+		agent.CallbackMode = mode
+		if agent.Token == "" || (agent.AESKey == "" && mode != CallbackPlaintext) {
+			return fileCfg, fmt.Errorf("agent %s: token and aesKey required", agent.Name)
+		}
+		if agent.CorpSecret != "" && agent.AgentID == "" {
+			return fileCfg, fmt.Errorf("agent %s: corpSecret requires agentId", agent.Name)
+		}
+	}
+	// Names show up as the requester identity, so they must not pass for
+	// one of the built-in credentials.
+	seenTokens := map[string]bool{"anonymous": true, "quota-override": true, "admin": true, "publisher": true, "bridge": true, "unknown": true}
+	for i := range fileCfg.Tokens {
+		t := &fileCfg.Tokens[i]
+		t.Name = strings.TrimSpace(t.Name)
+		t.Token = strings.TrimSpace(os.ExpandEnv(t.Token))
+		if t.Name == "" || t.Token == "" {
+			return fileCfg, fmt.Errorf("token %d: name and token required", i+1)
+		}
+		if seenTokens[t.Name] {
+			return fileCfg, fmt.Errorf("token %s: duplicate or reserved name", t.Name)
+		}
+		seenTokens[t.Name] = true
+		if len(t.Scopes) == 0 {
+			return fileCfg, fmt.Errorf("token %s: scopes required", t.Name)
+		}
+		for _, scope := range t.Scopes {
+			if !slices.Contains(KnownScopes, scope) {
+				return fileCfg, fmt.Errorf("token %s: unknown scope %q (want one of %s)", t.Name, scope, strings.Join(KnownScopes, ", "))
+			}
+		}
+	}
+	seenChannels := map[string]bool{"wecom": true}
+	for i := range fileCfg.Channels {
+		ch := &fileCfg.Channels[i]
+		for _, field := range []*string{&ch.AppID, &ch.AppSecret, &ch.VerificationToken, &ch.EncryptKey, &ch.APIBase} {
+			*field = strings.TrimSpace(os.ExpandEnv(*field))
+		}
+		ch.Name = strings.TrimSpace(ch.Name)
+		if ch.Name == "" || strings.Contains(ch.Name, "/") {
+			return fileCfg, fmt.Errorf("channel %d: name required (no slashes)", i+1)
+		}
+		if seenChannels[ch.Name] {
+			return fileCfg, fmt.Errorf("channel %s: duplicate or reserved name", ch.Name)
+		}
+		seenChannels[ch.Name] = true
+		if ch.Type = strings.ToLower(strings.TrimSpace(ch.Type)); ch.Type != "feishu" {
+			return fileCfg, fmt.Errorf("channel %s: unknown type %q (want feishu)", ch.Name, ch.Type)
+		}
+		if ch.VerificationToken == "" && ch.EncryptKey == "" {
+			return fileCfg, fmt.Errorf("channel %s: verificationToken or encryptKey required", ch.Name)
+		}
+		ch.APIBase = strings.TrimRight(firstNonEmpty(ch.APIBase, "https://open.feishu.cn"), "/")
+	}
+	for i := range fileCfg.API {
+		route := &fileCfg.API[i]
+		route.Path = strings.Trim(strings.TrimSpace(route.Path), "/")
+		if !ValidAPIPath(strings.TrimSuffix(route.Path, "/*")) {
+			return fileCfg, fmt.Errorf("api %d: invalid path %q", i+1, route.Path)
+		}
+		if route.Path == "gettoken" {
+			return fileCfg, errors.New("api: gettoken cannot be allowed")
+		}
+		if len(route.Methods) == 0 {
+			route.Methods = []string{http.MethodGet}
+		}
+		for j, method := range route.Methods {
+			method = strings.ToUpper(strings.TrimSpace(method))
+			if method != http.MethodGet && method != http.MethodPost {
+				return fileCfg, fmt.Errorf("api %s: unsupported method %q (GET or POST)", route.Path, method)
+			}
+			route.Methods[j] = method
+		}
+		if route.RatePerMinute < 0 {
+			return fileCfg, fmt.Errorf("api %s: ratePerMinute must be >= 0", route.Path)
+		}
+		route.AgentID = strings.TrimSpace(route.AgentID)
+	}
+	return fileCfg, nil
+}
@@ -0,0 +1,266 @@
+package eventstore
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/Tennen/Paimon/tools/bridge/hub"
+)
+
+// FileStore keeps events as JSON lines in one append-only file, with a
+// sparse ID -> offset index so replays seek close to their starting point.
+// Writes are not fsynced: a crash can lose the last few events, which the
+// inbound outbox re-broadcasts under new IDs.
+type FileStore struct {
+	mu       sync.Mutex
+	path     string
+	file     *os.File
+	size     int64
+	count    int
+	marks    []indexMark
+	maxAge   time.Duration
+	maxBytes int64
+}
+
+// indexMark records the byte offset of the line holding event ID.
+type indexMark struct {
+	id     int64
+	offset int64
+}
+
+// storedEvent is one line of the event file, or one Redis stream entry.
+type storedEvent struct {
+	ID       int64           `json:"id"`
+	Type     string          `json:"type"`
+	Time     time.Time       `json:"time"`
+	Topics   []string        `json:"topics,omitempty"`
+	Agent    string          `json:"agent,omitempty"`
+	FromUser string          `json:"fromUser,omitempty"`
+	MsgType  string          `json:"msgType,omitempty"`
+	Payload  json.RawMessage `json:"payload"`
+}
+
+// markEvery is the number of events between index marks.
+const markEvery = 256
+
+// OpenFile opens or creates the store file at path. maxAge and maxBytes
+// bound what Trim keeps; zero disables a limit.
+func OpenFile(path string, maxAge time.Duration, maxBytes int64) (*FileStore, error) {
+	if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+		return nil, err
+	}
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_RDWR|os.O_APPEND, 0o600)
+	if err != nil {
+		return nil, err
+	}
+	st := &FileStore{path: path, file: f, maxAge: maxAge, maxBytes: maxBytes}
+	if err := st.reindexLocked(); err != nil {
+		_ = f.Close()
+		return nil, err
+	}
+	return st, nil
+}
+
+// scanLocked calls fn for each line from offset on with the line's offset
+// and decoded event; undecodable lines are skipped. fn returns false to stop.
+// The caller holds st.mu.
+func (st *FileStore) scanLocked(offset int64, fn func(off int64, line []byte, ev storedEvent) bool) error {
+	if _, err := st.file.Seek(offset, io.SeekStart); err != nil {
+		return err
+	}
+	rd := bufio.NewReaderSize(st.file, 64*1024)
+	off := offset
+	for {
+		line, err := rd.ReadBytes('\n')
+		if len(line) > 0 && line[len(line)-1] == '\n' {
+			var ev storedEvent
+			if json.Unmarshal(line, &ev) == nil && !fn(off, line, ev) {
+				return nil
+			}
+		}
+		off += int64(len(line))
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+	}
+}
+
+// reindexLocked rebuilds the size, count and index marks from the file. The
+// caller holds st.mu.
+func (st *FileStore) reindexLocked() error {
+	st.size, st.count, st.marks = 0, 0, nil
+	err := st.scanLocked(0, func(off int64, line []byte, ev storedEvent) bool {
+		if st.count%markEvery == 0 {
+			st.marks = append(st.marks, indexMark{id: ev.ID, offset: off})
+		}
+		st.count++
+		st.size = off + int64(len(line))
+		return true
+	})
+	return err
+}
+
+func (st *FileStore) Append(ev hub.Event) error {
+	if !json.Valid(ev.Payload) {
+		return fmt.Errorf("event %d: payload is not JSON", ev.ID)
+	}
+	if ev.Time.IsZero() {
+		ev.Time = time.Now().UTC()
+	}
+	line, err := json.Marshal(storedEvent{ID: ev.ID, Type: ev.Type, Time: ev.Time, Topics: ev.Topics, Agent: ev.Agent, FromUser: ev.FromUser, MsgType: ev.MsgType, Payload: ev.Payload})
+	if err != nil {
+		return err
+	}
+	line = append(line, '\n')
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	if _, err := st.file.Write(line); err != nil {
+		return err
+	}
+	if st.count%markEvery == 0 {
+		st.marks = append(st.marks, indexMark{id: ev.ID, offset: st.size})
+	}
+	st.count++
+	st.size += int64(len(line))
+	return nil
+}
+
+func (st *FileStore) After(id int64, filter hub.Filter) ([]hub.Event, error) {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	// Start at the last mark not past id+1; everything before it is older.
+	i := sort.Search(len(st.marks), func(i int) bool { return st.marks[i].id > id+1 })
+	var offset int64
+	if i > 0 {
+		offset = st.marks[i-1].offset
+	}
+	out := make([]hub.Event, 0)
+	err := st.scanLocked(offset, func(_ int64, _ []byte, ev storedEvent) bool {
+		e := ev.event()
+		if e.ID > id && filter.Matches(e) {
+			out = append(out, e)
+		}
+		return true
+	})
+	return out, err
+}
+
+func (st *FileStore) Tail(n int) ([]hub.Event, error) {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	var offset int64
+	if skip := st.count - n; skip > 0 {
+		if m := skip / markEvery; m < len(st.marks) {
+			offset = st.marks[m].offset
+		}
+	}
+	out := make([]hub.Event, 0, n)
+	err := st.scanLocked(offset, func(_ int64, _ []byte, ev storedEvent) bool {
+		out = append(out, ev.event())
+		return true
+	})
+	if len(out) > n {
+		out = out[len(out)-n:]
+	}
+	return out, err
+}
+
+func (st *FileStore) Before(id int64, fn func(ev hub.Event) bool) error {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	// Walk the index segments backwards, reading each one forwards; the
+	// segment starting at mark i holds the IDs below mark i+1.
+	i := sort.Search(len(st.marks), func(i int) bool { return st.marks[i].id >= id })
+	for k := i - 1; k >= 0; k-- {
+		end := st.size
+		if k+1 < len(st.marks) {
+			end = st.marks[k+1].offset
+		}
+		segment := make([]hub.Event, 0, markEvery)
+		err := st.scanLocked(st.marks[k].offset, func(off int64, _ []byte, ev storedEvent) bool {
+			if off >= end {
+				return false
+			}
+			if ev.ID < id {
+				segment = append(segment, ev.event())
+			}
+			return true
+		})
+		if err != nil {
+			return err
+		}
+		for j := len(segment) - 1; j >= 0; j-- {
+			if !fn(segment[j]) {
+				return nil
+			}
+		}
+	}
+	return nil
+}
+
+func (st *FileStore) Trim(now time.Time) (int, error) {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	// Find the first line to keep: past the age limit and, counting from the
+	// end, within the size limit. If no line qualifies, everything goes.
+	keepFrom := st.size
+	err := st.scanLocked(0, func(off int64, _ []byte, ev storedEvent) bool {
+		tooOld := st.maxAge > 0 && now.Sub(ev.Time) > st.maxAge
+		tooBig := st.maxBytes > 0 && st.size-off > st.maxBytes
+		if tooOld || tooBig {
+			return true
+		}
+		keepFrom = off
+		return false
+	})
+	if err != nil {
+		return 0, err
+	}
+	if keepFrom == 0 {
+		return 0, nil
+	}
+	before := st.count
+
+	if _, err := st.file.Seek(keepFrom, io.SeekStart); err != nil {
+		return 0, err
+	}
+	tmp, err := os.OpenFile(st.path+".tmp", os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0o600)
+	if err != nil {
+		return 0, err
+	}
+	_, err = io.Copy(tmp, st.file)
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Rename(st.path+".tmp", st.path)
+	}
+	if err != nil {
+		_ = os.Remove(st.path + ".tmp")
+		return 0, err
+	}
+	f, err := os.OpenFile(st.path, os.O_CREATE|os.O_RDWR|os.O_APPEND, 0o600)
+	if err != nil {
+		return 0, err
+	}
+	_ = st.file.Close()
+	st.file = f
+	if err := st.reindexLocked(); err != nil {
+		return 0, err
+	}
+	return before - st.count, nil
+}
+
+func (ev storedEvent) event() hub.Event {
+	return hub.Event{ID: ev.ID, Type: ev.Type, Payload: []byte(ev.Payload), Topics: ev.Topics, Agent: ev.Agent, FromUser: ev.FromUser, MsgType: ev.MsgType, Time: ev.Time}
+}
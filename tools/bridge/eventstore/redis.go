@@ -0,0 +1,305 @@
+package eventstore
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/Tennen/Paimon/tools/bridge/config"
+	"github.com/Tennen/Paimon/tools/bridge/hub"
+	"github.com/Tennen/Paimon/tools/bridge/metrics"
+	"github.com/Tennen/Paimon/tools/bridge/redis"
+)
+
+// RedisStore shares events between replicas through Redis. Publish
+// assigns the next ID, appends the event to a stream and publishes it on a
+// pub/sub channel in one script. Every replica, the publishing one included,
+// subscribes to the channel and fans out what arrives, so all replicas serve
+// the same IDs and Last-Event-ID works on any of them. The stream backs
+// replay and lets a replica catch up on events it missed while unsubscribed.
+type RedisStore struct {
+	client  *redis.Client
+	reader  *redis.Client // dedicated to Follow's subscription
+	key     string
+	seqKey  string
+	channel string
+	maxLen  int
+	maxAge  time.Duration
+}
+
+// Replica is the bridge a RedisStore feeds. NextEventID is the ID it
+// expects next; IngestReplicated fans out an event under its stored ID and
+// ignores IDs below NextEventID.
+type Replica interface {
+	NextEventID() int64
+	IngestReplicated(ev hub.Event)
+}
+
+// pageSize is the number of stream entries read per XRANGE/XREVRANGE.
+const pageSize = 500
+
+// redisPublishScript takes the next ID from the counter, appends the event
+// under it and publishes "<id> <event>". A lost counter resumes after the
+// newest stream entry, so IDs never go backwards.
+const redisPublishScript = `
+local id = redis.call('INCR', KEYS[1])
+local last = redis.call('XREVRANGE', KEYS[2], '+', '-', 'COUNT', 1)
+if #last > 0 then
+  local top = tonumber(string.match(last[1][1], '^%d+'))
+  if id <= top then
+    id = top + 1
+    redis.call('SET', KEYS[1], id)
+  end
+end
+redis.call('XADD', KEYS[2], 'MAXLEN', '~', ARGV[2], id .. '-0', 'event', ARGV[1])
+redis.call('PUBLISH', ARGV[3], id .. ' ' .. ARGV[1])
+return id`
+
+// OpenRedis connects to BRIDGE_REDIS_URL and uses the stream, counter and
+// channel keyed by the corp's receive ID.
+func OpenRedis(cfg config.Config) (*RedisStore, error) {
+	client, err := redis.New(cfg.RedisURL)
+	if err != nil {
+		return nil, err
+	}
+	reader, err := redis.New(cfg.RedisURL)
+	if err != nil {
+		return nil, err
+	}
+	// The hash tag keeps both keys in one slot for Redis Cluster.
+	key := "wecom-bridge:{events:" + cfg.WeComReceiveID + "}"
+	st := &RedisStore{client: client, reader: reader, key: key, seqKey: key + ":seq", channel: key + ":live", maxLen: cfg.EventStoreMaxEvents, maxAge: cfg.EventStoreMaxAge}
+	if _, err := client.Do("PING"); err != nil {
+		return nil, fmt.Errorf("redis: %w", err)
+	}
+	return st, nil
+}
+
+// Publish stores ev under the next shared ID and returns that ID.
+func (st *RedisStore) Publish(ev hub.Event) (int64, error) {
+	line, err := json.Marshal(storedEvent{Type: ev.Type, Time: ev.Time, Topics: ev.Topics, Agent: ev.Agent, FromUser: ev.FromUser, MsgType: ev.MsgType, Payload: ev.Payload})
+	if err != nil {
+		return 0, err
+	}
+	reply, err := st.client.Do("EVAL", redisPublishScript, "2", st.seqKey, st.key, string(line), strconv.Itoa(st.maxLen), st.channel)
+	if err != nil {
+		return 0, err
+	}
+	id, ok := reply.(int64)
+	if !ok {
+		return 0, fmt.Errorf("redis: unexpected publish reply %v", reply)
+	}
+	return id, nil
+}
+
+// Append is a no-op: Publish already stored the event before it was fanned
+// out.
+func (st *RedisStore) Append(hub.Event) error { return nil }
+
+func (st *RedisStore) After(id int64, filter hub.Filter) ([]hub.Event, error) {
+	out := make([]hub.Event, 0)
+	start := id + 1
+	for {
+		reply, err := st.client.Do("XRANGE", st.key, strconv.FormatInt(start, 10), "+", "COUNT", strconv.Itoa(pageSize))
+		if err != nil {
+			return nil, err
+		}
+		page, n, last := parseRedisEvents(reply)
+		for _, ev := range page {
+			if filter.Matches(ev) {
+				out = append(out, ev)
+			}
+		}
+		if n < pageSize {
+			return out, nil
+		}
+		start = last + 1
+	}
+}
+
+func (st *RedisStore) Tail(n int) ([]hub.Event, error) {
+	reply, err := st.client.Do("XREVRANGE", st.key, "+", "-", "COUNT", strconv.Itoa(n))
+	if err != nil {
+		return nil, err
+	}
+	events, _, _ := parseRedisEvents(reply)
+	slices.Reverse(events)
+	return events, nil
+}
+
+func (st *RedisStore) Before(id int64, fn func(ev hub.Event) bool) error {
+	for end := id - 1; end > 0; {
+		reply, err := st.client.Do("XREVRANGE", st.key, strconv.FormatInt(end, 10), "-", "COUNT", strconv.Itoa(pageSize))
+		if err != nil {
+			return err
+		}
+		page, n, last := parseRedisEvents(reply)
+		for _, ev := range page {
+			if !fn(ev) {
+				return nil
+			}
+		}
+		if n < pageSize {
+			return nil
+		}
+		end = last - 1
+	}
+	return nil
+}
+
+// Trim drops events older than the age limit; XADD's MAXLEN already caps the
+// stream's length.
+func (st *RedisStore) Trim(now time.Time) (int, error) {
+	if st.maxAge <= 0 {
+		return 0, nil
+	}
+	// Find the first event to keep, or one past the newest if all are old.
+	var keepFrom int64
+	start := "-"
+	for {
+		reply, err := st.client.Do("XRANGE", st.key, start, "+", "COUNT", strconv.Itoa(pageSize))
+		if err != nil {
+			return 0, err
+		}
+		page, n, last := parseRedisEvents(reply)
+		for _, ev := range page {
+			if now.Sub(ev.Time) <= st.maxAge {
+				keepFrom = ev.ID
+				break
+			}
+		}
+		if keepFrom != 0 {
+			break
+		}
+		if n == 0 {
+			return 0, nil
+		}
+		if n < pageSize {
+			keepFrom = last + 1
+			break
+		}
+		start = strconv.FormatInt(last+1, 10)
+	}
+	reply, err := st.client.Do("XTRIM", st.key, "MINID", strconv.FormatInt(keepFrom, 10))
+	if err != nil {
+		return 0, err
+	}
+	trimmed, _ := reply.(int64)
+	return int(trimmed), nil
+}
+
+// Follow subscribes to the event channel and fans out each published event
+// with its shared ID until the process exits. After every (re)subscribe, and
+// whenever an ID was skipped, it reads the missing events from the stream,
+// so nothing published while it was disconnected is lost.
+func (st *RedisStore) Follow(r Replica, metrics *metrics.Registry) {
+	for {
+		err := st.reader.Subscribe(st.channel, func() error { return st.catchUp(r) }, func(message string) error {
+			return st.receive(r, message)
+		})
+		slog.Error("redis event follow failed", "err", err)
+		metrics.Inc("wecom_bridge_event_store_errors_total", "op", "follow")
+		time.Sleep(redis.RetryDelay)
+	}
+}
+
+// catchUp fans out the stream's events after the newest one this replica
+// has.
+func (st *RedisStore) catchUp(r Replica) error {
+	events, err := st.After(r.NextEventID()-1, hub.Filter{})
+	if err != nil {
+		return err
+	}
+	for _, ev := range events {
+		r.IngestReplicated(ev)
+	}
+	return nil
+}
+
+// receive fans out one channel message. A message past the next expected
+// ID means others were missed (or IDs jumped), so the stream is read
+// instead, in order.
+func (st *RedisStore) receive(r Replica, message string) error {
+	rawID, value, _ := strings.Cut(message, " ")
+	id, err := strconv.ParseInt(rawID, 10, 64)
+	if err != nil {
+		slog.Warn("redis channel message skipped", "message", truncate(message, 100))
+		return nil
+	}
+	switch next := r.NextEventID(); {
+	case id < next:
+		return nil
+	case id > next:
+		return st.catchUp(r)
+	}
+	ev, err := decodeRedisEvent(id, value)
+	if err != nil {
+		slog.Warn("redis channel message skipped", "id", id, "err", err)
+		return nil
+	}
+	r.IngestReplicated(ev)
+	return nil
+}
+
+// parseRedisEvents decodes a list of stream entries, skipping malformed ones
+// so a bad entry cannot stall replay. n is the number of entries read and
+// last the ID of the final one, for paging past skipped entries.
+func parseRedisEvents(reply any) (events []hub.Event, n int, last int64) {
+	entries, _ := reply.([]any)
+	events = make([]hub.Event, 0, len(entries))
+	for _, entry := range entries {
+		pair, _ := entry.([]any)
+		if len(pair) != 2 {
+			continue
+		}
+		rawID, _ := pair[0].(string)
+		ms, _, _ := strings.Cut(rawID, "-")
+		id, err := strconv.ParseInt(ms, 10, 64)
+		if err != nil {
+			continue
+		}
+		last = id
+		fields, _ := pair[1].([]any)
+		var value string
+		for i := 0; i+1 < len(fields); i += 2 {
+			if name, _ := fields[i].(string); name == "event" {
+				value, _ = fields[i+1].(string)
+			}
+		}
+		ev, err := decodeRedisEvent(id, value)
+		if err != nil {
+			slog.Warn("redis stream entry skipped", "id", rawID, "err", err)
+			continue
+		}
+		events = append(events, ev)
+	}
+	return events, len(entries), last
+}
+
+// decodeRedisEvent decodes an event stored or published by
+// redisPublishScript.
+func decodeRedisEvent(id int64, value string) (hub.Event, error) {
+	var stored storedEvent
+	if err := json.Unmarshal([]byte(value), &stored); err != nil {
+		return hub.Event{}, err
+	}
+	if !json.Valid(stored.Payload) {
+		return hub.Event{}, errors.New("invalid payload")
+	}
+	stored.ID = id
+	return stored.event(), nil
+}
+
+// truncate shortens s to at most n runes for logging.
+func truncate(s string, n int) string {
+	runes := []rune(s)
+	if len(runes) <= n {
+		return s
+	}
+	return string(runes[:n]) + "…"
+}
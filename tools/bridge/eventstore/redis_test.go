@@ -0,0 +1,250 @@
+package eventstore
+
+import (
+	"encoding/json"
+	"fmt"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/Tennen/Paimon/tools/bridge/config"
+	"github.com/Tennen/Paimon/tools/bridge/hub"
+	"github.com/Tennen/Paimon/tools/bridge/metrics"
+	"github.com/Tennen/Paimon/tools/bridge/redis"
+	"github.com/Tennen/Paimon/tools/bridge/redis/redistest"
+)
+
+// newFakeRedis starts a fake Redis that runs redisPublishScript.
+func newFakeRedis(t *testing.T) *redistest.Server {
+	srv := redistest.NewServer(t)
+	srv.Script(redisPublishScript, func(tx *redistest.Tx, keys, args []string) (any, error) {
+		if len(keys) != 2 || len(args) != 3 {
+			t.Errorf("EVAL keys %q args %q", keys, args)
+			return nil, redis.Error("ERR bad script call")
+		}
+		seqKey, key, event, channel := keys[0], keys[1], args[0], args[2]
+		maxLen, _ := strconv.Atoi(args[1])
+		if !strings.HasPrefix(seqKey, key) || !strings.HasPrefix(channel, key) {
+			t.Errorf("keys %q %q %q: counter and channel are not next to the stream", seqKey, key, channel)
+		}
+		// INCR, then resume after the newest entry if the counter was lost.
+		id := tx.Incr(seqKey)
+		if last, ok := tx.Last(key); ok && id <= last.ID {
+			id = last.ID + 1
+			tx.Set(seqKey, id)
+		}
+		if err := tx.XAdd(key, redistest.Entry{ID: id, Event: event}, maxLen); err != nil {
+			return nil, err
+		}
+		tx.Publish(channel, strconv.FormatInt(id, 10)+" "+event)
+		return id, nil
+	})
+	return srv
+}
+
+func TestRedisPublishIDOrdering(t *testing.T) {
+	f := newFakeRedis(t)
+	cfg := config.Config{RedisURL: f.URL("", ""), WeComReceiveID: "corp", EventStoreMaxEvents: 1000}
+	st, err := OpenRedis(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if st.key != "wecom-bridge:{events:corp}" || st.seqKey != "wecom-bridge:{events:corp}:seq" {
+		t.Fatal(st.key, st.seqKey)
+	}
+	publish := func() int64 {
+		t.Helper()
+		id, err := st.Publish(hub.Event{Type: "message", Payload: []byte(`{"text":"hi"}`), Time: time.Now().UTC()})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return id
+	}
+	var got []int64
+	got = append(got, publish(), publish())
+	// A lost counter, e.g. after a failover, resumes after the newest entry.
+	if _, err := st.client.Do("DEL", st.seqKey); err != nil {
+		t.Fatal(err)
+	}
+	got = append(got, publish())
+	// So does one that went backwards.
+	if _, err := st.client.Do("SET", st.seqKey, "1"); err != nil {
+		t.Fatal(err)
+	}
+	got = append(got, publish())
+	// One ahead of the stream is kept, leaving a gap.
+	if _, err := st.client.Do("SET", st.seqKey, "10"); err != nil {
+		t.Fatal(err)
+	}
+	got = append(got, publish())
+	if want := []int64{1, 2, 3, 4, 11}; !slices.Equal(got, want) {
+		t.Fatalf("ids %v, want %v", got, want)
+	}
+
+	// Replicas publishing at once get distinct IDs in stream order.
+	other, err := OpenRedis(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var wg sync.WaitGroup
+	for _, s := range []*RedisStore{st, other} {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for range 20 {
+				if _, err := s.Publish(hub.Event{Type: "message", Payload: []byte(`{}`)}); err != nil {
+					t.Error(err)
+				}
+			}
+		}()
+	}
+	wg.Wait()
+	var ids []int64
+	for _, e := range f.Stream(st.key) {
+		ids = append(ids, e.ID)
+	}
+	if len(ids) != 45 || ids[len(ids)-1] != 51 {
+		t.Fatalf("ids %v", ids)
+	}
+	for i := 1; i < len(ids); i++ {
+		if ids[i] <= ids[i-1] {
+			t.Fatalf("ids %v not increasing at %d", ids, i)
+		}
+	}
+	events, err := st.Tail(2)
+	if err != nil || len(events) != 2 || events[0].ID != 50 || events[1].ID != 51 {
+		t.Fatal(events, err)
+	}
+}
+
+// testReplica records what Follow fans out, like the bridge's state.
+type testReplica struct {
+	mu   sync.Mutex
+	next int64
+	ch   chan hub.Event
+}
+
+func (r *testReplica) NextEventID() int64 {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.next
+}
+
+func (r *testReplica) IngestReplicated(ev hub.Event) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if ev.ID < r.next {
+		return
+	}
+	r.next = ev.ID + 1
+	r.ch <- ev
+}
+
+func TestRedisFanOut(t *testing.T) {
+	if testing.Short() {
+		t.Skip("waits redis.RetryDelay")
+	}
+	f := newFakeRedis(t)
+	cfg := config.Config{RedisURL: f.URL("", ""), WeComReceiveID: "corp", EventStoreMaxEvents: 1000}
+	type replica struct {
+		store   *RedisStore
+		metrics *metrics.Registry
+		r       *testReplica
+	}
+	start := func() replica {
+		st, err := OpenRedis(cfg)
+		if err != nil {
+			t.Fatal(err)
+		}
+		rep := replica{st, metrics.New(), &testReplica{next: 1, ch: make(chan hub.Event, 16)}}
+		go st.Follow(rep.r, rep.metrics)
+		return rep
+	}
+	a, b := start(), start()
+	// Both follow connections must be subscribed before anything is
+	// published, or the first events would only arrive via catch-up.
+	waitUntil(t, "both replicas subscribed", func() bool { return len(f.Seen("SUBSCRIBE")) == 2 })
+	broadcast := func(r replica, text string) {
+		t.Helper()
+		payload, _ := json.Marshal(map[string]any{"text": text})
+		if _, err := r.store.Publish(hub.Event{Type: "message", Payload: payload, Time: time.Now().UTC()}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// receive checks that every replica gets exactly the events want, in
+	// order, with the shared IDs.
+	receive := func(timeout time.Duration, want ...string) {
+		t.Helper()
+		for name, r := range map[string]replica{"a": a, "b": b} {
+			for _, text := range want {
+				select {
+				case ev := <-r.r.ch:
+					var payload map[string]any
+					_ = json.Unmarshal(ev.Payload, &payload)
+					if got := strconv.FormatInt(ev.ID, 10) + " " + fmt.Sprint(payload["text"]); got != text {
+						t.Fatalf("replica %s got %q, want %q", name, got, text)
+					}
+				case <-time.After(timeout):
+					t.Fatalf("replica %s did not receive %q", name, text)
+				}
+			}
+			select {
+			case ev := <-r.r.ch:
+				t.Fatalf("replica %s got unexpected event %d", name, ev.ID)
+			case <-time.After(100 * time.Millisecond):
+			}
+		}
+	}
+
+	// Each replica fans out what the other publishes, over the channel.
+	broadcast(a, "x")
+	broadcast(b, "y")
+	receive(2*time.Second, "1 x", "2 y")
+	if len(f.Seen("XRANGE")) != 2 {
+		t.Fatalf("XRANGE %q, want only the catch-up after subscribing", f.Seen("XRANGE"))
+	}
+
+	// A message that never arrives is read from the stream once the next
+	// one shows the gap.
+	f.Mute(1)
+	broadcast(a, "lost")
+	broadcast(b, "z")
+	receive(2*time.Second, "3 lost", "4 z")
+	for _, args := range f.Seen("XRANGE")[2:] {
+		if args[2] != "3" {
+			t.Fatalf("gap catch-up %q, want after 2", args)
+		}
+	}
+
+	// Events published while the subscriptions are down are read from the
+	// stream after resubscribing, exactly once.
+	f.DropSubscribers()
+	broadcast(b, "down")
+	receive(redis.RetryDelay+3*time.Second, "5 down")
+	broadcast(a, "up")
+	receive(2*time.Second, "6 up")
+
+	subscribes := f.Seen("SUBSCRIBE")
+	if len(subscribes) != 4 || !slices.Equal(subscribes[0], []string{"SUBSCRIBE", "wecom-bridge:{events:corp}:live"}) {
+		t.Fatalf("%q", subscribes)
+	}
+	var out strings.Builder
+	a.metrics.WriteText(&out)
+	if !strings.Contains(out.String(), `wecom_bridge_event_store_errors_total{op="follow"} 1`) {
+		t.Fatal(out.String())
+	}
+}
+
+func waitUntil(t *testing.T, what string, cond func() bool) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatalf("timed out waiting for %s", what)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
@@ -0,0 +1,73 @@
+// Package eventstore persists the bridge's broadcast events so
+// Last-Event-ID replay survives restarts: FileStore keeps them in a local
+// JSONL file, RedisStore shares them, and their IDs, between replicas.
+package eventstore
+
+import (
+	"errors"
+	"fmt"
+	"log/slog"
+	"time"
+
+	"github.com/Tennen/Paimon/tools/bridge/config"
+	"github.com/Tennen/Paimon/tools/bridge/hub"
+	"github.com/Tennen/Paimon/tools/bridge/metrics"
+)
+
+// Store persists broadcast events with their IDs so Last-Event-ID
+// replay survives restarts. Events are appended in increasing ID order.
+// Another backend (e.g. BoltDB or SQLite) plugs in by implementing it and
+// adding a case to Open. Except for the redis store, Append runs on a
+// Writer's goroutine rather than under the bridge's state lock, so it may
+// block on I/O.
+type Store interface {
+	Append(ev hub.Event) error
+	// After returns the stored events with ID > id that match filter,
+	// oldest first.
+	After(id int64, filter hub.Filter) ([]hub.Event, error)
+	// Tail returns the newest n events, oldest first.
+	Tail(n int) ([]hub.Event, error)
+	// Before calls fn for the stored events with ID < id, newest first,
+	// until fn returns false.
+	Before(id int64, fn func(ev hub.Event) bool) error
+	// Trim drops events older than the store's age limit, then the oldest
+	// ones beyond its size limit, reporting how many were dropped.
+	Trim(now time.Time) (int, error)
+}
+
+// Open returns the backend selected by BRIDGE_EVENT_STORE, or nil
+// for the in-memory buffer only.
+func Open(cfg config.Config) (Store, error) {
+	switch cfg.EventStore {
+	case "memory":
+		return nil, nil
+	case "file":
+		if cfg.EventStoreFile == "" {
+			return nil, errors.New("BRIDGE_EVENT_STORE=file requires BRIDGE_EVENT_STORE_FILE or BRIDGE_DATA_DIR")
+		}
+		return OpenFile(cfg.EventStoreFile, cfg.EventStoreMaxAge, int64(cfg.EventStoreMaxMB)<<20)
+	case "redis":
+		if cfg.RedisURL == "" {
+			return nil, errors.New("BRIDGE_EVENT_STORE=redis requires BRIDGE_REDIS_URL")
+		}
+		// Replicas share one ID sequence, which replication cannot follow.
+		if cfg.Mode != "primary" {
+			return nil, errors.New("BRIDGE_EVENT_STORE=redis requires BRIDGE_MODE=primary on every replica")
+		}
+		return OpenRedis(cfg)
+	}
+	return nil, fmt.Errorf("unsupported BRIDGE_EVENT_STORE %q (memory, file or redis)", cfg.EventStore)
+}
+
+// RunTrim applies the store's retention limits once a minute.
+func RunTrim(store Store, metrics *metrics.Registry) {
+	for range time.Tick(time.Minute) {
+		n, err := store.Trim(time.Now())
+		if err != nil {
+			slog.Error("event store trim failed", "err", err)
+			metrics.Inc("wecom_bridge_event_store_errors_total", "op", "trim")
+			continue
+		}
+		metrics.Add("wecom_bridge_event_store_trimmed_total", int64(n))
+	}
+}
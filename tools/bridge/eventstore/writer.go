@@ -0,0 +1,118 @@
+package eventstore
+
+import (
+	"log/slog"
+	"sync"
+	"time"
+
+	"github.com/Tennen/Paimon/tools/bridge/hub"
+	"github.com/Tennen/Paimon/tools/bridge/metrics"
+)
+
+// Writer appends events to a store from its own goroutine, so a slow disk
+// does not hold the bridge's state lock during broadcasts. Events are written in the
+// order they were queued; reads wait for the queue first, so they see every
+// event broadcast before them. At most maxPending events wait; while the
+// store is stalled further events are dropped from it, though they are
+// still broadcast.
+type Writer struct {
+	Store
+	metrics    *metrics.Registry
+	wake       chan struct{}
+	maxPending int
+
+	mu      sync.Mutex
+	idle    *sync.Cond // broadcast after each batch is written
+	pending []hub.Event
+	writing bool
+	dropped int64 // since the queue last had room
+}
+
+// NewWriter starts a writer queueing up to maxPending events, or
+// 100000 when maxPending is not positive.
+func NewWriter(store Store, metrics *metrics.Registry, maxPending int) *Writer {
+	if maxPending <= 0 {
+		maxPending = 100000
+	}
+	w := &Writer{Store: store, metrics: metrics, wake: make(chan struct{}, 1), maxPending: maxPending}
+	w.idle = sync.NewCond(&w.mu)
+	go w.run()
+	return w
+}
+
+// Append queues ev without waiting for the write; write errors are logged
+// and counted by run. When the queue is full ev is dropped and counted.
+func (w *Writer) Append(ev hub.Event) error {
+	w.mu.Lock()
+	if len(w.pending) >= w.maxPending {
+		w.dropped++
+		first := w.dropped == 1
+		w.mu.Unlock()
+		w.metrics.Inc("wecom_bridge_event_store_dropped_total")
+		if first {
+			slog.Warn("event store queue full, dropping events until it drains", "event_id", ev.ID, "queued", w.maxPending)
+		}
+		return nil
+	}
+	dropped := w.dropped
+	w.dropped = 0
+	w.pending = append(w.pending, ev)
+	w.mu.Unlock()
+	if dropped > 0 {
+		slog.Warn("event store queue has room again", "dropped", dropped, "next_event_id", ev.ID)
+	}
+	select {
+	case w.wake <- struct{}{}:
+	default:
+	}
+	return nil
+}
+
+func (w *Writer) run() {
+	for range w.wake {
+		w.mu.Lock()
+		batch := w.pending
+		w.pending = nil
+		w.writing = true
+		w.mu.Unlock()
+		for _, ev := range batch {
+			if err := w.Store.Append(ev); err != nil {
+				slog.Error("event store append failed", "event_id", ev.ID, "err", err)
+				w.metrics.Inc("wecom_bridge_event_store_errors_total", "op", "append")
+			}
+		}
+		w.mu.Lock()
+		w.writing = false
+		w.idle.Broadcast()
+		w.mu.Unlock()
+	}
+}
+
+// Flush waits until every queued event has been written.
+func (w *Writer) Flush() {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	for len(w.pending) > 0 || w.writing {
+		w.idle.Wait()
+	}
+}
+
+func (w *Writer) After(id int64, filter hub.Filter) ([]hub.Event, error) {
+	w.Flush()
+	return w.Store.After(id, filter)
+}
+
+func (w *Writer) Tail(n int) ([]hub.Event, error) {
+	w.Flush()
+	return w.Store.Tail(n)
+}
+
+func (w *Writer) Before(id int64, fn func(ev hub.Event) bool) error {
+	w.Flush()
+	return w.Store.Before(id, fn)
+}
+
+func (w *Writer) Trim(now time.Time) (int, error) {
+	w.Flush()
+	return w.Store.Trim(now)
+}
@@ -0,0 +1,82 @@
+package eventstore
+
+import (
+	"slices"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/Tennen/Paimon/tools/bridge/hub"
+	"github.com/Tennen/Paimon/tools/bridge/metrics"
+)
+
+// gatedStore is a store whose appends wait for gate to close.
+type gatedStore struct {
+	gate chan struct{}
+
+	mu     sync.Mutex
+	events []hub.Event
+}
+
+func (st *gatedStore) Append(ev hub.Event) error {
+	<-st.gate
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	st.events = append(st.events, ev)
+	return nil
+}
+
+func (st *gatedStore) After(int64, hub.Filter) ([]hub.Event, error) { return nil, nil }
+func (st *gatedStore) Tail(int) ([]hub.Event, error)                { return nil, nil }
+func (st *gatedStore) Before(int64, func(hub.Event) bool) error     { return nil }
+func (st *gatedStore) Trim(time.Time) (int, error)                  { return 0, nil }
+
+func TestWriterDropsWhenFull(t *testing.T) {
+	metrics := metrics.New()
+	store := &gatedStore{gate: make(chan struct{})}
+	w := NewWriter(store, metrics, 2)
+	// The writer takes event 1 and stalls on it; 2 and 3 fill the queue.
+	_ = w.Append(hub.Event{ID: 1})
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		w.mu.Lock()
+		writing := w.writing
+		w.mu.Unlock()
+		if writing {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("writer did not start")
+		}
+		time.Sleep(time.Millisecond)
+	}
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for id := int64(2); id <= 5; id++ {
+			_ = w.Append(hub.Event{ID: id})
+		}
+	}()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("append blocked on a stalled store")
+	}
+	close(store.gate)
+	w.Flush()
+	_ = w.Append(hub.Event{ID: 6})
+	w.Flush()
+	var ids []int64
+	for _, ev := range store.events {
+		ids = append(ids, ev.ID)
+	}
+	if !slices.Equal(ids, []int64{1, 2, 3, 6}) {
+		t.Fatalf("stored %v", ids)
+	}
+	var out strings.Builder
+	metrics.WriteText(&out)
+	if !strings.Contains(out.String(), "wecom_bridge_event_store_dropped_total 2") {
+		t.Fatal(out.String())
+	}
+}
@@ -0,0 +1,201 @@
+// Package federation subscribes a bridge to upstream bridges' streams and
+// re-broadcasts their events locally, keeping a replay cursor per upstream
+// so a reconnect resumes where it left off.
+package federation
+
+import (
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/Tennen/Paimon/tools/bridge/atomicfile"
+	"github.com/Tennen/Paimon/tools/bridge/config"
+	"github.com/Tennen/Paimon/tools/bridge/metrics"
+	"github.com/Tennen/Paimon/tools/bridge/sse"
+)
+
+// Federation subscribes to upstream bridges and re-broadcasts their events
+// locally, remembering a replay cursor per upstream.
+type Federation struct {
+	cfg       config.Config
+	client    *http.Client
+	metrics   *metrics.Registry
+	broadcast Broadcast
+	mu        sync.Mutex
+	cursors   map[string]int64
+	dirty     bool
+}
+
+// Broadcast publishes a merged event to the local bridge's subscribers.
+type Broadcast func(eventType string, payload map[string]any)
+
+// New returns a federation for cfg.Upstreams, resuming the cursors saved in
+// cfg.FederationState. It connects through client and hands merged events to
+// broadcast.
+func New(cfg config.Config, client *http.Client, metrics *metrics.Registry, broadcast Broadcast) *Federation {
+	f := &Federation{cfg: cfg, client: client, metrics: metrics, broadcast: broadcast, cursors: make(map[string]int64)}
+	if cfg.FederationState != "" {
+		if data, err := os.ReadFile(cfg.FederationState); err == nil {
+			_ = json.Unmarshal(data, &f.cursors)
+		}
+	}
+	return f
+}
+
+// Start follows every upstream and begins persisting the cursors.
+func (f *Federation) Start(upstreams []config.Upstream) {
+	for _, up := range upstreams {
+		go f.follow(up)
+	}
+	go f.persistLoop()
+}
+
+// Snapshot returns a copy of the per-upstream cursors.
+func (f *Federation) Snapshot() map[string]int64 {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	out := make(map[string]int64, len(f.cursors))
+	for name, id := range f.cursors {
+		out[name] = id
+	}
+	return out
+}
+
+// Resume moves the cursors forward to those copied from a primary, so a
+// promoted standby does not replay what the primary already merged.
+func (f *Federation) Resume(cursors map[string]int64) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	for name, id := range cursors {
+		if id > f.cursors[name] {
+			f.cursors[name] = id
+			f.dirty = true
+		}
+	}
+}
+
+// follow keeps a connection to one upstream open, reconnecting with backoff.
+func (f *Federation) follow(up config.Upstream) {
+	backoff := time.Second
+	for {
+		err := f.consume(up)
+		f.metrics.Inc("wecom_bridge_federation_disconnects_total", "upstream", up.Name)
+		slog.Warn("federation disconnected", "upstream", up.Name, "err", err)
+		time.Sleep(backoff)
+		if backoff < 30*time.Second {
+			backoff *= 2
+		}
+	}
+}
+
+func (f *Federation) consume(up config.Upstream) error {
+	endpoint := up.URL + "/stream"
+	if len(up.Topics) > 0 {
+		endpoint += "?topics=" + url.QueryEscape(strings.Join(up.Topics, ","))
+	}
+	req, err := http.NewRequest(http.MethodGet, endpoint, nil)
+	if err != nil {
+		return err
+	}
+	if up.Token != "" {
+		req.Header.Set("Authorization", "Bearer "+up.Token)
+	}
+	f.mu.Lock()
+	cursor := f.cursors[up.Name]
+	f.mu.Unlock()
+	if cursor > 0 {
+		req.Header.Set("Last-Event-ID", strconv.FormatInt(cursor, 10))
+	}
+	resp, err := f.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("http %d", resp.StatusCode)
+	}
+	slog.Info("federation connected", "upstream", up.Name, "since_event_id", cursor)
+
+	return sse.Read(resp.Body, func(id int64, eventType string, data []byte) {
+		f.merge(up, id, eventType, data)
+	})
+}
+
+// merge re-broadcasts an upstream event under a new local ID. The via list
+// records every bridge that merged the event, so an event coming back to a
+// bridge it already passed through (or originated from) is dropped.
+func (f *Federation) merge(up config.Upstream, id int64, eventType string, data []byte) {
+	if eventType == "shutdown" && id <= 0 {
+		// The upstream is going away; the reconnect loop takes over.
+		return
+	}
+	defer func() {
+		if id > 0 {
+			f.mu.Lock()
+			f.cursors[up.Name] = id
+			f.dirty = true
+			f.mu.Unlock()
+		}
+	}()
+	var payload map[string]any
+	if err := json.Unmarshal(data, &payload); err != nil {
+		return
+	}
+	// The upstream's signature does not cover the re-broadcast payload.
+	delete(payload, "sig")
+	via := make([]string, 0)
+	if list, ok := payload["via"].([]any); ok {
+		for _, v := range list {
+			name := fmt.Sprintf("%v", v)
+			if name == f.cfg.BridgeName {
+				return
+			}
+			via = append(via, name)
+		}
+	}
+	if origin, ok := payload["origin"].(string); ok && origin == f.cfg.BridgeName {
+		return
+	}
+	payload["via"] = append(via, f.cfg.BridgeName)
+	if _, ok := payload["origin"]; !ok {
+		payload["origin"] = up.Name
+	}
+	if list, ok := payload["topics"].([]any); ok {
+		topics := make([]string, 0, len(list))
+		for _, t := range list {
+			topics = append(topics, fmt.Sprintf("%v", t))
+		}
+		payload["topics"] = topics
+	}
+	if eventType == "" {
+		eventType = "message"
+	}
+	f.broadcast(eventType, payload)
+	f.metrics.Inc("wecom_bridge_federation_events_total", "upstream", up.Name)
+}
+
+func (f *Federation) persistLoop() {
+	if f.cfg.FederationState == "" {
+		return
+	}
+	for range time.Tick(2 * time.Second) {
+		f.mu.Lock()
+		if !f.dirty {
+			f.mu.Unlock()
+			continue
+		}
+		data, _ := json.Marshal(f.cursors)
+		f.dirty = false
+		f.mu.Unlock()
+		if err := atomicfile.Write(f.cfg.FederationState, data); err != nil {
+			slog.Error("federation state write failed", "err", err)
+		}
+	}
+}
@@ -0,0 +1,109 @@
+package federation
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/Tennen/Paimon/tools/bridge/config"
+	"github.com/Tennen/Paimon/tools/bridge/metrics"
+)
+
+// upstream serves a fixed list of events as an event stream, honouring
+// Last-Event-ID, then ends the response.
+func upstream(events []string) *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Authorization") != "Bearer up" {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		after, _ := strconv.ParseInt(r.Header.Get("Last-Event-ID"), 10, 64)
+		w.Header().Set("Content-Type", "text/event-stream")
+		for i, data := range events {
+			if id := int64(i + 1); id > after {
+				fmt.Fprintf(w, "id: %d\nevent: message\ndata: %s\n\n", id, data)
+			}
+		}
+	}))
+}
+
+func TestConsumeMergesUpstreamEvents(t *testing.T) {
+	events := []string{
+		`{"text":"a","sig":"x"}`,
+		// Events that already passed through or came from this bridge are
+		// dropped instead of looping.
+		`{"text":"loop","via":["edge"]}`,
+		`{"text":"back","origin":"edge"}`,
+		`{"text":"t","topics":["sales"],"origin":"branch","via":["branch"]}`,
+	}
+	srv := upstream(events)
+	defer srv.Close()
+
+	var mu sync.Mutex
+	var merged []map[string]any
+	reg := metrics.New()
+	fed := New(config.Config{BridgeName: "edge"}, srv.Client(), reg, func(eventType string, payload map[string]any) {
+		mu.Lock()
+		defer mu.Unlock()
+		if eventType != "message" {
+			t.Errorf("event type %q", eventType)
+		}
+		merged = append(merged, payload)
+	})
+	if err := fed.consume(config.Upstream{Name: "hq", URL: srv.URL, Token: "wrong"}); err == nil || err.Error() != "http 401" {
+		t.Fatal(err)
+	}
+	up := config.Upstream{Name: "hq", URL: srv.URL, Token: "up"}
+	_ = fed.consume(up)
+	if got := fed.Snapshot()["hq"]; got != 4 {
+		t.Fatalf("cursor %d", got)
+	}
+	if len(merged) != 2 {
+		t.Fatalf("%v", merged)
+	}
+	for i, want := range []struct {
+		origin string
+		via    []string
+	}{{"hq", []string{"edge"}}, {"branch", []string{"branch", "edge"}}} {
+		data, _ := json.Marshal(merged[i])
+		var payload struct {
+			Origin string   `json:"origin"`
+			Via    []string `json:"via"`
+			Sig    string   `json:"sig"`
+		}
+		_ = json.Unmarshal(data, &payload)
+		if payload.Origin != want.origin || !reflect.DeepEqual(payload.Via, want.via) || payload.Sig != "" {
+			t.Errorf("event %d: %+v", i, payload)
+		}
+	}
+	if !reflect.DeepEqual(merged[1]["topics"], []string{"sales"}) {
+		t.Fatalf("topics %v", merged[1]["topics"])
+	}
+
+	// A reconnect resumes after the cursor, so nothing is merged twice.
+	merged = nil
+	_ = fed.consume(up)
+	if len(merged) != 0 {
+		t.Fatalf("replayed %v", merged)
+	}
+	var text strings.Builder
+	reg.WriteText(&text)
+	if !strings.Contains(text.String(), `wecom_bridge_federation_events_total{upstream="hq"} 2`) {
+		t.Fatal(text.String())
+	}
+}
+
+func TestResume(t *testing.T) {
+	fed := New(config.Config{}, http.DefaultClient, metrics.New(), nil)
+	fed.Resume(map[string]int64{"hq": 5, "branch": 2})
+	fed.Resume(map[string]int64{"hq": 3})
+	if got := fed.Snapshot(); !reflect.DeepEqual(got, map[string]int64{"hq": 5, "branch": 2}) {
+		t.Fatal(got)
+	}
+}
@@ -0,0 +1,132 @@
+package grpcwire
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+
+	"github.com/Tennen/Paimon/tools/bridge/hub"
+)
+
+// Fields calls fn for each field of a protobuf message: varints pass
+// their value, length-delimited fields their bytes. Fixed-width fields are
+// skipped; no message of the API uses them.
+func Fields(data []byte, fn func(field int, v uint64, b []byte)) error {
+	for len(data) > 0 {
+		tag, n := binary.Uvarint(data)
+		if n <= 0 {
+			return errors.New("invalid protobuf tag")
+		}
+		data = data[n:]
+		switch tag & 7 {
+		case 0:
+			v, n := binary.Uvarint(data)
+			if n <= 0 {
+				return errors.New("invalid protobuf varint")
+			}
+			data = data[n:]
+			fn(int(tag>>3), v, nil)
+		case 1:
+			if len(data) < 8 {
+				return errors.New("truncated protobuf field")
+			}
+			data = data[8:]
+		case 2:
+			size, n := binary.Uvarint(data)
+			if n <= 0 || size > uint64(len(data)-n) {
+				return errors.New("truncated protobuf field")
+			}
+			fn(int(tag>>3), 0, data[n:n+int(size)])
+			data = data[n+int(size):]
+		case 5:
+			if len(data) < 4 {
+				return errors.New("truncated protobuf field")
+			}
+			data = data[4:]
+		default:
+			return errors.New("invalid protobuf wire type")
+		}
+	}
+	return nil
+}
+
+// Protobuf encoders; zero values are omitted as in proto3.
+func AppendTag(b []byte, field, wireType int) []byte {
+	return binary.AppendUvarint(b, uint64(field)<<3|uint64(wireType))
+}
+
+func AppendBytes(b []byte, field int, v []byte) []byte {
+	if len(v) == 0 {
+		return b
+	}
+	b = AppendTag(b, field, 2)
+	b = binary.AppendUvarint(b, uint64(len(v)))
+	return append(b, v...)
+}
+
+func AppendString(b []byte, field int, v string) []byte {
+	return AppendBytes(b, field, []byte(v))
+}
+
+func AppendInt(b []byte, field int, v int64) []byte {
+	if v == 0 {
+		return b
+	}
+	return binary.AppendUvarint(AppendTag(b, field, 0), uint64(v))
+}
+
+// EncodeEvent encodes an Event, decoding the common fields of a
+// message payload into Event.message.
+func EncodeEvent(ev hub.Event) []byte {
+	b := AppendInt(nil, 1, ev.ID)
+	eventType := ev.Type
+	if eventType == "" {
+		eventType = "message"
+	}
+	b = AppendString(b, 2, eventType)
+	b = AppendBytes(b, 3, ev.Payload)
+	if ev.Type != "" && ev.Type != "message" {
+		return b
+	}
+	var p struct {
+		MessageID    string   `json:"messageId"`
+		SessionID    string   `json:"sessionId"`
+		FromUser     string   `json:"fromUser"`
+		ToUser       string   `json:"toUser"`
+		Text         string   `json:"text"`
+		MsgType      string   `json:"msgType"`
+		Event        string   `json:"event"`
+		EventKey     string   `json:"eventKey"`
+		AgentID      string   `json:"agentId"`
+		MediaID      string   `json:"mediaId"`
+		PicURL       string   `json:"picUrl"`
+		ReceivedAt   string   `json:"receivedAt"`
+		ReceivedAtMs int64    `json:"receivedAtMs"`
+		CreateTime   int64    `json:"createTime"`
+		Agent        string   `json:"agent"`
+		Channel      string   `json:"channel"`
+		Topics       []string `json:"topics"`
+		Labels       []string `json:"labels"`
+	}
+	if json.Unmarshal(ev.Payload, &p) != nil {
+		return b
+	}
+	var m []byte
+	for i, v := range []string{p.MessageID, p.SessionID, p.FromUser, p.ToUser, p.Text, p.MsgType, p.Event, p.EventKey, p.AgentID, p.MediaID, p.PicURL, p.ReceivedAt} {
+		m = AppendString(m, i+1, v)
+	}
+	m = AppendInt(m, 13, p.ReceivedAtMs)
+	m = AppendInt(m, 14, p.CreateTime)
+	m = AppendString(m, 15, p.Agent)
+	m = AppendString(m, 16, p.Channel)
+	for _, topic := range p.Topics {
+		m = AppendString(m, 17, topic)
+	}
+	for _, label := range p.Labels {
+		m = AppendString(m, 18, label)
+	}
+	// An empty Message is still sent so clients can tell it was decoded.
+	b = AppendTag(b, 4, 2)
+	b = binary.AppendUvarint(b, uint64(len(m)))
+	return append(b, m...)
+}
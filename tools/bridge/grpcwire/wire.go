@@ -0,0 +1,77 @@
+// Package grpcwire implements the parts of gRPC and protobuf the bridge's
+// gRPC API needs on top of net/http: length-prefixed messages, status
+// trailers and the proto3 wire format of wecom-bridge.proto.
+package grpcwire
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// gRPC status codes used by the gRPC API.
+const (
+	OK                 = 0
+	InvalidArgument    = 3
+	PermissionDenied   = 7
+	ResourceExhausted  = 8
+	FailedPrecondition = 9
+	Unimplemented      = 12
+	Unavailable        = 14
+	Unauthenticated    = 16
+)
+
+// Finish sets the status trailers; they follow whatever was written.
+func Finish(w http.ResponseWriter, code int, msg string) {
+	w.Header().Set(http.TrailerPrefix+"Grpc-Status", strconv.Itoa(code))
+	if msg != "" {
+		w.Header().Set(http.TrailerPrefix+"Grpc-Message", PercentEncode(msg))
+	}
+}
+
+// PercentEncode encodes a status message as the gRPC HTTP/2 protocol
+// requires: "%" and bytes outside printable ASCII become %XX.
+func PercentEncode(msg string) string {
+	var b strings.Builder
+	for i := 0; i < len(msg); i++ {
+		if c := msg[i]; c < 0x20 || c > 0x7e || c == '%' {
+			fmt.Fprintf(&b, "%%%02X", c)
+		} else {
+			b.WriteByte(c)
+		}
+	}
+	return b.String()
+}
+
+// ReadMessage reads the one request message of a unary or
+// server-streaming call. Compressed messages are not supported.
+func ReadMessage(r io.Reader, limit int64) ([]byte, error) {
+	var prefix [5]byte
+	if _, err := io.ReadFull(r, prefix[:]); err != nil {
+		return nil, errors.New("missing request message")
+	}
+	if prefix[0] != 0 {
+		return nil, errors.New("compressed messages are not supported")
+	}
+	n := binary.BigEndian.Uint32(prefix[1:])
+	if int64(n) > limit {
+		return nil, fmt.Errorf("request message over %d bytes", limit)
+	}
+	msg := make([]byte, n)
+	if _, err := io.ReadFull(r, msg); err != nil {
+		return nil, errors.New("truncated request message")
+	}
+	return msg, nil
+}
+
+// WriteMessage writes msg as one uncompressed message.
+func WriteMessage(w io.Writer, msg []byte) error {
+	frame := make([]byte, 5, 5+len(msg))
+	binary.BigEndian.PutUint32(frame[1:], uint32(len(msg)))
+	_, err := w.Write(append(frame, msg...))
+	return err
+}
@@ -0,0 +1,95 @@
+package grpcwire
+
+import (
+	"encoding/hex"
+	"fmt"
+	"reflect"
+	"testing"
+
+	"github.com/Tennen/Paimon/tools/bridge/hub"
+)
+
+// Golden bytes were encoded independently of the bridge, following the
+// field numbers of wecom-bridge.proto.
+const (
+	goldenMessagePayload = `{"messageId":"m1","fromUser":"u1","text":"hi","receivedAtMs":1700000000000,"topics":["a","b"]}`
+	// Event{id: 7, type: "message", payload, message: Message{message_id:
+	// "m1", from_user: "u1", text: "hi", received_at_ms: 1700000000000,
+	// topics: ["a", "b"]}}
+	goldenMessageEvent = "0807" + "12076d657373616765" +
+		"1a5e" + "7b226d6573736167654964223a226d31222c2266726f6d55736572223a227531222c2274657874223a226869222c22726563656976656441744d73223a313730303030303030303030302c22746f70696373223a5b2261222c2262225d7d" +
+		"221b" + "0a026d31" + "1a027531" + "2a026869" + "6880d095ffbc31" + "8a010161" + "8a010162"
+	// Event{id: 12, type: "send_status", payload: {"status":"sent"}}
+	goldenStatusEvent = "080c" + "120b73656e645f737461747573" + "1a117b22737461747573223a2273656e74227d"
+)
+
+func TestEncodeEvent(t *testing.T) {
+	for _, tc := range []struct {
+		name string
+		ev   hub.Event
+		want string
+	}{
+		{"message", hub.Event{ID: 7, Type: "message", Payload: []byte(goldenMessagePayload)}, goldenMessageEvent},
+		{"untyped is message", hub.Event{ID: 7, Payload: []byte(goldenMessagePayload)}, goldenMessageEvent},
+		{"other type has no message", hub.Event{ID: 12, Type: "send_status", Payload: []byte(`{"status":"sent"}`)}, goldenStatusEvent},
+		// An empty Message is still present, as field 4 with length 0.
+		{"empty message", hub.Event{ID: 1, Payload: []byte(`{}`)}, "0801" + "12076d657373616765" + "1a027b7d" + "2200"},
+		{"undecodable payload", hub.Event{ID: 1, Payload: []byte(`[1]`)}, "0801" + "12076d657373616765" + "1a035b315d"},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			if got := hex.EncodeToString(EncodeEvent(tc.ev)); got != tc.want {
+				t.Fatalf("got  %s\nwant %s", got, tc.want)
+			}
+		})
+	}
+}
+
+func TestPercentEncode(t *testing.T) {
+	for in, want := range map[string]string{
+		"unknown method /a.B/C": "unknown method /a.B/C",
+		"100% done; ok":         "100%25 done; ok",
+		"line\nbreak":           "line%0Abreak",
+		"企业":                    "%E4%BC%81%E4%B8%9A",
+	} {
+		if got := PercentEncode(in); got != want {
+			t.Errorf("%q: got %q, want %q", in, got, want)
+		}
+	}
+}
+
+func TestAppendInt(t *testing.T) {
+	// proto3 omits zero values and encodes negative int64 in ten bytes.
+	for v, want := range map[int64]string{0: "", 1: "0801", 300: "08ac02", -1: "08ffffffffffffffffff01"} {
+		if got := hex.EncodeToString(AppendInt(nil, 1, v)); got != want {
+			t.Errorf("%d: got %s, want %s", v, got, want)
+		}
+	}
+}
+
+func TestFields(t *testing.T) {
+	// SubscribeRequest{last_event_id: 300, topics: ["t1"], msg_types:
+	// ["text"]} with an unknown fixed64 field 9 and fixed32 field 10.
+	req, _ := hex.DecodeString("08ac02" + "12027431" + "490101010101010101" + "2a0474657874" + "5502020202")
+	var got []string
+	if err := Fields(req, func(field int, v uint64, b []byte) {
+		got = append(got, fmt.Sprintf("%d:%d:%s", field, v, b))
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if want := []string{"1:300:", "2:0:t1", "5:0:text"}; !reflect.DeepEqual(got, want) {
+		t.Fatalf("got %v, want %v", got, want)
+	}
+	for in, want := range map[string]string{
+		"80":         "invalid protobuf tag",
+		"0880":       "invalid protobuf varint",
+		"1205616263": "truncated protobuf field",
+		"490102":     "truncated protobuf field",
+		"5501":       "truncated protobuf field",
+		"0b":         "invalid protobuf wire type",
+	} {
+		data, _ := hex.DecodeString(in)
+		if err := Fields(data, func(int, uint64, []byte) {}); err == nil || err.Error() != want {
+			t.Errorf("%s: got %v, want %s", in, err, want)
+		}
+	}
+}
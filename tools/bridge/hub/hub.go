@@ -0,0 +1,239 @@
+// Package hub fans events out to many stream subscribers. Subscribers are
+// spread over shards, each with its own lock and delivery goroutine, so a
+// publish queues the event once per shard instead of visiting every
+// subscriber, and registering a subscriber locks a single shard.
+//
+// Publish never blocks. When a shard's queue is full the event is lost for
+// that shard, and its subscribers are told how many events they missed, the
+// same way a subscriber with a full queue of its own drops events.
+package hub
+
+import (
+	"fmt"
+	"io"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Event is one event of the stream.
+type Event struct {
+	ID      int64
+	Type    string
+	Payload []byte
+	Topics  []string
+	Agent   string
+	// FromUser and MsgType copy the inbound message's fields for stream
+	// filters; they are empty for application events.
+	FromUser string
+	MsgType  string
+	// Time is when the event was buffered.
+	Time time.Time
+}
+
+// WriteSSE writes ev as a server-sent event frame; Type defaults to
+// "message".
+func WriteSSE(w io.Writer, ev Event) error {
+	eventType := ev.Type
+	if strings.TrimSpace(eventType) == "" {
+		eventType = "message"
+	}
+	_, err := fmt.Fprintf(w, "id: %d\nevent: %s\ndata: %s\n\n", ev.ID, eventType, ev.Payload)
+	return err
+}
+
+// Filter selects the events a subscriber receives; empty fields match
+// everything, and values compare case-insensitively.
+type Filter struct {
+	Topics    []string
+	Agents    []string
+	FromUsers []string
+	MsgTypes  []string
+}
+
+// Matches reports whether ev passes every non-empty field of f. An event
+// matches Topics when any of its topics is listed.
+func (f Filter) Matches(ev Event) bool {
+	if len(f.Topics) > 0 {
+		found := false
+		for _, topic := range ev.Topics {
+			if containsFold(f.Topics, topic) {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return false
+		}
+	}
+	if len(f.Agents) > 0 && !containsFold(f.Agents, ev.Agent) {
+		return false
+	}
+	if len(f.FromUsers) > 0 && !containsFold(f.FromUsers, ev.FromUser) {
+		return false
+	}
+	if len(f.MsgTypes) > 0 && !containsFold(f.MsgTypes, ev.MsgType) {
+		return false
+	}
+	return true
+}
+
+func containsFold(list []string, value string) bool {
+	for _, item := range list {
+		if strings.EqualFold(strings.TrimSpace(item), value) {
+			return true
+		}
+	}
+	return false
+}
+
+// Subscriber receives the events published to a Hub. Both methods run on
+// the subscriber's shard goroutine and must not block: a subscriber with a
+// full queue drops or disconnects by its own policy.
+type Subscriber interface {
+	// Deliver hands over the next event, in publish order.
+	Deliver(ev Event)
+	// Missed reports n events that overflowed the shard's queue after the
+	// subscriber was added and were never delivered. They are counted
+	// without regard to any filter of the subscriber.
+	Missed(n int64)
+}
+
+// Hub holds subscribers in shards.
+type Hub struct {
+	shards []*shard
+	next   atomic.Uint64
+
+	mu     sync.RWMutex
+	closed bool
+}
+
+type shard struct {
+	mu sync.Mutex
+	// subs maps each subscriber to the number of lost events that were
+	// already pending when it was added, which it is not told about.
+	subs map[Subscriber]int64
+	// queue holds published events until the shard's goroutine delivers
+	// them; lost counts those that did not fit.
+	queue chan Event
+	lost  atomic.Int64
+}
+
+// New starts a hub with n shards (at least one) whose queues hold up to
+// queue events each.
+func New(n, queue int) *Hub {
+	h := &Hub{shards: make([]*shard, max(n, 1))}
+	for i := range h.shards {
+		h.shards[i] = &shard{subs: make(map[Subscriber]int64), queue: make(chan Event, max(queue, 1))}
+		go h.shards[i].run()
+	}
+	return h
+}
+
+// Add assigns s to a shard round-robin. s receives every event published
+// after Add returns, or is told it missed it. It may also receive events
+// published before, that were still queued on its shard, and a Publish
+// running concurrently with Add may or may not reach it; subscribers that
+// need an exact starting point compare event IDs. Events lost before Add
+// are not reported to s.
+func (h *Hub) Add(s Subscriber) {
+	sh := h.shards[h.next.Add(1)%uint64(len(h.shards))]
+	sh.mu.Lock()
+	sh.subs[s] = sh.lost.Load()
+	sh.mu.Unlock()
+}
+
+// Remove unregisters s; it is not called again once Remove returns.
+func (h *Hub) Remove(s Subscriber) {
+	for _, sh := range h.shards {
+		sh.mu.Lock()
+		_, ok := sh.subs[s]
+		delete(sh.subs, s)
+		sh.mu.Unlock()
+		if ok {
+			return
+		}
+	}
+}
+
+// Count returns the number of subscribers.
+func (h *Hub) Count() int {
+	n := 0
+	for _, sh := range h.shards {
+		sh.mu.Lock()
+		n += len(sh.subs)
+		sh.mu.Unlock()
+	}
+	return n
+}
+
+// Each calls fn for every subscriber until fn returns false. fn runs with
+// the subscriber's shard locked and must not add or remove subscribers.
+func (h *Hub) Each(fn func(s Subscriber) bool) {
+	for _, sh := range h.shards {
+		sh.mu.Lock()
+		for s := range sh.subs {
+			if !fn(s) {
+				sh.mu.Unlock()
+				return
+			}
+		}
+		sh.mu.Unlock()
+	}
+}
+
+// Publish queues ev on every shard without blocking and returns the number
+// of shards whose queue was full, whose subscribers miss ev. Publishing to
+// a closed hub does nothing.
+func (h *Hub) Publish(ev Event) (overflowed int) {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+	if h.closed {
+		return 0
+	}
+	for _, sh := range h.shards {
+		select {
+		case sh.queue <- ev:
+		default:
+			sh.lost.Add(1)
+			overflowed++
+		}
+	}
+	return overflowed
+}
+
+// Close stops the shard goroutines once they have delivered the queued
+// events. Later publishes are ignored.
+func (h *Hub) Close() {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if h.closed {
+		return
+	}
+	h.closed = true
+	for _, sh := range h.shards {
+		close(sh.queue)
+	}
+}
+
+// run delivers queued events to the shard's subscribers until the hub is
+// closed. Events lost to a full queue are reported after the next event
+// the shard delivers.
+func (sh *shard) run() {
+	for ev := range sh.queue {
+		sh.mu.Lock()
+		for s := range sh.subs {
+			s.Deliver(ev)
+		}
+		if n := sh.lost.Swap(0); n > 0 {
+			for s, before := range sh.subs {
+				if n > before {
+					s.Missed(n - before)
+				}
+				sh.subs[s] = 0
+			}
+		}
+		sh.mu.Unlock()
+	}
+}
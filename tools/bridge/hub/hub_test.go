@@ -0,0 +1,198 @@
+package hub
+
+import (
+	"bytes"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// recorder collects delivered event IDs.
+type recorder struct {
+	mu  sync.Mutex
+	ids []int64
+}
+
+func (r *recorder) Deliver(ev Event) {
+	r.mu.Lock()
+	r.ids = append(r.ids, ev.ID)
+	r.mu.Unlock()
+}
+
+func (r *recorder) Missed(n int64) {}
+
+func (r *recorder) received() []int64 {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return append([]int64(nil), r.ids...)
+}
+
+func waitFor(t *testing.T, cond func() bool) {
+	t.Helper()
+	deadline := time.Now().Add(2 * time.Second)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatal("timed out")
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func TestHubDeliversInOrderToEveryShard(t *testing.T) {
+	h := New(4, 100)
+	subs := make([]*recorder, 10)
+	for i := range subs {
+		subs[i] = &recorder{}
+		h.Add(subs[i])
+	}
+	if h.Count() != 10 {
+		t.Fatalf("Count = %d", h.Count())
+	}
+	for id := int64(1); id <= 100; id++ {
+		h.Publish(Event{ID: id})
+	}
+	for i, sub := range subs {
+		waitFor(t, func() bool { return len(sub.received()) == 100 })
+		for j, id := range sub.received() {
+			if id != int64(j+1) {
+				t.Fatalf("subscriber %d got %d at %d", i, id, j)
+			}
+		}
+	}
+}
+
+func TestHubRemove(t *testing.T) {
+	h := New(2, 8)
+	a, b := &recorder{}, &recorder{}
+	h.Add(a)
+	h.Add(b)
+	h.Remove(a)
+	h.Remove(a)
+	if h.Count() != 1 {
+		t.Fatalf("Count = %d", h.Count())
+	}
+	h.Publish(Event{ID: 1})
+	waitFor(t, func() bool { return len(b.received()) == 1 })
+	if len(a.received()) != 0 {
+		t.Fatal("removed subscriber received an event")
+	}
+	seen := 0
+	h.Each(func(s Subscriber) bool {
+		seen++
+		return false
+	})
+	if seen != 1 {
+		t.Fatalf("Each visited %d", seen)
+	}
+}
+
+func TestFilterMatches(t *testing.T) {
+	ev := Event{Topics: []string{"ops", "alerts"}, Agent: "hr", FromUser: "ZhangSan", MsgType: "text"}
+	cases := []struct {
+		name   string
+		filter Filter
+		want   bool
+	}{
+		{"empty", Filter{}, true},
+		{"topic", Filter{Topics: []string{"alerts"}}, true},
+		{"other topic", Filter{Topics: []string{"sales"}}, false},
+		{"agent", Filter{Agents: []string{"HR"}}, true},
+		{"other agent", Filter{Agents: []string{"it"}}, false},
+		{"sender folds case", Filter{FromUsers: []string{" zhangsan "}}, true},
+		{"msg type", Filter{MsgTypes: []string{"image", "text"}}, true},
+		{"all fields must match", Filter{Topics: []string{"ops"}, MsgTypes: []string{"image"}}, false},
+	}
+	for _, c := range cases {
+		if got := c.filter.Matches(ev); got != c.want {
+			t.Errorf("%s: Matches = %v", c.name, got)
+		}
+	}
+	if (Filter{Topics: []string{"ops"}}).Matches(Event{}) {
+		t.Error("an event without topics matched a topic filter")
+	}
+}
+
+func TestWriteSSE(t *testing.T) {
+	var buf bytes.Buffer
+	if err := WriteSSE(&buf, Event{ID: 7, Payload: []byte(`{"a":1}`)}); err != nil {
+		t.Fatal(err)
+	}
+	if err := WriteSSE(&buf, Event{ID: 8, Type: "recalled", Payload: []byte(`{}`)}); err != nil {
+		t.Fatal(err)
+	}
+	want := "id: 7\nevent: message\ndata: {\"a\":1}\n\nid: 8\nevent: recalled\ndata: {}\n\n"
+	if buf.String() != want {
+		t.Fatalf("WriteSSE wrote %q", buf.String())
+	}
+}
+
+// blocker holds its shard's goroutine inside Deliver until released.
+type blocker struct {
+	recorder
+	release chan struct{}
+	missed  atomic.Int64
+}
+
+func (b *blocker) Deliver(ev Event) {
+	<-b.release
+	b.recorder.Deliver(ev)
+}
+
+func (b *blocker) Missed(n int64) { b.missed.Add(n) }
+
+func TestPublishOverflowNeverBlocks(t *testing.T) {
+	h := New(1, 2)
+	b := &blocker{release: make(chan struct{})}
+	h.Add(b)
+	// The first event is taken by the blocked goroutine, two fill the queue
+	// and the rest overflow.
+	overflowed := 0
+	for id := int64(1); id <= 10; id++ {
+		overflowed += h.Publish(Event{ID: id})
+		if id == 1 {
+			waitFor(t, func() bool { return len(h.shards[0].queue) == 0 })
+		}
+	}
+	if overflowed != 7 {
+		t.Fatalf("overflowed %d", overflowed)
+	}
+	close(b.release)
+	waitFor(t, func() bool { return b.missed.Load() == 7 })
+	if got := b.received(); len(got) != 3 || got[2] != 3 {
+		t.Fatalf("received %v", got)
+	}
+	h.Close()
+	h.Close()
+	if h.Publish(Event{ID: 11}) != 0 {
+		t.Fatal("publish after Close")
+	}
+}
+
+func TestMissedCountsOnlyEventsAfterAdd(t *testing.T) {
+	// A shard whose goroutine starts late, so the queue overflows first.
+	sh := &shard{subs: make(map[Subscriber]int64), queue: make(chan Event, 2)}
+	h := &Hub{shards: []*shard{sh}}
+	early := &blocker{release: make(chan struct{})}
+	close(early.release)
+	h.Add(early)
+	for id := int64(1); id <= 4; id++ {
+		h.Publish(Event{ID: id})
+	}
+	late := &blocker{release: early.release}
+	h.Add(late)
+	h.Publish(Event{ID: 5})
+	go sh.run()
+	defer h.Close()
+	waitFor(t, func() bool { return len(late.received()) == 2 && early.missed.Load() == 3 })
+	// The late subscriber gets the events still queued when it joined, but
+	// only the loss of event 5.
+	if got := late.missed.Load(); got != 1 {
+		t.Fatalf("late subscriber missed %d", got)
+	}
+	h.Publish(Event{ID: 6})
+	waitFor(t, func() bool { return len(late.received()) == 3 })
+	if early.missed.Load() != 3 || late.missed.Load() != 1 {
+		t.Fatalf("missed %d and %d", early.missed.Load(), late.missed.Load())
+	}
+}
@@ -0,0 +1,225 @@
+// Package mediacache keeps media downloaded from WeCom on disk so repeated
+// /media/get requests, and transcodes of voice messages, are served without
+// another download.
+package mediacache
+
+import (
+	"crypto/sha1"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/Tennen/Paimon/tools/bridge/atomicfile"
+	"github.com/Tennen/Paimon/tools/bridge/config"
+)
+
+// Cache keeps downloaded media on disk as <key>.bin next to a <key>.json
+// sidecar, where key is the SHA-1 of the media_id. A nil cache is disabled.
+// Entries older than ttl are misses; ttl and maxMB are also enforced by
+// Trim after each write.
+type Cache struct {
+	dir   string
+	ttl   time.Duration
+	maxMB int
+
+	trimMu sync.Mutex
+}
+
+// Media is the sidecar describing a cached file.
+type Media struct {
+	MediaID     string `json:"mediaId"`
+	Filename    string `json:"filename"`
+	ContentType string `json:"contentType"`
+}
+
+// New returns a cache in dir, or nil, which disables caching, when dir is
+// empty.
+func New(dir string, ttl time.Duration, maxMB int) *Cache {
+	if dir == "" {
+		return nil
+	}
+	return &Cache{dir: dir, ttl: ttl, maxMB: maxMB}
+}
+
+// expired reports whether cached content has outlived the TTL.
+func (c *Cache) expired(info os.FileInfo) bool {
+	return c.ttl > 0 && time.Since(info.ModTime()) > c.ttl
+}
+
+// Trim applies the TTL and size cap, skipping the run when another one is
+// in progress.
+func (c *Cache) Trim(now time.Time) (int, int64, error) {
+	if c == nil || (c.ttl <= 0 && c.maxMB <= 0) || !c.trimMu.TryLock() {
+		return 0, 0, nil
+	}
+	defer c.trimMu.Unlock()
+	return c.Prune(&config.RetentionPolicy{MaxMB: c.maxMB, MaxAgePeriod: c.ttl}, now)
+}
+
+func (c *Cache) path(mediaID, ext string) string {
+	sum := sha1.Sum([]byte(mediaID))
+	return filepath.Join(c.dir, hex.EncodeToString(sum[:])+ext)
+}
+
+// Get returns a cached file's sidecar and content.
+func (c *Cache) Get(mediaID string) (Media, []byte, bool) {
+	var meta Media
+	if c == nil {
+		return meta, nil, false
+	}
+	raw, err := os.ReadFile(c.path(mediaID, ".json"))
+	if err != nil || json.Unmarshal(raw, &meta) != nil || meta.MediaID != mediaID {
+		return meta, nil, false
+	}
+	if info, err := os.Stat(c.path(mediaID, ".bin")); err != nil || c.expired(info) {
+		return meta, nil, false
+	}
+	data, err := os.ReadFile(c.path(mediaID, ".bin"))
+	if err != nil {
+		return meta, nil, false
+	}
+	return meta, data, true
+}
+
+// Open returns a cached file for streaming; the caller closes it.
+func (c *Cache) Open(mediaID string) (Media, *os.File, bool) {
+	var meta Media
+	if c == nil {
+		return meta, nil, false
+	}
+	raw, err := os.ReadFile(c.path(mediaID, ".json"))
+	if err != nil || json.Unmarshal(raw, &meta) != nil || meta.MediaID != mediaID {
+		return meta, nil, false
+	}
+	f, err := os.Open(c.path(mediaID, ".bin"))
+	if err != nil {
+		return meta, nil, false
+	}
+	if info, err := f.Stat(); err != nil || c.expired(info) {
+		f.Close()
+		return meta, nil, false
+	}
+	return meta, f, true
+}
+
+// Create stages a streamed download in the cache directory. It returns nil
+// when the cache is disabled.
+func (c *Cache) Create(meta Media) (*Writer, error) {
+	if c == nil {
+		return nil, nil
+	}
+	if err := os.MkdirAll(c.dir, 0o755); err != nil {
+		return nil, err
+	}
+	f, err := os.CreateTemp(c.dir, "download-*.tmp")
+	if err != nil {
+		return nil, err
+	}
+	return &Writer{cache: c, meta: meta, file: f}, nil
+}
+
+// Writer receives a download while it is streamed to the client;
+// Commit publishes it like Put, Abort discards it.
+type Writer struct {
+	cache *Cache
+	meta  Media
+	file  *os.File
+}
+
+func (cw *Writer) Write(p []byte) (int, error) {
+	return cw.file.Write(p)
+}
+
+func (cw *Writer) Commit() error {
+	if err := cw.file.Close(); err != nil {
+		_ = os.Remove(cw.file.Name())
+		return err
+	}
+	if err := os.Rename(cw.file.Name(), cw.cache.path(cw.meta.MediaID, ".bin")); err != nil {
+		_ = os.Remove(cw.file.Name())
+		return err
+	}
+	raw, err := json.Marshal(cw.meta)
+	if err != nil {
+		return err
+	}
+	return atomicfile.Write(cw.cache.path(cw.meta.MediaID, ".json"), raw)
+}
+
+func (cw *Writer) Abort() {
+	_ = cw.file.Close()
+	_ = os.Remove(cw.file.Name())
+}
+
+// Put stores the data before its sidecar so a reader never sees metadata
+// without content.
+func (c *Cache) Put(meta Media, data []byte) error {
+	if err := atomicfile.Write(c.path(meta.MediaID, ".bin"), data); err != nil {
+		return err
+	}
+	raw, err := json.Marshal(meta)
+	if err != nil {
+		return err
+	}
+	return atomicfile.Write(c.path(meta.MediaID, ".json"), raw)
+}
+
+// Prune deletes cached media older than p's MaxAge, then the oldest entries
+// until the cache fits in p.MaxMB. Age is measured from the download.
+func (c *Cache) Prune(p *config.RetentionPolicy, now time.Time) (int, int64, error) {
+	entries, err := os.ReadDir(c.dir)
+	if errors.Is(err, os.ErrNotExist) {
+		return 0, 0, nil
+	}
+	if err != nil {
+		return 0, 0, err
+	}
+	type cacheFile struct {
+		key     string
+		size    int64
+		modTime time.Time
+	}
+	files := make([]cacheFile, 0)
+	var total int64
+	for _, entry := range entries {
+		key, ok := strings.CutSuffix(entry.Name(), ".bin")
+		if !ok || entry.IsDir() {
+			continue
+		}
+		info, err := entry.Info()
+		if err != nil {
+			continue
+		}
+		size := info.Size()
+		if meta, err := os.Stat(filepath.Join(c.dir, key+".json")); err == nil {
+			size += meta.Size()
+		}
+		files = append(files, cacheFile{key: key, size: size, modTime: info.ModTime()})
+		total += size
+	}
+	sort.Slice(files, func(i, j int) bool { return files[i].modTime.Before(files[j].modTime) })
+	limit := int64(p.MaxMB) << 20
+	removed := 0
+	var reclaimed int64
+	for _, f := range files {
+		expired := p.MaxAgePeriod > 0 && now.Sub(f.modTime) > p.MaxAgePeriod
+		if !expired && (limit <= 0 || total-reclaimed <= limit) {
+			continue
+		}
+		// The sidecar goes first so a concurrent get misses instead of
+		// finding metadata without data.
+		_ = os.Remove(filepath.Join(c.dir, f.key+".json"))
+		if err := os.Remove(filepath.Join(c.dir, f.key+".bin")); err != nil && !errors.Is(err, os.ErrNotExist) {
+			return removed, reclaimed, err
+		}
+		removed++
+		reclaimed += f.size
+	}
+	return removed, reclaimed, nil
+}
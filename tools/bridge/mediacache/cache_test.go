@@ -0,0 +1,52 @@
+package mediacache
+
+import (
+	"os"
+	"testing"
+	"time"
+
+	"github.com/Tennen/Paimon/tools/bridge/config"
+)
+
+func TestPrune(t *testing.T) {
+	c := New(t.TempDir(), 0, 0)
+	if err := c.Put(Media{MediaID: "a", Filename: "a.jpg", ContentType: "image/jpeg"}, make([]byte, 600<<10)); err != nil {
+		t.Fatal(err)
+	}
+	hourAgo := time.Now().Add(-time.Hour)
+	os.Chtimes(c.path("a", ".bin"), hourAgo, hourAgo)
+	w, err := c.Create(Media{MediaID: "b", Filename: "b.jpg"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	w.Write(make([]byte, 600<<10))
+	if err := w.Commit(); err != nil {
+		t.Fatal(err)
+	}
+	if m, d, ok := c.Get("a"); !ok || m.Filename != "a.jpg" || len(d) != 600<<10 {
+		t.Fatal("get")
+	}
+
+	// Over the size cap, the oldest download goes first.
+	removed, reclaimed, err := c.Prune(&config.RetentionPolicy{MaxMB: 1}, time.Now())
+	if err != nil || removed != 1 || reclaimed < 600<<10 {
+		t.Fatal(removed, reclaimed, err)
+	}
+	if _, _, ok := c.Get("a"); ok {
+		t.Fatal("a should be pruned")
+	}
+	if _, f, ok := c.Open("b"); !ok {
+		t.Fatal("b kept")
+	} else {
+		f.Close()
+	}
+
+	// A nil cache is disabled.
+	var disabled *Cache
+	if _, _, ok := disabled.Get("b"); ok {
+		t.Fatal("disabled cache hit")
+	}
+	if w, err := disabled.Create(Media{MediaID: "c"}); w != nil || err != nil {
+		t.Fatal(w, err)
+	}
+}
@@ -0,0 +1,72 @@
+// Package metrics keeps the bridge's counters and renders them in the
+// Prometheus text format for /metrics.
+package metrics
+
+import (
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// Registry holds counters by name and label set. It is safe for concurrent
+// use.
+type Registry struct {
+	mu       sync.Mutex
+	counters map[string]map[string]int64
+}
+
+// New returns an empty registry.
+func New() *Registry {
+	return &Registry{counters: make(map[string]map[string]int64)}
+}
+
+// Inc increments a counter; labels are given as alternating name/value pairs.
+func (m *Registry) Inc(name string, labels ...string) {
+	m.Add(name, 1, labels...)
+}
+
+// Add adds delta to a counter.
+func (m *Registry) Add(name string, delta int64, labels ...string) {
+	parts := make([]string, 0, len(labels)/2)
+	for i := 0; i+1 < len(labels); i += 2 {
+		parts = append(parts, fmt.Sprintf("%s=%q", labels[i], labels[i+1]))
+	}
+	key := strings.Join(parts, ",")
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	series, ok := m.counters[name]
+	if !ok {
+		series = make(map[string]int64)
+		m.counters[name] = series
+	}
+	series[key] += delta
+}
+
+// WriteText writes every counter, sorted by name and labels.
+func (m *Registry) WriteText(w io.Writer) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	names := make([]string, 0, len(m.counters))
+	for name := range m.counters {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		fmt.Fprintf(w, "# TYPE %s counter\n", name)
+		keys := make([]string, 0, len(m.counters[name]))
+		for key := range m.counters[name] {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+		for _, key := range keys {
+			if key == "" {
+				fmt.Fprintf(w, "%s %d\n", name, m.counters[name][key])
+			} else {
+				fmt.Fprintf(w, "%s{%s} %d\n", name, key, m.counters[name][key])
+			}
+		}
+	}
+}
@@ -0,0 +1,25 @@
+package metrics
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestRegistryWriteText(t *testing.T) {
+	m := New()
+	m.Inc("b_total", "agent", "1000002", "status", "ok")
+	m.Inc("b_total", "agent", "1000002", "status", "ok")
+	m.Add("b_total", 3, "agent", `a"b`, "status", "error")
+	m.Inc("a_total")
+	var out strings.Builder
+	m.WriteText(&out)
+	want := `# TYPE a_total counter
+a_total 1
+# TYPE b_total counter
+b_total{agent="1000002",status="ok"} 2
+b_total{agent="a\"b",status="error"} 3
+`
+	if out.String() != want {
+		t.Fatalf("got\n%s\nwant\n%s", out.String(), want)
+	}
+}
@@ -0,0 +1,186 @@
+// Package outbox persists each inbound event before WeCom is acknowledged,
+// so one received just before a crash is broadcast after the restart
+// instead of lost.
+package outbox
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+
+	"github.com/Tennen/Paimon/tools/bridge/atomicfile"
+)
+
+// Outbox persists each inbound event before WeCom is acknowledged and
+// marks it flushed once broadcast, so a crash in between cannot lose it.
+type Outbox struct {
+	mu      sync.Mutex
+	path    string
+	file    *os.File
+	nextSeq int64
+	pending map[int64]Entry
+	lines   int
+}
+
+// Entry is one line of the outbox file; a flushed line carries only
+// the sequence number of the pending entry it completes.
+type Entry struct {
+	Seq     int64          `json:"seq"`
+	Flushed bool           `json:"flushed,omitempty"`
+	Payload map[string]any `json:"payload,omitempty"`
+}
+
+// New returns an outbox that keeps pending entries in memory until Open
+// gives it a file.
+func New() *Outbox {
+	return &Outbox{nextSeq: 1, pending: make(map[int64]Entry)}
+}
+
+// Open replays an existing outbox file to find unflushed entries and keeps it
+// open for appending. An empty path disables persistence.
+func (o *Outbox) Open(path string) error {
+	if path == "" {
+		return nil
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+		return err
+	}
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_RDWR|os.O_APPEND, 0o600)
+	if err != nil {
+		return err
+	}
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	for scanner.Scan() {
+		var entry Entry
+		if err := json.Unmarshal(scanner.Bytes(), &entry); err != nil {
+			continue
+		}
+		o.lines++
+		if entry.Seq >= o.nextSeq {
+			o.nextSeq = entry.Seq + 1
+		}
+		if entry.Flushed {
+			delete(o.pending, entry.Seq)
+		} else if entry.Payload != nil {
+			o.pending[entry.Seq] = entry
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		_ = f.Close()
+		return err
+	}
+	o.path = path
+	o.file = f
+	return nil
+}
+
+// Close closes the outbox file. Later adds fail, as after a crash.
+func (o *Outbox) Close() error {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	if o.file == nil {
+		return nil
+	}
+	return o.file.Close()
+}
+
+// Add durably records payload as pending and returns its sequence number.
+func (o *Outbox) Add(payload map[string]any) (int64, error) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	seq := o.nextSeq
+	o.nextSeq++
+	if o.file == nil {
+		return seq, nil
+	}
+	entry := Entry{Seq: seq, Payload: payload}
+	if err := o.writeLocked(entry); err != nil {
+		return 0, err
+	}
+	if err := o.file.Sync(); err != nil {
+		return 0, err
+	}
+	o.pending[seq] = entry
+	return seq, nil
+}
+
+// Flush marks a pending entry as delivered. The marker is not synced: after
+// a crash the event is broadcast again, which consumers dedupe by messageId.
+func (o *Outbox) Flush(seq int64) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	if o.file == nil || seq == 0 {
+		return
+	}
+	delete(o.pending, seq)
+	if err := o.writeLocked(Entry{Seq: seq, Flushed: true}); err != nil {
+		slog.Error("outbox write failed", "err", err)
+		return
+	}
+	if o.lines >= compactLines {
+		if err := o.compactLocked(); err != nil {
+			slog.Error("outbox compact failed", "err", err)
+		}
+	}
+}
+
+// Unflushed returns the pending entries in arrival order.
+func (o *Outbox) Unflushed() []Entry {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	out := make([]Entry, 0, len(o.pending))
+	for _, entry := range o.pending {
+		out = append(out, entry)
+	}
+	sort.Slice(out, func(i, j int) bool { return out[i].Seq < out[j].Seq })
+	return out
+}
+
+// writeLocked appends one entry to the file. The caller holds o.mu.
+func (o *Outbox) writeLocked(entry Entry) error {
+	line, err := json.Marshal(entry)
+	if err != nil {
+		return err
+	}
+	if _, err := o.file.Write(append(line, '\n')); err != nil {
+		return err
+	}
+	o.lines++
+	return nil
+}
+
+// compactLines is the number of file lines past which Flush rewrites the
+// file with only the pending entries.
+const compactLines = 1000
+
+// compactLocked atomically rewrites the file with only the still-pending
+// entries. The caller holds o.mu.
+func (o *Outbox) compactLocked() error {
+	var buf bytes.Buffer
+	for _, entry := range o.pending {
+		line, err := json.Marshal(entry)
+		if err != nil {
+			return err
+		}
+		buf.Write(append(line, '\n'))
+	}
+	if err := atomicfile.Write(o.path, buf.Bytes()); err != nil {
+		return err
+	}
+	f, err := os.OpenFile(o.path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0o600)
+	if err != nil {
+		return err
+	}
+	_ = o.file.Close()
+	o.file = f
+	o.lines = len(o.pending)
+	return nil
+}
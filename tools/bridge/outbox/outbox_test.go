@@ -0,0 +1,59 @@
+package outbox
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestReopen(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "outbox.jsonl")
+	o := New()
+	if err := o.Open(path); err != nil {
+		t.Fatal(err)
+	}
+	first, _ := o.Add(map[string]any{"messageId": "m1"})
+	second, _ := o.Add(map[string]any{"messageId": "m2"})
+	o.Flush(first)
+	o.Close()
+
+	// A restart finds the unflushed entry and continues the sequence.
+	again := New()
+	if err := again.Open(path); err != nil {
+		t.Fatal(err)
+	}
+	defer again.Close()
+	pending := again.Unflushed()
+	if len(pending) != 1 || pending[0].Seq != second || pending[0].Payload["messageId"] != "m2" {
+		t.Fatalf("pending %+v", pending)
+	}
+	if seq, err := again.Add(map[string]any{"messageId": "m3"}); err != nil || seq != 3 {
+		t.Fatal(seq, err)
+	}
+}
+
+func TestCompact(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "outbox.jsonl")
+	o := New()
+	if err := o.Open(path); err != nil {
+		t.Fatal(err)
+	}
+	defer o.Close()
+	// Each delivered entry takes two lines; past compactLines the file
+	// keeps only what is pending.
+	for i := 0; i < compactLines/2; i++ {
+		seq, err := o.Add(map[string]any{"n": i})
+		if err != nil {
+			t.Fatal(err)
+		}
+		o.Flush(seq)
+	}
+	if _, err := o.Add(map[string]any{"n": "pending"}); err != nil {
+		t.Fatal(err)
+	}
+	raw, _ := os.ReadFile(path)
+	if lines := strings.Count(string(raw), "\n"); lines != 1 {
+		t.Fatalf("%d lines after compaction", lines)
+	}
+}
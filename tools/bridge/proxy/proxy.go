@@ -0,0 +1,188 @@
+// Package proxy is the client side of the bridge's qyapi proxy: a shared
+// outbound transport, an interceptor chain around every qyapi request, and
+// helpers that send a request and explain WeCom's errcodes.
+package proxy
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"time"
+)
+
+// Interceptor wraps one outgoing qyapi request. It may change the request
+// (clone it first), inspect the response, or answer without calling next.
+type Interceptor func(req *http.Request, next http.RoundTripper) (*http.Response, error)
+
+type interceptorTransport struct {
+	interceptor Interceptor
+	next        http.RoundTripper
+}
+
+func (t interceptorTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	return t.interceptor(req, t.next)
+}
+
+// Chain returns a RoundTripper that runs the interceptors, outermost first,
+// around base.
+func Chain(base http.RoundTripper, interceptors ...Interceptor) http.RoundTripper {
+	rt := base
+	for i := len(interceptors) - 1; i >= 0; i-- {
+		rt = interceptorTransport{interceptor: interceptors[i], next: rt}
+	}
+	return rt
+}
+
+// TransportOptions configure NewTransport. The limits mean what they do on
+// http.Transport and net.Dialer, where zero is no limit; a nil Proxy means
+// no proxy.
+type TransportOptions struct {
+	Proxy           func(*http.Request) (*url.URL, error)
+	DialTimeout     time.Duration
+	MaxIdleConns    int
+	MaxConnsPerHost int
+	IdleTimeout     time.Duration
+	// RootCAs replaces the system roots when set.
+	RootCAs *x509.CertPool
+}
+
+// NewTransport returns a pooled transport, based on http.DefaultTransport,
+// for all outgoing requests, so proxy settings, trusted CAs and connections
+// are shared.
+func NewTransport(opts TransportOptions) *http.Transport {
+	t := http.DefaultTransport.(*http.Transport).Clone()
+	t.Proxy = opts.Proxy
+	t.DialContext = (&net.Dialer{Timeout: opts.DialTimeout, KeepAlive: 30 * time.Second}).DialContext
+	t.MaxIdleConns = opts.MaxIdleConns
+	t.MaxIdleConnsPerHost = opts.MaxIdleConns
+	t.MaxConnsPerHost = opts.MaxConnsPerHost
+	t.IdleConnTimeout = opts.IdleTimeout
+	if opts.RootCAs != nil {
+		t.TLSClientConfig = &tls.Config{RootCAs: opts.RootCAs}
+	}
+	return t
+}
+
+// Do sends a qyapi request bound to ctx, so that it is abandoned when the
+// caller goes away: a JSON POST when body is non-nil, a GET otherwise.
+func Do(ctx context.Context, client *http.Client, endpoint string, body []byte) (*http.Response, error) {
+	method, reader := http.MethodGet, io.Reader(nil)
+	if body != nil {
+		method, reader = http.MethodPost, bytes.NewReader(body)
+	}
+	req, err := http.NewRequestWithContext(ctx, method, endpoint, reader)
+	if err != nil {
+		return nil, err
+	}
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	return client.Do(req)
+}
+
+// Call sends a request like Do and returns the response body, treating a
+// non-2xx status or a non-zero errcode as an error. The body is returned
+// with the error when there is one.
+func Call(ctx context.Context, client *http.Client, endpoint string, body []byte) ([]byte, error) {
+	resp, err := Do(ctx, client, endpoint, body)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	data, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return data, fmt.Errorf("http %d", resp.StatusCode)
+	}
+	var result struct {
+		ErrCode int    `json:"errcode"`
+		ErrMsg  string `json:"errmsg"`
+	}
+	_ = json.Unmarshal(data, &result)
+	if result.ErrCode != 0 {
+		return data, fmt.Errorf("errcode %d %s (%s)", result.ErrCode, result.ErrMsg, LookupError(result.ErrCode).Message)
+	}
+	return data, nil
+}
+
+// ErrorInfo explains a qyapi errcode for support engineers.
+type ErrorInfo struct {
+	Message   string
+	Retryable bool
+	Hint      string
+}
+
+var errorInfos = map[int]ErrorInfo{
+	-1:     {"WeCom system busy", true, "retry with backoff"},
+	40001:  {"invalid corpsecret or access token", false, "check the app secret for this agent"},
+	40003:  {"invalid userid", false, "check touser; the user may not exist in this corp"},
+	40004:  {"invalid media type", false, "type must be image, voice, video or file"},
+	40005:  {"invalid file type", false, "check the file extension against the media type"},
+	40006:  {"invalid file size", false, "image <= 10MB, voice <= 2MB, video <= 10MB, file <= 20MB"},
+	40007:  {"invalid media_id", false, "media ids expire after 3 days; upload again"},
+	40008:  {"invalid message type", false, "check msgtype in the message body"},
+	40013:  {"invalid corpid", false, "check WECOM_CORP_ID / corpid"},
+	40014:  {"invalid access_token", true, "fetch a new token with gettoken and retry"},
+	40054:  {"invalid menu url domain", false, "menu url must be under the app's trusted domain"},
+	40056:  {"invalid agentid", false, "check agentid matches the app of the access token"},
+	40058:  {"invalid parameter", false, "check required fields and JSON types in the request body"},
+	41001:  {"missing access_token", false, "pass access_token or configure WECOM_CORP_ID/WECOM_CORP_SECRET"},
+	41002:  {"missing corpid", false, "pass corpid"},
+	41004:  {"missing corpsecret", false, "pass corpsecret"},
+	42001:  {"access_token expired", true, "fetch a new token with gettoken and retry"},
+	44001:  {"empty media file", false, "the uploaded media is empty"},
+	44004:  {"empty text content", false, "text.content must not be empty"},
+	45002:  {"content too long", false, "text messages are limited to 2048 bytes"},
+	45007:  {"voice playtime too long", false, "voice messages are limited to 60 seconds"},
+	45009:  {"API call frequency exceeded", true, "slow down; per-app and per-user limits apply"},
+	45033:  {"API concurrency limit exceeded", true, "reduce concurrent calls and retry"},
+	48002:  {"API forbidden", false, "the app has no permission for this API in the admin console"},
+	50001:  {"redirect_uri domain not trusted", false, "set the trusted domain in the app settings"},
+	60011:  {"no permission for user/department", false, "the target is outside the app's visible range"},
+	60020:  {"IP not in allowlist", false, "add the bridge's egress IP to the app's trusted IPs"},
+	81013:  {"user, party and tag all invalid", false, "check touser/toparty/totag"},
+	82001:  {"all recipients invalid", false, "recipients are outside the app's visible range"},
+	301002: {"no permission for the specified app", false, "check the access token belongs to this agent"},
+}
+
+// LookupError explains code; unknown codes get a generic message.
+func LookupError(code int) ErrorInfo {
+	if info, ok := errorInfos[code]; ok {
+		return info
+	}
+	return ErrorInfo{Message: "unknown WeCom error"}
+}
+
+// EnrichError adds error, explanation, retryable, hint and docs fields to a
+// qyapi response carrying a non-zero errcode. Other bodies are returned
+// unchanged.
+func EnrichError(data []byte, label string) []byte {
+	var body map[string]any
+	if err := json.Unmarshal(data, &body); err != nil {
+		return data
+	}
+	code, ok := body["errcode"].(float64)
+	if !ok || code == 0 {
+		return data
+	}
+	info := LookupError(int(code))
+	body["error"] = label + " failed"
+	body["explanation"] = info.Message
+	body["retryable"] = info.Retryable
+	body["hint"] = info.Hint
+	body["docs"] = fmt.Sprintf("https://developer.work.weixin.qq.com/devtool/query?e=%d", int(code))
+	enriched, err := json.Marshal(body)
+	if err != nil {
+		return data
+	}
+	return enriched
+}
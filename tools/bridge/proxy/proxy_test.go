@@ -0,0 +1,110 @@
+package proxy
+
+import (
+	"context"
+	"crypto/x509"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestChainOrder(t *testing.T) {
+	var order []string
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		order = append(order, "server "+r.Header.Get("X-Tag"))
+		_, _ = w.Write([]byte(`{"errcode":0}`))
+	}))
+	defer srv.Close()
+	mark := func(name string) Interceptor {
+		return func(req *http.Request, next http.RoundTripper) (*http.Response, error) {
+			order = append(order, name)
+			req = req.Clone(req.Context())
+			req.Header.Set("X-Tag", req.Header.Get("X-Tag")+name)
+			return next.RoundTrip(req)
+		}
+	}
+	client := &http.Client{Transport: Chain(http.DefaultTransport, mark("a"), mark("b"))}
+	if _, err := Call(context.Background(), client, srv.URL, nil); err != nil {
+		t.Fatal(err)
+	}
+	if strings.Join(order, ",") != "a,b,server ab" {
+		t.Fatalf("order = %v", order)
+	}
+}
+
+func TestCall(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		switch r.URL.Path {
+		case "/ok":
+			if r.Method != http.MethodPost || r.Header.Get("Content-Type") != "application/json" || string(body) != `{"x":1}` {
+				t.Errorf("request %s %s %s", r.Method, r.Header.Get("Content-Type"), body)
+			}
+			_, _ = w.Write([]byte(`{"errcode":0,"errmsg":"ok","msgid":"m"}`))
+		case "/get":
+			if r.Method != http.MethodGet {
+				t.Errorf("method %s", r.Method)
+			}
+			_, _ = w.Write([]byte(`{"errcode":0}`))
+		case "/errcode":
+			_, _ = w.Write([]byte(`{"errcode":40014,"errmsg":"invalid access_token"}`))
+		default:
+			w.WriteHeader(http.StatusBadGateway)
+		}
+	}))
+	defer srv.Close()
+	ctx := context.Background()
+	client := srv.Client()
+	if data, err := Call(ctx, client, srv.URL+"/ok", []byte(`{"x":1}`)); err != nil || !strings.Contains(string(data), `"msgid":"m"`) {
+		t.Fatal(string(data), err)
+	}
+	if _, err := Call(ctx, client, srv.URL+"/get", nil); err != nil {
+		t.Fatal(err)
+	}
+	data, err := Call(ctx, client, srv.URL+"/errcode", nil)
+	if err == nil || !strings.Contains(err.Error(), "errcode 40014") || !strings.Contains(err.Error(), "invalid access_token") || len(data) == 0 {
+		t.Fatal(string(data), err)
+	}
+	if _, err := Call(ctx, client, srv.URL+"/down", nil); err == nil || err.Error() != "http 502" {
+		t.Fatal(err)
+	}
+	cancelled, cancel := context.WithCancel(ctx)
+	cancel()
+	if _, err := Call(cancelled, client, srv.URL+"/ok", nil); err == nil {
+		t.Fatal("a cancelled context should abandon the request")
+	}
+}
+
+func TestEnrichError(t *testing.T) {
+	var body map[string]any
+	if err := json.Unmarshal(EnrichError([]byte(`{"errcode":45009,"errmsg":"freq"}`), "send"), &body); err != nil {
+		t.Fatal(err)
+	}
+	if body["error"] != "send failed" || body["retryable"] != true || body["explanation"] != "API call frequency exceeded" ||
+		body["docs"] != "https://developer.work.weixin.qq.com/devtool/query?e=45009" || body["errmsg"] != "freq" {
+		t.Fatal(body)
+	}
+	for _, unchanged := range []string{`{"errcode":0,"errmsg":"ok"}`, `not json`, `{"msgid":"x"}`} {
+		if got := string(EnrichError([]byte(unchanged), "send")); got != unchanged {
+			t.Errorf("EnrichError changed %s to %s", unchanged, got)
+		}
+	}
+	if info := LookupError(123); info.Message != "unknown WeCom error" || info.Retryable {
+		t.Fatal(info)
+	}
+}
+
+func TestNewTransport(t *testing.T) {
+	tr := NewTransport(TransportOptions{MaxIdleConns: 7, MaxConnsPerHost: 3, IdleTimeout: time.Second})
+	if tr.Proxy != nil || tr.MaxIdleConns != 7 || tr.MaxIdleConnsPerHost != 7 || tr.MaxConnsPerHost != 3 || tr.IdleConnTimeout != time.Second {
+		t.Fatalf("%+v", tr)
+	}
+	roots := x509.NewCertPool()
+	if tr := NewTransport(TransportOptions{RootCAs: roots}); tr.TLSClientConfig == nil || tr.TLSClientConfig.RootCAs != roots {
+		t.Fatal("RootCAs not applied")
+	}
+}
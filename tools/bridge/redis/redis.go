@@ -0,0 +1,241 @@
+// Package redis is a minimal RESP2 client for the few commands the bridge
+// sends to Redis: the shared event stream and its pub/sub channel, and the
+// callback deduplication keys. It keeps one connection per client and
+// redials on the next call after a network failure.
+package redis
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	timeout = 2 * time.Second
+	// RetryDelay is how long calls fail fast after a failed dial.
+	RetryDelay   = 5 * time.Second
+	pingInterval = 5 * time.Second
+)
+
+// Client runs commands on one connection, serialized.
+type Client struct {
+	addr     string
+	username string
+	password string
+	db       int
+
+	mu        sync.Mutex
+	conn      net.Conn
+	rd        *bufio.Reader
+	downUntil time.Time
+}
+
+// Error is an error reply (-ERR ...) from the server.
+type Error string
+
+func (e Error) Error() string { return string(e) }
+
+// New parses redis://[user:password@]host[:port][/db]; it does not dial.
+func New(rawURL string) (*Client, error) {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return nil, err
+	}
+	if u.Scheme != "redis" {
+		return nil, fmt.Errorf("unsupported redis scheme %q", u.Scheme)
+	}
+	c := &Client{addr: u.Host}
+	if u.Port() == "" {
+		c.addr = net.JoinHostPort(u.Hostname(), "6379")
+	}
+	if u.User != nil {
+		c.username = u.User.Username()
+		c.password, _ = u.User.Password()
+	}
+	if db := strings.Trim(u.Path, "/"); db != "" {
+		if c.db, err = strconv.Atoi(db); err != nil {
+			return nil, fmt.Errorf("invalid redis db %q", db)
+		}
+	}
+	return c, nil
+}
+
+// Do runs one command and returns its reply: string, int64, nil, []any or
+// an Error. Network failures drop the connection for the next call; after
+// a failed dial, calls fail fast for RetryDelay.
+func (c *Client) Do(args ...string) (any, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.conn == nil {
+		if time.Now().Before(c.downUntil) {
+			return nil, errors.New("redis unavailable")
+		}
+		if err := c.connectLocked(); err != nil {
+			c.downUntil = time.Now().Add(RetryDelay)
+			return nil, err
+		}
+	}
+	reply, err := c.commandLocked(args, timeout)
+	var replyErr Error
+	if err != nil && !errors.As(err, &replyErr) {
+		_ = c.conn.Close()
+		c.conn = nil
+	}
+	return reply, err
+}
+
+// Subscribe subscribes to channel on a new connection, calls ready once the
+// subscription is confirmed and then fn for every message, until the
+// connection fails or ready or fn return an error. It always returns an
+// error. A PING every 5s must be answered within 2s, so a silently dead
+// connection is noticed too. The client runs no other command meanwhile.
+func (c *Client) Subscribe(channel string, ready func() error, fn func(message string) error) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.conn == nil {
+		if err := c.connectLocked(); err != nil {
+			return err
+		}
+	}
+	conn := c.conn
+	defer func() {
+		_ = conn.Close()
+		c.conn = nil
+	}()
+	reply, err := c.commandLocked([]string{"SUBSCRIBE", channel}, timeout)
+	if err != nil {
+		return err
+	}
+	if items, _ := reply.([]any); len(items) != 3 || items[0] != "subscribe" {
+		return fmt.Errorf("redis: unexpected subscribe reply %v", reply)
+	}
+	if err := ready(); err != nil {
+		return err
+	}
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		ticker := time.NewTicker(pingInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-done:
+				return
+			case <-ticker.C:
+				_ = conn.SetWriteDeadline(time.Now().Add(timeout))
+				_, _ = conn.Write([]byte("*1\r\n$4\r\nPING\r\n"))
+			}
+		}
+	}()
+	for {
+		_ = conn.SetReadDeadline(time.Now().Add(pingInterval + timeout))
+		reply, err := ReadReply(c.rd)
+		if err != nil {
+			return err
+		}
+		// Anything else is a "pong", which only proves the connection.
+		if items, _ := reply.([]any); len(items) == 3 && items[0] == "message" {
+			message, _ := items[2].(string)
+			if err := fn(message); err != nil {
+				return err
+			}
+		}
+	}
+}
+
+func (c *Client) connectLocked() error {
+	conn, err := net.DialTimeout("tcp", c.addr, timeout)
+	if err != nil {
+		return err
+	}
+	c.conn = conn
+	c.rd = bufio.NewReader(conn)
+	setup := make([][]string, 0, 2)
+	if c.password != "" {
+		if c.username != "" {
+			setup = append(setup, []string{"AUTH", c.username, c.password})
+		} else {
+			setup = append(setup, []string{"AUTH", c.password})
+		}
+	}
+	if c.db != 0 {
+		setup = append(setup, []string{"SELECT", strconv.Itoa(c.db)})
+	}
+	for _, args := range setup {
+		if _, err := c.commandLocked(args, timeout); err != nil {
+			_ = conn.Close()
+			c.conn = nil
+			return fmt.Errorf("redis %s: %w", args[0], err)
+		}
+	}
+	return nil
+}
+
+func (c *Client) commandLocked(args []string, timeout time.Duration) (any, error) {
+	var buf bytes.Buffer
+	fmt.Fprintf(&buf, "*%d\r\n", len(args))
+	for _, arg := range args {
+		fmt.Fprintf(&buf, "$%d\r\n%s\r\n", len(arg), arg)
+	}
+	_ = c.conn.SetDeadline(time.Now().Add(timeout))
+	if _, err := c.conn.Write(buf.Bytes()); err != nil {
+		return nil, err
+	}
+	return ReadReply(c.rd)
+}
+
+// ReadReply reads one RESP2 value. Error replies nested in an array are
+// kept as Error items.
+func ReadReply(rd *bufio.Reader) (any, error) {
+	line, err := rd.ReadString('\n')
+	if err != nil {
+		return nil, err
+	}
+	line = strings.TrimRight(line, "\r\n")
+	if line == "" {
+		return nil, errors.New("redis: empty reply")
+	}
+	switch line[0] {
+	case '+':
+		return line[1:], nil
+	case '-':
+		return nil, Error(line[1:])
+	case ':':
+		return strconv.ParseInt(line[1:], 10, 64)
+	case '$':
+		n, err := strconv.Atoi(line[1:])
+		if err != nil || n < 0 {
+			return nil, err
+		}
+		data := make([]byte, n+2)
+		if _, err := io.ReadFull(rd, data); err != nil {
+			return nil, err
+		}
+		return string(data[:n]), nil
+	case '*':
+		n, err := strconv.Atoi(line[1:])
+		if err != nil || n < 0 {
+			return nil, err
+		}
+		items := make([]any, n)
+		for i := range items {
+			if items[i], err = ReadReply(rd); err != nil {
+				var replyErr Error
+				if !errors.As(err, &replyErr) {
+					return nil, err
+				}
+				items[i] = replyErr
+			}
+		}
+		return items, nil
+	}
+	return nil, fmt.Errorf("redis: unexpected reply %q", line)
+}
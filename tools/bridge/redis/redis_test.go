@@ -0,0 +1,174 @@
+package redis_test
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/Tennen/Paimon/tools/bridge/redis"
+	"github.com/Tennen/Paimon/tools/bridge/redis/redistest"
+)
+
+func TestReadReply(t *testing.T) {
+	for in, want := range map[string]string{
+		"+OK\r\n":        `"OK"`,
+		"-ERR boom\r\n":  `error "ERR boom"`,
+		":-42\r\n":       `-42`,
+		"$3\r\na\rb\r\n": `"a\rb"`,
+		"$0\r\n\r\n":     `""`,
+		"$-1\r\n":        `<nil>`,
+		"*-1\r\n":        `<nil>`,
+		"*0\r\n":         `[]`,
+		"*3\r\n$1\r\na\r\n-ERR in\r\n*1\r\n:1\r\n": `["a" "ERR in" [1]]`,
+		"?x\r\n":       `error "redis: unexpected reply \"?x\""`,
+		"\r\n":         `error "redis: empty reply"`,
+		"$5\r\nab\r\n": `error "unexpected EOF"`,
+	} {
+		reply, err := redis.ReadReply(bufio.NewReader(strings.NewReader(in)))
+		got := formatReply(reply)
+		if err != nil {
+			got = fmt.Sprintf("error %q", err.Error())
+		}
+		if got != want {
+			t.Errorf("%q: got %s, want %s", in, got, want)
+		}
+	}
+}
+
+// formatReply renders a ReadReply reply for comparison.
+func formatReply(reply any) string {
+	switch v := reply.(type) {
+	case []any:
+		items := make([]string, len(v))
+		for i, item := range v {
+			items[i] = formatReply(item)
+		}
+		return "[" + strings.Join(items, " ") + "]"
+	case string, redis.Error:
+		return fmt.Sprintf("%q", v)
+	}
+	return fmt.Sprint(reply)
+}
+
+func TestClientReconnect(t *testing.T) {
+	srv := redistest.NewServer(t)
+	c, err := redis.New(srv.URL("app:secret@", "/2"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if reply, err := c.Do("PING"); err != nil || reply != "PONG" {
+		t.Fatal(reply, err)
+	}
+	// An error reply keeps the connection.
+	if _, err := c.Do("NOPE"); err == nil || err.Error() != "ERR unknown command 'NOPE'" {
+		t.Fatal(err)
+	}
+	srv.DropConns()
+	if _, err := c.Do("PING"); err == nil {
+		t.Fatal("want error on the dropped connection")
+	}
+	// The next call redials and authenticates again.
+	if reply, err := c.Do("PING"); err != nil || reply != "PONG" {
+		t.Fatal(reply, err)
+	}
+	setup := srv.Seen("AUTH", "SELECT")
+	want := [][]string{{"AUTH", "app", "secret"}, {"SELECT", "2"}, {"AUTH", "app", "secret"}, {"SELECT", "2"}}
+	if srv.Dials() != 2 || !slices.EqualFunc(setup, want, slices.Equal) {
+		t.Fatalf("dialed %d, setup %q", srv.Dials(), setup)
+	}
+
+	bad, _ := redis.New(srv.URL(":wrong@", ""))
+	if _, err := bad.Do("PING"); err == nil || err.Error() != "redis AUTH: WRONGPASS invalid password" {
+		t.Fatal(err)
+	}
+	// A failed connection fails fast until RetryDelay has passed.
+	if _, err := bad.Do("PING"); err == nil || err.Error() != "redis unavailable" {
+		t.Fatal(err)
+	}
+	if srv.Dials() != 3 {
+		t.Fatalf("dialed %d", srv.Dials())
+	}
+
+	for _, raw := range []string{"rediss://host", "redis://host/x", "://"} {
+		if _, err := redis.New(raw); err == nil {
+			t.Errorf("%s: want error", raw)
+		}
+	}
+}
+
+func TestClientSubscribe(t *testing.T) {
+	srv := redistest.NewServer(t)
+	const publish = "return redis.call('PUBLISH', KEYS[1], ARGV[1])"
+	srv.Script(publish, func(tx *redistest.Tx, keys, args []string) (any, error) {
+		tx.Publish(keys[0], args[0])
+		return int64(1), nil
+	})
+	pub, _ := redis.New(srv.URL("", ""))
+	sub, _ := redis.New(srv.URL("", ""))
+	stop := errors.New("stop")
+	messages := make(chan string, 4)
+	done := make(chan error, 1)
+	go func() {
+		done <- sub.Subscribe("live", func() error {
+			messages <- "ready"
+			return nil
+		}, func(message string) error {
+			messages <- message
+			if message == "last" {
+				return stop
+			}
+			return nil
+		})
+	}()
+	next := func() string {
+		t.Helper()
+		select {
+		case m := <-messages:
+			return m
+		case <-time.After(2 * time.Second):
+			t.Fatal("no message")
+			return ""
+		}
+	}
+	if m := next(); m != "ready" {
+		t.Fatal(m)
+	}
+	for _, m := range []string{"a b", "last"} {
+		if _, err := pub.Do("EVAL", publish, "1", "live", m); err != nil {
+			t.Fatal(err)
+		}
+		if got := next(); got != m {
+			t.Fatalf("got %q, want %q", got, m)
+		}
+	}
+	if err := <-done; err != stop {
+		t.Fatal(err)
+	}
+
+	// A dropped subscription ends Subscribe with the network error.
+	go func() {
+		done <- sub.Subscribe("live", func() error {
+			messages <- "ready"
+			return nil
+		}, func(string) error { return nil })
+	}()
+	if m := next(); m != "ready" {
+		t.Fatal(m)
+	}
+	srv.DropSubscribers()
+	select {
+	case err := <-done:
+		if err == nil || err == stop {
+			t.Fatal(err)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("Subscribe did not return")
+	}
+	if got := srv.Seen("SUBSCRIBE"); len(got) != 2 || got[0][1] != "live" {
+		t.Fatalf("%q", got)
+	}
+}
@@ -0,0 +1,325 @@
+// Package redistest runs an in-memory RESP server for tests. It knows the
+// commands the bridge sends: PING, AUTH, SELECT, SET (NX, PX), DEL, XRANGE,
+// XREVRANGE, SUBSCRIBE and EVAL, with scripts emulated in Go (see Script).
+// It records every command and can drop connections like a Redis restart.
+package redistest
+
+import (
+	"bufio"
+	"fmt"
+	"net"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/Tennen/Paimon/tools/bridge/redis"
+)
+
+// Server is the fake Redis. AUTH and SELECT accept any password but
+// "wrong".
+type Server struct {
+	t  testing.TB
+	ln net.Listener
+
+	mu       sync.Mutex
+	values   map[string]int64
+	streams  map[string][]Entry
+	scripts  map[string]ScriptFunc
+	commands [][]string
+	conns    []*conn
+	dialed   int
+	mute     int
+}
+
+// Entry is a stream entry with a single "event" field, as the bridge
+// writes them.
+type Entry struct {
+	ID    int64
+	Event string
+}
+
+// ScriptFunc emulates a Lua script. It runs with the server locked, as
+// scripts run atomically in Redis, and may use the Tx methods on the
+// server it is given. The reply is a string, an int64 or an error.
+type ScriptFunc func(tx *Tx, keys, args []string) (any, error)
+
+// Tx is the server as seen by a running script.
+type Tx struct{ s *Server }
+
+// conn is a client connection; writes are locked because published messages
+// reach subscribers from other connections' goroutines.
+type conn struct {
+	net.Conn
+	mu      sync.Mutex
+	channel string // set once subscribed
+}
+
+func (c *conn) send(reply string) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	_, err := c.Write([]byte(reply))
+	return err
+}
+
+// NewServer starts a server that is stopped when the test ends.
+func NewServer(t testing.TB) *Server {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := &Server{t: t, ln: ln, values: make(map[string]int64), streams: make(map[string][]Entry), scripts: make(map[string]ScriptFunc)}
+	go func() {
+		for {
+			nc, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			c := &conn{Conn: nc}
+			s.mu.Lock()
+			s.dialed++
+			s.conns = append(s.conns, c)
+			s.mu.Unlock()
+			go s.serve(c)
+		}
+	}()
+	t.Cleanup(s.Close)
+	return s
+}
+
+// URL returns a redis:// URL for the server, e.g. URL("user:pass@", "/2").
+func (s *Server) URL(userinfo, db string) string {
+	return "redis://" + userinfo + s.ln.Addr().String() + db
+}
+
+// Close stops accepting connections and drops the open ones.
+func (s *Server) Close() {
+	_ = s.ln.Close()
+	s.DropConns()
+}
+
+// Script registers the emulation of the script with source src for EVAL.
+func (s *Server) Script(src string, fn ScriptFunc) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.scripts[src] = fn
+}
+
+// DropConns closes every open connection, as a Redis restart would.
+func (s *Server) DropConns() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, c := range s.conns {
+		_ = c.Close()
+	}
+	s.conns = nil
+}
+
+// DropSubscribers closes the subscribed connections only.
+func (s *Server) DropSubscribers() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, c := range s.conns {
+		if c.channel != "" {
+			_ = c.Close()
+		}
+	}
+}
+
+// Mute drops the next n published messages instead of delivering them, as
+// a subscriber's lost connection would.
+func (s *Server) Mute(n int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.mute = n
+}
+
+// Seen returns the commands received so far whose name is one of names.
+func (s *Server) Seen(names ...string) [][]string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var out [][]string
+	for _, args := range s.commands {
+		if slices.Contains(names, args[0]) {
+			out = append(out, args)
+		}
+	}
+	return out
+}
+
+// Dials returns how many connections were accepted.
+func (s *Server) Dials() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.dialed
+}
+
+// Stream returns a copy of the stream at key.
+func (s *Server) Stream(key string) []Entry {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return slices.Clone(s.streams[key])
+}
+
+// Incr increments the counter at key.
+func (tx *Tx) Incr(key string) int64 {
+	tx.s.values[key]++
+	return tx.s.values[key]
+}
+
+// Set sets the counter at key.
+func (tx *Tx) Set(key string, n int64) {
+	tx.s.values[key] = n
+}
+
+// Last returns the newest entry of the stream at key.
+func (tx *Tx) Last(key string) (Entry, bool) {
+	entries := tx.s.streams[key]
+	if len(entries) == 0 {
+		return Entry{}, false
+	}
+	return entries[len(entries)-1], true
+}
+
+// XAdd appends to the stream at key, keeping the newest maxLen entries. IDs
+// must increase, as in Redis.
+func (tx *Tx) XAdd(key string, e Entry, maxLen int) error {
+	if last, ok := tx.Last(key); ok && e.ID <= last.ID {
+		return redis.Error("ERR The ID specified in XADD is equal or smaller than the target stream top item")
+	}
+	entries := append(tx.s.streams[key], e)
+	if len(entries) > maxLen {
+		entries = entries[len(entries)-maxLen:]
+	}
+	tx.s.streams[key] = entries
+	return nil
+}
+
+// Publish delivers message to the channel's subscribers.
+func (tx *Tx) Publish(channel, message string) {
+	if tx.s.mute > 0 {
+		tx.s.mute--
+		return
+	}
+	for _, c := range tx.s.conns {
+		if c.channel == channel {
+			_ = c.send(fmt.Sprintf("*3\r\n$7\r\nmessage\r\n$%d\r\n%s\r\n$%d\r\n%s\r\n", len(channel), channel, len(message), message))
+		}
+	}
+}
+
+func (s *Server) serve(c *conn) {
+	rd := bufio.NewReader(c)
+	for {
+		req, err := redis.ReadReply(rd)
+		if err != nil {
+			_ = c.Close()
+			return
+		}
+		items, _ := req.([]any)
+		if len(items) == 0 {
+			_ = c.Close()
+			return
+		}
+		args := make([]string, len(items))
+		for i, item := range items {
+			args[i], _ = item.(string)
+		}
+		args[0] = strings.ToUpper(args[0])
+		if err := c.send(s.reply(c, args)); err != nil {
+			return
+		}
+	}
+}
+
+// reply answers one command from c.
+func (s *Server) reply(c *conn, args []string) string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.commands = append(s.commands, args)
+	var b strings.Builder
+	switch args[0] {
+	case "PING":
+		if c.channel != "" {
+			b.WriteString("*2\r\n$4\r\npong\r\n$0\r\n\r\n")
+		} else {
+			b.WriteString("+PONG\r\n")
+		}
+	case "AUTH", "SELECT":
+		if args[len(args)-1] == "wrong" {
+			b.WriteString("-WRONGPASS invalid password\r\n")
+		} else {
+			b.WriteString("+OK\r\n")
+		}
+	case "SET":
+		if _, ok := s.values[args[1]]; ok && slices.Contains(args[3:], "NX") {
+			b.WriteString("$-1\r\n")
+			break
+		}
+		s.values[args[1]], _ = strconv.ParseInt(args[2], 10, 64)
+		b.WriteString("+OK\r\n")
+	case "DEL":
+		delete(s.values, args[1])
+		b.WriteString(":1\r\n")
+	case "SUBSCRIBE":
+		c.channel = args[1]
+		fmt.Fprintf(&b, "*3\r\n$9\r\nsubscribe\r\n$%d\r\n%s\r\n:1\r\n", len(args[1]), args[1])
+	case "EVAL":
+		fn := s.scripts[args[1]]
+		nkeys, _ := strconv.Atoi(args[2])
+		if fn == nil || len(args) < 3+nkeys {
+			s.t.Errorf("EVAL of an unknown script or bad key count: %q", args[2:])
+			b.WriteString("-ERR bad script call\r\n")
+			break
+		}
+		reply, err := fn(&Tx{s}, args[3:3+nkeys], args[3+nkeys:])
+		if err != nil {
+			fmt.Fprintf(&b, "-%s\r\n", err)
+			break
+		}
+		switch v := reply.(type) {
+		case int64:
+			fmt.Fprintf(&b, ":%d\r\n", v)
+		case string:
+			fmt.Fprintf(&b, "$%d\r\n%s\r\n", len(v), v)
+		default:
+			b.WriteString("$-1\r\n")
+		}
+	case "XRANGE":
+		start, _ := strconv.ParseInt(args[2], 10, 64)
+		count, _ := strconv.Atoi(args[5])
+		var out []Entry
+		for _, e := range s.streams[args[1]] {
+			if e.ID >= start && len(out) < count {
+				out = append(out, e)
+			}
+		}
+		writeEntries(&b, out)
+	case "XREVRANGE":
+		end := int64(1<<63 - 1)
+		if args[2] != "+" {
+			end, _ = strconv.ParseInt(args[2], 10, 64)
+		}
+		count, _ := strconv.Atoi(args[5])
+		entries := s.streams[args[1]]
+		var out []Entry
+		for i := len(entries) - 1; i >= 0 && len(out) < count; i-- {
+			if entries[i].ID <= end {
+				out = append(out, entries[i])
+			}
+		}
+		writeEntries(&b, out)
+	default:
+		fmt.Fprintf(&b, "-ERR unknown command '%s'\r\n", args[0])
+	}
+	return b.String()
+}
+
+func writeEntries(b *strings.Builder, entries []Entry) {
+	fmt.Fprintf(b, "*%d\r\n", len(entries))
+	for _, e := range entries {
+		id := strconv.FormatInt(e.ID, 10) + "-0"
+		fmt.Fprintf(b, "*2\r\n$%d\r\n%s\r\n*2\r\n$5\r\nevent\r\n$%d\r\n%s\r\n", len(id), id, len(e.Event), e.Event)
+	}
+}
@@ -0,0 +1,243 @@
+// Package ruleexpr compiles the condition language of event rules' "when"
+// field into predicates over a payload and its labels.
+package ruleexpr
+
+import (
+	"errors"
+	"fmt"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+)
+
+// Expr is a compiled rule condition. field returns a payload field as a
+// string; labels are those added by earlier rules.
+type Expr func(field func(string) string, labels []string) bool
+
+// Compile compiles the condition language of rules' "when":
+//
+//	msgType == "image" && !(fromUser in ["bot1", "bot2"])
+//	text contains "refund" || labels contains "vip"
+//
+// Operands are payload fields (fromUser, text, msgType, event, agent,
+// channel, ...) or labels; operators are ==, !=, contains (case-insensitive),
+// startsWith, endsWith, matches (Go regexp) and in [...], combined with &&,
+// || and !. A bare field is true when it is not empty.
+func Compile(src string) (Expr, error) {
+	p := &ruleExprParser{}
+	if err := p.tokenize(src); err != nil {
+		return nil, err
+	}
+	expr, err := p.parseOr()
+	if err != nil {
+		return nil, err
+	}
+	if p.pos < len(p.tokens) {
+		return nil, fmt.Errorf("unexpected %q", p.tokens[p.pos])
+	}
+	return expr, nil
+}
+
+type ruleExprParser struct {
+	tokens []string
+	pos    int
+}
+
+// tokenize splits src into identifiers, quoted strings (kept with their
+// quotes) and punctuation.
+func (p *ruleExprParser) tokenize(src string) error {
+	for i := 0; i < len(src); {
+		c := src[i]
+		switch {
+		case c == ' ' || c == '\t' || c == '\n':
+			i++
+		case c == '"':
+			j := i + 1
+			for j < len(src) && src[j] != '"' {
+				if src[j] == '\\' {
+					j++
+				}
+				j++
+			}
+			if j >= len(src) {
+				return errors.New("unterminated string")
+			}
+			p.tokens = append(p.tokens, src[i:j+1])
+			i = j + 1
+		case strings.HasPrefix(src[i:], "&&"), strings.HasPrefix(src[i:], "||"), strings.HasPrefix(src[i:], "=="), strings.HasPrefix(src[i:], "!="):
+			p.tokens = append(p.tokens, src[i:i+2])
+			i += 2
+		case strings.ContainsRune("()[],!", rune(c)):
+			p.tokens = append(p.tokens, src[i:i+1])
+			i++
+		case c == '_' || c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z':
+			j := i
+			for j < len(src) && (src[j] == '_' || src[j] == '.' || src[j] >= 'a' && src[j] <= 'z' || src[j] >= 'A' && src[j] <= 'Z' || src[j] >= '0' && src[j] <= '9') {
+				j++
+			}
+			p.tokens = append(p.tokens, src[i:j])
+			i = j
+		default:
+			return fmt.Errorf("unexpected %q", c)
+		}
+	}
+	if len(p.tokens) == 0 {
+		return errors.New("empty expression")
+	}
+	return nil
+}
+
+func (p *ruleExprParser) peek() string {
+	if p.pos < len(p.tokens) {
+		return p.tokens[p.pos]
+	}
+	return ""
+}
+
+func (p *ruleExprParser) next() string {
+	tok := p.peek()
+	if tok != "" {
+		p.pos++
+	}
+	return tok
+}
+
+func (p *ruleExprParser) parseOr() (Expr, error) {
+	left, err := p.parseAnd()
+	if err != nil {
+		return nil, err
+	}
+	for p.peek() == "||" {
+		p.next()
+		right, err := p.parseAnd()
+		if err != nil {
+			return nil, err
+		}
+		l := left
+		left = func(f func(string) string, labels []string) bool { return l(f, labels) || right(f, labels) }
+	}
+	return left, nil
+}
+
+func (p *ruleExprParser) parseAnd() (Expr, error) {
+	left, err := p.parseUnary()
+	if err != nil {
+		return nil, err
+	}
+	for p.peek() == "&&" {
+		p.next()
+		right, err := p.parseUnary()
+		if err != nil {
+			return nil, err
+		}
+		l := left
+		left = func(f func(string) string, labels []string) bool { return l(f, labels) && right(f, labels) }
+	}
+	return left, nil
+}
+
+func (p *ruleExprParser) parseUnary() (Expr, error) {
+	switch p.peek() {
+	case "!":
+		p.next()
+		inner, err := p.parseUnary()
+		if err != nil {
+			return nil, err
+		}
+		return func(f func(string) string, labels []string) bool { return !inner(f, labels) }, nil
+	case "(":
+		p.next()
+		inner, err := p.parseOr()
+		if err != nil {
+			return nil, err
+		}
+		if p.next() != ")" {
+			return nil, errors.New("missing )")
+		}
+		return inner, nil
+	}
+	return p.parseCondition()
+}
+
+func (p *ruleExprParser) parseString() (string, error) {
+	tok := p.next()
+	if !strings.HasPrefix(tok, `"`) {
+		return "", fmt.Errorf("expected string, got %q", tok)
+	}
+	return strconv.Unquote(tok)
+}
+
+func (p *ruleExprParser) parseCondition() (Expr, error) {
+	name := p.next()
+	if name == "" || !(name[0] == '_' || name[0] >= 'a' && name[0] <= 'z' || name[0] >= 'A' && name[0] <= 'Z') {
+		return nil, fmt.Errorf("expected field, got %q", name)
+	}
+	// values returns the operand: the labels, or the field as one value.
+	values := func(f func(string) string, labels []string) []string {
+		if name == "labels" {
+			return labels
+		}
+		return []string{f(name)}
+	}
+	var test func(v string) bool
+	switch op := p.peek(); op {
+	case "==", "!=", "contains", "startsWith", "endsWith", "matches":
+		p.next()
+		want, err := p.parseString()
+		if err != nil {
+			return nil, err
+		}
+		switch op {
+		case "==":
+			test = func(v string) bool { return v == want }
+		case "!=":
+			// != holds when no value equals want.
+			return func(f func(string) string, labels []string) bool {
+				return !slices.Contains(values(f, labels), want)
+			}, nil
+		case "contains":
+			lower := strings.ToLower(want)
+			if name == "labels" {
+				test = func(v string) bool { return strings.EqualFold(v, want) }
+			} else {
+				test = func(v string) bool { return strings.Contains(strings.ToLower(v), lower) }
+			}
+		case "startsWith":
+			test = func(v string) bool { return strings.HasPrefix(v, want) }
+		case "endsWith":
+			test = func(v string) bool { return strings.HasSuffix(v, want) }
+		case "matches":
+			re, err := regexp.Compile(want)
+			if err != nil {
+				return nil, err
+			}
+			test = re.MatchString
+		}
+	case "in":
+		p.next()
+		if p.next() != "[" {
+			return nil, errors.New("expected [ after in")
+		}
+		var list []string
+		for p.peek() != "]" {
+			s, err := p.parseString()
+			if err != nil {
+				return nil, err
+			}
+			list = append(list, s)
+			if p.peek() == "," {
+				p.next()
+			} else if p.peek() != "]" {
+				return nil, errors.New("expected , or ]")
+			}
+		}
+		p.next()
+		test = func(v string) bool { return slices.Contains(list, v) }
+	default:
+		test = func(v string) bool { return v != "" }
+	}
+	return func(f func(string) string, labels []string) bool {
+		return slices.ContainsFunc(values(f, labels), test)
+	}, nil
+}
@@ -0,0 +1,85 @@
+package ruleexpr
+
+import (
+	"testing"
+)
+
+func TestCompileEval(t *testing.T) {
+	fields := map[string]string{
+		"msgType":  "text",
+		"fromUser": "alice",
+		"text":     `Need a Refund "now"`,
+	}
+	field := func(name string) string { return fields[name] }
+	labels := []string{"vip"}
+	for src, want := range map[string]bool{
+		`msgType == "text"`:                  true,
+		`msgType != "text"`:                  false,
+		`msgType`:                            true,
+		`agent`:                              false,
+		`!!agent`:                            false,
+		`kfMessage.origin`:                   false,
+		`fromUser in ["bob", "alice"]`:       true,
+		`fromUser in ["bob",]`:               false,
+		`fromUser in []`:                     false,
+		`!(fromUser in ["bob"])`:             true,
+		`!msgType == "text"`:                 false,
+		`text contains "REFUND"`:             true,
+		`text contains "退款"`:                 false,
+		`text contains "\"now\""`:            true,
+		`text startsWith "Need"`:             true,
+		`text startsWith "need"`:             false,
+		`text endsWith "now\""`:              true,
+		`text matches "(?i)refund\\s"`:       true,
+		`text matches "^Refund"`:             false,
+		`labels`:                             true,
+		`labels == "vip"`:                    true,
+		`labels != "vip"`:                    false,
+		`labels contains "VIP"`:              true,
+		`labels contains "vi"`:               false,
+		`labels in ["a", "vip"]`:             true,
+		"msgType == \"text\"\n\t&& fromUser": true,
+		// && binds tighter than ||.
+		`fromUser == "alice" || msgType == "image" && fromUser == "bob"`:       true,
+		`(fromUser == "alice" || msgType == "image") && fromUser == "bob"`:     false,
+		`msgType == "image" && fromUser == "alice" || labels contains "vip"`:   true,
+		`msgType == "image" && (fromUser == "alice" || labels contains "vip")`: false,
+		`!(msgType == "image" || fromUser == "bob") && text`:                   true,
+	} {
+		expr, err := Compile(src)
+		if err != nil {
+			t.Errorf("%s: %v", src, err)
+			continue
+		}
+		if got := expr(field, labels); got != want {
+			t.Errorf("%s: got %v, want %v", src, got, want)
+		}
+	}
+}
+
+func TestCompileErrors(t *testing.T) {
+	for src, want := range map[string]string{
+		``:                         "empty expression",
+		`   `:                      "empty expression",
+		`msgType ==`:               `expected string, got ""`,
+		`msgType == text`:          `expected string, got "text"`,
+		`"text"`:                   `expected field, got "\"text\""`,
+		`(msgType == "a"`:          "missing )",
+		`msgType == "a")`:          `unexpected ")"`,
+		`msgType == "a`:            "unterminated string",
+		`msgType == "a\"`:          "unterminated string",
+		`msgType = "a"`:            `unexpected '='`,
+		`msgType == "a" &&`:        `expected field, got ""`,
+		`msgType == "a" fromUser`:  `unexpected "fromUser"`,
+		`fromUser in "a"`:          "expected [ after in",
+		`fromUser in ["a" "b"]`:    "expected , or ]",
+		`fromUser in ["a"`:         "expected , or ]",
+		`text matches "("`:         "error parsing regexp: missing closing ): `(`",
+		`msgType == "\q"`:          "invalid syntax",
+		`msgType == "a" # comment`: `unexpected '#'`,
+	} {
+		if _, err := Compile(src); err == nil || err.Error() != want {
+			t.Errorf("%q: got %v, want %s", src, err, want)
+		}
+	}
+}
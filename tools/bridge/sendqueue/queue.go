@@ -0,0 +1,293 @@
+// Package sendqueue holds the bridge's asynchronous /proxy/send requests
+// and retries them with backoff. Every state change of a job is appended to
+// a JSONL file, so pending sends and recent delivery states survive
+// restarts.
+package sendqueue
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/Tennen/Paimon/tools/bridge/atomicfile"
+	"github.com/Tennen/Paimon/tools/bridge/config"
+)
+
+// Job is one asynchronous /proxy/send request. AccessToken is only set
+// when the caller passed one; otherwise each attempt uses the managed token
+// of the message's agentid.
+type Job struct {
+	ID             string          `json:"id"`
+	IdempotencyKey string          `json:"idempotencyKey,omitempty"`
+	Requester      string          `json:"requester"`
+	AccessToken    string          `json:"accessToken,omitempty"`
+	Message        json.RawMessage `json:"message"`
+	TimeoutMS      int             `json:"timeoutMs,omitempty"`
+	SkipQuota      bool            `json:"skipQuota,omitempty"`
+	Status         string          `json:"status"`
+	Attempts       int             `json:"attempts"`
+	MsgID          string          `json:"msgid,omitempty"`
+	ErrCode        int             `json:"errcode,omitempty"`
+	LastError      string          `json:"lastError,omitempty"`
+	CreatedAt      time.Time       `json:"createdAt"`
+	UpdatedAt      time.Time       `json:"updatedAt"`
+	NextAttemptAt  time.Time       `json:"nextAttemptAt,omitzero"`
+}
+
+// compactLines is the file length past which update rewrites the file,
+// once most of its lines are superseded.
+const compactLines = 1000
+
+// Send job states; sent, failed and unknown are final. A job is sending
+// while an attempt is in flight, and unknown when the attempt may have
+// reached WeCom without an answer, so retrying it could send it twice.
+const (
+	Queued   = "queued"
+	Retrying = "retrying"
+	Sending  = "sending"
+	Sent     = "sent"
+	Failed   = "failed"
+	Unknown  = "unknown"
+)
+
+// Queue holds asynchronous sends. Finished jobs are kept for
+// SendQueueKeep so their status and idempotency keys stay valid.
+type Queue struct {
+	mu    sync.Mutex
+	path  string
+	file  *os.File
+	lines int
+	jobs  map[string]*Job
+	// keys maps requester + "\x00" + idempotency key to a job ID.
+	keys map[string]string
+	wake chan struct{}
+
+	maxJobs     int
+	maxAttempts int
+	retryBase   time.Duration
+	retryMax    time.Duration
+	keep        time.Duration
+}
+
+// New returns an in-memory queue configured by cfg's SendQueue settings.
+func New(cfg config.Config) *Queue {
+	return &Queue{
+		jobs:        make(map[string]*Job),
+		keys:        make(map[string]string),
+		wake:        make(chan struct{}, 1),
+		maxJobs:     cfg.SendQueueMax,
+		maxAttempts: cfg.SendQueueMaxAttempts,
+		retryBase:   cfg.SendQueueRetryBase,
+		retryMax:    cfg.SendQueueRetryMax,
+		keep:        cfg.SendQueueKeep,
+	}
+}
+
+// Open replays an existing queue file, the last line of each job winning,
+// and keeps it open for appending. An empty path disables persistence.
+func (q *Queue) Open(path string) error {
+	if path == "" {
+		return nil
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+		return err
+	}
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_RDWR|os.O_APPEND, 0o600)
+	if err != nil {
+		return err
+	}
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(make([]byte, 64*1024), 4*1024*1024)
+	for scanner.Scan() {
+		var job Job
+		if err := json.Unmarshal(scanner.Bytes(), &job); err != nil || job.ID == "" {
+			continue
+		}
+		q.lines++
+		if job.Status == Sending {
+			// The previous process stopped during this attempt.
+			job.Status, job.LastError, job.NextAttemptAt = Unknown, "interrupted by a restart", time.Time{}
+		}
+		q.jobs[job.ID] = &job
+		if job.IdempotencyKey != "" {
+			q.keys[job.Requester+"\x00"+job.IdempotencyKey] = job.ID
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		_ = f.Close()
+		return err
+	}
+	q.path = path
+	q.file = f
+	return nil
+}
+
+// Enqueue durably adds job, or returns the existing job and false when the
+// requester already used its idempotency key.
+func (q *Queue) Enqueue(job *Job) (Job, bool, error) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	key := job.Requester + "\x00" + job.IdempotencyKey
+	if job.IdempotencyKey != "" {
+		if id, ok := q.keys[key]; ok {
+			if existing, ok := q.jobs[id]; ok {
+				return *existing, false, nil
+			}
+		}
+	}
+	pending := 0
+	for _, j := range q.jobs {
+		if j.Status == Queued || j.Status == Retrying || j.Status == Sending {
+			pending++
+		}
+	}
+	if q.maxJobs > 0 && pending >= q.maxJobs {
+		return Job{}, false, ErrFull
+	}
+	if err := q.writeLocked(job); err != nil {
+		return Job{}, false, err
+	}
+	if q.file != nil {
+		if err := q.file.Sync(); err != nil {
+			return Job{}, false, err
+		}
+	}
+	q.jobs[job.ID] = job
+	if job.IdempotencyKey != "" {
+		q.keys[key] = job.ID
+	}
+	select {
+	case q.wake <- struct{}{}:
+	default:
+	}
+	return *job, true, nil
+}
+
+// ErrFull is returned by Enqueue when SendQueueMax jobs are pending.
+var ErrFull = errors.New("send queue full")
+
+// Get returns a copy of the job with id.
+func (q *Queue) Get(id string) (Job, bool) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	job, ok := q.jobs[id]
+	if !ok {
+		return Job{}, false
+	}
+	return *job, true
+}
+
+// due returns copies of the jobs whose next attempt is due, oldest first.
+func (q *Queue) due(now time.Time) []Job {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	var out []Job
+	for _, job := range q.jobs {
+		if (job.Status == Queued || job.Status == Retrying) && !job.NextAttemptAt.After(now) {
+			out = append(out, *job)
+		}
+	}
+	sort.Slice(out, func(i, j int) bool { return out[i].CreatedAt.Before(out[j].CreatedAt) })
+	return out
+}
+
+// update records a job's new state. The marker is not synced: after a
+// machine crash the job is at worst sent again.
+func (q *Queue) update(job Job) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if _, ok := q.jobs[job.ID]; !ok {
+		return
+	}
+	q.jobs[job.ID] = &job
+	if err := q.writeLocked(&job); err != nil {
+		slog.Error("send queue write failed", "err", err)
+		return
+	}
+	if q.lines >= compactLines && q.lines >= 2*len(q.jobs) {
+		if err := q.compactLocked(); err != nil {
+			slog.Error("send queue compact failed", "err", err)
+		}
+	}
+}
+
+// prune drops finished jobs older than the keep period.
+func (q *Queue) prune(now time.Time) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	removed := 0
+	for id, job := range q.jobs {
+		if (job.Status == Sent || job.Status == Failed || job.Status == Unknown) && now.Sub(job.UpdatedAt) > q.keep {
+			delete(q.jobs, id)
+			delete(q.keys, job.Requester+"\x00"+job.IdempotencyKey)
+			removed++
+		}
+	}
+	if removed > 0 && q.file != nil {
+		if err := q.compactLocked(); err != nil {
+			slog.Error("send queue compact failed", "err", err)
+		}
+	}
+}
+
+// next returns when the earliest pending job is due, or the zero time.
+func (q *Queue) next() time.Time {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	var next time.Time
+	for _, job := range q.jobs {
+		if (job.Status == Queued || job.Status == Retrying) && (next.IsZero() || job.NextAttemptAt.Before(next)) {
+			next = job.NextAttemptAt
+		}
+	}
+	return next
+}
+
+// writeLocked appends one job state to the file. The caller holds q.mu.
+func (q *Queue) writeLocked(job *Job) error {
+	if q.file == nil {
+		return nil
+	}
+	line, err := json.Marshal(job)
+	if err != nil {
+		return err
+	}
+	if _, err := q.file.Write(append(line, '\n')); err != nil {
+		return err
+	}
+	q.lines++
+	return nil
+}
+
+// compactLocked atomically rewrites the file with one line per job. The
+// caller holds q.mu.
+func (q *Queue) compactLocked() error {
+	var buf bytes.Buffer
+	for _, job := range q.jobs {
+		line, err := json.Marshal(job)
+		if err != nil {
+			return err
+		}
+		buf.Write(append(line, '\n'))
+	}
+	if err := atomicfile.Write(q.path, buf.Bytes()); err != nil {
+		return err
+	}
+	f, err := os.OpenFile(q.path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0o600)
+	if err != nil {
+		return err
+	}
+	_ = q.file.Close()
+	q.file = f
+	q.lines = len(q.jobs)
+	return nil
+}
@@ -0,0 +1,78 @@
+package sendqueue
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/Tennen/Paimon/tools/bridge/config"
+	"github.com/Tennen/Paimon/tools/bridge/metrics"
+)
+
+func TestSettle(t *testing.T) {
+	q := New(config.Config{SendQueueMaxAttempts: 3, SendQueueRetryBase: time.Second, SendQueueRetryMax: 3 * time.Second})
+	metrics := metrics.New()
+	now := time.Now().UTC()
+	retry := Outcome{ErrCode: 45009, Err: "api freq out of limit"}
+	for _, tc := range []struct {
+		name     string
+		attempts int
+		out      Outcome
+		status   string
+		next     time.Duration
+	}{
+		{"sent", 0, Outcome{Sent: true, MsgID: "m1"}, Sent, 0},
+		{"first retry", 0, retry, Retrying, time.Second},
+		{"backoff doubles", 1, retry, Retrying, 2 * time.Second},
+		{"out of attempts", 2, retry, Failed, 0},
+		{"final", 0, Outcome{ErrCode: 40003, Err: "invalid userid", Final: true}, Failed, 0},
+		{"no answer", 0, Outcome{Err: "send http 504", NoAnswer: true}, Unknown, 0},
+	} {
+		job := q.settle(Job{ID: tc.name, Status: Sending, Attempts: tc.attempts, ErrCode: 1, LastError: "before"}, tc.out, now, metrics)
+		if job.Status != tc.status || job.Attempts != tc.attempts+1 || !job.UpdatedAt.Equal(now) {
+			t.Errorf("%s: %+v", tc.name, job)
+		}
+		if next := job.NextAttemptAt.Sub(now); tc.next != 0 && next != tc.next || tc.next == 0 && !job.NextAttemptAt.IsZero() {
+			t.Errorf("%s: next attempt in %s", tc.name, next)
+		}
+		if job.Status == Sent && (job.MsgID != "m1" || job.ErrCode != 0 || job.LastError != "") || job.Status != Sent && (job.ErrCode != tc.out.ErrCode || job.LastError != tc.out.Err) {
+			t.Errorf("%s: %+v", tc.name, job)
+		}
+	}
+	q = New(config.Config{SendQueueMaxAttempts: 10, SendQueueRetryBase: time.Second, SendQueueRetryMax: 3 * time.Second})
+	if job := q.settle(Job{Attempts: 4}, retry, now, metrics); job.NextAttemptAt.Sub(now) != 3*time.Second {
+		t.Errorf("backoff %s, want the 3s cap", job.NextAttemptAt.Sub(now))
+	}
+	var out strings.Builder
+	metrics.WriteText(&out)
+	if !strings.Contains(out.String(), `wecom_bridge_send_queue_total{result="unknown"} 1`) || !strings.Contains(out.String(), `wecom_bridge_send_queue_total{result="failed"} 2`) {
+		t.Fatal(out.String())
+	}
+}
+
+func TestOpenInterrupted(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "jsonl")
+	lines := `{"id":"a","requester":"test","message":{},"status":"queued","attempts":0}
+{"id":"a","requester":"test","message":{},"status":"sending","attempts":0}
+{"id":"b","requester":"test","message":{},"status":"sending","attempts":1}
+{"id":"b","requester":"test","message":{},"status":"sent","attempts":1,"msgid":"m1"}
+`
+	if err := os.WriteFile(path, []byte(lines), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	q := New(config.Config{})
+	if err := q.Open(path); err != nil {
+		t.Fatal(err)
+	}
+	if a, _ := q.Get("a"); a.Status != Unknown || a.LastError != "interrupted by a restart" {
+		t.Fatalf("a: %+v", a)
+	}
+	if b, _ := q.Get("b"); b.Status != Sent {
+		t.Fatalf("b: %+v", b)
+	}
+	if due := q.due(time.Now()); len(due) != 0 {
+		t.Fatalf("due %v", due)
+	}
+}
@@ -0,0 +1,125 @@
+package sendqueue
+
+import (
+	"log/slog"
+	"time"
+
+	"github.com/Tennen/Paimon/tools/bridge/metrics"
+)
+
+// Outcome is the result of one delivery attempt.
+type Outcome struct {
+	// Sent is set when WeCom accepted the message as MsgID.
+	Sent    bool
+	MsgID   string
+	ErrCode int
+	Err     string
+	// Final is set when retrying cannot help, e.g. an invalid recipient.
+	Final bool
+	// NoAnswer is set when the send got no answer from WeCom (a timeout, a
+	// dropped connection or an HTTP error), so it may have been delivered.
+	NoAnswer bool
+}
+
+// Sender makes one delivery attempt of job.
+type Sender func(job Job) Outcome
+
+// Run delivers due jobs one at a time, in order, until closing is closed.
+// Jobs still pending then are resumed by the next start.
+func (q *Queue) Run(closing <-chan struct{}, send Sender, metrics *metrics.Registry) {
+	prune := time.NewTicker(time.Minute)
+	defer prune.Stop()
+	for {
+		for _, job := range q.due(time.Now()) {
+			select {
+			case <-closing:
+				return
+			default:
+			}
+			job.Status = Sending
+			q.update(job)
+			q.update(q.settle(job, send(job), time.Now().UTC(), metrics))
+		}
+		wait := time.Minute
+		if next := q.next(); !next.IsZero() {
+			wait = max(time.Until(next), 0)
+		}
+		timer := time.NewTimer(wait)
+		select {
+		case <-closing:
+			timer.Stop()
+			return
+		case <-q.wake:
+		case <-timer.C:
+		case now := <-prune.C:
+			q.prune(now)
+		}
+		timer.Stop()
+	}
+}
+
+// settle returns job's state after an attempt with outcome out. Failures are
+// retried with exponential backoff up to maxAttempts unless they are final;
+// a send without an answer is unknown and never retried, as retrying it
+// could deliver it twice.
+func (q *Queue) settle(job Job, out Outcome, now time.Time, metrics *metrics.Registry) Job {
+	job.Attempts++
+	job.UpdatedAt = now
+	if out.Sent {
+		job.Status, job.MsgID, job.ErrCode, job.LastError = Sent, out.MsgID, 0, ""
+		job.NextAttemptAt = time.Time{}
+		metrics.Inc("wecom_bridge_send_queue_total", "result", "sent")
+		return job
+	}
+	job.ErrCode, job.LastError = out.ErrCode, out.Err
+	if out.NoAnswer {
+		job.Status = Unknown
+		job.NextAttemptAt = time.Time{}
+		metrics.Inc("wecom_bridge_send_queue_total", "result", "unknown")
+		slog.Warn("queued send outcome unknown, not retried", "id", job.ID, "attempts", job.Attempts, "err", job.LastError)
+		return job
+	}
+	if out.Final || job.Attempts >= q.maxAttempts {
+		job.Status = Failed
+		job.NextAttemptAt = time.Time{}
+		metrics.Inc("wecom_bridge_send_queue_total", "result", "failed")
+		slog.Warn("queued send failed", "id", job.ID, "attempts", job.Attempts, "errcode", job.ErrCode, "err", job.LastError)
+		return job
+	}
+	backoff := q.retryBase << min(job.Attempts-1, 20)
+	if backoff <= 0 || backoff > q.retryMax {
+		backoff = q.retryMax
+	}
+	job.Status = Retrying
+	job.NextAttemptAt = now.Add(backoff)
+	metrics.Inc("wecom_bridge_send_queue_total", "result", "retry")
+	slog.Info("queued send retrying", "id", job.ID, "attempt", job.Attempts, "errcode", job.ErrCode, "backoff", backoff.String())
+	return job
+}
+
+// Report is the job as reported to callers, without token or message.
+func (j Job) Report() map[string]any {
+	out := map[string]any{
+		"id":        j.ID,
+		"status":    j.Status,
+		"attempts":  j.Attempts,
+		"createdAt": j.CreatedAt,
+		"updatedAt": j.UpdatedAt,
+	}
+	if j.IdempotencyKey != "" {
+		out["idempotencyKey"] = j.IdempotencyKey
+	}
+	if j.MsgID != "" {
+		out["msgid"] = j.MsgID
+	}
+	if j.ErrCode != 0 {
+		out["errcode"] = j.ErrCode
+	}
+	if j.LastError != "" {
+		out["lastError"] = j.LastError
+	}
+	if !j.NextAttemptAt.IsZero() {
+		out["nextAttemptAt"] = j.NextAttemptAt
+	}
+	return out
+}
@@ -0,0 +1,251 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/Tennen/Paimon/tools/bridge/config"
+	"github.com/Tennen/Paimon/tools/bridge/hub"
+	"github.com/Tennen/Paimon/tools/bridge/metrics"
+)
+
+// handleAdminConfig reads (GET) or updates (POST/PATCH with a partial JSON
+// object) the runtime tunables. With ?persist=true the result is written to
+// the tunables file and survives restarts.
+func handleAdminConfig(w http.ResponseWriter, r *http.Request, cfg config.Config, state *bridgeState) {
+	if !checkAdminAuth(w, r, cfg) {
+		return
+	}
+	switch r.Method {
+	case http.MethodGet:
+	case http.MethodPost, http.MethodPatch:
+		body, err := readBody(r)
+		if err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			_, _ = w.Write([]byte("missing body"))
+			return
+		}
+		// One update at a time, so concurrent patches and persists do not
+		// overwrite each other's fields.
+		state.tunablesUpdateMu.Lock()
+		defer state.tunablesUpdateMu.Unlock()
+		next := state.currentTunables()
+		if err := json.Unmarshal(body, &next); err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			_, _ = w.Write([]byte("invalid json"))
+			return
+		}
+		if err := state.applyTunables(next); err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			_, _ = w.Write([]byte(err.Error()))
+			return
+		}
+		slog.InfoContext(r.Context(), "admin config updated", "tunables", state.currentTunables())
+		if r.URL.Query().Get("persist") == "true" {
+			if err := state.saveTunables(cfg.TunablesFile); err != nil {
+				w.WriteHeader(http.StatusInternalServerError)
+				_, _ = w.Write([]byte(fmt.Sprintf("persist failed: %v", err)))
+				return
+			}
+		}
+	default:
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(state.currentTunables())
+}
+
+// clientStatus describes a connected stream consumer for /admin/clients.
+type clientStatus struct {
+	ID          string    `json:"id"`
+	Identity    string    `json:"identity"`
+	Path        string    `json:"path"`
+	RemoteAddr  string    `json:"remoteAddr"`
+	UserAgent   string    `json:"userAgent,omitempty"`
+	Topics      []string  `json:"topics,omitempty"`
+	Agents      []string  `json:"agents,omitempty"`
+	FromUsers   []string  `json:"fromUsers,omitempty"`
+	MsgTypes    []string  `json:"msgTypes,omitempty"`
+	ConnectedAt time.Time `json:"connectedAt"`
+	LastEventID int64     `json:"lastEventId"`
+	Delivered   int64     `json:"delivered"`
+	Dropped     int64     `json:"dropped"`
+	Queued      int       `json:"queued"`
+}
+
+// handleAdminClients lists connected /stream and /replication/stream
+// clients (GET /admin/clients) or force-disconnects one (DELETE
+// /admin/clients/{id}); a disconnected client may reconnect with
+// Last-Event-ID.
+func handleAdminClients(w http.ResponseWriter, r *http.Request, cfg config.Config, state *bridgeState) {
+	if !checkAdminAuth(w, r, cfg) {
+		return
+	}
+	id := strings.TrimPrefix(strings.TrimPrefix(r.URL.Path, "/admin/clients"), "/")
+	switch {
+	case r.Method == http.MethodGet && id == "":
+		w.Header().Set("Content-Type", "application/json")
+		_ = json.NewEncoder(w).Encode(map[string]any{"clients": state.clientStatuses()})
+	case r.Method == http.MethodDelete && id != "":
+		if !state.disconnectClient(id) {
+			w.WriteHeader(http.StatusNotFound)
+			_, _ = w.Write([]byte("unknown client"))
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		_ = json.NewEncoder(w).Encode(map[string]any{"ok": true, "id": id})
+	default:
+		w.WriteHeader(http.StatusMethodNotAllowed)
+	}
+}
+
+// clientStatuses returns the connected clients, oldest first.
+func (s *bridgeState) clientStatuses() []clientStatus {
+	statuses := make([]clientStatus, 0, s.clients.Count())
+	s.clients.Each(func(sub hub.Subscriber) bool {
+		c := sub.(*sseClient)
+		statuses = append(statuses, clientStatus{
+			ID:          c.id,
+			Identity:    c.identity,
+			Path:        c.path,
+			RemoteAddr:  c.remoteAddr,
+			UserAgent:   c.userAgent,
+			Topics:      c.filter.Topics,
+			Agents:      c.filter.Agents,
+			FromUsers:   c.filter.FromUsers,
+			MsgTypes:    c.filter.MsgTypes,
+			ConnectedAt: c.connectedAt,
+			LastEventID: c.lastEventID.Load(),
+			Delivered:   c.delivered.Load(),
+			Dropped:     c.dropped.Load(),
+			Queued:      len(c.ch),
+		})
+		return true
+	})
+	sort.Slice(statuses, func(i, j int) bool { return statuses[i].ConnectedAt.Before(statuses[j].ConnectedAt) })
+	return statuses
+}
+
+// disconnectClient ends the stream of the client with the given ID.
+func (s *bridgeState) disconnectClient(id string) bool {
+	found := false
+	s.clients.Each(func(sub hub.Subscriber) bool {
+		if c := sub.(*sseClient); c.id == id {
+			c.kickOnce.Do(func() { close(c.kick) })
+			found = true
+		}
+		return !found
+	})
+	return found
+}
+
+// handleAdminBuffer reports replay buffer occupancy and the event ID the
+// next broadcast will get.
+func handleAdminBuffer(w http.ResponseWriter, r *http.Request, cfg config.Config, state *bridgeState) {
+	if r.Method != http.MethodGet {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	if !checkAdminAuth(w, r, cfg) {
+		return
+	}
+	state.mu.Lock()
+	status := map[string]any{
+		"size":        len(state.buffer),
+		"capacity":    state.bufferCap,
+		"nextEventId": state.nextEventID,
+		"clients":     state.clients.Count(),
+	}
+	if n := len(state.buffer); n > 0 {
+		status["oldestEventId"] = state.buffer[0].ID
+		status["newestEventId"] = state.buffer[n-1].ID
+	}
+	state.mu.Unlock()
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(status)
+}
+
+// maxCallbackFailures bounds the rejected callbacks kept for inspection.
+const maxCallbackFailures = 100
+
+// callbackFailure is a WeCom callback rejected for a bad signature or a
+// payload that did not decrypt, usually a token or AES key mismatch.
+type callbackFailure struct {
+	Time       time.Time `json:"time"`
+	Kind       string    `json:"kind"`
+	Agent      string    `json:"agent,omitempty"`
+	Path       string    `json:"path"`
+	RemoteAddr string    `json:"remoteAddr"`
+	RequestID  string    `json:"requestId,omitempty"`
+	Detail     string    `json:"detail,omitempty"`
+}
+
+// callbackFailures keeps the most recent rejected callbacks; the zero value
+// is ready to use.
+type callbackFailures struct {
+	mu      sync.Mutex
+	entries []callbackFailure
+}
+
+func (f *callbackFailures) add(metrics *metrics.Registry, entry callbackFailure) {
+	metrics.Inc("wecom_bridge_callback_failures_total", "kind", entry.Kind)
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.entries = append(f.entries, entry)
+	if len(f.entries) > maxCallbackFailures {
+		f.entries = f.entries[len(f.entries)-maxCallbackFailures:]
+	}
+}
+
+// recent returns the kept failures, newest first.
+func (f *callbackFailures) recent() []callbackFailure {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	out := make([]callbackFailure, len(f.entries))
+	for i, entry := range f.entries {
+		out[len(out)-1-i] = entry
+	}
+	return out
+}
+
+// recordCallbackFailure keeps and logs a callback rejected by its handler.
+func (s *bridgeState) recordCallbackFailure(r *http.Request, agent, kind, detail string) {
+	s.addCallbackFailure(r.Context(), callbackFailure{
+		Kind:       kind,
+		Agent:      agent,
+		Path:       r.URL.Path,
+		RemoteAddr: r.RemoteAddr,
+		RequestID:  requestID(r.Context()),
+		Detail:     detail,
+	})
+}
+
+// addCallbackFailure records f, stamped with the current time. Callbacks
+// failing decryption in a worker no longer have their request.
+func (s *bridgeState) addCallbackFailure(ctx context.Context, f callbackFailure) {
+	f.Time = time.Now().UTC()
+	s.failures.add(s.metrics, f)
+	slog.WarnContext(ctx, "wecom callback rejected", "reason", f.Kind, "agent", f.Agent)
+}
+
+// handleAdminFailures lists recent callbacks rejected for a bad signature
+// or failed decryption, newest first.
+func handleAdminFailures(w http.ResponseWriter, r *http.Request, cfg config.Config, state *bridgeState) {
+	if r.Method != http.MethodGet {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	if !checkAdminAuth(w, r, cfg) {
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(map[string]any{"failures": state.failures.recent()})
+}
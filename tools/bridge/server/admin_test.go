@@ -0,0 +1,171 @@
+package server
+
+import (
+	"encoding/json"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/Tennen/Paimon/tools/bridge/config"
+	"github.com/Tennen/Paimon/tools/bridge/metrics"
+)
+
+func newTunablesState(cfg config.Config) *bridgeState {
+	state := &bridgeState{nextEventID: 1, bufferCap: cfg.MessageBufferCap, metrics: metrics.New(), quotas: newSendQuota(0, 0), cfg: cfg}
+	state.tunables = tunablesFromConfig(cfg)
+	return state
+}
+
+func adminConfigRequest(cfg config.Config, state *bridgeState, method, target, body string) *httptest.ResponseRecorder {
+	r := httptest.NewRequest(method, target, strings.NewReader(body))
+	if cfg.AdminToken != "" {
+		r.Header.Set("Authorization", "Bearer "+cfg.AdminToken)
+	}
+	w := httptest.NewRecorder()
+	handleAdminConfig(w, r, cfg, state)
+	return w
+}
+
+func TestAdminAuthFailsClosedWithoutTokens(t *testing.T) {
+	cfg := config.Config{MessageBufferCap: 10, StreamClientBuffer: 16, StreamDropPolicy: "drop-newest"}
+	w := adminConfigRequest(cfg, newTunablesState(cfg), http.MethodGet, "/admin/config", "")
+	if w.Code != http.StatusForbidden {
+		t.Fatalf("status %d", w.Code)
+	}
+	cfg.BridgeToken = "bridge"
+	r := httptest.NewRequest(http.MethodGet, "/admin/config", nil)
+	r.Header.Set("Authorization", "Bearer bridge")
+	w = httptest.NewRecorder()
+	handleAdminConfig(w, r, cfg, newTunablesState(cfg))
+	if w.Code != http.StatusOK {
+		t.Fatalf("bridge token: status %d", w.Code)
+	}
+}
+
+func TestAdminConfigTunables(t *testing.T) {
+	defer logLevel.Set(slog.LevelInfo)
+	send, _ := config.ParseRateLimit("10/m")
+	cfg := config.Config{
+		AdminToken:         "admin",
+		MessageBufferCap:   10,
+		StreamHeartbeat:    15 * time.Second,
+		StreamClientBuffer: 16,
+		StreamDropPolicy:   "drop-newest",
+		RateLimits:         map[string]config.RateLimit{"send": send},
+		TunablesFile:       filepath.Join(t.TempDir(), "tunables.json"),
+	}
+	state := newTunablesState(cfg)
+
+	var got runtimeTunables
+	w := adminConfigRequest(cfg, state, http.MethodGet, "/admin/config", "")
+	if err := json.Unmarshal(w.Body.Bytes(), &got); err != nil {
+		t.Fatal(err)
+	}
+	if got.StreamHeartbeat != "15s" || got.StreamClientBuffer != 16 || got.RateLimits["send"] != "10/m" || got.LogLevel != "info" {
+		t.Fatalf("%+v", got)
+	}
+
+	w = adminConfigRequest(cfg, state, http.MethodPatch, "/admin/config?persist=true",
+		`{"streamHeartbeat":"30s","streamDropPolicy":"drop-oldest","rateLimits":{"send":"","media":"5/s:20"},"logLevel":"debug"}`)
+	if w.Code != http.StatusOK {
+		t.Fatalf("status %d: %s", w.Code, w.Body)
+	}
+	live := state.config()
+	if live.StreamHeartbeat != 30*time.Second || live.StreamDropPolicy != "drop-oldest" || logLevel.Level() != slog.LevelDebug {
+		t.Fatalf("live config %v %s %s", live.StreamHeartbeat, live.StreamDropPolicy, logLevel.Level())
+	}
+	if _, ok := live.RateLimits["send"]; ok || live.RateLimits["media"].Burst != 20 {
+		t.Fatalf("rate limits %+v", live.RateLimits)
+	}
+	data, err := os.ReadFile(cfg.TunablesFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var saved runtimeTunables
+	if err := json.Unmarshal(data, &saved); err != nil {
+		t.Fatal(err)
+	}
+	if saved.StreamHeartbeat != "30s" || saved.RateLimits["media"] != "5/s:20" || len(saved.RateLimits) != 1 || saved.LogLevel != "debug" {
+		t.Fatalf("%+v", saved)
+	}
+
+	for _, body := range []string{
+		`{"streamHeartbeat":"soon"}`,
+		`{"streamClientBuffer":0}`,
+		`{"streamDropPolicy":"drop-all"}`,
+		`{"rateLimits":{"publish":"1/s"}}`,
+		`{"rateLimits":{"send":"1/d"}}`,
+		`{"logLevel":"loud"}`,
+	} {
+		if w := adminConfigRequest(cfg, state, http.MethodPatch, "/admin/config", body); w.Code != http.StatusBadRequest {
+			t.Errorf("%s: status %d", body, w.Code)
+		}
+	}
+	if state.config().StreamHeartbeat != 30*time.Second {
+		t.Fatal("rejected update applied")
+	}
+}
+
+func TestAdminConfigConcurrentPatches(t *testing.T) {
+	cfg := config.Config{AdminToken: "admin", MessageBufferCap: 10, StreamClientBuffer: 16, StreamDropPolicy: "drop-newest"}
+	state := newTunablesState(cfg)
+	var wg sync.WaitGroup
+	for i := range 20 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			class := config.RateClasses[i%len(config.RateClasses)]
+			adminConfigRequest(cfg, state, http.MethodPatch, "/admin/config", `{"rateLimits":{"`+class+`":"1/s"}}`)
+		}()
+	}
+	wg.Wait()
+	if got := state.currentTunables().RateLimits; len(got) != len(config.RateClasses) {
+		t.Fatalf("lost updates: %v", got)
+	}
+}
+
+func TestRateLimitString(t *testing.T) {
+	for _, text := range []string{"10/s", "60/m", "1/s:5", "100/h", "90/m:3"} {
+		limit, err := config.ParseRateLimit(text)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := limit.String(); got != text {
+			t.Errorf("%s formats as %s", text, got)
+		}
+	}
+}
+
+func TestBearerTokens(t *testing.T) {
+	cfg := config.Config{BridgeToken: "bridge", AdminToken: "admin", Tokens: []config.Token{{Name: "ci", Token: "ci-token", Scopes: []string{config.ScopeProxySend}}}}
+	for header, want := range map[string]string{
+		"":                "anonymous",
+		"Bearer ":         "anonymous",
+		"Bearer bridge":   "bridge",
+		"Bearer bridgeX":  "unknown",
+		"Bearer brid":     "unknown",
+		"bearer bridge":   "unknown",
+		"Bearer admin":    "admin",
+		"Bearer ci-token": "ci",
+	} {
+		r := httptest.NewRequest(http.MethodGet, "/", nil)
+		if header != "" {
+			r.Header.Set("Authorization", header)
+		}
+		if got := requesterIdentity(r, cfg); got != want {
+			t.Errorf("%q: identity %s, want %s", header, got, want)
+		}
+	}
+	// Unset tokens match nothing, not even an empty bearer.
+	r := httptest.NewRequest(http.MethodGet, "/", nil)
+	r.Header.Set("Authorization", "Bearer ")
+	if hasBearer(r, "") || bridgeAuthStatus(r, cfg, config.ScopeProxySend) != http.StatusUnauthorized {
+		t.Fatal("empty bearer admitted")
+	}
+}
@@ -0,0 +1,238 @@
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strconv"
+
+	"github.com/Tennen/Paimon/tools/bridge/config"
+	"github.com/Tennen/Paimon/tools/bridge/proxy"
+)
+
+func handleProxyMenuCreate(w http.ResponseWriter, r *http.Request, cfg config.Config, state *bridgeState) {
+	if r.Method != http.MethodPost {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	if !checkBridgeAuth(w, r, cfg, config.ScopeProxyApp) {
+		return
+	}
+
+	body, err := readBody(r)
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		_, _ = w.Write([]byte("missing body"))
+		return
+	}
+	var payload struct {
+		AccessToken string          `json:"access_token"`
+		AgentID     string          `json:"agentid"`
+		Menu        json.RawMessage `json:"menu"`
+		TimeoutMS   int             `json:"timeout_ms"`
+	}
+	if err := json.Unmarshal(body, &payload); err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		_, _ = w.Write([]byte("invalid json"))
+		return
+	}
+	payload.AgentID = firstNonEmpty(payload.AgentID, cfg.WeComAgentID)
+	if payload.AccessToken == "" {
+		payload.AccessToken = state.managedToken(payload.AgentID)
+	}
+	if payload.AccessToken == "" || payload.AgentID == "" || len(payload.Menu) == 0 {
+		w.WriteHeader(http.StatusBadRequest)
+		_, _ = w.Write([]byte("missing access_token/agentid/menu"))
+		return
+	}
+
+	endpoint := fmt.Sprintf(
+		"https://qyapi.weixin.qq.com/cgi-bin/menu/create?access_token=%s&agentid=%s",
+		url.QueryEscape(payload.AccessToken),
+		url.QueryEscape(payload.AgentID),
+	)
+	client := qyapiClient(proxyTimeout(r, cfg, "menu", payload.TimeoutMS))
+	resp, err := proxy.Do(r.Context(), client, endpoint, payload.Menu)
+	if err != nil {
+		w.WriteHeader(http.StatusBadGateway)
+		_, _ = w.Write([]byte("menu create failed"))
+		return
+	}
+	defer resp.Body.Close()
+	data, err := io.ReadAll(resp.Body)
+	if err != nil {
+		w.WriteHeader(http.StatusBadGateway)
+		_, _ = w.Write([]byte("menu create read failed"))
+		return
+	}
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		w.WriteHeader(http.StatusBadGateway)
+		_, _ = w.Write([]byte(fmt.Sprintf("menu create http %d", resp.StatusCode)))
+		return
+	}
+
+	var result struct {
+		ErrCode int `json:"errcode"`
+	}
+	_ = json.Unmarshal(data, &result)
+	if result.ErrCode != 0 {
+		writeWeComError(w, http.StatusBadGateway, data, "menu create")
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	_, _ = w.Write(data)
+}
+
+// handleProxyMenuQuery forwards menu/get and menu/delete, which only take the
+// access token and agent id.
+func handleProxyMenuQuery(w http.ResponseWriter, r *http.Request, cfg config.Config, state *bridgeState, action string) {
+	if r.Method != http.MethodPost {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	if !checkBridgeAuth(w, r, cfg, config.ScopeProxyApp) {
+		return
+	}
+
+	var payload struct {
+		AccessToken string `json:"access_token"`
+		AgentID     string `json:"agentid"`
+		TimeoutMS   int    `json:"timeout_ms"`
+	}
+	if body, err := readBody(r); err == nil {
+		if err := json.Unmarshal(body, &payload); err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			_, _ = w.Write([]byte("invalid json"))
+			return
+		}
+	}
+	payload.AgentID = firstNonEmpty(payload.AgentID, cfg.WeComAgentID)
+	if payload.AccessToken == "" {
+		payload.AccessToken = state.managedToken(payload.AgentID)
+	}
+	if payload.AccessToken == "" || payload.AgentID == "" {
+		w.WriteHeader(http.StatusBadRequest)
+		_, _ = w.Write([]byte("missing access_token/agentid"))
+		return
+	}
+
+	query := url.Values{}
+	query.Set("access_token", payload.AccessToken)
+	query.Set("agentid", payload.AgentID)
+	endpoint := fmt.Sprintf("https://qyapi.weixin.qq.com/cgi-bin/menu/%s?%s", action, query.Encode())
+	forwardWeCom(w, r, endpoint, nil, "menu "+action, proxyTimeout(r, cfg, "menu", payload.TimeoutMS))
+}
+
+func handleProxyAgentGet(w http.ResponseWriter, r *http.Request, cfg config.Config, state *bridgeState) {
+	if r.Method != http.MethodPost {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	if !checkBridgeAuth(w, r, cfg, config.ScopeProxyApp) {
+		return
+	}
+
+	var payload struct {
+		AccessToken string `json:"access_token"`
+		AgentID     string `json:"agentid"`
+		TimeoutMS   int    `json:"timeout_ms"`
+	}
+	if body, err := readBody(r); err == nil {
+		if err := json.Unmarshal(body, &payload); err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			_, _ = w.Write([]byte("invalid json"))
+			return
+		}
+	}
+	payload.AgentID = firstNonEmpty(payload.AgentID, cfg.WeComAgentID)
+	if payload.AccessToken == "" {
+		payload.AccessToken = state.managedToken(payload.AgentID)
+	}
+	if payload.AccessToken == "" || payload.AgentID == "" {
+		w.WriteHeader(http.StatusBadRequest)
+		_, _ = w.Write([]byte("missing access_token/agentid"))
+		return
+	}
+
+	query := url.Values{}
+	query.Set("access_token", payload.AccessToken)
+	query.Set("agentid", payload.AgentID)
+	forwardWeCom(w, r, fmt.Sprintf("https://qyapi.weixin.qq.com/cgi-bin/agent/get?%s", query.Encode()), nil, "agent get", proxyTimeout(r, cfg, "agent", payload.TimeoutMS))
+}
+
+// handleProxyAgentSet updates the app's name, description, redirect domain,
+// home URL and related flags via agent/set. Only the documented fields are
+// forwarded.
+func handleProxyAgentSet(w http.ResponseWriter, r *http.Request, cfg config.Config, state *bridgeState) {
+	if r.Method != http.MethodPost {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	if !checkBridgeAuth(w, r, cfg, config.ScopeProxyApp) {
+		return
+	}
+
+	body, err := readBody(r)
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		_, _ = w.Write([]byte("missing body"))
+		return
+	}
+	var payload struct {
+		AccessToken        string `json:"access_token"`
+		AgentID            string `json:"agentid"`
+		Name               string `json:"name,omitempty"`
+		Description        string `json:"description,omitempty"`
+		RedirectDomain     string `json:"redirect_domain,omitempty"`
+		HomeURL            string `json:"home_url,omitempty"`
+		LogoMediaID        string `json:"logo_mediaid,omitempty"`
+		ReportLocationFlag *int   `json:"report_location_flag,omitempty"`
+		IsReportEnter      *int   `json:"isreportenter,omitempty"`
+		TimeoutMS          int    `json:"timeout_ms"`
+	}
+	if err := json.Unmarshal(body, &payload); err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		_, _ = w.Write([]byte("invalid json"))
+		return
+	}
+	payload.AgentID = firstNonEmpty(payload.AgentID, cfg.WeComAgentID)
+	if payload.AccessToken == "" {
+		payload.AccessToken = state.managedToken(payload.AgentID)
+	}
+	agentID, err := strconv.Atoi(payload.AgentID)
+	if payload.AccessToken == "" || err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		_, _ = w.Write([]byte("missing access_token/agentid"))
+		return
+	}
+
+	settings := map[string]any{"agentid": agentID}
+	for key, value := range map[string]string{
+		"name":            payload.Name,
+		"description":     payload.Description,
+		"redirect_domain": payload.RedirectDomain,
+		"home_url":        payload.HomeURL,
+		"logo_mediaid":    payload.LogoMediaID,
+	} {
+		if value != "" {
+			settings[key] = value
+		}
+	}
+	if payload.ReportLocationFlag != nil {
+		settings["report_location_flag"] = *payload.ReportLocationFlag
+	}
+	if payload.IsReportEnter != nil {
+		settings["isreportenter"] = *payload.IsReportEnter
+	}
+	if len(settings) == 1 {
+		w.WriteHeader(http.StatusBadRequest)
+		_, _ = w.Write([]byte("no agent settings"))
+		return
+	}
+
+	data, _ := json.Marshal(settings)
+	endpoint := fmt.Sprintf("https://qyapi.weixin.qq.com/cgi-bin/agent/set?access_token=%s", url.QueryEscape(payload.AccessToken))
+	forwardWeCom(w, r, endpoint, data, "agent set", proxyTimeout(r, cfg, "agent", payload.TimeoutMS))
+}
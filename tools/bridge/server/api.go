@@ -0,0 +1,270 @@
+package server
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/Tennen/Paimon/tools/bridge/config"
+	"github.com/Tennen/Paimon/tools/bridge/proxy"
+)
+
+// handleProxyAPI forwards /proxy/api/{path} to cgi-bin/{path} for paths on
+// the config file's api allowlist, with the caller's query and body and the
+// bridge's access token. Responses are relayed; a non-zero errcode becomes
+// 502 with the usual explanation.
+func handleProxyAPI(w http.ResponseWriter, r *http.Request, cfg config.Config, state *bridgeState) {
+	if !checkBridgeAuth(w, r, cfg, config.ScopeProxyApp) {
+		return
+	}
+	path := strings.TrimPrefix(r.URL.Path, "/proxy/api/")
+	var route *config.APIRoute
+	if config.ValidAPIPath(path) {
+		for i := range cfg.APIRoutes {
+			if cfg.APIRoutes[i].Matches(r.Method, path) {
+				route = &cfg.APIRoutes[i]
+				break
+			}
+		}
+	}
+	if route == nil {
+		state.metrics.Inc("wecom_bridge_api_proxy_total", "route", "none", "result", "forbidden")
+		w.WriteHeader(http.StatusForbidden)
+		_, _ = w.Write([]byte("api path not allowed"))
+		return
+	}
+	if route.RatePerMinute > 0 {
+		if wait, ok := state.apiLimits.reserve(route.Path, route.RatePerMinute, 0, time.Now()); !ok {
+			state.metrics.Inc("wecom_bridge_api_proxy_total", "route", route.Path, "result", "rate_limited")
+			w.Header().Set("Retry-After", strconv.Itoa(int(wait.Seconds())+1))
+			w.WriteHeader(http.StatusTooManyRequests)
+			_, _ = w.Write([]byte("api rate limit exceeded"))
+			return
+		}
+	}
+	token := state.managedToken(route.AgentID)
+	if token == "" {
+		w.WriteHeader(http.StatusServiceUnavailable)
+		_, _ = w.Write([]byte("no managed access token"))
+		return
+	}
+	var body io.Reader
+	if r.Method != http.MethodGet {
+		data, err := io.ReadAll(io.LimitReader(r.Body, maxBodyBytes))
+		if err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			_, _ = w.Write([]byte("invalid body"))
+			return
+		}
+		body = bytes.NewReader(data)
+	}
+	query := r.URL.Query()
+	query.Set("access_token", token)
+	endpoint := "https://qyapi.weixin.qq.com/cgi-bin/" + path + "?" + query.Encode()
+	req, err := http.NewRequestWithContext(r.Context(), r.Method, endpoint, body)
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		_, _ = w.Write([]byte("invalid request"))
+		return
+	}
+	if ct := r.Header.Get("Content-Type"); ct != "" && body != nil {
+		req.Header.Set("Content-Type", ct)
+	}
+	resp, err := qyapiClient(proxyTimeout(r, cfg, "api", 0)).Do(req)
+	if err != nil {
+		state.metrics.Inc("wecom_bridge_api_proxy_total", "route", route.Path, "result", "error")
+		w.WriteHeader(http.StatusBadGateway)
+		_, _ = w.Write([]byte("api call failed"))
+		return
+	}
+	defer resp.Body.Close()
+	data, err := io.ReadAll(resp.Body)
+	if err != nil {
+		state.metrics.Inc("wecom_bridge_api_proxy_total", "route", route.Path, "result", "error")
+		w.WriteHeader(http.StatusBadGateway)
+		_, _ = w.Write([]byte("api read failed"))
+		return
+	}
+	var result struct {
+		ErrCode int `json:"errcode"`
+	}
+	if json.Unmarshal(data, &result) == nil && result.ErrCode != 0 {
+		state.metrics.Inc("wecom_bridge_api_proxy_total", "route", route.Path, "result", "wecom_error")
+		writeWeComError(w, http.StatusBadGateway, data, "api "+path)
+		return
+	}
+	state.metrics.Inc("wecom_bridge_api_proxy_total", "route", route.Path, "result", "ok")
+	if ct := resp.Header.Get("Content-Type"); ct != "" {
+		w.Header().Set("Content-Type", ct)
+	}
+	if cd := resp.Header.Get("Content-Disposition"); cd != "" {
+		w.Header().Set("Content-Disposition", cd)
+	}
+	w.WriteHeader(resp.StatusCode)
+	_, _ = w.Write(data)
+}
+
+// forwardWeCom calls a qyapi endpoint (GET when body is nil, JSON POST
+// otherwise) and relays the JSON body, mapping transport failures and non-zero
+// errcodes to 502.
+func forwardWeCom(w http.ResponseWriter, r *http.Request, endpoint string, body []byte, label string, timeout time.Duration) {
+	data, ok := callWeCom(w, r, qyapiClient(timeout), endpoint, body, label)
+	if !ok {
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	_, _ = w.Write(data)
+}
+
+// callWeCom is forwardWeCom for handlers that post-process the result: it
+// writes failures to w and returns the body of a successful call.
+func callWeCom(w http.ResponseWriter, r *http.Request, client *http.Client, endpoint string, body []byte, label string) ([]byte, bool) {
+	resp, err := proxy.Do(r.Context(), client, endpoint, body)
+	if err != nil {
+		w.WriteHeader(http.StatusBadGateway)
+		_, _ = w.Write([]byte(label + " failed"))
+		return nil, false
+	}
+	defer resp.Body.Close()
+	data, err := io.ReadAll(resp.Body)
+	if err != nil {
+		w.WriteHeader(http.StatusBadGateway)
+		_, _ = w.Write([]byte(label + " read failed"))
+		return nil, false
+	}
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		w.WriteHeader(http.StatusBadGateway)
+		_, _ = w.Write([]byte(fmt.Sprintf("%s http %d", label, resp.StatusCode)))
+		return nil, false
+	}
+
+	var result struct {
+		ErrCode int `json:"errcode"`
+	}
+	_ = json.Unmarshal(data, &result)
+	if result.ErrCode != 0 {
+		writeWeComError(w, http.StatusBadGateway, data, label)
+		return nil, false
+	}
+	return data, true
+}
+
+// handleProxyAuthUserInfo resolves a web OAuth code into the WeCom user
+// behind it, using the managed token of agentid's app so the web UI never
+// sees a corp secret. The body is {"code","agentid","detail","timeout_ms"};
+// with detail the user_ticket of a snsapi_privateinfo login is exchanged
+// through auth/getuserdetail. The ticket itself is not returned.
+func handleProxyAuthUserInfo(w http.ResponseWriter, r *http.Request, cfg config.Config, state *bridgeState) {
+	if r.Method != http.MethodPost {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	if !checkBridgeAuth(w, r, cfg, config.ScopeProxyApp) {
+		return
+	}
+
+	body, err := readBody(r)
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		_, _ = w.Write([]byte("missing body"))
+		return
+	}
+	var payload struct {
+		Code      string `json:"code"`
+		AgentID   string `json:"agentid"`
+		Detail    bool   `json:"detail"`
+		TimeoutMS int    `json:"timeout_ms"`
+	}
+	if err := json.Unmarshal(body, &payload); err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		_, _ = w.Write([]byte("invalid json"))
+		return
+	}
+	if payload.Code == "" {
+		w.WriteHeader(http.StatusBadRequest)
+		_, _ = w.Write([]byte("missing code"))
+		return
+	}
+	token := state.managedToken(firstNonEmpty(payload.AgentID, cfg.WeComAgentID))
+	if token == "" {
+		w.WriteHeader(http.StatusServiceUnavailable)
+		_, _ = w.Write([]byte("no managed access token"))
+		return
+	}
+
+	client := qyapiClient(proxyTimeout(r, cfg, "auth", payload.TimeoutMS))
+	query := url.Values{}
+	query.Set("access_token", token)
+	query.Set("code", payload.Code)
+	data, ok := callWeCom(w, r, client, "https://qyapi.weixin.qq.com/cgi-bin/auth/getuserinfo?"+query.Encode(), nil, "auth getuserinfo")
+	if !ok {
+		state.metrics.Inc("wecom_bridge_auth_userinfo_total", "result", "error")
+		return
+	}
+	// Field names are matched case-insensitively, which also covers the
+	// older UserId/OpenId/DeviceId spelling.
+	var info struct {
+		UserID         string `json:"userid"`
+		OpenID         string `json:"openid"`
+		ExternalUserID string `json:"external_userid"`
+		DeviceID       string `json:"deviceid"`
+		UserTicket     string `json:"user_ticket"`
+	}
+	_ = json.Unmarshal(data, &info)
+	resp := map[string]any{
+		"member": info.UserID != "",
+		"userid": info.UserID,
+	}
+	if info.OpenID != "" {
+		resp["openid"] = info.OpenID
+	}
+	if info.ExternalUserID != "" {
+		resp["externalUserId"] = info.ExternalUserID
+	}
+	if info.DeviceID != "" {
+		resp["deviceId"] = info.DeviceID
+	}
+
+	if payload.Detail {
+		if info.UserTicket == "" {
+			state.metrics.Inc("wecom_bridge_auth_userinfo_total", "result", "no_ticket")
+			w.WriteHeader(http.StatusBadRequest)
+			_, _ = w.Write([]byte("no user_ticket: detail needs a member login with scope snsapi_privateinfo"))
+			return
+		}
+		ticket, _ := json.Marshal(map[string]string{"user_ticket": info.UserTicket})
+		data, ok := callWeCom(w, r, client, "https://qyapi.weixin.qq.com/cgi-bin/auth/getuserdetail?access_token="+url.QueryEscape(token), ticket, "auth getuserdetail")
+		if !ok {
+			state.metrics.Inc("wecom_bridge_auth_userinfo_total", "result", "error")
+			return
+		}
+		var detail struct {
+			Gender  string `json:"gender"`
+			Avatar  string `json:"avatar"`
+			QRCode  string `json:"qr_code"`
+			Mobile  string `json:"mobile"`
+			Email   string `json:"email"`
+			BizMail string `json:"biz_mail"`
+			Address string `json:"address"`
+		}
+		_ = json.Unmarshal(data, &detail)
+		resp["detail"] = map[string]string{
+			"gender":  detail.Gender,
+			"avatar":  detail.Avatar,
+			"qrCode":  detail.QRCode,
+			"mobile":  detail.Mobile,
+			"email":   detail.Email,
+			"bizMail": detail.BizMail,
+			"address": detail.Address,
+		}
+	}
+	state.metrics.Inc("wecom_bridge_auth_userinfo_total", "result", "ok")
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(resp)
+}
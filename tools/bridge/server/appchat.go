@@ -0,0 +1,280 @@
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"github.com/Tennen/Paimon/tools/bridge/config"
+)
+
+// WeCom's limits for app chats, the group chats an app creates.
+const (
+	minAppChatMembers = 2
+	maxAppChatMembers = 2000
+	maxAppChatName    = 50
+)
+
+var appChatIDPattern = regexp.MustCompile(`^[0-9A-Za-z]{1,32}$`)
+
+// writeFieldProblems answers 400 with one entry per invalid field.
+func writeFieldProblems(w http.ResponseWriter, what string, problems []string) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusBadRequest)
+	_ = json.NewEncoder(w).Encode(map[string]any{
+		"error":  "invalid " + what,
+		"fields": problems,
+	})
+}
+
+// appChatToken returns the caller's access_token or the managed token of
+// agentid's app; app chats belong to the app that created them.
+func appChatToken(cfg config.Config, state *bridgeState, accessToken string, agentID any) string {
+	return firstNonEmpty(accessToken, state.managedToken(firstNonEmpty(jsonID(agentID), cfg.WeComAgentID)))
+}
+
+// handleProxyAppChatCreate creates an app chat through appchat/create. The
+// body is {"name","owner","userlist","chatid"} plus the usual access_token,
+// agentid (which only selects the managed token) and timeout_ms; WeCom
+// answers with the chatid.
+func handleProxyAppChatCreate(w http.ResponseWriter, r *http.Request, cfg config.Config, state *bridgeState) {
+	if r.Method != http.MethodPost {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	if !checkBridgeAuth(w, r, cfg, config.ScopeProxyApp) {
+		return
+	}
+
+	body, err := readBody(r)
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		_, _ = w.Write([]byte("missing body"))
+		return
+	}
+	var payload struct {
+		AccessToken string   `json:"access_token"`
+		AgentID     any      `json:"agentid"`
+		TimeoutMS   int      `json:"timeout_ms"`
+		Name        string   `json:"name"`
+		Owner       string   `json:"owner"`
+		UserList    []string `json:"userlist"`
+		ChatID      string   `json:"chatid"`
+	}
+	if err := json.Unmarshal(body, &payload); err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		_, _ = w.Write([]byte("invalid json"))
+		return
+	}
+	var problems []string
+	if n := len(payload.UserList); n < minAppChatMembers || n > maxAppChatMembers {
+		problems = append(problems, fmt.Sprintf("userlist needs %d to %d members", minAppChatMembers, maxAppChatMembers))
+	}
+	if utf8.RuneCountInString(payload.Name) > maxAppChatName {
+		problems = append(problems, fmt.Sprintf("name exceeds %d characters", maxAppChatName))
+	}
+	if payload.Owner != "" && !slices.Contains(payload.UserList, payload.Owner) {
+		problems = append(problems, "owner must be in userlist")
+	}
+	if payload.ChatID != "" && !appChatIDPattern.MatchString(payload.ChatID) {
+		problems = append(problems, "chatid must be 1 to 32 letters or digits")
+	}
+	if len(problems) > 0 {
+		writeFieldProblems(w, "appchat", problems)
+		return
+	}
+	accessToken := appChatToken(cfg, state, payload.AccessToken, payload.AgentID)
+	if accessToken == "" {
+		w.WriteHeader(http.StatusBadRequest)
+		_, _ = w.Write([]byte("missing access_token"))
+		return
+	}
+
+	chat := map[string]any{"userlist": payload.UserList}
+	for key, value := range map[string]string{"name": payload.Name, "owner": payload.Owner, "chatid": payload.ChatID} {
+		if value != "" {
+			chat[key] = value
+		}
+	}
+	data, _ := json.Marshal(chat)
+	endpoint := "https://qyapi.weixin.qq.com/cgi-bin/appchat/create?access_token=" + url.QueryEscape(accessToken)
+	forwardWeCom(w, r, endpoint, data, "appchat create", proxyTimeout(r, cfg, "appchat", payload.TimeoutMS))
+}
+
+// handleProxyAppChatUpdate renames an app chat, changes its owner or adds and
+// removes members through appchat/update.
+func handleProxyAppChatUpdate(w http.ResponseWriter, r *http.Request, cfg config.Config, state *bridgeState) {
+	if r.Method != http.MethodPost {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	if !checkBridgeAuth(w, r, cfg, config.ScopeProxyApp) {
+		return
+	}
+
+	body, err := readBody(r)
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		_, _ = w.Write([]byte("missing body"))
+		return
+	}
+	var payload struct {
+		AccessToken string   `json:"access_token"`
+		AgentID     any      `json:"agentid"`
+		TimeoutMS   int      `json:"timeout_ms"`
+		ChatID      string   `json:"chatid"`
+		Name        string   `json:"name"`
+		Owner       string   `json:"owner"`
+		AddUserList []string `json:"add_user_list"`
+		DelUserList []string `json:"del_user_list"`
+	}
+	if err := json.Unmarshal(body, &payload); err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		_, _ = w.Write([]byte("invalid json"))
+		return
+	}
+	var problems []string
+	if payload.ChatID == "" {
+		problems = append(problems, "chatid is required")
+	}
+	if payload.Name == "" && payload.Owner == "" && len(payload.AddUserList) == 0 && len(payload.DelUserList) == 0 {
+		problems = append(problems, "name, owner, add_user_list or del_user_list is required")
+	}
+	if utf8.RuneCountInString(payload.Name) > maxAppChatName {
+		problems = append(problems, fmt.Sprintf("name exceeds %d characters", maxAppChatName))
+	}
+	for _, user := range payload.AddUserList {
+		if slices.Contains(payload.DelUserList, user) {
+			problems = append(problems, user+" is in both add_user_list and del_user_list")
+		}
+	}
+	if len(problems) > 0 {
+		writeFieldProblems(w, "appchat", problems)
+		return
+	}
+	accessToken := appChatToken(cfg, state, payload.AccessToken, payload.AgentID)
+	if accessToken == "" {
+		w.WriteHeader(http.StatusBadRequest)
+		_, _ = w.Write([]byte("missing access_token"))
+		return
+	}
+
+	update := map[string]any{"chatid": payload.ChatID}
+	for key, value := range map[string]string{"name": payload.Name, "owner": payload.Owner} {
+		if value != "" {
+			update[key] = value
+		}
+	}
+	for key, value := range map[string][]string{"add_user_list": payload.AddUserList, "del_user_list": payload.DelUserList} {
+		if len(value) > 0 {
+			update[key] = value
+		}
+	}
+	data, _ := json.Marshal(update)
+	endpoint := "https://qyapi.weixin.qq.com/cgi-bin/appchat/update?access_token=" + url.QueryEscape(accessToken)
+	forwardWeCom(w, r, endpoint, data, "appchat update", proxyTimeout(r, cfg, "appchat", payload.TimeoutMS))
+}
+
+// handleProxyAppChatSend posts a typed message to an app chat through
+// appchat/send, splitting long text like /proxy/send/typed. Sends are
+// archived with toUser "chat:<chatid>"; per-user quotas do not apply.
+func handleProxyAppChatSend(w http.ResponseWriter, r *http.Request, cfg config.Config, state *bridgeState) {
+	if r.Method != http.MethodPost {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	if !checkBridgeAuth(w, r, cfg, config.ScopeProxySend) {
+		return
+	}
+
+	body, err := readBody(r)
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		_, _ = w.Write([]byte("missing body"))
+		return
+	}
+	var payload struct {
+		AccessToken string `json:"access_token"`
+		AgentID     any    `json:"agentid"`
+		TimeoutMS   int    `json:"timeout_ms"`
+		ChatID      string `json:"chatid"`
+		Safe        int    `json:"safe"`
+		typedContent
+	}
+	if err := json.Unmarshal(body, &payload); err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		_, _ = w.Write([]byte("invalid json"))
+		return
+	}
+	var problems []string
+	if payload.ChatID == "" {
+		problems = append(problems, "chatid is required")
+	}
+	if problems = append(problems, payload.validateContent(typedAppChatTypes)...); len(problems) > 0 {
+		writeFieldProblems(w, "message", problems)
+		return
+	}
+	accessToken := appChatToken(cfg, state, payload.AccessToken, payload.AgentID)
+	if accessToken == "" {
+		w.WriteHeader(http.StatusBadRequest)
+		_, _ = w.Write([]byte("missing access_token"))
+		return
+	}
+
+	requester := requesterIdentity(r, cfg)
+	endpoint := "https://qyapi.weixin.qq.com/cgi-bin/appchat/send?access_token=" + url.QueryEscape(accessToken)
+	client := qyapiClient(proxyTimeout(r, cfg, "appchat", payload.TimeoutMS))
+	contents := payload.contents()
+	for i, content := range contents {
+		message := map[string]any{"chatid": payload.ChatID, "msgtype": payload.MsgType, payload.MsgType: content}
+		if payload.Safe != 0 {
+			message["safe"] = payload.Safe
+		}
+		data, _ := json.Marshal(message)
+		record := outboundRecord(data, requester)
+		w.Header().Set("X-Bridge-Parts-Sent", strconv.Itoa(i))
+		_, ok := callWeCom(w, r, client, endpoint, data, "appchat send")
+		if !ok {
+			record.Error = "appchat send failed"
+			state.archive.Append(record)
+			return
+		}
+		state.archive.Append(record)
+		state.usage.record(requester, func(c *usageCounters) { c.Sends++ })
+	}
+	w.Header().Set("X-Bridge-Parts-Sent", strconv.Itoa(len(contents)))
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(map[string]any{
+		"errcode": 0,
+		"errmsg":  "ok",
+		"parts":   len(contents),
+	})
+}
+
+// proxyTimeout returns the upstream timeout for a proxy call: the caller's
+// X-Bridge-Timeout header (duration or milliseconds) or timeout_ms field,
+// capped at ProxyTimeoutMax, else the endpoint's default.
+func proxyTimeout(r *http.Request, cfg config.Config, endpoint string, timeoutMS int) time.Duration {
+	requested := time.Duration(timeoutMS) * time.Millisecond
+	if v := strings.TrimSpace(r.Header.Get("X-Bridge-Timeout")); v != "" {
+		if ms, err := strconv.Atoi(v); err == nil {
+			requested = time.Duration(ms) * time.Millisecond
+		} else if d, err := time.ParseDuration(v); err == nil {
+			requested = d
+		}
+	}
+	if requested <= 0 {
+		return cfg.ProxyTimeouts[endpoint]
+	}
+	if cfg.ProxyTimeoutMax > 0 && requested > cfg.ProxyTimeoutMax {
+		return cfg.ProxyTimeoutMax
+	}
+	return requested
+}
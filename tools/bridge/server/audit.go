@@ -0,0 +1,177 @@
+package server
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/Tennen/Paimon/tools/bridge/auditlog"
+	"github.com/Tennen/Paimon/tools/bridge/config"
+)
+
+// auditEntryKey carries a gRPC call's *auditlog.Entry so the method can add the
+// targets it decoded.
+type auditEntryKey struct{}
+
+// auditMiddleware records every /proxy call in the audit log once it has
+// been answered, including those refused for auth, quota or read-only mode.
+func auditMiddleware(cfg config.Config, state *bridgeState, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !strings.HasPrefix(r.URL.Path, "/proxy/") {
+			next.ServeHTTP(w, r)
+			return
+		}
+		entry := auditlog.Entry{
+			RequestID: requestID(r.Context()),
+			Identity:  requesterIdentity(r, cfg),
+			Method:    r.Method,
+			Endpoint:  r.URL.Path,
+			AgentID:   r.URL.Query().Get("agentid"),
+		}
+		auditTargets(r, &entry)
+		rec := &auditRecorder{ResponseWriter: w, status: http.StatusOK}
+		start := time.Now()
+		next.ServeHTTP(rec, r)
+		entry.DurationMS = time.Since(start).Milliseconds()
+		entry.Status = rec.status
+		var result struct {
+			ErrCode *int   `json:"errcode"`
+			ErrMsg  string `json:"errmsg"`
+		}
+		if json.Unmarshal(rec.head, &result) == nil {
+			entry.ErrCode = result.ErrCode
+			if result.ErrCode != nil && *result.ErrCode != 0 {
+				entry.Error = result.ErrMsg
+			}
+		} else if rec.status >= 400 {
+			entry.Error = strings.TrimSpace(string(rec.head))
+		}
+		entry.Error = truncateRunes(redactSecrets(entry.Error), archiveTextLimit)
+		state.audit.Append(entry)
+	})
+}
+
+// auditTargets reads the targets from a JSON request body, leaving the body
+// intact for the handler. Multipart uploads and bodies over auditPeekBytes
+// are not inspected.
+func auditTargets(r *http.Request, entry *auditlog.Entry) {
+	if r.Body == nil || r.ContentLength > auditPeekBytes || strings.HasPrefix(r.Header.Get("Content-Type"), "multipart/") {
+		return
+	}
+	peek, err := io.ReadAll(io.LimitReader(r.Body, auditPeekBytes+1))
+	r.Body = struct {
+		io.Reader
+		io.Closer
+	}{io.MultiReader(bytes.NewReader(peek), r.Body), r.Body}
+	if err != nil || len(peek) > auditPeekBytes {
+		return
+	}
+	setAuditTargets(entry, peek)
+}
+
+// setAuditTargets fills the recipients, agent and message type from a JSON
+// message, keeping the agent taken from the query when it has none.
+func setAuditTargets(entry *auditlog.Entry, message []byte) {
+	var body struct {
+		ToUser  any    `json:"touser"`
+		ToParty any    `json:"toparty"`
+		ToTag   any    `json:"totag"`
+		ChatID  string `json:"chatid"`
+		AgentID any    `json:"agentid"`
+		MsgType string `json:"msgtype"`
+	}
+	if json.Unmarshal(message, &body) != nil {
+		return
+	}
+	entry.ToUser = auditList(body.ToUser)
+	entry.ToParty = auditList(body.ToParty)
+	entry.ToTag = auditList(body.ToTag)
+	entry.ChatID = body.ChatID
+	entry.AgentID = firstNonEmpty(jsonID(body.AgentID), entry.AgentID)
+	entry.MsgType = body.MsgType
+}
+
+// auditList joins a recipient field given as "a|b" or ["a","b"].
+func auditList(v any) string {
+	switch v := v.(type) {
+	case string:
+		return v
+	case []any:
+		parts := make([]string, 0, len(v))
+		for _, item := range v {
+			parts = append(parts, fmt.Sprint(item))
+		}
+		return strings.Join(parts, "|")
+	}
+	return ""
+}
+
+// auditRecorder passes a response through, keeping its status and the
+// start of its body for the errcode.
+type auditRecorder struct {
+	http.ResponseWriter
+	status      int
+	wroteHeader bool
+	head        []byte
+}
+
+func (a *auditRecorder) WriteHeader(status int) {
+	if !a.wroteHeader {
+		a.status = status
+		a.wroteHeader = true
+	}
+	a.ResponseWriter.WriteHeader(status)
+}
+
+func (a *auditRecorder) Write(p []byte) (int, error) {
+	a.wroteHeader = true
+	if room := auditPeekBytes - len(a.head); room > 0 {
+		a.head = append(a.head, p[:min(len(p), room)]...)
+	}
+	return a.ResponseWriter.Write(p)
+}
+
+func (a *auditRecorder) Unwrap() http.ResponseWriter {
+	return a.ResponseWriter
+}
+
+// handleAdminAudit returns recent audit entries, newest first.
+func handleAdminAudit(w http.ResponseWriter, r *http.Request, cfg config.Config, state *bridgeState) {
+	if r.Method != http.MethodGet {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	if !checkAdminAuth(w, r, cfg) {
+		return
+	}
+	q := r.URL.Query()
+	since, err := parseTimeParam(q.Get("since"))
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		_, _ = w.Write([]byte("invalid since"))
+		return
+	}
+	limit := 100
+	if v := q.Get("limit"); v != "" {
+		if n, err := strconv.Atoi(v); err == nil && n > 0 && n <= 1000 {
+			limit = n
+		}
+	}
+	identity, endpoint, toUser := q.Get("identity"), q.Get("endpoint"), q.Get("touser")
+	failed := q.Get("failed") == "true"
+	entries := state.audit.Recent(func(e auditlog.Entry) bool {
+		return (identity == "" || e.Identity == identity) &&
+			(endpoint == "" || strings.HasPrefix(e.Endpoint, endpoint)) &&
+			(toUser == "" || slices.Contains(strings.Split(e.ToUser, "|"), toUser)) &&
+			(since.IsZero() || !e.Time.Before(since)) &&
+			(!failed || e.Status >= 400 || e.GRPCStatus != 0 || (e.ErrCode != nil && *e.ErrCode != 0))
+	}, limit)
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(map[string]any{"entries": entries})
+}
@@ -0,0 +1,209 @@
+package server
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"net/url"
+	"slices"
+	"strings"
+
+	"github.com/Tennen/Paimon/tools/bridge/config"
+	"github.com/Tennen/Paimon/tools/bridge/proxy"
+)
+
+func writeWeComError(w http.ResponseWriter, status int, data []byte, label string) {
+	enriched := proxy.EnrichError(data, label)
+	if !json.Valid(enriched) {
+		w.WriteHeader(status)
+		_, _ = w.Write([]byte(label + " failed"))
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	_, _ = w.Write(enriched)
+}
+
+// lookupScopedToken finds the scoped token a request's bearer matches.
+func lookupScopedToken(r *http.Request, cfg config.Config) (config.Token, bool) {
+	bearer, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+	if !ok || bearer == "" {
+		return config.Token{}, false
+	}
+	for _, t := range cfg.Tokens {
+		if subtle.ConstantTimeCompare([]byte(bearer), []byte(t.Token)) == 1 {
+			return t, true
+		}
+	}
+	return config.Token{}, false
+}
+
+// hasBearer reports whether r carries "Bearer token", comparing in constant
+// time. An empty token never matches.
+func hasBearer(r *http.Request, token string) bool {
+	if token == "" {
+		return false
+	}
+	return subtle.ConstantTimeCompare([]byte(r.Header.Get("Authorization")), []byte("Bearer "+token)) == 1
+}
+
+// bridgeAuthStatus admits (200) the bridge token, or a scoped token carrying
+// scope; a scoped token without it gets 403, anything else 401. Without
+// either kind of token configured the endpoints are open.
+func bridgeAuthStatus(r *http.Request, cfg config.Config, scope string) int {
+	if cfg.BridgeToken == "" && len(cfg.Tokens) == 0 {
+		return http.StatusOK
+	}
+	if hasBearer(r, cfg.BridgeToken) {
+		return http.StatusOK
+	}
+	if t, ok := lookupScopedToken(r, cfg); ok {
+		if t.Allows(scope) {
+			return http.StatusOK
+		}
+		return http.StatusForbidden
+	}
+	return http.StatusUnauthorized
+}
+
+func checkBridgeAuth(w http.ResponseWriter, r *http.Request, cfg config.Config, scope string) bool {
+	switch bridgeAuthStatus(r, cfg, scope) {
+	case http.StatusOK:
+		return true
+	case http.StatusForbidden:
+		w.WriteHeader(http.StatusForbidden)
+		_, _ = w.Write([]byte("missing scope " + scope))
+	default:
+		w.WriteHeader(http.StatusUnauthorized)
+		_, _ = w.Write([]byte("unauthorized"))
+	}
+	return false
+}
+
+// requesterIdentity names the credential a request was authorized with, for
+// attribution in the archive.
+func requesterIdentity(r *http.Request, cfg config.Config) string {
+	switch {
+	case r.Header.Get("Authorization") == "" || r.Header.Get("Authorization") == "Bearer ":
+		return "anonymous"
+	case hasBearer(r, cfg.QuotaOverrideToken):
+		return "quota-override"
+	case hasBearer(r, cfg.AdminToken):
+		return "admin"
+	case hasBearer(r, cfg.PublishToken):
+		return "publisher"
+	case hasBearer(r, cfg.BridgeToken):
+		return "bridge"
+	}
+	if t, ok := lookupScopedToken(r, cfg); ok {
+		return t.Name
+	}
+	return "unknown"
+}
+
+// checkAdminAuth guards /admin endpoints with BRIDGE_ADMIN_TOKEN or a scoped
+// token carrying "admin", falling back to the bridge token when no admin
+// token is configured.
+func checkAdminAuth(w http.ResponseWriter, r *http.Request, cfg config.Config) bool {
+	// Admin endpoints change and persist settings, so unlike the others
+	// they are closed until some token is configured.
+	if cfg.AdminToken == "" && cfg.BridgeToken == "" && len(cfg.Tokens) == 0 {
+		w.WriteHeader(http.StatusForbidden)
+		_, _ = w.Write([]byte("admin endpoints disabled: set BRIDGE_ADMIN_TOKEN"))
+		return false
+	}
+	if cfg.AdminToken == "" {
+		return checkBridgeAuth(w, r, cfg, config.ScopeAdmin)
+	}
+	if hasBearer(r, cfg.AdminToken) {
+		return true
+	}
+	if t, ok := lookupScopedToken(r, cfg); ok {
+		if t.Allows(config.ScopeAdmin) {
+			return true
+		}
+		w.WriteHeader(http.StatusForbidden)
+		_, _ = w.Write([]byte("missing scope " + config.ScopeAdmin))
+		return false
+	}
+	w.WriteHeader(http.StatusUnauthorized)
+	_, _ = w.Write([]byte("unauthorized"))
+	return false
+}
+
+func readBody(r *http.Request) ([]byte, error) {
+	body, err := io.ReadAll(io.LimitReader(r.Body, maxBodyBytes))
+	if err != nil {
+		return nil, err
+	}
+	if len(body) == 0 {
+		return nil, errors.New("empty body")
+	}
+	return body, nil
+}
+
+func firstNonEmpty(values ...string) string {
+	for _, v := range values {
+		if strings.TrimSpace(v) != "" {
+			return v
+		}
+	}
+	return ""
+}
+
+func parseFilenameFromDisposition(disposition string) string {
+	trimmed := strings.TrimSpace(disposition)
+	if trimmed == "" {
+		return ""
+	}
+	lower := strings.ToLower(trimmed)
+	if idx := strings.Index(lower, "filename*=utf-8''"); idx >= 0 {
+		start := idx + len("filename*=utf-8''")
+		rest := strings.TrimSpace(trimmed[start:])
+		if semi := strings.Index(rest, ";"); semi >= 0 {
+			rest = rest[:semi]
+		}
+		rest = strings.Trim(rest, "\"'")
+		if decoded, err := url.QueryUnescape(rest); err == nil {
+			return decoded
+		}
+		return rest
+	}
+
+	if idx := strings.Index(lower, "filename="); idx >= 0 {
+		start := idx + len("filename=")
+		rest := strings.TrimSpace(trimmed[start:])
+		if semi := strings.Index(rest, ";"); semi >= 0 {
+			rest = rest[:semi]
+		}
+		return strings.Trim(strings.TrimSpace(rest), "\"'")
+	}
+	return ""
+}
+
+// parseToUsers returns the distinct touser entries of a message/send body,
+// and whether it is also addressed to @all, departments (toparty) or tags
+// (totag), whose members per-user quotas cannot count.
+func parseToUsers(message json.RawMessage) (users []string, broadcast bool) {
+	var msg struct {
+		ToUser  string `json:"touser"`
+		ToParty string `json:"toparty"`
+		ToTag   string `json:"totag"`
+	}
+	if err := json.Unmarshal(message, &msg); err != nil {
+		return nil, false
+	}
+	broadcast = strings.TrimSpace(msg.ToParty) != "" || strings.TrimSpace(msg.ToTag) != ""
+	users = make([]string, 0)
+	for _, u := range strings.Split(msg.ToUser, "|") {
+		switch u = strings.TrimSpace(u); {
+		case u == "@all":
+			broadcast = true
+		case u != "" && !slices.Contains(users, u):
+			users = append(users, u)
+		}
+	}
+	return users, broadcast
+}
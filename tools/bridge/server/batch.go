@@ -0,0 +1,252 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"mime/multipart"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/Tennen/Paimon/tools/bridge/config"
+	"github.com/Tennen/Paimon/tools/bridge/proxy"
+)
+
+// countingReader counts bytes read through it.
+type countingReader struct {
+	r io.Reader
+	n int64
+}
+
+func (c *countingReader) Read(p []byte) (int, error) {
+	n, err := c.r.Read(p)
+	c.n += int64(n)
+	return n, err
+}
+
+// uploadWeComMedia posts one file to media/upload and returns WeCom's JSON
+// response.
+func uploadWeComMedia(ctx context.Context, client *http.Client, accessToken, typeName, filename string, data []byte) ([]byte, error) {
+	endpoint := fmt.Sprintf("https://qyapi.weixin.qq.com/cgi-bin/media/upload?access_token=%s&type=%s", url.QueryEscape(accessToken), url.QueryEscape(typeName))
+
+	var buf bytes.Buffer
+	writer := multipart.NewWriter(&buf)
+	part, err := writer.CreateFormFile("media", filename)
+	if err != nil {
+		return nil, errors.New("upload failed")
+	}
+	_, _ = part.Write(data)
+	_ = writer.Close()
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, endpoint, &buf)
+	if err != nil {
+		return nil, errors.New("upload failed")
+	}
+	req.Header.Set("Content-Type", writer.FormDataContentType())
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, errors.New("upload failed")
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return nil, fmt.Errorf("upload http %d", resp.StatusCode)
+	}
+	respData, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, errors.New("upload read failed")
+	}
+	return respData, nil
+}
+
+// mediaUploadItem is one file of a batch upload.
+type mediaUploadItem struct {
+	Base64      string `json:"base64"`
+	Filename    string `json:"filename"`
+	ContentType string `json:"content_type"`
+	Type        string `json:"type"`
+
+	data []byte
+}
+
+// handleProxyUploadBatch uploads several files concurrently and reports a
+// media_id or error for each, in request order. It accepts either JSON
+// {"access_token","type","files":[{"base64","filename","type"}]} or a
+// multipart form with access_token/type fields and one part per file.
+func handleProxyUploadBatch(w http.ResponseWriter, r *http.Request, cfg config.Config, state *bridgeState) {
+	if r.Method != http.MethodPost {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	if !checkBridgeAuth(w, r, cfg, config.ScopeProxyMedia) {
+		return
+	}
+
+	r.Body = http.MaxBytesReader(w, r.Body, cfg.MediaBatchMaxBytes)
+	var accessToken, defaultType string
+	var timeoutMS int
+	var items []mediaUploadItem
+	if strings.HasPrefix(r.Header.Get("Content-Type"), "multipart/form-data") {
+		reader, err := r.MultipartReader()
+		if err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			_, _ = w.Write([]byte("invalid multipart form"))
+			return
+		}
+		for {
+			part, err := reader.NextPart()
+			if errors.Is(err, io.EOF) {
+				break
+			}
+			var data []byte
+			if err == nil {
+				data, err = io.ReadAll(part)
+			}
+			if err != nil {
+				w.WriteHeader(http.StatusBadRequest)
+				_, _ = w.Write([]byte("invalid multipart form"))
+				return
+			}
+			field := part.FormName()
+			if part.FileName() == "" {
+				switch field {
+				case "access_token":
+					accessToken = strings.TrimSpace(string(data))
+				case "type":
+					defaultType = strings.TrimSpace(string(data))
+				case "timeout_ms":
+					timeoutMS, _ = strconv.Atoi(strings.TrimSpace(string(data)))
+				}
+				continue
+			}
+			item := mediaUploadItem{Filename: part.FileName(), data: data}
+			// A part named image/voice/video/file selects its media type.
+			switch field {
+			case "image", "voice", "video", "file":
+				item.Type = field
+			}
+			items = append(items, item)
+		}
+	} else {
+		body, err := io.ReadAll(r.Body)
+		if err != nil || len(body) == 0 {
+			w.WriteHeader(http.StatusBadRequest)
+			_, _ = w.Write([]byte("missing body"))
+			return
+		}
+		var payload struct {
+			AccessToken string            `json:"access_token"`
+			Type        string            `json:"type"`
+			Files       []mediaUploadItem `json:"files"`
+			TimeoutMS   int               `json:"timeout_ms"`
+		}
+		if err := json.Unmarshal(body, &payload); err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			_, _ = w.Write([]byte("invalid json"))
+			return
+		}
+		accessToken, defaultType, timeoutMS, items = payload.AccessToken, payload.Type, payload.TimeoutMS, payload.Files
+	}
+	if accessToken == "" {
+		accessToken = state.managedToken("")
+	}
+	if accessToken == "" || len(items) == 0 {
+		w.WriteHeader(http.StatusBadRequest)
+		_, _ = w.Write([]byte("missing access_token/files"))
+		return
+	}
+	if len(items) > maxMediaBatchFiles {
+		w.WriteHeader(http.StatusBadRequest)
+		_, _ = w.Write([]byte(fmt.Sprintf("too many files (max %d)", maxMediaBatchFiles)))
+		return
+	}
+
+	client := qyapiClient(proxyTimeout(r, cfg, "media_upload", timeoutMS))
+	results := make([]map[string]any, len(items))
+	jobs := make(chan int)
+	var wg sync.WaitGroup
+	for n := 0; n < cfg.MediaUploadConcurrency && n < len(items); n++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range jobs {
+				results[i] = uploadBatchItem(r.Context(), client, accessToken, firstNonEmpty(defaultType, "image"), i, items[i])
+			}
+		}()
+	}
+	for i := range items {
+		jobs <- i
+	}
+	close(jobs)
+	wg.Wait()
+
+	uploaded := 0
+	for _, result := range results {
+		if _, ok := result["media_id"]; ok {
+			uploaded++
+		}
+	}
+	state.metrics.Add("wecom_bridge_media_batch_files_total", int64(uploaded), "result", "ok")
+	state.metrics.Add("wecom_bridge_media_batch_files_total", int64(len(items)-uploaded), "result", "error")
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(map[string]any{
+		"uploaded": uploaded,
+		"failed":   len(items) - uploaded,
+		"results":  results,
+	})
+}
+
+// uploadBatchItem uploads one batch file and describes the outcome.
+func uploadBatchItem(ctx context.Context, client *http.Client, accessToken, defaultType string, index int, item mediaUploadItem) map[string]any {
+	typeName := firstNonEmpty(item.Type, defaultType)
+	filename := item.Filename
+	if filename == "" {
+		if typeName == "image" {
+			filename = fmt.Sprintf("upload-%d.jpg", index+1)
+		} else {
+			filename = fmt.Sprintf("upload-%d.dat", index+1)
+		}
+	}
+	result := map[string]any{"index": index, "filename": filename, "type": typeName}
+	data := item.data
+	if data == nil {
+		decoded, err := base64.StdEncoding.DecodeString(item.Base64)
+		if err != nil || len(decoded) == 0 {
+			result["error"] = "invalid base64"
+			return result
+		}
+		data = decoded
+	}
+	respData, err := uploadWeComMedia(ctx, client, accessToken, typeName, filename, data)
+	if err != nil {
+		result["error"] = err.Error()
+		return result
+	}
+	var reply struct {
+		ErrCode   int    `json:"errcode"`
+		ErrMsg    string `json:"errmsg"`
+		MediaID   string `json:"media_id"`
+		CreatedAt string `json:"created_at"`
+	}
+	if err := json.Unmarshal(respData, &reply); err != nil {
+		result["error"] = "invalid upload response"
+		return result
+	}
+	if reply.ErrCode != 0 || reply.MediaID == "" {
+		var detail map[string]any
+		_ = json.Unmarshal(proxy.EnrichError(respData, "upload"), &detail)
+		for key, value := range detail {
+			result[key] = value
+		}
+		return result
+	}
+	result["media_id"] = reply.MediaID
+	result["created_at"] = reply.CreatedAt
+	return result
+}
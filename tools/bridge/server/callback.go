@@ -0,0 +1,290 @@
+package server
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"net/netip"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/Tennen/Paimon/tools/bridge/config"
+	"github.com/Tennen/Paimon/tools/bridge/metrics"
+	"github.com/Tennen/Paimon/tools/wecom/callback"
+	wxcrypto "github.com/Tennen/Paimon/tools/wecom/crypto"
+)
+
+// wecomMessage is a decoded callback (see callback.Message).
+type wecomMessage = callback.Message
+
+func handleWeCom(w http.ResponseWriter, r *http.Request, cfg config.Config, state *bridgeState) {
+	if !state.callbackIPs.check(w, r, cfg, state.metrics) {
+		return
+	}
+	switch r.Method {
+	case http.MethodGet:
+		handleWeComVerify(w, r, cfg, state)
+	case http.MethodPost:
+		handleWeComPost(w, r, cfg, state)
+	default:
+		w.WriteHeader(http.StatusMethodNotAllowed)
+	}
+}
+
+// maxRejectedIPs bounds the ip label of wecom_bridge_callback_ip_rejected_total;
+// further sources are counted as "other".
+const maxRejectedIPs = 256
+
+// callbackAllowlist rejects /wecom requests from outside
+// BRIDGE_CALLBACK_ALLOWLIST and, with BRIDGE_CALLBACK_ALLOWLIST_AUTO, the
+// callback IPs last fetched from WeCom. It runs before signature checks so
+// forged callbacks cost no decryption.
+type callbackAllowlist struct {
+	mu       sync.RWMutex
+	fetched  []netip.Prefix
+	rejected map[string]bool
+}
+
+func (a *callbackAllowlist) set(prefixes []netip.Prefix) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.fetched = prefixes
+}
+
+func (a *callbackAllowlist) allows(cfg config.Config, addr netip.Addr) bool {
+	for _, p := range cfg.CallbackAllowlist {
+		if p.Contains(addr) {
+			return true
+		}
+	}
+	a.mu.RLock()
+	defer a.mu.RUnlock()
+	for _, p := range a.fetched {
+		if p.Contains(addr) {
+			return true
+		}
+	}
+	return false
+}
+
+// check writes 403 and counts the source when r is not allowed. Until the
+// first fetch succeeds only BRIDGE_CALLBACK_ALLOWLIST applies.
+func (a *callbackAllowlist) check(w http.ResponseWriter, r *http.Request, cfg config.Config, metrics *metrics.Registry) bool {
+	if len(cfg.CallbackAllowlist) == 0 && !cfg.CallbackAllowlistAuto {
+		return true
+	}
+	addr, ok := clientAddr(r, cfg.TrustedProxies)
+	if ok && a.allows(cfg, addr) {
+		return true
+	}
+	label := "invalid"
+	if ok {
+		label = addr.String()
+	}
+	a.mu.Lock()
+	if a.rejected == nil {
+		a.rejected = make(map[string]bool)
+	}
+	first := !a.rejected[label]
+	switch {
+	case first && len(a.rejected) >= maxRejectedIPs:
+		label, first = "other", false
+	case first:
+		a.rejected[label] = true
+	}
+	a.mu.Unlock()
+	if first {
+		slog.Warn("wecom callback from unlisted address", "ip", label, "path", r.URL.Path)
+	}
+	metrics.Inc("wecom_bridge_callback_ip_rejected_total", "ip", label)
+	w.WriteHeader(http.StatusForbidden)
+	_, _ = w.Write([]byte("forbidden"))
+	return false
+}
+
+// clientAddr returns the request's source address. When the peer is a
+// trusted proxy, the nearest untrusted X-Forwarded-For entry is used.
+func clientAddr(r *http.Request, trusted []netip.Prefix) (netip.Addr, bool) {
+	ap, err := netip.ParseAddrPort(r.RemoteAddr)
+	if err != nil {
+		return netip.Addr{}, false
+	}
+	addr := ap.Addr().Unmap()
+	isTrusted := func(a netip.Addr) bool {
+		for _, p := range trusted {
+			if p.Contains(a) {
+				return true
+			}
+		}
+		return false
+	}
+	if !isTrusted(addr) {
+		return addr, true
+	}
+	hops := strings.Split(strings.Join(r.Header.Values("X-Forwarded-For"), ","), ",")
+	for i := len(hops) - 1; i >= 0; i-- {
+		hop, err := netip.ParseAddr(strings.TrimSpace(hops[i]))
+		if err != nil {
+			return netip.Addr{}, false
+		}
+		if hop = hop.Unmap(); !isTrusted(hop) {
+			return hop, true
+		}
+	}
+	return addr, true
+}
+
+// refreshCallbackIPs fetches WeCom's callback IPs every
+// BRIDGE_CALLBACK_ALLOWLIST_REFRESH, retrying failures after a minute. The
+// previous list stays in force while a refresh fails.
+func (s *bridgeState) refreshCallbackIPs(cfg config.Config) {
+	for {
+		wait := cfg.CallbackAllowlistRefresh
+		prefixes, err := s.fetchCallbackIPs(cfg)
+		if err != nil {
+			slog.Warn("wecom callback ip refresh failed", "err", err)
+			s.metrics.Inc("wecom_bridge_callback_ip_refresh_total", "result", "error")
+			wait = min(wait, time.Minute)
+		} else {
+			s.callbackIPs.set(prefixes)
+			s.metrics.Inc("wecom_bridge_callback_ip_refresh_total", "result", "ok")
+			slog.Info("wecom callback ips refreshed", "count", len(prefixes))
+		}
+		select {
+		case <-s.closing:
+			return
+		case <-time.After(wait):
+		}
+	}
+}
+
+// fetchCallbackIPs calls getcallbackip with the first managed token that
+// can be fetched.
+func (s *bridgeState) fetchCallbackIPs(cfg config.Config) ([]netip.Prefix, error) {
+	var token string
+	var err error
+	for _, m := range s.tokenManagers() {
+		if m.secret == "" {
+			continue
+		}
+		if token, err = m.get(); err == nil {
+			break
+		}
+	}
+	if token == "" {
+		if err == nil {
+			err = errors.New("no managed access token")
+		}
+		return nil, err
+	}
+	resp, err := qyapiClient(cfg.ProxyTimeouts["gettoken"]).Get(fmt.Sprintf("https://qyapi.weixin.qq.com/cgi-bin/getcallbackip?access_token=%s", url.QueryEscape(token)))
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	var result struct {
+		ErrCode int      `json:"errcode"`
+		ErrMsg  string   `json:"errmsg"`
+		IPList  []string `json:"ip_list"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&result); err != nil {
+		return nil, fmt.Errorf("getcallbackip decode: %w", err)
+	}
+	if result.ErrCode != 0 {
+		return nil, fmt.Errorf("getcallbackip errcode %d %s", result.ErrCode, result.ErrMsg)
+	}
+	var prefixes []netip.Prefix
+	for _, item := range result.IPList {
+		p, err := config.ParsePrefixes([]string{item})
+		if err != nil {
+			slog.Warn("wecom callback ip skipped", "ip", item, "err", err)
+			continue
+		}
+		prefixes = append(prefixes, p...)
+	}
+	if len(prefixes) == 0 {
+		return nil, errors.New("getcallbackip returned no addresses")
+	}
+	return prefixes, nil
+}
+
+func handleWeComVerify(w http.ResponseWriter, r *http.Request, cfg config.Config, state *bridgeState) {
+	_, reply, err := wecomAdapter{cfg: cfg, state: state}.verifyCallback(r, nil)
+	if err != nil {
+		writeCallbackError(w, r, state, cfg.AgentName, err)
+		return
+	}
+	writeCallbackReply(w, *reply)
+}
+
+// validPlainSignature checks the signature of plaintext callbacks: SHA-1
+// over the sorted token, timestamp and nonce, sent as ?signature=.
+func validPlainSignature(cfg config.Config, q url.Values) bool {
+	signature := q.Get("signature")
+	return wxcrypto.VerifySignature(signature, cfg.WeComToken, q.Get("timestamp"), q.Get("nonce"))
+}
+
+// plainCallback reports whether a callback carries its content unencrypted:
+// always in plaintext mode, and in compat mode when it lacks the encrypted
+// copy or msg_signature. Compat apps send the plaintext fields next to
+// Encrypt and sign both ways.
+func plainCallback(cfg config.Config, q url.Values, encrypted string) bool {
+	return cfg.CallbackMode == config.CallbackPlaintext || (cfg.CallbackMode == config.CallbackCompat && (encrypted == "" || q.Get("msg_signature") == ""))
+}
+
+func handleWeComPost(w http.ResponseWriter, r *http.Request, cfg config.Config, state *bridgeState) {
+	body, err := readBody(r)
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		_, _ = w.Write([]byte("missing body"))
+		return
+	}
+	// Only the signature is checked here; the workers decrypt, so a flood
+	// of callbacks costs the handlers little before the queue sheds it.
+	a := wecomAdapter{cfg: cfg, state: state}
+	encrypted := callback.ExtractEncrypted(body)
+	err = a.configured()
+	if err == nil {
+		_, err = a.checkSignature(r.URL.Query(), encrypted, "")
+	}
+	if err != nil {
+		writeCallbackError(w, r, state, cfg.AgentName, err)
+		return
+	}
+
+	job := callbackJob{agent: cfg.AgentName, requestID: requestID(r.Context()), path: r.URL.Path, remoteAddr: r.RemoteAddr, receivedAt: time.Now().UTC(), reply: make(chan callbackReply, 1)}
+	if plainCallback(cfg, r.URL.Query(), encrypted) {
+		job.plain, job.unencrypted = string(body), true
+	} else {
+		job.encrypted = encrypted
+	}
+	select {
+	case state.callbacks.queue <- job:
+	default:
+		// Shed load: WeCom retries callbacks that are not acknowledged.
+		state.metrics.Inc("wecom_bridge_callbacks_shed_total")
+		w.WriteHeader(http.StatusServiceUnavailable)
+		_, _ = w.Write([]byte("overloaded"))
+		return
+	}
+
+	timer := time.NewTimer(cfg.CallbackTimeout)
+	defer timer.Stop()
+	select {
+	case reply := <-job.reply:
+		if reply.contentType != "" {
+			w.Header().Set("Content-Type", reply.contentType)
+		}
+		w.WriteHeader(reply.status)
+		_, _ = w.Write(reply.body)
+	case <-timer.C:
+		state.metrics.Inc("wecom_bridge_callback_timeouts_total")
+		w.WriteHeader(http.StatusServiceUnavailable)
+		_, _ = w.Write([]byte("processing timeout"))
+	case <-r.Context().Done():
+	}
+}
@@ -0,0 +1,285 @@
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/Tennen/Paimon/tools/bridge/archive"
+	"github.com/Tennen/Paimon/tools/bridge/config"
+	"github.com/Tennen/Paimon/tools/bridge/hub"
+	"github.com/Tennen/Paimon/tools/bridge/metrics"
+	"github.com/Tennen/Paimon/tools/bridge/outbox"
+	"github.com/Tennen/Paimon/tools/wecom/callback"
+	wxcrypto "github.com/Tennen/Paimon/tools/wecom/crypto"
+)
+
+const callbackAESKey = "abcdefghijklmnopqrstuvwxyz0123456789ABCDEFG"
+
+// callbackConfig is an encrypted-mode app with one worker.
+func callbackConfig() config.Config {
+	return config.Config{
+		WeComToken:      "token",
+		WeComAESKey:     callbackAESKey,
+		WeComReceiveID:  "corp",
+		CallbackWorkers: 1,
+		CallbackQueue:   4,
+		CallbackTimeout: 5 * time.Second,
+		FailureMode:     "ack",
+		DedupTTL:        time.Hour,
+	}
+}
+
+// callbackState is a bridge state with the stores processCallback uses. The
+// callback pool is left to the test.
+func callbackState(cfg config.Config) *bridgeState {
+	state := &bridgeState{
+		nextEventID: 1,
+		bufferCap:   config.DefaultBufferSize,
+		cfg:         cfg,
+		closing:     make(chan struct{}),
+		metrics:     metrics.New(),
+		archive:     archive.New(100),
+		outbox:      outbox.New(),
+		usage:       &usageTracker{buckets: make(map[usageKey]*usageCounters)},
+		dedup:       &callbackDeduper{ttl: cfg.DedupTTL, seen: make(map[string]time.Time)},
+		replies:     &replySlots{slots: make(map[string]*replySlot)},
+	}
+	state.clients = hub.New(streamHubShards, streamHubQueue)
+	return state
+}
+
+// textCallback is the XML of a text message with msgID from alice.
+func textCallback(msgID, content string) string {
+	return fmt.Sprintf("<xml><ToUserName>corp</ToUserName><FromUserName>alice</FromUserName><CreateTime>1700000000</CreateTime><MsgType>text</MsgType><Content>%s</Content><MsgId>%s</MsgId><AgentID>1000002</AgentID></xml>", content, msgID)
+}
+
+// postCallback sends plain encrypted and signed as WeCom would, or with
+// encrypted as is when plain is empty.
+func postCallback(t *testing.T, cfg config.Config, state *bridgeState, plain, encrypted string) *httptest.ResponseRecorder {
+	t.Helper()
+	if plain != "" {
+		var err error
+		if encrypted, err = wxcrypto.Encrypt(plain, cfg.WeComAESKey, cfg.WeComReceiveID); err != nil {
+			t.Fatal(err)
+		}
+	}
+	signature := wxcrypto.Signature(cfg.WeComToken, "1700000000", "nonce", encrypted)
+	r := httptest.NewRequest(http.MethodPost, "/wecom?msg_signature="+signature+"&timestamp=1700000000&nonce=nonce", strings.NewReader("<xml><ToUserName>corp</ToUserName><Encrypt>"+encrypted+"</Encrypt></xml>"))
+	w := httptest.NewRecorder()
+	handleWeComPost(w, r, cfg, state)
+	return w
+}
+
+// streamTexts returns the text of every buffered event.
+func streamTexts(state *bridgeState) []string {
+	var texts []string
+	for _, ev := range state.getMissed(0, streamFilter{}) {
+		var payload struct {
+			Text string `json:"text"`
+		}
+		_ = json.Unmarshal(ev.Payload, &payload)
+		texts = append(texts, payload.Text)
+	}
+	return texts
+}
+
+func TestCallbackDecryptsInWorker(t *testing.T) {
+	cfg := callbackConfig()
+	state := callbackState(cfg)
+	defer state.clients.Close()
+	state.callbacks = newCallbackPool(cfg, state)
+
+	if w := postCallback(t, cfg, state, textCallback("m1", "hi"), ""); w.Code != http.StatusOK || w.Body.String() != "success" {
+		t.Fatal(w.Code, w.Body.String())
+	}
+	if got := strings.Join(streamTexts(state), ","); got != "hi" {
+		t.Fatal(got)
+	}
+
+	// A signed payload that does not decrypt passes the handler and is
+	// rejected by the worker, which records the failure.
+	if w := postCallback(t, cfg, state, "", "bm90IGEgdmFsaWQgY2lwaGVydGV4dA=="); w.Code != http.StatusBadRequest || w.Body.String() != "decrypt failed" {
+		t.Fatal(w.Code, w.Body.String())
+	}
+	if failures := state.failures.recent(); len(failures) != 1 || failures[0].Kind != "decrypt" || failures[0].Path != "/wecom" {
+		t.Fatalf("%+v", failures)
+	}
+
+	// A bad signature never reaches the queue.
+	r := httptest.NewRequest(http.MethodPost, "/wecom?msg_signature=bad&timestamp=1700000000&nonce=nonce", strings.NewReader("<xml><Encrypt>x</Encrypt></xml>"))
+	w := httptest.NewRecorder()
+	handleWeComPost(w, r, cfg, state)
+	if w.Code != http.StatusUnauthorized {
+		t.Fatal(w.Code, w.Body.String())
+	}
+	if failures := state.failures.recent(); len(failures) != 2 || failures[0].Kind != "signature" {
+		t.Fatalf("%+v", failures)
+	}
+}
+
+func TestCallbackQueueFull(t *testing.T) {
+	cfg := callbackConfig()
+	cfg.CallbackTimeout = 50 * time.Millisecond
+	state := callbackState(cfg)
+	defer state.clients.Close()
+	// No workers: the first callback waits in the queue until the handler
+	// gives up, the second finds the queue full.
+	state.callbacks = &callbackPool{queue: make(chan callbackJob, 1)}
+	if w := postCallback(t, cfg, state, textCallback("m1", "a"), ""); w.Code != http.StatusServiceUnavailable || w.Body.String() != "processing timeout" {
+		t.Fatal(w.Code, w.Body.String())
+	}
+	start := time.Now()
+	if w := postCallback(t, cfg, state, textCallback("m2", "b"), ""); w.Code != http.StatusServiceUnavailable || w.Body.String() != "overloaded" {
+		t.Fatal(w.Code, w.Body.String())
+	}
+	if time.Since(start) >= cfg.CallbackTimeout {
+		t.Fatal("a full queue waited for the callback timeout")
+	}
+	var metrics strings.Builder
+	state.metrics.WriteText(&metrics)
+	if !strings.Contains(metrics.String(), "wecom_bridge_callbacks_shed_total 1") || !strings.Contains(metrics.String(), "wecom_bridge_callback_timeouts_total 1") {
+		t.Fatal(metrics.String())
+	}
+
+	// The queued callback is still delivered once a worker runs, and its
+	// redelivery is a duplicate.
+	queued := <-state.callbacks.queue
+	processCallback(cfg, state, queued)
+	if reply := <-queued.reply; reply.status != http.StatusOK {
+		t.Fatal(reply.status)
+	}
+	state.callbacks = newCallbackPool(cfg, state)
+	if w := postCallback(t, cfg, state, textCallback("m1", "a"), ""); w.Code != http.StatusOK {
+		t.Fatal(w.Code, w.Body.String())
+	}
+	if got := strings.Join(streamTexts(state), ","); got != "a" {
+		t.Fatal(got)
+	}
+}
+
+func TestCallbackDeliveryErrorReleasesDedup(t *testing.T) {
+	for _, mode := range []string{"retry", "ack"} {
+		t.Run(mode, func(t *testing.T) {
+			cfg := callbackConfig()
+			cfg.FailureMode = mode
+			state := callbackState(cfg)
+			defer state.clients.Close()
+			path := filepath.Join(t.TempDir(), "archive.jsonl")
+			if err := state.archive.Open(path); err != nil {
+				t.Fatal(err)
+			}
+			state.callbacks = newCallbackPool(cfg, state)
+
+			// The archive cannot be written, so delivery fails.
+			_ = state.archive.Close()
+			w := postCallback(t, cfg, state, textCallback("m1", "hi"), "")
+			// Only retry mode tells WeCom, and lets its redelivery through
+			// the deduplication window.
+			if mode == "retry" && (w.Code != http.StatusServiceUnavailable || w.Body.String() != "delivery failed") || mode == "ack" && w.Code != http.StatusOK {
+				t.Fatal(w.Code, w.Body.String())
+			}
+
+			state.archive = archive.New(100)
+			if err := state.archive.Open(path); err != nil {
+				t.Fatal(err)
+			}
+			defer state.archive.Close()
+			if w := postCallback(t, cfg, state, textCallback("m1", "hi"), ""); w.Code != http.StatusOK {
+				t.Fatal(w.Code, w.Body.String())
+			}
+			want := map[string]string{"retry": "hi,hi", "ack": "hi"}[mode]
+			if got := strings.Join(streamTexts(state), ","); got != want {
+				t.Fatalf("broadcast %q", got)
+			}
+			var metrics strings.Builder
+			state.metrics.WriteText(&metrics)
+			if duplicates := strings.Contains(metrics.String(), "wecom_bridge_duplicates_total 1"); duplicates != (mode == "ack") {
+				t.Fatal(metrics.String())
+			}
+		})
+	}
+}
+
+func TestPassiveReplyDeadline(t *testing.T) {
+	cfg := callbackConfig()
+	cfg.ReplyWait = 300 * time.Millisecond
+	state := callbackState(cfg)
+	defer state.clients.Close()
+	state.callbacks = newCallbackPool(cfg, state)
+	reply := func(msgID, text string) int {
+		w := httptest.NewRecorder()
+		handleReply(w, httptest.NewRequest(http.MethodPost, "/reply/"+msgID, strings.NewReader(`{"text":"`+text+`"}`)), cfg, state)
+		return w.Code
+	}
+	post := func(msgID string) <-chan *httptest.ResponseRecorder {
+		done := make(chan *httptest.ResponseRecorder, 1)
+		go func() { done <- postCallback(t, cfg, state, textCallback(msgID, "question"), "") }()
+		return done
+	}
+
+	// A reply within ReplyWait becomes the encrypted answer to the callback.
+	done := post("m1")
+	deadline := time.Now().Add(2 * time.Second)
+	for reply("m1", "answer") == http.StatusNotFound {
+		if time.Now().After(deadline) {
+			t.Fatal("no reply slot opened")
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+	w := <-done
+	plain, ok := wxcrypto.Decrypt(callback.ExtractEncrypted(w.Body.Bytes()), cfg.WeComAESKey, cfg.WeComReceiveID)
+	if w.Code != http.StatusOK || !ok || !strings.Contains(plain, "<Content><![CDATA[answer]]></Content>") || !strings.Contains(plain, "<ToUserName><![CDATA[alice]]></ToUserName>") {
+		t.Fatal(w.Code, w.Body.String(), plain)
+	}
+	if code := reply("m1", "again"); code != http.StatusNotFound {
+		t.Fatal(code)
+	}
+
+	// Without one the callback is answered "success" once ReplyWait has
+	// passed, well inside the callback timeout.
+	start := time.Now()
+	if w := <-post("m2"); w.Code != http.StatusOK || w.Body.String() != "success" {
+		t.Fatal(w.Code, w.Body.String())
+	}
+	if elapsed := time.Since(start); elapsed < cfg.ReplyWait || elapsed >= cfg.CallbackTimeout {
+		t.Fatal(elapsed)
+	}
+	if code := reply("m2", "late"); code != http.StatusNotFound {
+		t.Fatal(code)
+	}
+
+	// ReplyWait counts from arrival, so time spent in the queue is not
+	// waited again.
+	encrypted, _ := wxcrypto.Encrypt(textCallback("m3", "queued"), cfg.WeComAESKey, cfg.WeComReceiveID)
+	job := callbackJob{encrypted: encrypted, path: "/wecom", receivedAt: time.Now().Add(-cfg.ReplyWait), reply: make(chan callbackReply, 1)}
+	start = time.Now()
+	processCallback(cfg, state, job)
+	if r := <-job.reply; r.status != http.StatusOK || string(r.body) != "success" || time.Since(start) >= cfg.ReplyWait {
+		t.Fatal(r.status, string(r.body), time.Since(start))
+	}
+	var metrics strings.Builder
+	state.metrics.WriteText(&metrics)
+	if !strings.Contains(metrics.String(), `wecom_bridge_passive_replies_total{result="sent"} 1`) || !strings.Contains(metrics.String(), `wecom_bridge_passive_replies_total{result="expired"} 2`) {
+		t.Fatal(metrics.String())
+	}
+}
+
+func TestReplyWaitBelowCallbackTimeout(t *testing.T) {
+	for _, tc := range []struct{ wait, timeout, want string }{
+		{"2s", "5s", "2s"},
+		{"10s", "3s", "2.5s"},
+		{"1s", "300ms", "0s"},
+	} {
+		t.Setenv("BRIDGE_REPLY_WAIT", tc.wait)
+		t.Setenv("BRIDGE_CALLBACK_TIMEOUT", tc.timeout)
+		if got := config.Load().ReplyWait.String(); got != tc.want {
+			t.Errorf("wait %s, timeout %s: got %s", tc.wait, tc.timeout, got)
+		}
+	}
+}
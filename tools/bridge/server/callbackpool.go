@@ -0,0 +1,220 @@
+package server
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/Tennen/Paimon/tools/bridge/config"
+)
+
+// callbackPool decrypts and broadcasts verified callbacks on a fixed set of
+// workers behind a bounded queue, so slow sinks never hold up WeCom.
+type callbackPool struct {
+	queue chan callbackJob
+	busy  atomic.Int64
+	wg    sync.WaitGroup
+}
+
+// callbackJob is one signature-verified callback waiting for a worker.
+type callbackJob struct {
+	agent      string
+	requestID  string
+	path       string
+	remoteAddr string
+	// A callback with a verified signature: encrypted is its Encrypt field,
+	// which the worker decrypts into plain, or plain is the XML as received
+	// when it is unencrypted.
+	encrypted   string
+	plain       string
+	unencrypted bool
+	receivedAt  time.Time
+	reply       chan callbackReply
+}
+
+// callbackReply is the answer a worker hands back to the waiting handler
+// once the event is durable; broadcasting continues after it is sent.
+type callbackReply struct {
+	status      int
+	contentType string
+	body        []byte
+}
+
+func newCallbackPool(cfg config.Config, state *bridgeState) *callbackPool {
+	p := &callbackPool{queue: make(chan callbackJob, cfg.CallbackQueue)}
+	for i := 0; i < cfg.CallbackWorkers; i++ {
+		p.wg.Add(1)
+		go func() {
+			defer p.wg.Done()
+			for job := range p.queue {
+				p.busy.Add(1)
+				processCallback(state.config(), state, job)
+				p.busy.Add(-1)
+			}
+		}()
+	}
+	return p
+}
+
+// drain stops accepting callbacks and waits for the queued ones to finish
+// or ctx to expire. No handler may enqueue afterwards.
+func (p *callbackPool) drain(ctx context.Context) {
+	close(p.queue)
+	done := make(chan struct{})
+	go func() {
+		p.wg.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-ctx.Done():
+		slog.Warn("shutdown: callbacks still processing", "callbacks", p.busy.Load())
+	}
+}
+
+// processCallback decrypts a verified callback, persists it to the outbox,
+// answers the waiting handler and then broadcasts and archives the event.
+func processCallback(cfg config.Config, state *bridgeState, job callbackJob) {
+	respond := func(status int, contentType string, body []byte) {
+		job.reply <- callbackReply{status: status, contentType: contentType, body: body}
+	}
+	// Work continues after the request is answered, so only its ID is kept.
+	ctx := context.WithValue(context.Background(), requestIDKey{}, job.requestID)
+	if job.agent != "" {
+		cfg, _ = cfg.ForAgent(job.agent)
+	}
+
+	if job.encrypted != "" {
+		plain, err := wecomAdapter{cfg: cfg, state: state}.decrypt(job.encrypted, "")
+		if err != nil {
+			state.addCallbackFailure(ctx, callbackFailure{Kind: "decrypt", Agent: job.agent, Path: job.path, RemoteAddr: job.remoteAddr, RequestID: job.requestID})
+			respond(http.StatusBadRequest, "", []byte("decrypt failed"))
+			return
+		}
+		job.plain = string(plain)
+	}
+
+	if job.unencrypted {
+		// Passive replies to a plaintext callback go back unencrypted.
+		cfg.CallbackMode = config.CallbackPlaintext
+	}
+
+	msg, _ := wecomAdapter{cfg: cfg, state: state}.decodeInbound([]byte(job.plain))
+	if msg == nil {
+		respond(http.StatusOK, "", []byte("success"))
+		return
+	}
+
+	dedupKey := callbackDedupKey(cfg, msg)
+	if dedupKey != "" && !state.dedup.claim(dedupKey, state.metrics) {
+		state.metrics.Inc("wecom_bridge_duplicates_total")
+		slog.InfoContext(ctx, "wecom duplicate callback ignored", "key", dedupKey)
+		respond(http.StatusOK, "", []byte("success"))
+		return
+	}
+
+	payload := map[string]any{
+		"messageId":  firstNonEmpty(msg.MsgID, fmt.Sprintf("%s-%d", msg.FromUser, job.receivedAt.UnixMilli())),
+		"sessionId":  msg.FromUser,
+		"fromUser":   msg.FromUser,
+		"toUser":     msg.ToUser,
+		"text":       msg.Content,
+		"msgType":    msg.MsgType,
+		"event":      msg.Event,
+		"eventKey":   msg.EventKey,
+		"agentId":    msg.AgentID,
+		"mediaId":    msg.MediaID,
+		"picUrl":     msg.PicURL,
+		"receivedAt": job.receivedAt.Format(time.RFC3339),
+	}
+	addTimeFields(cfg, payload, msg.CreateTime, job.receivedAt)
+	if len(msg.Detail) > 0 {
+		payload["eventDetail"] = msg.Detail
+	}
+	if msg.ChatID != "" {
+		payload["chatId"] = msg.ChatID
+	}
+	if len(cfg.Agents) > 0 {
+		payload["agent"] = firstNonEmpty(cfg.AgentName, "default")
+	}
+
+	labels, drop := applyEventRules(cfg.Rules, msg, payload, state.metrics)
+	if drop {
+		slog.InfoContext(ctx, "wecom message dropped by rules", "message_id", payload["messageId"])
+		respond(http.StatusOK, "", []byte("success"))
+		return
+	}
+	if len(labels) > 0 {
+		payload["labels"] = labels
+	}
+	if topics := routeTopics(cfg.Routes, msg, labels); len(topics) > 0 {
+		payload["topics"] = topics
+	}
+
+	// In "retry" mode WeCom only hears success once the event is persisted,
+	// broadcast and archived; any failure answers 503 so WeCom redelivers.
+	retry := cfg.FailureMode == "retry"
+	seq, err := state.outbox.Add(payload)
+	if err != nil {
+		slog.ErrorContext(ctx, "wecom outbox write failed", "message_id", payload["messageId"], "err", err)
+		state.metrics.Inc("wecom_bridge_delivery_failures_total", "stage", "outbox")
+		if retry {
+			state.dedup.release(dedupKey)
+			respond(http.StatusServiceUnavailable, "", []byte("outbox unavailable"))
+			return
+		}
+	}
+
+	reply := callbackReply{status: http.StatusOK, body: []byte("success")}
+	var slot chan string
+	if ackText := state.currentTunables().AutoAckText; shouldAutoAck(cfg, ackText, msg) {
+		xmlReply, err := buildTextReply(cfg, msg, ackText)
+		if err == nil {
+			reply = callbackReply{status: http.StatusOK, contentType: "application/xml", body: xmlReply}
+		} else {
+			slog.WarnContext(ctx, "wecom auto-ack failed", "err", err)
+		}
+	} else if cfg.ReplyWait > 0 && msg.MsgID != "" && msg.MsgType != "event" {
+		// Hold the callback open so a consumer can answer it passively.
+		slot = state.replies.open(msg.MsgID)
+		defer state.replies.close(msg.MsgID)
+		payload["replyable"] = true
+	}
+	if !retry && slot == nil {
+		job.reply <- reply
+	}
+
+	if cfg.LinkExtract && msg.MsgType == "text" {
+		if links := state.links.collect(msg.Content, cfg.LinkUnfurl, state.metrics); len(links) > 0 {
+			payload["links"] = links
+		}
+	}
+	if cfg.ContactEnrich && msg.MsgType == "event" {
+		state.contacts.enrich(ctx, cfg, state, msg, payload)
+	}
+	deliverErr := deliverInbound(state, payload)
+	state.outbox.Flush(seq)
+	if retry && deliverErr != nil {
+		// Let WeCom's redelivery through the deduplication window.
+		state.dedup.release(dedupKey)
+		respond(http.StatusServiceUnavailable, "", []byte("delivery failed"))
+	} else if retry || slot != nil {
+		if slot != nil {
+			reply = awaitPassiveReply(ctx, cfg, state, msg, slot, job.receivedAt, reply)
+		}
+		job.reply <- reply
+	}
+
+	if cfg.Welcome != nil && msg.MsgType == "event" && containsFold(cfg.Welcome.Events, msg.Event) {
+		go sendWelcome(cfg, state, msg)
+	}
+	if msg.MsgType == "event" && msg.Event == "kf_msg_or_event" && state.kf != nil {
+		openKfID, _ := msg.Detail["openKfId"].(string)
+		token, _ := msg.Detail["token"].(string)
+		state.kf.trigger(openKfID, token)
+	}
+}
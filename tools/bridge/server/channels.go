@@ -0,0 +1,388 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/Tennen/Paimon/tools/bridge/archive"
+	"github.com/Tennen/Paimon/tools/bridge/config"
+	"github.com/Tennen/Paimon/tools/wecom/callback"
+	wxcrypto "github.com/Tennen/Paimon/tools/wecom/crypto"
+)
+
+// channelAdapter connects an IM platform to the bridge's pipeline:
+// callbacks are authenticated and decoded into the common message shape,
+// then go through rules, routes and the event stream like WeCom's; sends
+// and media downloads go through the platform's API.
+type channelAdapter interface {
+	// verifyCallback authenticates a callback and returns its plaintext
+	// body. A non-nil reply answers a handshake (URL verification) instead.
+	// Failures are *callbackError.
+	verifyCallback(r *http.Request, body []byte) ([]byte, *callbackReply, error)
+	// decodeInbound parses a verified body; nil means nothing to publish.
+	decodeInbound(plain []byte) (*wecomMessage, error)
+	// sendMessage sends text to a user or chat and returns the message ID.
+	sendMessage(to, text string) (string, error)
+	// fetchMedia downloads a file named by an inbound message's mediaId.
+	fetchMedia(mediaID string) ([]byte, string, error)
+}
+
+// callbackError rejects a callback with status. A kind (signature,
+// decrypt) records it as a failure for /admin/failures.
+type callbackError struct {
+	status int
+	kind   string
+	detail string
+	msg    string
+}
+
+func (e *callbackError) Error() string {
+	return e.msg
+}
+
+func writeCallbackError(w http.ResponseWriter, r *http.Request, state *bridgeState, agent string, err error) {
+	var ce *callbackError
+	if !errors.As(err, &ce) {
+		ce = &callbackError{status: http.StatusBadRequest, msg: err.Error()}
+	}
+	if ce.kind != "" {
+		state.recordCallbackFailure(r, agent, ce.kind, ce.detail)
+	}
+	w.WriteHeader(ce.status)
+	_, _ = w.Write([]byte(ce.msg))
+}
+
+func writeCallbackReply(w http.ResponseWriter, reply callbackReply) {
+	if reply.contentType != "" {
+		w.Header().Set("Content-Type", reply.contentType)
+	}
+	w.WriteHeader(reply.status)
+	_, _ = w.Write(reply.body)
+}
+
+// wecomAdapter is the WeCom app of cfg. /wecom uses its callback steps
+// around the callback pool, which adds passive replies and the outbox;
+// /proxy/channels/wecom uses its send and media calls.
+type wecomAdapter struct {
+	cfg   config.Config
+	state *bridgeState
+}
+
+func (a wecomAdapter) verifyCallback(r *http.Request, body []byte) ([]byte, *callbackReply, error) {
+	q := r.URL.Query()
+	if err := a.configured(); err != nil {
+		return nil, nil, err
+	}
+	if r.Method == http.MethodGet {
+		echostr := q.Get("echostr")
+		if echostr == "" {
+			return nil, nil, &callbackError{status: http.StatusBadRequest, msg: "missing echostr"}
+		}
+		// Plaintext verification signs only token, timestamp and nonce
+		// and expects echostr back as is.
+		plain, err := a.open(q, echostr, []byte(echostr), "url verification")
+		if err != nil {
+			return nil, nil, err
+		}
+		return nil, &callbackReply{status: http.StatusOK, contentType: "text/plain", body: plain}, nil
+	}
+	plain, err := a.open(q, callback.ExtractEncrypted(body), body, "")
+	return plain, nil, err
+}
+
+// configured fails when the app lacks the token or AES key its callback
+// mode needs.
+func (a wecomAdapter) configured() error {
+	if a.cfg.WeComToken == "" || (a.cfg.WeComAESKey == "" && a.cfg.CallbackMode != config.CallbackPlaintext) {
+		return &callbackError{status: http.StatusInternalServerError, msg: "missing token or aes key"}
+	}
+	return nil
+}
+
+// open checks a callback's signature and returns raw for unencrypted
+// callbacks, or encrypted decrypted.
+func (a wecomAdapter) open(q url.Values, encrypted string, raw []byte, detail string) ([]byte, error) {
+	plain, err := a.checkSignature(q, encrypted, detail)
+	if err != nil || plain {
+		return raw, err
+	}
+	return a.decrypt(encrypted, detail)
+}
+
+// checkSignature checks a callback's signature, reporting whether it is
+// unencrypted. It is cheap enough for the request handler; decryption is
+// left to the callback workers.
+func (a wecomAdapter) checkSignature(q url.Values, encrypted, detail string) (bool, error) {
+	cfg := a.cfg
+	if plainCallback(cfg, q, encrypted) {
+		if !validPlainSignature(cfg, q) {
+			return true, &callbackError{status: http.StatusUnauthorized, kind: "signature", detail: firstNonEmpty(detail, "plaintext"), msg: "invalid signature"}
+		}
+		return true, nil
+	}
+	if encrypted == "" {
+		return false, &callbackError{status: http.StatusBadRequest, msg: "missing encrypt"}
+	}
+	signature := firstNonEmpty(q.Get("msg_signature"), q.Get("signature"))
+	if !wxcrypto.VerifySignature(signature, cfg.WeComToken, q.Get("timestamp"), q.Get("nonce"), encrypted) {
+		return false, &callbackError{status: http.StatusUnauthorized, kind: "signature", detail: detail, msg: "invalid signature"}
+	}
+	return false, nil
+}
+
+// decrypt opens the Encrypt field of a callback whose signature was checked.
+func (a wecomAdapter) decrypt(encrypted, detail string) ([]byte, error) {
+	cfg := a.cfg
+	plain, ok := wxcrypto.Decrypt(encrypted, cfg.WeComAESKey, cfg.WeComReceiveID)
+	if !ok {
+		return nil, &callbackError{status: http.StatusBadRequest, kind: "decrypt", detail: detail, msg: "decrypt failed"}
+	}
+	return []byte(plain), nil
+}
+
+func (a wecomAdapter) decodeInbound(plain []byte) (*wecomMessage, error) {
+	return callback.Parse(string(plain)), nil
+}
+
+func (a wecomAdapter) sendMessage(to, text string) (string, error) {
+	token := a.state.managedToken(a.cfg.WeComAgentID)
+	if token == "" {
+		return "", errors.New("no managed access token")
+	}
+	body, _ := json.Marshal(map[string]any{
+		"touser":  to,
+		"msgtype": "text",
+		"agentid": a.cfg.AgentIDNumber,
+		"text":    map[string]string{"content": text},
+	})
+	data, err := postWeComJSON(context.Background(), fmt.Sprintf("https://qyapi.weixin.qq.com/cgi-bin/message/send?access_token=%s", url.QueryEscape(token)), body, a.cfg.ProxyTimeouts["send"])
+	if err != nil {
+		return "", err
+	}
+	var result struct {
+		MsgID string `json:"msgid"`
+	}
+	_ = json.Unmarshal(data, &result)
+	return result.MsgID, nil
+}
+
+func (a wecomAdapter) fetchMedia(mediaID string) ([]byte, string, error) {
+	token := a.state.managedToken(a.cfg.WeComAgentID)
+	if token == "" {
+		return nil, "", errors.New("no managed access token")
+	}
+	query := url.Values{}
+	query.Set("access_token", token)
+	query.Set("media_id", mediaID)
+	resp, err := qyapiClient(a.cfg.ProxyTimeouts["media_get"]).Get(fmt.Sprintf("https://qyapi.weixin.qq.com/cgi-bin/media/get?%s", query.Encode()))
+	if err != nil {
+		return nil, "", err
+	}
+	defer resp.Body.Close()
+	data, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, "", err
+	}
+	contentType := resp.Header.Get("Content-Type")
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return nil, "", fmt.Errorf("http %d", resp.StatusCode)
+	}
+	if strings.Contains(strings.ToLower(contentType), "application/json") {
+		var result struct {
+			ErrCode int    `json:"errcode"`
+			ErrMsg  string `json:"errmsg"`
+		}
+		_ = json.Unmarshal(data, &result)
+		return nil, "", fmt.Errorf("errcode %d %s", result.ErrCode, result.ErrMsg)
+	}
+	return data, firstNonEmpty(contentType, "application/octet-stream"), nil
+}
+
+// channel returns the adapter serving name: "wecom" for the WECOM_* app,
+// otherwise a configured channel.
+func (s *bridgeState) channel(name string) (channelAdapter, bool) {
+	if name == "wecom" {
+		return wecomAdapter{cfg: s.config(), state: s}, true
+	}
+	a, ok := s.channels[name]
+	return a, ok
+}
+
+// publishInbound applies rules and routes to a message that arrived outside
+// the WeCom callback pool and delivers its payload. It returns false when a
+// rule dropped the message.
+func publishInbound(cfg config.Config, state *bridgeState, msg *wecomMessage, payload map[string]any, receivedAt time.Time) bool {
+	addTimeFields(cfg, payload, msg.CreateTime, receivedAt)
+	labels, drop := applyEventRules(cfg.Rules, msg, payload, state.metrics)
+	if drop {
+		return false
+	}
+	if len(labels) > 0 {
+		payload["labels"] = labels
+	}
+	if topics := routeTopics(cfg.Routes, msg, labels); len(topics) > 0 {
+		payload["topics"] = topics
+	}
+	_ = deliverInbound(state, payload)
+	return true
+}
+
+// handleChannelCallback receives the callbacks of a configured channel on
+// /channels/{name}, normalizes them and publishes them to the event stream
+// with "channel" set to its name.
+func handleChannelCallback(w http.ResponseWriter, r *http.Request, cfg config.Config, state *bridgeState) {
+	name := strings.TrimPrefix(r.URL.Path, "/channels/")
+	adapter, ok := state.channels[name]
+	if !ok {
+		w.WriteHeader(http.StatusNotFound)
+		_, _ = w.Write([]byte("unknown channel"))
+		return
+	}
+	if r.Method != http.MethodPost {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	body, err := readBody(r)
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		_, _ = w.Write([]byte("missing body"))
+		return
+	}
+	plain, reply, err := adapter.verifyCallback(r, body)
+	if err != nil {
+		writeCallbackError(w, r, state, name, err)
+		return
+	}
+	if reply != nil {
+		writeCallbackReply(w, *reply)
+		return
+	}
+	msg, err := adapter.decodeInbound(plain)
+	if err != nil {
+		slog.WarnContext(r.Context(), "channel callback undecodable", "channel", name, "err", err)
+		w.WriteHeader(http.StatusBadRequest)
+		_, _ = w.Write([]byte("invalid callback"))
+		return
+	}
+	// Acknowledge quickly; platforms redeliver slow callbacks.
+	if msg == nil {
+		_, _ = w.Write([]byte("success"))
+		return
+	}
+	if msg.MsgID != "" && !state.dedup.claim(fmt.Sprintf("wecom-bridge:dedup:channel:%s:%s", name, msg.MsgID), state.metrics) {
+		state.metrics.Inc("wecom_bridge_duplicates_total")
+		_, _ = w.Write([]byte("success"))
+		return
+	}
+	receivedAt := time.Now().UTC()
+	payload := map[string]any{
+		"messageId":  firstNonEmpty(msg.MsgID, fmt.Sprintf("%s-%d", msg.FromUser, receivedAt.UnixMilli())),
+		"sessionId":  firstNonEmpty(msg.ToUser, msg.FromUser),
+		"fromUser":   msg.FromUser,
+		"toUser":     msg.ToUser,
+		"text":       msg.Content,
+		"msgType":    msg.MsgType,
+		"event":      msg.Event,
+		"mediaId":    msg.MediaID,
+		"receivedAt": receivedAt.Format(time.RFC3339),
+		"channel":    name,
+	}
+	if len(msg.Detail) > 0 {
+		payload["eventDetail"] = msg.Detail
+	}
+	if publishInbound(cfg, state, msg, payload, receivedAt) {
+		state.metrics.Inc("wecom_bridge_channel_messages_total", "channel", name, "msgtype", msg.MsgType)
+	}
+	_, _ = w.Write([]byte("success"))
+}
+
+// handleProxyChannel serves POST /proxy/channels/{name}/send, a plain text
+// message to {"to","text"}, and GET /proxy/channels/{name}/media?media_id=
+// for any channel including "wecom".
+func handleProxyChannel(w http.ResponseWriter, r *http.Request, cfg config.Config, state *bridgeState) {
+	name, action, _ := strings.Cut(strings.TrimPrefix(r.URL.Path, "/proxy/channels/"), "/")
+	adapter, ok := state.channel(name)
+	if !ok {
+		w.WriteHeader(http.StatusNotFound)
+		_, _ = w.Write([]byte("unknown channel"))
+		return
+	}
+	switch action {
+	case "send":
+		if r.Method != http.MethodPost {
+			w.WriteHeader(http.StatusMethodNotAllowed)
+			return
+		}
+		if !checkBridgeAuth(w, r, cfg, config.ScopeProxySend) {
+			return
+		}
+		body, err := readBody(r)
+		if err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			_, _ = w.Write([]byte("missing body"))
+			return
+		}
+		var payload struct {
+			To   string `json:"to"`
+			Text string `json:"text"`
+		}
+		if json.Unmarshal(body, &payload) != nil || payload.To == "" || payload.Text == "" {
+			w.WriteHeader(http.StatusBadRequest)
+			_, _ = w.Write([]byte("to and text required"))
+			return
+		}
+		record := archive.Record{Kind: "outbound", SessionID: payload.To, ToUser: payload.To, MsgType: "text", Text: truncateRunes(payload.Text, archiveTextLimit), Requester: requesterIdentity(r, cfg), FullText: payload.Text}
+		msgID, err := adapter.sendMessage(payload.To, payload.Text)
+		record.MsgID = msgID
+		if err != nil {
+			record.Error = err.Error()
+		}
+		state.archive.Append(record)
+		state.sessions.observe(record, time.Now().UTC())
+		if err != nil {
+			state.metrics.Inc("wecom_bridge_channel_sends_total", "channel", name, "result", "error")
+			slog.WarnContext(r.Context(), "channel send failed", "channel", name, "err", err)
+			w.WriteHeader(http.StatusBadGateway)
+			_, _ = w.Write([]byte("send failed: " + err.Error()))
+			return
+		}
+		state.metrics.Inc("wecom_bridge_channel_sends_total", "channel", name, "result", "ok")
+		state.usage.record(record.Requester, func(c *usageCounters) { c.Sends++ })
+		w.Header().Set("Content-Type", "application/json")
+		_ = json.NewEncoder(w).Encode(map[string]any{"channel": name, "msgid": msgID})
+	case "media":
+		if r.Method != http.MethodGet {
+			w.WriteHeader(http.StatusMethodNotAllowed)
+			return
+		}
+		if !checkBridgeAuth(w, r, cfg, config.ScopeProxyMedia) {
+			return
+		}
+		mediaID := strings.TrimSpace(r.URL.Query().Get("media_id"))
+		if mediaID == "" {
+			w.WriteHeader(http.StatusBadRequest)
+			_, _ = w.Write([]byte("missing media_id"))
+			return
+		}
+		data, contentType, err := adapter.fetchMedia(mediaID)
+		if err != nil {
+			slog.WarnContext(r.Context(), "channel media failed", "channel", name, "err", err)
+			w.WriteHeader(http.StatusBadGateway)
+			_, _ = w.Write([]byte("media get failed: " + err.Error()))
+			return
+		}
+		state.usage.record(requesterIdentity(r, cfg), func(c *usageCounters) { c.MediaBytes += int64(len(data)) })
+		w.Header().Set("Content-Type", contentType)
+		_, _ = w.Write(data)
+	default:
+		w.WriteHeader(http.StatusNotFound)
+	}
+}
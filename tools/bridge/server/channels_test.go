@@ -0,0 +1,186 @@
+package server
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/Tennen/Paimon/tools/bridge/archive"
+	"github.com/Tennen/Paimon/tools/bridge/config"
+	"github.com/Tennen/Paimon/tools/bridge/hub"
+	"github.com/Tennen/Paimon/tools/bridge/metrics"
+)
+
+func channelTestState() *bridgeState {
+	state := &bridgeState{
+		nextEventID: 1,
+		bufferCap:   config.DefaultBufferSize,
+		metrics:     metrics.New(),
+		archive:     archive.New(100),
+		usage:       &usageTracker{buckets: make(map[usageKey]*usageCounters)},
+		dedup:       &callbackDeduper{ttl: time.Hour, seen: make(map[string]time.Time)},
+	}
+	state.clients = hub.New(streamHubShards, streamHubQueue)
+	return state
+}
+
+func TestWeComAdapterUsesAgentApp(t *testing.T) {
+	cfg, ok := config.Config{WeComAgentID: "1000001", AgentIDNumber: 1000001, Agents: []config.Agent{{Name: "sales", AgentID: "1000002"}}}.ForAgent("sales")
+	if !ok {
+		t.Fatal("agent not found")
+	}
+	fresh := time.Now().Add(time.Hour)
+	state := channelTestState()
+	defer state.clients.Close()
+	state.tokens = &tokenManager{token: "default", expiresAt: fresh}
+	state.agentTokens = map[string]*tokenManager{"1000002": {token: "sales", expiresAt: fresh}}
+
+	var requests []string
+	previous := outboundTransport
+	defer func() { outboundTransport = previous }()
+	outboundTransport = roundTripFunc(func(r *http.Request) (*http.Response, error) {
+		token := r.URL.Query().Get("access_token")
+		if r.URL.Path == "/cgi-bin/media/get" {
+			requests = append(requests, "media "+token)
+			return &http.Response{StatusCode: http.StatusOK, Header: http.Header{"Content-Type": {"image/png"}}, Body: io.NopCloser(strings.NewReader("png"))}, nil
+		}
+		var body map[string]json.RawMessage
+		_ = json.NewDecoder(r.Body).Decode(&body)
+		requests = append(requests, fmt.Sprintf("send %s %s", token, body["agentid"]))
+		return &http.Response{StatusCode: http.StatusOK, Header: make(http.Header), Body: io.NopCloser(strings.NewReader(`{"errcode":0,"errmsg":"ok","msgid":"m1"}`))}, nil
+	})
+
+	a := wecomAdapter{cfg: cfg, state: state}
+	if msgID, err := a.sendMessage("alice", "hi"); err != nil || msgID != "m1" {
+		t.Fatal(msgID, err)
+	}
+	if data, contentType, err := a.fetchMedia("media1"); err != nil || string(data) != "png" || contentType != "image/png" {
+		t.Fatal(string(data), contentType, err)
+	}
+	// The agent ID goes out as a JSON number, and both calls use the app's
+	// own token.
+	if got := strings.Join(requests, "; "); got != "send sales 1000002; media sales" {
+		t.Fatal(got)
+	}
+}
+
+func TestConfigRejectsNonNumericAgentID(t *testing.T) {
+	errs, _ := configProblems(config.Config{Port: 8080, WeComAgentID: "app", Agents: []config.Agent{{Name: "sales", AgentID: "1000002"}, {Name: "ops", AgentID: "x1"}}})
+	got := strings.Join(errs, "; ")
+	if !strings.Contains(got, `WECOM_AGENT_ID: agent ID "app" is not a number`) || !strings.Contains(got, `agent ops: agent ID "x1" is not a number`) || strings.Contains(got, "agent sales") {
+		t.Fatal(got)
+	}
+}
+
+// encryptFeishu is the inverse of decryptFeishu.
+func encryptFeishu(t *testing.T, plain []byte, encryptKey string) string {
+	key := sha256.Sum256([]byte(encryptKey))
+	block, err := aes.NewCipher(key[:])
+	if err != nil {
+		t.Fatal(err)
+	}
+	pad := aes.BlockSize - len(plain)%aes.BlockSize
+	data := append(bytes.Repeat([]byte{0}, aes.BlockSize), plain...)
+	data = append(data, bytes.Repeat([]byte{byte(pad)}, pad)...)
+	cipher.NewCBCEncrypter(block, data[:aes.BlockSize]).CryptBlocks(data[aes.BlockSize:], data[aes.BlockSize:])
+	return base64.StdEncoding.EncodeToString(data)
+}
+
+func TestFeishuChannel(t *testing.T) {
+	ch := config.Channel{Name: "lark", Type: "feishu", AppID: "cli_1", AppSecret: "s", VerificationToken: "vt", EncryptKey: "ek", APIBase: "https://feishu.test"}
+	state := channelTestState()
+	defer state.clients.Close()
+	state.channels = map[string]channelAdapter{"lark": newFeishuAdapter(ch, nil)}
+	cfg := config.Config{}
+
+	push := func(event map[string]any, tamper bool) *httptest.ResponseRecorder {
+		plain, _ := json.Marshal(event)
+		body, _ := json.Marshal(map[string]string{"encrypt": encryptFeishu(t, plain, ch.EncryptKey)})
+		req := httptest.NewRequest(http.MethodPost, "/channels/lark", bytes.NewReader(body))
+		sum := sha256.Sum256([]byte("1700000000" + "n1" + ch.EncryptKey + string(body)))
+		if tamper {
+			sum[0]++
+		}
+		req.Header.Set("X-Lark-Request-Timestamp", "1700000000")
+		req.Header.Set("X-Lark-Request-Nonce", "n1")
+		req.Header.Set("X-Lark-Signature", fmt.Sprintf("%x", sum))
+		w := httptest.NewRecorder()
+		handleChannelCallback(w, req, cfg, state)
+		return w
+	}
+
+	w := push(map[string]any{"type": "url_verification", "challenge": "c1", "token": "vt"}, false)
+	if w.Code != http.StatusOK || strings.TrimSpace(w.Body.String()) != `{"challenge":"c1"}` {
+		t.Fatal(w.Code, w.Body.String())
+	}
+	message := map[string]any{
+		"schema": "2.0",
+		"header": map[string]string{"event_id": "e1", "event_type": "im.message.receive_v1", "token": "vt"},
+		"event": map[string]any{
+			"sender":  map[string]any{"sender_id": map[string]string{"open_id": "ou_1"}},
+			"message": map[string]string{"message_id": "om_1", "create_time": "1700000000000", "chat_id": "oc_1", "chat_type": "p2p", "message_type": "text", "content": `{"text":"hello"}`},
+		},
+	}
+	if w := push(message, true); w.Code != http.StatusUnauthorized {
+		t.Fatal("tampered signature accepted:", w.Code)
+	}
+	message["header"] = map[string]string{"event_id": "e1", "event_type": "im.message.receive_v1", "token": "wrong"}
+	if w := push(message, false); w.Code != http.StatusUnauthorized {
+		t.Fatal("wrong verification token accepted:", w.Code)
+	}
+	message["header"] = map[string]string{"event_id": "e1", "event_type": "im.message.receive_v1", "token": "vt"}
+	for range 2 {
+		if w := push(message, false); w.Code != http.StatusOK || w.Body.String() != "success" {
+			t.Fatal(w.Code, w.Body.String())
+		}
+	}
+	// The redelivery is dropped as a duplicate.
+	events := state.getMissed(0, streamFilter{})
+	if len(events) != 1 {
+		t.Fatalf("got %d events", len(events))
+	}
+	var payload map[string]any
+	if err := json.Unmarshal(events[0].Payload, &payload); err != nil {
+		t.Fatal(err)
+	}
+	if payload["channel"] != "lark" || payload["fromUser"] != "ou_1" || payload["sessionId"] != "oc_1" || payload["text"] != "hello" || payload["messageId"] != "om_1" {
+		t.Fatal(payload)
+	}
+
+	// Sends fetch a tenant access token once and address chats by chat_id.
+	var requests []string
+	previous := outboundTransport
+	defer func() { outboundTransport = previous }()
+	outboundTransport = roundTripFunc(func(r *http.Request) (*http.Response, error) {
+		requests = append(requests, r.URL.Path+"?"+r.URL.RawQuery+" "+r.Header.Get("Authorization"))
+		body := `{"code":0,"data":{"message_id":"om_2"}}`
+		if strings.HasSuffix(r.URL.Path, "/tenant_access_token/internal") {
+			body = `{"code":0,"tenant_access_token":"t-1","expire":7200}`
+		}
+		return &http.Response{StatusCode: http.StatusOK, Header: make(http.Header), Body: io.NopCloser(strings.NewReader(body))}, nil
+	})
+	for range 2 {
+		req := httptest.NewRequest(http.MethodPost, "/proxy/channels/lark/send", strings.NewReader(`{"to":"oc_1","text":"hi"}`))
+		w := httptest.NewRecorder()
+		handleProxyChannel(w, req, cfg, state)
+		if w.Code != http.StatusOK || strings.TrimSpace(w.Body.String()) != `{"channel":"lark","msgid":"om_2"}` {
+			t.Fatal(w.Code, w.Body.String())
+		}
+	}
+	want := "/open-apis/auth/v3/tenant_access_token/internal? ; " +
+		"/open-apis/im/v1/messages?receive_id_type=chat_id Bearer t-1; " +
+		"/open-apis/im/v1/messages?receive_id_type=chat_id Bearer t-1"
+	if got := strings.Join(requests, "; "); got != want {
+		t.Fatal(got)
+	}
+}
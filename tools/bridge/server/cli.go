@@ -0,0 +1,231 @@
+package server
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/Tennen/Paimon/tools/bridge/config"
+	"github.com/Tennen/Paimon/tools/wecom/callback"
+	wxcrypto "github.com/Tennen/Paimon/tools/wecom/crypto"
+)
+
+// cliConfig loads the configuration the way serve does, from the environment
+// and configFile, switched to the named app when agent is set.
+func cliConfig(configFile, agent string) (config.Config, error) {
+	if configFile != "" {
+		_ = os.Setenv("BRIDGE_CONFIG_FILE", configFile)
+		if err := config.ApplyFileSettings(configFile); err != nil {
+			return config.Config{}, fmt.Errorf("config file error: %v", err)
+		}
+	}
+	cfg := config.Load()
+	if agent != "" {
+		agentCfg, ok := cfg.ForAgent(agent)
+		if !ok {
+			return cfg, fmt.Errorf("unknown agent %q", agent)
+		}
+		cfg = agentCfg
+	}
+	transport, err := newOutboundTransport(cfg)
+	if err != nil {
+		return cfg, fmt.Errorf("outbound http: %v", err)
+	}
+	outboundTransport = transport
+	return cfg, nil
+}
+
+// cmdSend sends one text or markdown app message, e.g. for operational
+// notices from scripts: wecom-bridge send -to zhangsan -text "deploy done".
+// The text is read from stdin when -text is empty.
+func cmdSend(args []string) int {
+	flags := flag.NewFlagSet("send", flag.ExitOnError)
+	configFile := flags.String("config", os.Getenv("BRIDGE_CONFIG_FILE"), "JSON or YAML config file (BRIDGE_CONFIG_FILE)")
+	agent := flags.String("agent", "", "send as the named app from agents in the config file")
+	agentID := flags.String("agentid", "", "agent ID (default WECOM_AGENT_ID)")
+	to := flags.String("to", "", "recipient user IDs, separated by |")
+	party := flags.String("party", "", "recipient department IDs, separated by |")
+	tag := flags.String("tag", "", "recipient tag IDs, separated by |")
+	text := flags.String("text", "", "message text (default: read stdin)")
+	markdown := flags.Bool("markdown", false, "send as markdown instead of text")
+	_ = flags.Parse(args)
+
+	cfg, err := cliConfig(*configFile, *agent)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	if *to == "" && *party == "" && *tag == "" {
+		fmt.Fprintln(os.Stderr, "send: -to, -party or -tag is required")
+		return 2
+	}
+	content := *text
+	if content == "" {
+		data, err := io.ReadAll(os.Stdin)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, "send: read stdin:", err)
+			return 1
+		}
+		content = strings.TrimRight(string(data), "\n")
+	}
+	if content == "" {
+		fmt.Fprintln(os.Stderr, "send: empty message")
+		return 2
+	}
+	id, err := strconv.Atoi(firstNonEmpty(*agentID, cfg.WeComAgentID))
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "send: -agentid or WECOM_AGENT_ID is required")
+		return 2
+	}
+
+	secret := cfg.WeComCorpSecret
+	if s, ok := cfg.AgentSecrets[strconv.Itoa(id)]; ok {
+		secret = s
+	}
+	tokens := &tokenManager{corpID: cfg.WeComCorpID, secret: secret, timeout: cfg.ProxyTimeouts["gettoken"]}
+	token, err := tokens.get()
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "send: token:", err)
+		return 1
+	}
+	msgType := "text"
+	if *markdown {
+		msgType = "markdown"
+	}
+	message := map[string]any{"msgtype": msgType, "agentid": id, msgType: map[string]string{"content": content}}
+	for key, value := range map[string]string{"touser": *to, "toparty": *party, "totag": *tag} {
+		if value != "" {
+			message[key] = value
+		}
+	}
+	body, _ := json.Marshal(message)
+	data, err := postWeComJSON(context.Background(), "https://qyapi.weixin.qq.com/cgi-bin/message/send?access_token="+url.QueryEscape(token), body, cfg.ProxyTimeouts["send"])
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "send:", err)
+		return 1
+	}
+	var result struct {
+		MsgID        string `json:"msgid"`
+		InvalidUser  string `json:"invaliduser"`
+		InvalidParty string `json:"invalidparty"`
+		InvalidTag   string `json:"invalidtag"`
+	}
+	_ = json.Unmarshal(data, &result)
+	fmt.Println("sent", result.MsgID)
+	for name, value := range map[string]string{"user": result.InvalidUser, "party": result.InvalidParty, "tag": result.InvalidTag} {
+		if value != "" {
+			fmt.Fprintf(os.Stderr, "warning: invalid %s %s\n", name, value)
+		}
+	}
+	return 0
+}
+
+// cmdDecrypt prints the plaintext of an encrypted callback. The argument is
+// the Encrypt value, a whole callback body (XML or JSON) or "-" for stdin.
+func cmdDecrypt(args []string) int {
+	flags := flag.NewFlagSet("decrypt", flag.ExitOnError)
+	aesKey := flags.String("aes-key", os.Getenv("WECOM_AES_KEY"), "EncodingAESKey (WECOM_AES_KEY)")
+	receiveID := flags.String("receive-id", os.Getenv("WECOM_RECEIVE_ID"), "expected receive ID; empty accepts any (WECOM_RECEIVE_ID)")
+	_ = flags.Parse(args)
+	if flags.NArg() != 1 || *aesKey == "" {
+		fmt.Fprintln(os.Stderr, "usage: wecom-bridge decrypt -aes-key KEY [-receive-id ID] <blob|->")
+		return 2
+	}
+	blob := flags.Arg(0)
+	if blob == "-" {
+		data, err := io.ReadAll(os.Stdin)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, "decrypt: read stdin:", err)
+			return 1
+		}
+		blob = string(data)
+	}
+	blob = strings.TrimSpace(blob)
+	if encrypted := callback.ExtractEncrypted([]byte(blob)); encrypted != "" {
+		blob = encrypted
+	}
+	plain, ok := wxcrypto.Decrypt(blob, *aesKey, *receiveID)
+	if !ok {
+		fmt.Fprintln(os.Stderr, "decrypt: failed (wrong aes key, receive ID or corrupted payload)")
+		return 1
+	}
+	fmt.Println(plain)
+	return 0
+}
+
+// cmdVerifyURL sends the GET request WeCom uses to verify a callback URL to
+// a running bridge and checks that it echoes the challenge back.
+func cmdVerifyURL(args []string) int {
+	flags := flag.NewFlagSet("verify-url", flag.ExitOnError)
+	configFile := flags.String("config", os.Getenv("BRIDGE_CONFIG_FILE"), "JSON or YAML config file (BRIDGE_CONFIG_FILE)")
+	agent := flags.String("agent", "", "verify the named app's callback URL (/wecom/<agent>)")
+	target := flags.String("url", "", "callback URL (default http://127.0.0.1:PORT/wecom)")
+	_ = flags.Parse(args)
+
+	cfg, err := cliConfig(*configFile, *agent)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	endpoint := *target
+	if endpoint == "" {
+		scheme := "http"
+		if cfg.TLSCertFile != "" {
+			scheme = "https"
+		}
+		endpoint = fmt.Sprintf("%s://127.0.0.1:%d/wecom", scheme, cfg.Port)
+		if *agent != "" {
+			endpoint += "/" + url.PathEscape(*agent)
+		}
+	}
+	if cfg.WeComToken == "" || (cfg.WeComAESKey == "" && cfg.CallbackMode != config.CallbackPlaintext) {
+		fmt.Fprintln(os.Stderr, "verify-url: WECOM_TOKEN and WECOM_AES_KEY are required")
+		return 2
+	}
+
+	nonce := make([]byte, 8)
+	_, _ = rand.Read(nonce)
+	challenge := "verify-" + hex.EncodeToString(nonce)
+	q := url.Values{}
+	q.Set("timestamp", strconv.FormatInt(time.Now().Unix(), 10))
+	q.Set("nonce", hex.EncodeToString(nonce))
+	if cfg.CallbackMode == config.CallbackPlaintext {
+		q.Set("signature", wxcrypto.Signature(cfg.WeComToken, q.Get("timestamp"), q.Get("nonce")))
+		q.Set("echostr", challenge)
+	} else {
+		echostr, err := wxcrypto.Encrypt(challenge, cfg.WeComAESKey, cfg.WeComReceiveID)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, "verify-url:", err)
+			return 1
+		}
+		q.Set("msg_signature", wxcrypto.Signature(cfg.WeComToken, q.Get("timestamp"), q.Get("nonce"), echostr))
+		q.Set("echostr", echostr)
+	}
+	sep := "?"
+	if strings.Contains(endpoint, "?") {
+		sep = "&"
+	}
+	resp, err := outboundClient(10 * time.Second).Get(endpoint + sep + q.Encode())
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "verify-url:", err)
+		return 1
+	}
+	defer resp.Body.Close()
+	body, _ := io.ReadAll(io.LimitReader(resp.Body, 4096))
+	if resp.StatusCode != http.StatusOK || strings.TrimSpace(string(body)) != challenge {
+		fmt.Fprintf(os.Stderr, "verify-url: %s answered %d %q, want 200 %q\n", endpoint, resp.StatusCode, truncateRunes(string(body), 200), challenge)
+		return 1
+	}
+	fmt.Println("ok:", endpoint, "passed URL verification")
+	return 0
+}
@@ -0,0 +1,198 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/url"
+	"sync"
+	"time"
+
+	"github.com/Tennen/Paimon/tools/bridge/archive"
+	"github.com/Tennen/Paimon/tools/bridge/config"
+)
+
+// contactEnricher resolves the IDs in external contact and customer group
+// change events to names with the bridge's token, so consumers need no
+// lookups of their own. Results are cached for ttl.
+type contactEnricher struct {
+	ttl time.Duration
+
+	mu    sync.Mutex
+	cache map[string]contactCacheEntry
+}
+
+type contactCacheEntry struct {
+	value   map[string]any
+	expires time.Time
+}
+
+func newContactEnricher(ttl time.Duration) *contactEnricher {
+	return &contactEnricher{ttl: ttl, cache: make(map[string]contactCacheEntry)}
+}
+
+// enrich adds externalContact to change_external_contact events and
+// groupChat to change_external_chat events. Failed lookups are logged and
+// leave the payload as it was.
+func (e *contactEnricher) enrich(ctx context.Context, cfg config.Config, state *bridgeState, msg *wecomMessage, payload map[string]any) {
+	var kind, id string
+	switch msg.Event {
+	case "change_external_contact":
+		kind = "contact"
+		id, _ = msg.Detail["externalUserID"].(string)
+	case "change_external_chat":
+		kind = "chat"
+		id = msg.ChatID
+	default:
+		return
+	}
+	// Without credentials for the app there is nothing to look up with.
+	if id == "" || state.tokenFor(msg.AgentID).secret == "" {
+		return
+	}
+	value, err := e.lookup(ctx, cfg, state, msg.AgentID, kind, id)
+	if err != nil {
+		slog.WarnContext(ctx, "wecom contact enrichment failed", "kind", kind, "id", id, "err", err)
+		return
+	}
+	if kind == "contact" {
+		payload["externalContact"] = value
+	} else {
+		payload["groupChat"] = value
+	}
+}
+
+// lookup returns the cached details of the contact or chat id, fetching
+// them on a miss.
+func (e *contactEnricher) lookup(ctx context.Context, cfg config.Config, state *bridgeState, agentID, kind, id string) (map[string]any, error) {
+	key := kind + ":" + id
+	now := time.Now()
+	e.mu.Lock()
+	cached, ok := e.cache[key]
+	e.mu.Unlock()
+	if ok && now.Before(cached.expires) {
+		state.metrics.Inc("wecom_bridge_contact_enrich_total", "kind", kind, "result", "hit")
+		return cached.value, nil
+	}
+
+	token := state.managedToken(agentID)
+	if token == "" {
+		state.metrics.Inc("wecom_bridge_contact_enrich_total", "kind", kind, "result", "error")
+		return nil, errors.New("no access token")
+	}
+	var value map[string]any
+	var err error
+	if kind == "contact" {
+		value, err = fetchExternalContact(ctx, token, id, cfg.ProxyTimeouts["contact"])
+	} else {
+		value, err = fetchGroupChat(ctx, token, id, cfg.ProxyTimeouts["contact"])
+	}
+	if err != nil {
+		state.metrics.Inc("wecom_bridge_contact_enrich_total", "kind", kind, "result", "error")
+		return nil, err
+	}
+	state.metrics.Inc("wecom_bridge_contact_enrich_total", "kind", kind, "result", "ok")
+
+	e.mu.Lock()
+	if len(e.cache) >= maxContactCache {
+		for k, entry := range e.cache {
+			if !now.Before(entry.expires) {
+				delete(e.cache, k)
+			}
+		}
+		if len(e.cache) >= maxContactCache {
+			e.cache = make(map[string]contactCacheEntry)
+		}
+	}
+	e.cache[key] = contactCacheEntry{value: value, expires: now.Add(e.ttl)}
+	e.mu.Unlock()
+	return value, nil
+}
+
+// fetchExternalContact reads the name, avatar and company of an external
+// contact from externalcontact/get.
+func fetchExternalContact(ctx context.Context, token, externalUserID string, timeout time.Duration) (map[string]any, error) {
+	query := url.Values{"access_token": {token}, "external_userid": {externalUserID}}
+	data, err := postWeComJSON(ctx, "https://qyapi.weixin.qq.com/cgi-bin/externalcontact/get?"+query.Encode(), nil, timeout)
+	if err != nil {
+		return nil, err
+	}
+	var result struct {
+		ExternalContact struct {
+			Name         string `json:"name"`
+			Avatar       string `json:"avatar"`
+			Type         int    `json:"type"`
+			CorpName     string `json:"corp_name"`
+			CorpFullName string `json:"corp_full_name"`
+		} `json:"external_contact"`
+	}
+	if err := json.Unmarshal(data, &result); err != nil {
+		return nil, fmt.Errorf("externalcontact/get decode: %w", err)
+	}
+	c := result.ExternalContact
+	value := map[string]any{"externalUserId": externalUserID, "name": c.Name, "avatar": c.Avatar, "type": c.Type}
+	if c.CorpName != "" {
+		value["corpName"] = c.CorpName
+	}
+	if c.CorpFullName != "" {
+		value["corpFullName"] = c.CorpFullName
+	}
+	return value, nil
+}
+
+// fetchGroupChat reads the title, owner and size of a customer group from
+// externalcontact/groupchat/get.
+func fetchGroupChat(ctx context.Context, token, chatID string, timeout time.Duration) (map[string]any, error) {
+	body, _ := json.Marshal(map[string]any{"chat_id": chatID, "need_name": 0})
+	data, err := postWeComJSON(ctx, "https://qyapi.weixin.qq.com/cgi-bin/externalcontact/groupchat/get?access_token="+url.QueryEscape(token), body, timeout)
+	if err != nil {
+		return nil, err
+	}
+	var result struct {
+		GroupChat struct {
+			Name       string            `json:"name"`
+			Owner      string            `json:"owner"`
+			MemberList []json.RawMessage `json:"member_list"`
+		} `json:"group_chat"`
+	}
+	if err := json.Unmarshal(data, &result); err != nil {
+		return nil, fmt.Errorf("groupchat/get decode: %w", err)
+	}
+	g := result.GroupChat
+	return map[string]any{"chatId": chatID, "name": g.Name, "owner": g.Owner, "memberCount": len(g.MemberList)}, nil
+}
+
+// deliverInbound broadcasts an inbound payload and records it in the archive,
+// returning the first failure.
+func deliverInbound(state *bridgeState, payload map[string]any) error {
+	broadcastErr := state.broadcast(payload)
+	if broadcastErr != nil {
+		state.metrics.Inc("wecom_bridge_delivery_failures_total", "stage", "broadcast")
+	}
+	str := func(key string) string {
+		v, _ := payload[key].(string)
+		return v
+	}
+	rec := archive.Record{
+		Kind:      "inbound",
+		SessionID: str("sessionId"),
+		FromUser:  str("fromUser"),
+		ToUser:    str("toUser"),
+		AgentID:   str("agentId"),
+		MsgType:   str("msgType"),
+		Text:      str("text"),
+		MsgID:     str("messageId"),
+	}
+	archiveErr := state.archive.Append(rec)
+	state.sessions.observe(rec, time.Now().UTC())
+	if str("msgType") == "event" {
+		state.sessions.closeOn(str("event"), rec.SessionID)
+	}
+	if archiveErr != nil {
+		state.metrics.Inc("wecom_bridge_delivery_failures_total", "stage", "archive")
+		return archiveErr
+	}
+	return broadcastErr
+}
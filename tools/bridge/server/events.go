@@ -0,0 +1,246 @@
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/Tennen/Paimon/tools/bridge/config"
+	"github.com/Tennen/Paimon/tools/bridge/eventstore"
+	"github.com/Tennen/Paimon/tools/bridge/hub"
+	"github.com/Tennen/Paimon/tools/bridge/metrics"
+)
+
+// sseEvent is one event of the stream; Time is when this bridge buffered it.
+type sseEvent = hub.Event
+
+// sseClient is one /stream or /replication/stream consumer. The counters
+// are updated by the stream and fan-out and read by /admin/clients.
+type sseClient struct {
+	ch     chan sseEvent
+	filter streamFilter
+
+	id          string
+	identity    string
+	path        string
+	remoteAddr  string
+	userAgent   string
+	connectedAt time.Time
+	lastEventID atomic.Int64
+	delivered   atomic.Int64
+	dropped     atomic.Int64
+
+	// dropPolicy is what fan-out does when ch is full (see
+	// StreamDropPolicy). unreported counts drops the client has not been
+	// told about yet; notify wakes the stream to tell it.
+	dropPolicy string
+	unreported atomic.Int64
+	notify     chan struct{}
+	// overflowed is set when the disconnect policy kicked the client.
+	overflowed atomic.Bool
+
+	// kick is closed to force-disconnect the client.
+	kick     chan struct{}
+	kickOnce sync.Once
+
+	// joinedAfter is the newest event broadcast before the client was
+	// registered; older ones come from the replay instead.
+	joinedAfter int64
+	metrics     *metrics.Registry
+}
+
+// newSSEClient returns a stream client for r with the configured queue
+// size and drop policy.
+func newSSEClient(r *http.Request, cfg config.Config, identity string, filter streamFilter) *sseClient {
+	return &sseClient{
+		ch:          make(chan sseEvent, max(cfg.StreamClientBuffer, 1)),
+		filter:      filter,
+		id:          randomNonce(),
+		identity:    identity,
+		path:        r.URL.Path,
+		remoteAddr:  r.RemoteAddr,
+		userAgent:   r.UserAgent(),
+		connectedAt: time.Now().UTC(),
+		dropPolicy:  cfg.StreamDropPolicy,
+		notify:      make(chan struct{}, 1),
+		kick:        make(chan struct{}),
+	}
+}
+
+// writeDropped writes an "event: dropped" frame telling the client how
+// many events it missed. It has no id, so reconnecting with Last-Event-ID
+// replays the missed events that are still buffered.
+func writeDropped(w io.Writer, dropped, lastEventID int64, disconnected bool) error {
+	data, err := json.Marshal(map[string]any{"dropped": dropped, "lastEventId": lastEventID, "disconnected": disconnected})
+	if err != nil {
+		return err
+	}
+	_, err = fmt.Fprintf(w, "event: dropped\ndata: %s\n\n", data)
+	return err
+}
+
+// streamFilter selects the events a stream consumer receives; empty fields
+// match everything.
+type streamFilter = hub.Filter
+
+// addClient registers c for live events and returns the ID of the newest
+// event it will not receive, so callers can replay up to it.
+func (s *bridgeState) addClient(c *sseClient) int64 {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	c.joinedAfter = s.nextEventID - 1
+	c.metrics = s.metrics
+	s.clients.Add(c)
+	return c.joinedAfter
+}
+
+func (s *bridgeState) removeClient(c *sseClient) {
+	s.clients.Remove(c)
+}
+
+func (s *bridgeState) broadcast(payload map[string]any) error {
+	_, err := s.broadcastEvent("message", payload)
+	return err
+}
+
+// broadcastEvent buffers and fans out an event with the given SSE event type,
+// returning its ID (0 if the payload could not be encoded). The error reports
+// an encoding failure or a webhook queue that had to drop the event.
+func (s *bridgeState) broadcastEvent(eventType string, payload map[string]any) (int64, error) {
+	data, err := json.Marshal(payload)
+	if err != nil {
+		return 0, err
+	}
+
+	topics, _ := payload["topics"].([]string)
+	agent, _ := payload["agent"].(string)
+	fromUser, _ := payload["fromUser"].(string)
+	msgType, _ := payload["msgType"].(string)
+
+	event := sseEvent{Type: eventType, Payload: data, Topics: topics, Agent: agent, FromUser: fromUser, MsgType: msgType, Time: time.Now().UTC()}
+	s.mu.Lock()
+	shared, _ := s.store.(*eventstore.RedisStore)
+	if shared == nil {
+		event.ID = s.nextEventID
+		s.nextEventID++
+		s.fanoutLocked(event)
+		s.mu.Unlock()
+		subscribers := s.clients.Count()
+		slog.Debug("event broadcast", "event_id", event.ID, "type", eventType, "message_id", payload["messageId"], "subscribers", subscribers)
+	} else {
+		s.mu.Unlock()
+		// Redis assigns the ID; this replica's clients get the event from
+		// follow like every other replica's, so all see the same order.
+		if event.ID, err = shared.Publish(event); err != nil {
+			s.metrics.Inc("wecom_bridge_event_store_errors_total", "op", "publish")
+			return 0, fmt.Errorf("event publish: %w", err)
+		}
+		slog.Debug("event published", "event_id", event.ID, "type", eventType, "message_id", payload["messageId"])
+	}
+	id := event.ID
+
+	for _, sink := range s.sinks {
+		if !sink.enqueue(event) {
+			err = fmt.Errorf("webhook %s queue full", sink.url)
+		}
+	}
+	return id, err
+}
+
+// NextEventID returns the ID the next broadcast event gets.
+func (s *bridgeState) NextEventID() int64 {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.nextEventID
+}
+
+// IngestReplicated adds an event received from the primary, or through the
+// shared redis store, keeping its ID so Last-Event-ID stays valid when
+// consumers switch between bridges.
+func (s *bridgeState) IngestReplicated(event sseEvent) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if event.ID < s.nextEventID {
+		return
+	}
+	s.nextEventID = event.ID + 1
+	if event.Time.IsZero() {
+		event.Time = time.Now().UTC()
+	}
+	s.fanoutLocked(event)
+}
+
+// fanoutLocked appends the event to the replay buffer and queues it for the
+// stream hub, which offers it to every matching client, and for the event
+// store's writer. The caller holds s.mu, so events reach both in ID order.
+func (s *bridgeState) fanoutLocked(event sseEvent) {
+	if s.store != nil {
+		if err := s.store.Append(event); err != nil {
+			slog.Error("event store append failed", "event_id", event.ID, "err", err)
+			s.metrics.Inc("wecom_bridge_event_store_errors_total", "op", "append")
+		}
+	}
+	s.buffer = append(s.buffer, event)
+	if len(s.buffer) > s.bufferCap {
+		s.buffer = s.buffer[len(s.buffer)-s.bufferCap:]
+	}
+	if n := s.clients.Publish(event); n > 0 {
+		s.metrics.Add("wecom_bridge_stream_hub_overflow_total", int64(n))
+	}
+}
+
+// Deliver implements hub.Subscriber: it hands event to the client without
+// blocking if it was broadcast after registration and matches the filter,
+// applying the client's drop policy when its queue is full.
+func (c *sseClient) Deliver(event sseEvent) {
+	if event.ID <= c.joinedAfter || !c.filter.Matches(event) || c.overflowed.Load() {
+		return
+	}
+	select {
+	case c.ch <- event:
+		return
+	default:
+	}
+	if c.dropPolicy == "drop-oldest" {
+		// Only the hub sends on ch, so after taking one the send fits.
+		select {
+		case <-c.ch:
+		default:
+		}
+		select {
+		case c.ch <- event:
+		default:
+		}
+	}
+	c.drop(1)
+}
+
+// Missed implements hub.Subscriber: events that overflowed the hub count as
+// drops.
+func (c *sseClient) Missed(n int64) {
+	if !c.overflowed.Load() {
+		c.drop(n)
+	}
+}
+
+// drop records n lost events and wakes the stream to report them; under
+// the disconnect policy it also ends the stream.
+func (c *sseClient) drop(n int64) {
+	if c.dropPolicy == "disconnect" {
+		c.overflowed.Store(true)
+		c.kickOnce.Do(func() { close(c.kick) })
+		c.metrics.Inc("wecom_bridge_stream_overflow_disconnects_total")
+	}
+	c.dropped.Add(n)
+	c.unreported.Add(n)
+	c.metrics.Add("wecom_bridge_stream_dropped_total", n)
+	select {
+	case c.notify <- struct{}{}:
+	default:
+	}
+}
@@ -0,0 +1,306 @@
+package server
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/Tennen/Paimon/tools/bridge/config"
+)
+
+// feishuAdapter is a Feishu (Lark) custom app: event subscriptions arrive
+// on /channels/{name} and messages are sent with its tenant access token.
+type feishuAdapter struct {
+	ch       config.Channel
+	timeouts map[string]time.Duration
+
+	mu        sync.Mutex
+	token     string
+	expiresAt time.Time
+}
+
+func newFeishuAdapter(ch config.Channel, timeouts map[string]time.Duration) *feishuAdapter {
+	return &feishuAdapter{ch: ch, timeouts: timeouts}
+}
+
+// feishuEnvelope covers the URL verification request and the 2.0 event
+// schema.
+type feishuEnvelope struct {
+	Type      string `json:"type"`
+	Challenge string `json:"challenge"`
+	Token     string `json:"token"`
+	Header    struct {
+		EventID   string `json:"event_id"`
+		EventType string `json:"event_type"`
+		Token     string `json:"token"`
+	} `json:"header"`
+	Event json.RawMessage `json:"event"`
+}
+
+func (a *feishuAdapter) verifyCallback(r *http.Request, body []byte) ([]byte, *callbackReply, error) {
+	// With an encrypt key Feishu signs every push as SHA-256 over
+	// timestamp, nonce, key and body.
+	if sig := r.Header.Get("X-Lark-Signature"); sig != "" && a.ch.EncryptKey != "" {
+		sum := sha256.Sum256([]byte(r.Header.Get("X-Lark-Request-Timestamp") + r.Header.Get("X-Lark-Request-Nonce") + a.ch.EncryptKey + string(body)))
+		if !hmac.Equal([]byte(sig), []byte(fmt.Sprintf("%x", sum))) {
+			return nil, nil, &callbackError{status: http.StatusUnauthorized, kind: "signature", msg: "invalid signature"}
+		}
+	}
+	plain := body
+	if a.ch.EncryptKey != "" {
+		var wrapped struct {
+			Encrypt string `json:"encrypt"`
+		}
+		if json.Unmarshal(body, &wrapped) != nil || wrapped.Encrypt == "" {
+			return nil, nil, &callbackError{status: http.StatusBadRequest, msg: "missing encrypt"}
+		}
+		var err error
+		if plain, err = decryptFeishu(wrapped.Encrypt, a.ch.EncryptKey); err != nil {
+			return nil, nil, &callbackError{status: http.StatusBadRequest, kind: "decrypt", msg: "decrypt failed"}
+		}
+	}
+	var env feishuEnvelope
+	if err := json.Unmarshal(plain, &env); err != nil {
+		return nil, nil, &callbackError{status: http.StatusBadRequest, msg: "invalid json"}
+	}
+	if a.ch.VerificationToken != "" && subtle.ConstantTimeCompare([]byte(firstNonEmpty(env.Header.Token, env.Token)), []byte(a.ch.VerificationToken)) != 1 {
+		return nil, nil, &callbackError{status: http.StatusUnauthorized, kind: "signature", detail: "verification token", msg: "invalid token"}
+	}
+	if env.Type == "url_verification" {
+		answer, _ := json.Marshal(map[string]string{"challenge": env.Challenge})
+		return nil, &callbackReply{status: http.StatusOK, contentType: "application/json", body: answer}, nil
+	}
+	return plain, nil, nil
+}
+
+// decryptFeishu opens an encrypted push: AES-256-CBC keyed with the
+// SHA-256 of the encrypt key, the IV prepended, PKCS#7 padding.
+func decryptFeishu(encrypted, encryptKey string) ([]byte, error) {
+	raw, err := base64.StdEncoding.DecodeString(encrypted)
+	if err != nil {
+		return nil, err
+	}
+	if len(raw) < 2*aes.BlockSize || len(raw)%aes.BlockSize != 0 {
+		return nil, errors.New("invalid ciphertext length")
+	}
+	key := sha256.Sum256([]byte(encryptKey))
+	block, err := aes.NewCipher(key[:])
+	if err != nil {
+		return nil, err
+	}
+	data := raw[aes.BlockSize:]
+	cipher.NewCBCDecrypter(block, raw[:aes.BlockSize]).CryptBlocks(data, data)
+	pad := int(data[len(data)-1])
+	if pad == 0 || pad > aes.BlockSize {
+		return nil, errors.New("invalid padding")
+	}
+	return data[:len(data)-pad], nil
+}
+
+// decodeInbound turns im.message.receive_v1 into a message; other events
+// become msgType "event" with the event type as Event.
+func (a *feishuAdapter) decodeInbound(plain []byte) (*wecomMessage, error) {
+	var env feishuEnvelope
+	if err := json.Unmarshal(plain, &env); err != nil {
+		return nil, err
+	}
+	if env.Header.EventType == "" {
+		return nil, nil
+	}
+	var detail map[string]any
+	_ = json.Unmarshal(env.Event, &detail)
+	if env.Header.EventType != "im.message.receive_v1" {
+		return &wecomMessage{MsgType: "event", Event: env.Header.EventType, MsgID: env.Header.EventID, Detail: detail}, nil
+	}
+	var event struct {
+		Sender struct {
+			SenderID struct {
+				OpenID string `json:"open_id"`
+			} `json:"sender_id"`
+		} `json:"sender"`
+		Message struct {
+			MessageID   string `json:"message_id"`
+			CreateTime  string `json:"create_time"`
+			ChatID      string `json:"chat_id"`
+			ChatType    string `json:"chat_type"`
+			MessageType string `json:"message_type"`
+			Content     string `json:"content"`
+		} `json:"message"`
+	}
+	if err := json.Unmarshal(env.Event, &event); err != nil {
+		return nil, err
+	}
+	m := event.Message
+	var content struct {
+		Text     string `json:"text"`
+		ImageKey string `json:"image_key"`
+		FileKey  string `json:"file_key"`
+	}
+	_ = json.Unmarshal([]byte(m.Content), &content)
+	msg := &wecomMessage{
+		MsgType:  m.MessageType,
+		Content:  content.Text,
+		FromUser: event.Sender.SenderID.OpenID,
+		ToUser:   m.ChatID,
+		MsgID:    m.MessageID,
+		Detail:   detail,
+	}
+	// Resources are fetched per message, so the media ID names both.
+	if key := firstNonEmpty(content.ImageKey, content.FileKey); key != "" {
+		msg.MediaID = m.MessageID + "/" + key
+	}
+	if ms, err := strconv.ParseInt(m.CreateTime, 10, 64); err == nil {
+		msg.CreateTime = time.UnixMilli(ms).UTC()
+	}
+	return msg, nil
+}
+
+// accessToken returns the cached tenant access token, fetching a new one a
+// minute before it expires.
+func (a *feishuAdapter) accessToken() (string, error) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if a.token != "" && time.Now().Before(a.expiresAt) {
+		return a.token, nil
+	}
+	body, _ := json.Marshal(map[string]string{"app_id": a.ch.AppID, "app_secret": a.ch.AppSecret})
+	client := outboundClient(a.timeouts["gettoken"])
+	resp, err := client.Post(a.ch.APIBase+"/open-apis/auth/v3/tenant_access_token/internal", "application/json", bytes.NewReader(body))
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	var result struct {
+		Code   int    `json:"code"`
+		Msg    string `json:"msg"`
+		Token  string `json:"tenant_access_token"`
+		Expire int    `json:"expire"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&result); err != nil {
+		return "", fmt.Errorf("tenant_access_token decode: %w", err)
+	}
+	if result.Code != 0 || result.Token == "" {
+		return "", fmt.Errorf("tenant_access_token code %d %s", result.Code, result.Msg)
+	}
+	a.token = result.Token
+	a.expiresAt = time.Now().Add(time.Duration(result.Expire)*time.Second - time.Minute)
+	return a.token, nil
+}
+
+// feishuReceiveIDType infers receive_id_type from the ID's form.
+func feishuReceiveIDType(to string) string {
+	switch {
+	case strings.HasPrefix(to, "oc_"):
+		return "chat_id"
+	case strings.HasPrefix(to, "ou_"):
+		return "open_id"
+	case strings.HasPrefix(to, "on_"):
+		return "union_id"
+	case strings.Contains(to, "@"):
+		return "email"
+	}
+	return "user_id"
+}
+
+func (a *feishuAdapter) sendMessage(to, text string) (string, error) {
+	token, err := a.accessToken()
+	if err != nil {
+		return "", err
+	}
+	content, _ := json.Marshal(map[string]string{"text": text})
+	body, _ := json.Marshal(map[string]string{"receive_id": to, "msg_type": "text", "content": string(content)})
+	req, err := http.NewRequest(http.MethodPost, a.ch.APIBase+"/open-apis/im/v1/messages?receive_id_type="+feishuReceiveIDType(to), bytes.NewReader(body))
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("Authorization", "Bearer "+token)
+	req.Header.Set("Content-Type", "application/json; charset=utf-8")
+	client := outboundClient(a.timeouts["send"])
+	resp, err := client.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	var result struct {
+		Code int    `json:"code"`
+		Msg  string `json:"msg"`
+		Data struct {
+			MessageID string `json:"message_id"`
+		} `json:"data"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&result); err != nil {
+		return "", fmt.Errorf("send decode: %w", err)
+	}
+	if result.Code != 0 {
+		a.dropToken(result.Code, token)
+		return "", fmt.Errorf("code %d %s", result.Code, result.Msg)
+	}
+	return result.Data.MessageID, nil
+}
+
+func (a *feishuAdapter) fetchMedia(mediaID string) ([]byte, string, error) {
+	messageID, key, ok := strings.Cut(mediaID, "/")
+	if !ok || messageID == "" || key == "" {
+		return nil, "", errors.New("media_id must be <message_id>/<file_key>")
+	}
+	token, err := a.accessToken()
+	if err != nil {
+		return nil, "", err
+	}
+	kind := "file"
+	if strings.HasPrefix(key, "img_") {
+		kind = "image"
+	}
+	req, err := http.NewRequest(http.MethodGet, fmt.Sprintf("%s/open-apis/im/v1/messages/%s/resources/%s?type=%s", a.ch.APIBase, url.PathEscape(messageID), url.PathEscape(key), kind), nil)
+	if err != nil {
+		return nil, "", err
+	}
+	req.Header.Set("Authorization", "Bearer "+token)
+	client := outboundClient(a.timeouts["media_get"])
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, "", err
+	}
+	defer resp.Body.Close()
+	data, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, "", err
+	}
+	contentType := resp.Header.Get("Content-Type")
+	if strings.Contains(strings.ToLower(contentType), "application/json") || resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		var result struct {
+			Code int    `json:"code"`
+			Msg  string `json:"msg"`
+		}
+		_ = json.Unmarshal(data, &result)
+		a.dropToken(result.Code, token)
+		return nil, "", fmt.Errorf("http %d code %d %s", resp.StatusCode, result.Code, result.Msg)
+	}
+	return data, firstNonEmpty(contentType, "application/octet-stream"), nil
+}
+
+// dropToken forgets token when Feishu rejected it as invalid or expired.
+func (a *feishuAdapter) dropToken(code int, token string) {
+	if code != 99991661 && code != 99991663 && code != 99991668 {
+		return
+	}
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if a.token == token {
+		a.token = ""
+	}
+}
@@ -0,0 +1,103 @@
+package server
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/Tennen/Paimon/tools/bridge/auditlog"
+	"github.com/Tennen/Paimon/tools/bridge/config"
+	"github.com/Tennen/Paimon/tools/bridge/grpcwire"
+)
+
+// grpcMethod runs one RPC on its decoded request message and returns the
+// gRPC status. Server-streaming methods write their messages themselves.
+type grpcMethod func(w http.ResponseWriter, r *http.Request, cfg config.Config, state *bridgeState, req []byte) (int, string)
+
+// newGRPCServer serves the Bridge service of wecom-bridge.proto on its own
+// port. gRPC is plain HTTP/2 with length-prefixed protobuf messages and the
+// status in trailers, so it needs nothing beyond net/http.
+func newGRPCServer(cfg config.Config, state *bridgeState) *http.Server {
+	mux := http.NewServeMux()
+	for name, m := range map[string]struct {
+		scope  string
+		method grpcMethod
+	}{
+		"Subscribe":   {config.ScopeStreamRead, grpcSubscribe},
+		"SendMessage": {config.ScopeProxySend, grpcSendMessage},
+		"UploadMedia": {config.ScopeProxyMedia, grpcUploadMedia},
+	} {
+		mux.HandleFunc("/wecombridge.v1.Bridge/"+name, func(w http.ResponseWriter, r *http.Request) {
+			serveGRPC(w, r, state, name, m.scope, m.method)
+		})
+	}
+	mux.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/grpc")
+		grpcwire.Finish(w, grpcwire.Unimplemented, "unknown method "+r.URL.Path)
+	})
+	var protocols http.Protocols
+	protocols.SetHTTP2(true)
+	protocols.SetUnencryptedHTTP2(true)
+	server := &http.Server{
+		Addr:              fmt.Sprintf(":%d", cfg.GRPCPort),
+		Handler:           mux,
+		Protocols:         &protocols,
+		ReadHeaderTimeout: 10 * time.Second,
+	}
+	if state.certs != nil {
+		server.TLSConfig = state.certs.tlsConfig()
+	}
+	return server
+}
+
+func serveGRPC(w http.ResponseWriter, r *http.Request, state *bridgeState, name, scope string, method grpcMethod) {
+	if r.Method != http.MethodPost || !strings.HasPrefix(r.Header.Get("Content-Type"), "application/grpc") {
+		w.WriteHeader(http.StatusUnsupportedMediaType)
+		return
+	}
+	w.Header().Set("Content-Type", "application/grpc")
+	cfg := state.config()
+	code, msg := grpcwire.OK, ""
+	// Unary calls act like their /proxy counterparts and are audited alike.
+	var entry *auditlog.Entry
+	if scope != config.ScopeStreamRead {
+		entry = &auditlog.Entry{RequestID: requestID(r.Context()), Identity: requesterIdentity(r, cfg), Method: r.Method, Endpoint: r.URL.Path, Status: http.StatusOK}
+		r = r.WithContext(context.WithValue(r.Context(), auditEntryKey{}, entry))
+	}
+	start := time.Now()
+	defer func() {
+		state.metrics.Inc("wecom_bridge_grpc_requests_total", "method", name, "code", strconv.Itoa(code))
+		grpcwire.Finish(w, code, msg)
+		if entry != nil {
+			entry.GRPCStatus = code
+			entry.Error = truncateRunes(redactSecrets(msg), archiveTextLimit)
+			entry.DurationMS = time.Since(start).Milliseconds()
+			state.audit.Append(*entry)
+		}
+	}()
+	switch bridgeAuthStatus(r, cfg, scope) {
+	case http.StatusUnauthorized:
+		code, msg = grpcwire.Unauthenticated, "unauthorized"
+		return
+	case http.StatusForbidden:
+		code, msg = grpcwire.PermissionDenied, "missing scope "+scope
+		return
+	}
+	if wait, ok := state.allowRate(grpcRateClasses[scope], streamIdentity(r, cfg, state)); !ok {
+		code, msg = grpcwire.ResourceExhausted, fmt.Sprintf("rate limit exceeded, retry in %s", wait.Round(time.Second))
+		return
+	}
+	if scope != config.ScopeStreamRead && state.readOnly(cfg) {
+		code, msg = grpcwire.Unavailable, "read-only "+cfg.Mode
+		return
+	}
+	req, err := grpcwire.ReadMessage(r.Body, max(maxBodyBytes, cfg.MediaUploadMaxBytes))
+	if err != nil {
+		code, msg = grpcwire.InvalidArgument, err.Error()
+		return
+	}
+	code, msg = method(w, r, cfg, state, req)
+}
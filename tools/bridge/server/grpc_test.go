@@ -0,0 +1,177 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"encoding/hex"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/Tennen/Paimon/tools/bridge/archive"
+	"github.com/Tennen/Paimon/tools/bridge/auditlog"
+	"github.com/Tennen/Paimon/tools/bridge/config"
+	"github.com/Tennen/Paimon/tools/bridge/grpcwire"
+	"github.com/Tennen/Paimon/tools/bridge/hub"
+	"github.com/Tennen/Paimon/tools/bridge/metrics"
+)
+
+func newGRPCTestState(cfg config.Config) *bridgeState {
+	state := &bridgeState{
+		nextEventID: 1,
+		bufferCap:   config.DefaultBufferSize,
+		metrics:     metrics.New(),
+		archive:     archive.New(10),
+		audit:       auditlog.New(100),
+		usage:       &usageTracker{buckets: make(map[usageKey]*usageCounters)},
+		closing:     make(chan struct{}),
+		tokens:      &tokenManager{},
+		cfg:         cfg,
+	}
+	state.clients = hub.New(streamHubShards, streamHubQueue)
+	return state
+}
+
+// grpcFrame prefixes msg with the uncompressed gRPC message header.
+func grpcFrame(msg string) string {
+	data, _ := hex.DecodeString(msg)
+	var b bytes.Buffer
+	_ = grpcwire.WriteMessage(&b, data)
+	return b.String()
+}
+
+func TestServeGRPCStatus(t *testing.T) {
+	cfg := config.Config{BridgeToken: "bridge", Tokens: []config.Token{{Name: "reader", Token: "reader", Scopes: []string{config.ScopeStreamRead}}}}
+	for _, tc := range []struct {
+		name, method, auth, body string
+		code                     string
+		message                  string
+	}{
+		{"unauthenticated", "SendMessage", "", grpcFrame(""), "16", "unauthorized"},
+		{"missing scope", "SendMessage", "reader", grpcFrame(""), "7", "missing scope proxy:send"},
+		{"no message", "SendMessage", "bridge", "", "3", "missing request message"},
+		{"compressed", "SendMessage", "bridge", "\x01\x00\x00\x00\x00", "3", "compressed messages are not supported"},
+		{"truncated", "SendMessage", "bridge", "\x00\x00\x00\x00\x05ab", "3", "truncated request message"},
+		{"bad msgtype", "SendMessage", "bridge", grpcFrame("0a027531" + "2a056e65777373"), "3", "msgtype must be text or markdown; use message_json for others"},
+		{"no token", "SendMessage", "bridge", grpcFrame("0a027531" + "32026869"), "9", "no managed access token"},
+		{"upload without data", "UploadMedia", "bridge", grpcFrame("0a0466696c65"), "3", "data is required"},
+		{"unknown method", "Unknown", "bridge", grpcFrame(""), "12", "unknown method /wecombridge.v1.Bridge/Unknown"},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			state := newGRPCTestState(cfg)
+			r := httptest.NewRequest(http.MethodPost, "/wecombridge.v1.Bridge/"+tc.method, strings.NewReader(tc.body))
+			r.Header.Set("Content-Type", "application/grpc")
+			if tc.auth != "" {
+				r.Header.Set("Authorization", "Bearer "+tc.auth)
+			}
+			w := httptest.NewRecorder()
+			newGRPCServer(cfg, state).Handler.ServeHTTP(w, r)
+			res := w.Result()
+			if res.StatusCode != http.StatusOK || res.Header.Get("Content-Type") != "application/grpc" {
+				t.Fatalf("HTTP %d %q", res.StatusCode, res.Header.Get("Content-Type"))
+			}
+			if got := res.Trailer.Get("Grpc-Status"); got != tc.code {
+				t.Errorf("grpc-status %s, want %s", got, tc.code)
+			}
+			if got := res.Trailer.Get("Grpc-Message"); got != tc.message {
+				t.Errorf("grpc-message %q, want %q", got, tc.message)
+			}
+		})
+	}
+
+	r := httptest.NewRequest(http.MethodPost, "/wecombridge.v1.Bridge/SendMessage", strings.NewReader(grpcFrame("")))
+	r.Header.Set("Content-Type", "application/json")
+	w := httptest.NewRecorder()
+	newGRPCServer(cfg, newGRPCTestState(cfg)).Handler.ServeHTTP(w, r)
+	if w.Code != http.StatusUnsupportedMediaType {
+		t.Fatalf("non-gRPC content type: HTTP %d", w.Code)
+	}
+}
+
+func TestServeGRPCRateLimited(t *testing.T) {
+	limit, _ := config.ParseRateLimit("1/h")
+	cfg := config.Config{RateLimits: map[string]config.RateLimit{"send": limit}}
+	state := newGRPCTestState(cfg)
+	handler := newGRPCServer(cfg, state).Handler
+	var codes []string
+	for range 2 {
+		r := httptest.NewRequest(http.MethodPost, "/wecombridge.v1.Bridge/SendMessage", strings.NewReader(grpcFrame("")))
+		r.Header.Set("Content-Type", "application/grpc")
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, r)
+		codes = append(codes, w.Result().Trailer.Get("Grpc-Status"))
+	}
+	// The first call fails validation, the second never gets that far.
+	if codes[0] != "3" || codes[1] != "8" {
+		t.Fatalf("codes %v", codes)
+	}
+}
+
+// TestGRPCSubscribeOverHTTP2 runs Subscribe over cleartext HTTP/2, so the
+// status really travels in HTTP/2 trailers after the streamed messages.
+func TestGRPCSubscribeOverHTTP2(t *testing.T) {
+	cfg := config.Config{}
+	state := newGRPCTestState(cfg)
+	message := sseEvent{ID: 2, Type: "message", Payload: []byte(`{"messageId":"m1","fromUser":"u1","text":"hi"}`)}
+	state.buffer = []sseEvent{
+		{ID: 1, Type: "send_status", Payload: []byte(`{"status":"sent"}`)},
+		message,
+	}
+	state.nextEventID = 3
+	server := newGRPCServer(cfg, state)
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go server.Serve(ln)
+	defer server.Close()
+
+	var protocols http.Protocols
+	protocols.SetUnencryptedHTTP2(true)
+	client := &http.Client{Transport: &http.Transport{Protocols: &protocols}}
+	// SubscribeRequest{last_event_id: 1}
+	req, _ := http.NewRequestWithContext(context.Background(), http.MethodPost, "http://"+ln.Addr().String()+"/wecombridge.v1.Bridge/Subscribe", strings.NewReader(grpcFrame("0801")))
+	req.Header.Set("Content-Type", "application/grpc")
+	req.Header.Set("TE", "trailers")
+	res, err := client.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer res.Body.Close()
+	if res.ProtoMajor != 2 {
+		t.Fatalf("protocol %s", res.Proto)
+	}
+	var prefix [5]byte
+	if _, err := io.ReadFull(res.Body, prefix[:]); err != nil {
+		t.Fatal(err)
+	}
+	frame := make([]byte, int(prefix[1])<<24|int(prefix[2])<<16|int(prefix[3])<<8|int(prefix[4]))
+	if _, err := io.ReadFull(res.Body, frame); err != nil {
+		t.Fatal(err)
+	}
+	// Event 2 is the message; event 1 is before last_event_id.
+	want := hex.EncodeToString(grpcwire.EncodeEvent(message))
+	if prefix[0] != 0 || hex.EncodeToString(frame) != want {
+		t.Fatalf("frame %x %x\nwant %s", prefix, frame, want)
+	}
+
+	close(state.closing)
+	rest, err := io.ReadAll(res.Body)
+	if err != nil || len(rest) != 0 {
+		t.Fatalf("after shutdown: %q %v", rest, err)
+	}
+	if res.Trailer.Get("Grpc-Status") != "14" || res.Trailer.Get("Grpc-Message") != "server shutting down" {
+		t.Fatalf("trailers %v", res.Trailer)
+	}
+	deadline := time.Now().Add(time.Second)
+	for state.clients.Count() != 0 && time.Now().Before(deadline) {
+		time.Sleep(time.Millisecond)
+	}
+	if n := state.clients.Count(); n != 0 {
+		t.Fatalf("%d clients left registered", n)
+	}
+}
@@ -0,0 +1,297 @@
+package server
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/Tennen/Paimon/tools/bridge/auditlog"
+	"github.com/Tennen/Paimon/tools/bridge/config"
+	"github.com/Tennen/Paimon/tools/bridge/grpcwire"
+	"github.com/Tennen/Paimon/tools/bridge/proxy"
+	wxcrypto "github.com/Tennen/Paimon/tools/wecom/crypto"
+)
+
+// grpcSubscribe streams events to the caller. The client is registered
+// before the replay, and events already replayed are skipped when they
+// also arrive live.
+func grpcSubscribe(w http.ResponseWriter, r *http.Request, cfg config.Config, state *bridgeState, req []byte) (int, string) {
+	var lastEventID int64
+	var filter streamFilter
+	err := grpcwire.Fields(req, func(field int, v uint64, b []byte) {
+		switch field {
+		case 1:
+			lastEventID = int64(v)
+		case 2:
+			filter.Topics = append(filter.Topics, string(b))
+		case 3:
+			filter.Agents = append(filter.Agents, string(b))
+		case 4:
+			filter.FromUsers = append(filter.FromUsers, string(b))
+		case 5:
+			filter.MsgTypes = append(filter.MsgTypes, string(b))
+		}
+	})
+	if err != nil {
+		return grpcwire.InvalidArgument, err.Error()
+	}
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		return grpcwire.Unimplemented, "streaming unsupported"
+	}
+	identity := requesterIdentity(r, cfg)
+	out := &countingWriter{w: w}
+	defer func() {
+		state.usage.record(identity, func(c *usageCounters) { c.StreamBytes += out.n })
+	}()
+	client := newSSEClient(r, state.config(), identity, filter)
+	state.addClient(client)
+	defer state.removeClient(client)
+	w.WriteHeader(http.StatusOK)
+	flusher.Flush()
+
+	sent := lastEventID
+	send := func(ev sseEvent) bool {
+		if ev.ID <= sent {
+			return true
+		}
+		if cfg.SigningSecret != "" {
+			ev.Payload = withSignature(cfg.SigningSecret, ev.Payload, time.Now())
+		}
+		if err := grpcwire.WriteMessage(out, grpcwire.EncodeEvent(ev)); err != nil {
+			return false
+		}
+		flusher.Flush()
+		sent = ev.ID
+		client.lastEventID.Store(ev.ID)
+		client.delivered.Add(1)
+		return true
+	}
+	if lastEventID != 0 {
+		for _, ev := range state.getMissed(lastEventID, filter) {
+			if !send(ev) {
+				return grpcwire.Unavailable, "write failed"
+			}
+		}
+	}
+	for {
+		select {
+		case <-r.Context().Done():
+			return grpcwire.OK, ""
+		case <-state.closing:
+			return grpcwire.Unavailable, "server shutting down"
+		case <-client.kick:
+			if client.overflowed.Load() {
+				return grpcwire.ResourceExhausted, "stream queue full; resubscribe with last_event_id"
+			}
+			return grpcwire.Unavailable, "disconnected by admin"
+		case <-client.notify:
+			// Announced like the SSE frame, as an Event of type "dropped".
+			if n := client.unreported.Swap(0); n > 0 {
+				payload, _ := json.Marshal(map[string]any{"dropped": n, "lastEventId": sent})
+				if grpcwire.WriteMessage(out, grpcwire.EncodeEvent(sseEvent{Type: "dropped", Payload: payload})) != nil {
+					return grpcwire.Unavailable, "write failed"
+				}
+				flusher.Flush()
+			}
+		case ev := <-client.ch:
+			if !send(ev) {
+				return grpcwire.Unavailable, "write failed"
+			}
+		}
+	}
+}
+
+// responseCapture records the response sendAppMessage writes for an HTTP
+// caller, so gRPC and the send queue share its quota, archive and usage
+// accounting.
+type responseCapture struct {
+	header http.Header
+	status int
+	body   bytes.Buffer
+}
+
+func (c *responseCapture) Header() http.Header {
+	if c.header == nil {
+		c.header = make(http.Header)
+	}
+	return c.header
+}
+
+func (c *responseCapture) WriteHeader(status int) {
+	c.status = status
+}
+
+func (c *responseCapture) Write(p []byte) (int, error) {
+	return c.body.Write(p)
+}
+
+func grpcSendMessage(w http.ResponseWriter, r *http.Request, cfg config.Config, state *bridgeState, req []byte) (int, string) {
+	var in struct {
+		ToUser, ToParty, ToTag, AgentID, MsgType, Content string
+		MessageJSON                                       []byte
+	}
+	err := grpcwire.Fields(req, func(field int, _ uint64, b []byte) {
+		switch field {
+		case 1:
+			in.ToUser = string(b)
+		case 2:
+			in.ToParty = string(b)
+		case 3:
+			in.ToTag = string(b)
+		case 4:
+			in.AgentID = string(b)
+		case 5:
+			in.MsgType = string(b)
+		case 6:
+			in.Content = string(b)
+		case 7:
+			in.MessageJSON = b
+		}
+	})
+	if err != nil {
+		return grpcwire.InvalidArgument, err.Error()
+	}
+	message := in.MessageJSON
+	if len(message) == 0 {
+		msgType := firstNonEmpty(in.MsgType, "text")
+		if msgType != "text" && msgType != "markdown" {
+			return grpcwire.InvalidArgument, "msgtype must be text or markdown; use message_json for others"
+		}
+		if in.Content == "" || in.ToUser+in.ToParty+in.ToTag == "" {
+			return grpcwire.InvalidArgument, "content and a recipient are required"
+		}
+		body := map[string]any{
+			"touser":  in.ToUser,
+			"toparty": in.ToParty,
+			"totag":   in.ToTag,
+			"msgtype": msgType,
+			"agentid": json.Number(firstNonEmpty(in.AgentID, cfg.WeComAgentID, "0")),
+			msgType:   map[string]string{"content": in.Content},
+		}
+		message, _ = json.Marshal(body)
+	} else if !json.Valid(message) {
+		return grpcwire.InvalidArgument, "message_json is not valid JSON"
+	}
+	var target struct {
+		AgentID any `json:"agentid"`
+	}
+	_ = json.Unmarshal(message, &target)
+	if entry, ok := r.Context().Value(auditEntryKey{}).(*auditlog.Entry); ok {
+		setAuditTargets(entry, message)
+	}
+	token := state.managedToken(jsonID(target.AgentID))
+	if token == "" {
+		return grpcwire.FailedPrecondition, "no managed access token"
+	}
+	capture := &responseCapture{}
+	msgID, err := sendAppMessage(capture, r, cfg, state, token, message, 0, false)
+	if err != nil {
+		msg := strings.TrimSpace(capture.body.String())
+		switch capture.status {
+		case http.StatusTooManyRequests:
+			return grpcwire.ResourceExhausted, msg
+		case http.StatusForbidden:
+			return grpcwire.PermissionDenied, msg
+		case http.StatusBadRequest:
+			return grpcwire.InvalidArgument, msg
+		}
+		var result struct {
+			ErrCode int `json:"errcode"`
+		}
+		if json.Unmarshal(capture.body.Bytes(), &result) == nil && result.ErrCode != 0 {
+			return grpcwire.FailedPrecondition, msg
+		}
+		return grpcwire.Unavailable, msg
+	}
+	resp := grpcwire.AppendString(nil, 2, "ok")
+	resp = grpcwire.AppendString(resp, 3, msgID)
+	if err := grpcwire.WriteMessage(w, resp); err != nil {
+		return grpcwire.Unavailable, "write failed"
+	}
+	return grpcwire.OK, ""
+}
+
+func grpcUploadMedia(w http.ResponseWriter, r *http.Request, cfg config.Config, state *bridgeState, req []byte) (int, string) {
+	var typeName, filename string
+	var data []byte
+	err := grpcwire.Fields(req, func(field int, _ uint64, b []byte) {
+		switch field {
+		case 1:
+			typeName = string(b)
+		case 2:
+			filename = string(b)
+		case 3:
+			data = b
+		}
+	})
+	if err != nil {
+		return grpcwire.InvalidArgument, err.Error()
+	}
+	if len(data) == 0 {
+		return grpcwire.InvalidArgument, "data is required"
+	}
+	token := state.managedToken("")
+	if token == "" {
+		return grpcwire.FailedPrecondition, "no managed access token"
+	}
+	typeName = firstNonEmpty(typeName, "file")
+	respData, err := uploadWeComMedia(r.Context(), qyapiClient(proxyTimeout(r, cfg, "media_upload", 0)), token, typeName, firstNonEmpty(filename, "upload.bin"), data)
+	if err != nil {
+		return grpcwire.Unavailable, err.Error()
+	}
+	var result struct {
+		ErrCode   int    `json:"errcode"`
+		ErrMsg    string `json:"errmsg"`
+		Type      string `json:"type"`
+		MediaID   string `json:"media_id"`
+		CreatedAt string `json:"created_at"`
+	}
+	if err := json.Unmarshal(respData, &result); err != nil {
+		return grpcwire.Unavailable, "upload decode failed"
+	}
+	if result.ErrCode != 0 {
+		return grpcwire.FailedPrecondition, string(proxy.EnrichError(respData, "upload"))
+	}
+	state.usage.record(requesterIdentity(r, cfg), func(c *usageCounters) { c.MediaBytes += int64(len(data)) })
+	createdAt, _ := strconv.ParseInt(result.CreatedAt, 10, 64)
+	resp := grpcwire.AppendString(nil, 1, result.MediaID)
+	resp = grpcwire.AppendString(resp, 2, result.Type)
+	resp = grpcwire.AppendInt(resp, 3, createdAt)
+	if err := grpcwire.WriteMessage(w, resp); err != nil {
+		return grpcwire.Unavailable, "write failed"
+	}
+	return grpcwire.OK, ""
+}
+
+// withSignature appends a "sig" member signing the JSON object payload as
+// it was before the member was added. Other payloads are left unsigned.
+func withSignature(secret string, payload []byte, now time.Time) []byte {
+	payload = bytes.TrimSpace(payload)
+	if len(payload) < 2 || payload[0] != '{' || payload[len(payload)-1] != '}' {
+		return payload
+	}
+	out := make([]byte, 0, len(payload)+96)
+	out = append(out, payload[:len(payload)-1]...)
+	if len(bytes.TrimSpace(out)) > 1 {
+		out = append(out, ',')
+	}
+	out = append(out, `"sig":"`+wxcrypto.SignPayload(secret, payload, now)+`"}`...)
+	return out
+}
+
+// countingWriter counts bytes written through it.
+type countingWriter struct {
+	w io.Writer
+	n int64
+}
+
+func (c *countingWriter) Write(p []byte) (int, error) {
+	n, err := c.w.Write(p)
+	c.n += int64(n)
+	return n, err
+}
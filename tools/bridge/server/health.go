@@ -0,0 +1,139 @@
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"maps"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/Tennen/Paimon/tools/bridge/config"
+)
+
+func handleHealth(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	_, _ = w.Write([]byte(`{"ok":true}`))
+}
+
+// readyCheck is one entry of the /ready report.
+type readyCheck struct {
+	OK       bool     `json:"ok"`
+	Error    string   `json:"error,omitempty"`
+	Warnings []string `json:"warnings,omitempty"`
+}
+
+// readiness caches the /ready report so frequent probes do not turn into
+// gettoken calls; the zero value is ready to use.
+type readiness struct {
+	mu        sync.Mutex
+	checkedAt time.Time
+	ready     bool
+	checks    map[string]readyCheck
+}
+
+// handleReady is the readiness probe: unlike /health it answers 503 while
+// the configuration is invalid, access tokens cannot be obtained or the
+// bridge is shutting down.
+func handleReady(w http.ResponseWriter, r *http.Request, cfg config.Config, state *bridgeState) {
+	if r.Method != http.MethodGet {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	rd := &state.ready
+	rd.mu.Lock()
+	if rd.checks == nil || time.Since(rd.checkedAt) >= cfg.ReadyCache {
+		rd.checks = readyChecks(cfg, state)
+		rd.checkedAt = time.Now().UTC()
+		rd.ready = true
+		for _, check := range rd.checks {
+			rd.ready = rd.ready && check.OK
+		}
+	}
+	ready, checks, checkedAt := rd.ready, rd.checks, rd.checkedAt
+	rd.mu.Unlock()
+
+	// Shutdown is reported at once, not after the cache expires.
+	select {
+	case <-state.closing:
+		ready = false
+		checks = maps.Clone(checks)
+		checks["shutdown"] = readyCheck{Error: "shutting down"}
+	default:
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	if !ready {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}
+	_ = json.NewEncoder(w).Encode(map[string]any{
+		"ready":     ready,
+		"checks":    checks,
+		"checkedAt": checkedAt.Format(time.RFC3339),
+	})
+}
+
+// readyChecks runs the /ready checks: config validity, then one gettoken
+// per configured app secret unless BRIDGE_READY_TOKEN_CHECK is off. Tokens
+// come from the managers' caches, so WeCom is only called once they expire.
+func readyChecks(cfg config.Config, state *bridgeState) map[string]readyCheck {
+	checks := make(map[string]readyCheck)
+	errs, warnings := configProblems(cfg)
+	checks["config"] = readyCheck{OK: len(errs) == 0, Error: strings.Join(errs, "; "), Warnings: warnings}
+	if !cfg.ReadyTokenCheck {
+		return checks
+	}
+	managers := make(map[string]*tokenManager)
+	if cfg.WeComCorpSecret != "" && state.tokens != nil {
+		managers["token"] = state.tokens
+	}
+	for agentID, m := range state.agentTokens {
+		managers["token:"+agentID] = m
+	}
+	for name, m := range managers {
+		if _, err := m.get(); err != nil {
+			checks[name] = readyCheck{Error: redactSecrets(err.Error())}
+			continue
+		}
+		checks[name] = readyCheck{OK: true}
+	}
+	return checks
+}
+
+func handleMetrics(w http.ResponseWriter, r *http.Request, cfg config.Config, state *bridgeState) {
+	if r.Method != http.MethodGet {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	if !checkBridgeAuth(w, r, cfg, config.ScopeMetricsRead) {
+		return
+	}
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	state.metrics.WriteText(w)
+	if p := state.callbacks; p != nil {
+		fmt.Fprintf(w, "# TYPE wecom_bridge_callback_queue_depth gauge\nwecom_bridge_callback_queue_depth %d\n", len(p.queue))
+		fmt.Fprintf(w, "# TYPE wecom_bridge_callback_queue_capacity gauge\nwecom_bridge_callback_queue_capacity %d\n", cap(p.queue))
+		fmt.Fprintf(w, "# TYPE wecom_bridge_callback_workers_busy gauge\nwecom_bridge_callback_workers_busy %d\n", p.busy.Load())
+	}
+	if sb := state.standby; sb != nil {
+		promoted, lag := 0, int64(0)
+		if state.promoted.Load() {
+			promoted = 1
+		} else {
+			state.mu.Lock()
+			lag = max(sb.primaryNextID.Load()-state.nextEventID, 0)
+			state.mu.Unlock()
+		}
+		fmt.Fprintf(w, "# TYPE wecom_bridge_standby_promoted gauge\nwecom_bridge_standby_promoted %d\n", promoted)
+		fmt.Fprintf(w, "# TYPE wecom_bridge_standby_lag_events gauge\nwecom_bridge_standby_lag_events %d\n", lag)
+	}
+	if c := state.certs; c != nil && !c.expiry().IsZero() {
+		fmt.Fprintf(w, "# TYPE wecom_bridge_tls_cert_expiry_timestamp_seconds gauge\nwecom_bridge_tls_cert_expiry_timestamp_seconds %d\n", c.expiry().Unix())
+	}
+}
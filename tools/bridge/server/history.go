@@ -0,0 +1,271 @@
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"math"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/Tennen/Paimon/tools/bridge/archive"
+	"github.com/Tennen/Paimon/tools/bridge/config"
+)
+
+// handleSends searches the archived outbound sends, newest first. Filters:
+// touser, requester, msgType, q (substring of the truncated content), since
+// and until (RFC3339), limit.
+func handleSends(w http.ResponseWriter, r *http.Request, cfg config.Config, state *bridgeState) {
+	if r.Method != http.MethodGet {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	if !checkAdminAuth(w, r, cfg) {
+		return
+	}
+	q := r.URL.Query()
+	filter := archive.Filter{
+		Kind:      "outbound",
+		ToUser:    q.Get("touser"),
+		Requester: q.Get("requester"),
+		MsgType:   q.Get("msgType"),
+		Text:      q.Get("q"),
+		Limit:     100,
+	}
+	var err error
+	if filter.Since, err = parseTimeParam(q.Get("since")); err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		_, _ = w.Write([]byte("invalid since"))
+		return
+	}
+	if filter.Until, err = parseTimeParam(q.Get("until")); err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		_, _ = w.Write([]byte("invalid until"))
+		return
+	}
+	if v := q.Get("limit"); v != "" {
+		if n, err := strconv.Atoi(v); err == nil && n > 0 && n <= 1000 {
+			filter.Limit = n
+		}
+	}
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(map[string]any{"sends": state.archive.Search(filter)})
+}
+
+// historyMessage is one event in a GET /messages response.
+type historyMessage struct {
+	ID   int64           `json:"id"`
+	Time time.Time       `json:"time"`
+	Data json.RawMessage `json:"data"`
+}
+
+// handleMessages returns recent inbound messages from the event buffer (and
+// the persistent store, if configured), newest first, so consumers can load
+// conversation context on startup. Filters: fromUser, msgType, since and
+// until (RFC3339), limit; cursor continues from a previous nextCursor.
+func handleMessages(w http.ResponseWriter, r *http.Request, cfg config.Config, state *bridgeState) {
+	if r.Method != http.MethodGet {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	if !checkBridgeAuth(w, r, cfg, config.ScopeStreamRead) {
+		return
+	}
+	q := r.URL.Query()
+	since, err := parseTimeParam(q.Get("since"))
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		_, _ = w.Write([]byte("invalid since"))
+		return
+	}
+	until, err := parseTimeParam(q.Get("until"))
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		_, _ = w.Write([]byte("invalid until"))
+		return
+	}
+	if cfg.MessagesRetention > 0 {
+		if cutoff := time.Now().Add(-cfg.MessagesRetention); since.Before(cutoff) {
+			since = cutoff
+		}
+	}
+	limit := 100
+	if v := q.Get("limit"); v != "" {
+		if n, err := strconv.Atoi(v); err == nil && n > 0 && n <= 1000 {
+			limit = n
+		}
+	}
+	before := int64(math.MaxInt64)
+	if v := q.Get("cursor"); v != "" {
+		id, err := strconv.ParseInt(v, 36, 64)
+		if err != nil || id <= 0 {
+			w.WriteHeader(http.StatusBadRequest)
+			_, _ = w.Write([]byte("invalid cursor"))
+			return
+		}
+		before = id
+	}
+	filter := streamFilter{FromUsers: splitList(q.Get("fromUser")), MsgTypes: splitList(q.Get("msgType"))}
+
+	messages := make([]historyMessage, 0)
+	more := false
+	err = state.eventsBefore(before, func(ev sseEvent) bool {
+		// IDs grow with time, so the first event before since ends the walk.
+		if !since.IsZero() && ev.Time.Before(since) {
+			return false
+		}
+		if ev.Type != "message" || !filter.Matches(ev) || (!until.IsZero() && ev.Time.After(until)) {
+			return true
+		}
+		if len(messages) == limit {
+			more = true
+			return false
+		}
+		messages = append(messages, historyMessage{ID: ev.ID, Time: ev.Time, Data: ev.Payload})
+		return true
+	})
+	if err != nil {
+		slog.ErrorContext(r.Context(), "message history read failed", "err", err)
+		state.metrics.Inc("wecom_bridge_event_store_errors_total", "op", "history")
+		w.WriteHeader(http.StatusInternalServerError)
+		_, _ = w.Write([]byte("history unavailable"))
+		return
+	}
+	resp := map[string]any{"messages": messages}
+	if more {
+		resp["nextCursor"] = strconv.FormatInt(messages[len(messages)-1].ID, 36)
+	}
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(resp)
+}
+
+// handleArchiveSearch serves full-text search over the archived message text
+// with pagination and highlighted snippets.
+func handleArchiveSearch(w http.ResponseWriter, r *http.Request, cfg config.Config, state *bridgeState) {
+	if r.Method != http.MethodGet {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	if !checkAdminAuth(w, r, cfg) {
+		return
+	}
+	q := r.URL.Query()
+	query := strings.TrimSpace(q.Get("q"))
+	if query == "" {
+		w.WriteHeader(http.StatusBadRequest)
+		_, _ = w.Write([]byte("missing q"))
+		return
+	}
+	filter := archive.Filter{
+		Kind:      q.Get("kind"),
+		SessionID: q.Get("sessionId"),
+		Limit:     20,
+	}
+	var err error
+	if filter.Since, err = parseTimeParam(q.Get("since")); err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		_, _ = w.Write([]byte("invalid since"))
+		return
+	}
+	if filter.Until, err = parseTimeParam(q.Get("until")); err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		_, _ = w.Write([]byte("invalid until"))
+		return
+	}
+	if v := q.Get("limit"); v != "" {
+		if n, err := strconv.Atoi(v); err == nil && n > 0 && n <= 100 {
+			filter.Limit = n
+		}
+	}
+	offset, _ := strconv.Atoi(q.Get("offset"))
+	if offset < 0 {
+		offset = 0
+	}
+	hits, total := state.archive.FullTextSearch(query, filter, offset)
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(map[string]any{
+		"query":   query,
+		"total":   total,
+		"offset":  offset,
+		"limit":   filter.Limit,
+		"results": hits,
+	})
+}
+
+func parseTimeParam(v string) (time.Time, error) {
+	if v == "" {
+		return time.Time{}, nil
+	}
+	return time.Parse(time.RFC3339, v)
+}
+
+// outboundRecord summarizes a message/send body for the archive.
+func outboundRecord(message []byte, requester string) archive.Record {
+	var msg struct {
+		ToUser   string                   `json:"touser"`
+		ToParty  string                   `json:"toparty"`
+		ToTag    string                   `json:"totag"`
+		ChatID   string                   `json:"chatid"`
+		MsgType  string                   `json:"msgtype"`
+		AgentID  any                      `json:"agentid"`
+		Text     struct{ Content string } `json:"text"`
+		Markdown struct{ Content string } `json:"markdown"`
+		TextCard struct{ Title string }   `json:"textcard"`
+		News     struct {
+			Articles []struct{ Title string } `json:"articles"`
+		} `json:"news"`
+	}
+	_ = json.Unmarshal(message, &msg)
+	target := msg.ToUser
+	if msg.ToParty != "" {
+		target = strings.Trim(target+" party:"+msg.ToParty, " ")
+	}
+	if msg.ToTag != "" {
+		target = strings.Trim(target+" tag:"+msg.ToTag, " ")
+	}
+	if msg.ChatID != "" {
+		target = "chat:" + msg.ChatID
+	}
+	content := firstNonEmpty(msg.Text.Content, msg.Markdown.Content, msg.TextCard.Title)
+	if content == "" && len(msg.News.Articles) > 0 {
+		content = msg.News.Articles[0].Title
+	}
+	agentID := jsonID(msg.AgentID)
+	rec := archive.Record{
+		Kind:      "outbound",
+		ToUser:    target,
+		AgentID:   agentID,
+		MsgType:   msg.MsgType,
+		Text:      truncateRunes(content, archiveTextLimit),
+		Requester: requester,
+		FullText:  content,
+	}
+	// A send to exactly one user continues that user's session.
+	if target == msg.ToUser && target != "@all" && !strings.Contains(target, "|") {
+		rec.SessionID = target
+	}
+	return rec
+}
+
+// jsonID formats an ID WeCom accepts as either a JSON number or a string,
+// such as agentid, without exponent notation.
+func jsonID(v any) string {
+	switch id := v.(type) {
+	case nil:
+		return ""
+	case float64:
+		return strconv.FormatFloat(id, 'f', -1, 64)
+	default:
+		return fmt.Sprintf("%v", id)
+	}
+}
+
+func truncateRunes(value string, limit int) string {
+	runes := []rune(value)
+	if len(runes) <= limit {
+		return value
+	}
+	return string(runes[:limit]) + "…"
+}
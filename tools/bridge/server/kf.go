@@ -0,0 +1,253 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/Tennen/Paimon/tools/bridge/atomicfile"
+	"github.com/Tennen/Paimon/tools/bridge/config"
+)
+
+// kfSyncPageLimit bounds the sync_msg pages pulled per callback, so a huge
+// backlog is worked off over several callbacks.
+const kfSyncPageLimit = 50
+
+// kfSyncer pulls WeChat customer service (微信客服) messages with
+// kf/sync_msg whenever a kf_msg_or_event callback arrives, since those
+// callbacks carry no content, and broadcasts them like callback messages.
+// The cursor of each customer service account (open_kfid) is persisted so
+// nothing is pulled twice across restarts.
+type kfSyncer struct {
+	cfg   config.Config
+	state *bridgeState
+
+	mu      sync.Mutex
+	cursors map[string]string
+	// pending holds the newest callback token per account awaiting a sync.
+	pending map[string]string
+	wake    chan struct{}
+}
+
+// kfMessage is the envelope of one sync_msg entry; the rest of it is kept
+// as kfMessage in the payload.
+type kfMessage struct {
+	MsgID          string `json:"msgid"`
+	OpenKfID       string `json:"open_kfid"`
+	ExternalUserID string `json:"external_userid"`
+	SendTime       int64  `json:"send_time"`
+	Origin         int    `json:"origin"`
+	ServicerUserID string `json:"servicer_userid"`
+	MsgType        string `json:"msgtype"`
+}
+
+func newKFSyncer(cfg config.Config, state *bridgeState) *kfSyncer {
+	k := &kfSyncer{cfg: cfg, state: state, cursors: make(map[string]string), pending: make(map[string]string), wake: make(chan struct{}, 1)}
+	if cfg.KFCursorFile != "" {
+		if data, err := os.ReadFile(cfg.KFCursorFile); err == nil {
+			_ = json.Unmarshal(data, &k.cursors)
+		}
+	}
+	return k
+}
+
+// trigger schedules a sync of openKfID; token is the callback's sync token,
+// which lifts sync_msg's rate limit for ten minutes.
+func (k *kfSyncer) trigger(openKfID, token string) {
+	if openKfID == "" {
+		return
+	}
+	k.mu.Lock()
+	k.pending[openKfID] = token
+	k.mu.Unlock()
+	select {
+	case k.wake <- struct{}{}:
+	default:
+	}
+}
+
+func (k *kfSyncer) run() {
+	for range k.wake {
+		k.mu.Lock()
+		pending := k.pending
+		k.pending = make(map[string]string)
+		k.mu.Unlock()
+		for openKfID, token := range pending {
+			if err := k.sync(openKfID, token); err != nil {
+				k.state.metrics.Inc("wecom_bridge_kf_syncs_total", "result", "error")
+				slog.Warn("kf sync failed", "open_kfid", openKfID, "err", err)
+				continue
+			}
+			k.state.metrics.Inc("wecom_bridge_kf_syncs_total", "result", "ok")
+		}
+	}
+}
+
+// sync pulls every page after the account's cursor, broadcasting each
+// message and advancing the cursor page by page.
+func (k *kfSyncer) sync(openKfID, token string) error {
+	for page := 0; page < kfSyncPageLimit; page++ {
+		accessToken := k.state.managedToken(config.KFSecretKey)
+		if accessToken == "" {
+			return errors.New("no access token (set WECOM_CORP_ID with WECOM_KF_SECRET or WECOM_CORP_SECRET)")
+		}
+		k.mu.Lock()
+		cursor := k.cursors[openKfID]
+		k.mu.Unlock()
+		body, _ := json.Marshal(map[string]any{"cursor": cursor, "token": token, "limit": 1000, "open_kfid": openKfID})
+		endpoint := fmt.Sprintf("https://qyapi.weixin.qq.com/cgi-bin/kf/sync_msg?access_token=%s", url.QueryEscape(accessToken))
+		data, err := postWeComJSON(context.Background(), endpoint, body, k.cfg.ProxyTimeouts["kf"])
+		if err != nil {
+			return err
+		}
+		var result struct {
+			NextCursor string            `json:"next_cursor"`
+			HasMore    int               `json:"has_more"`
+			MsgList    []json.RawMessage `json:"msg_list"`
+		}
+		if err := json.Unmarshal(data, &result); err != nil {
+			return fmt.Errorf("invalid sync_msg response: %w", err)
+		}
+		for _, raw := range result.MsgList {
+			k.deliver(raw)
+		}
+		if result.NextCursor != "" {
+			k.mu.Lock()
+			k.cursors[openKfID] = result.NextCursor
+			saved, _ := json.Marshal(k.cursors)
+			k.mu.Unlock()
+			if k.cfg.KFCursorFile != "" {
+				if err := atomicfile.Write(k.cfg.KFCursorFile, saved); err != nil {
+					slog.Error("kf cursor write failed", "err", err)
+				}
+			}
+		}
+		if result.HasMore != 1 {
+			return nil
+		}
+	}
+	return nil
+}
+
+// deliver broadcasts and archives one synced message with the callback
+// payload fields, after the configured rules and routes.
+func (k *kfSyncer) deliver(raw json.RawMessage) {
+	var m kfMessage
+	var detail map[string]any
+	if json.Unmarshal(raw, &m) != nil || json.Unmarshal(raw, &detail) != nil {
+		return
+	}
+	cfg := k.state.config()
+	body, _ := detail[m.MsgType].(map[string]any)
+	str := func(key string) string {
+		v, _ := body[key].(string)
+		return v
+	}
+	receivedAt := time.Now().UTC()
+	// origin 3 is the customer, 4 a system event, 5 a servicer: a human or
+	// this bridge's own /proxy/kf/send replies. Servicer messages are not
+	// inbound, so they skip rules and routes and go out as kf_servicer.
+	if m.Origin == 5 {
+		event := map[string]any{
+			"type":           "kf_servicer",
+			"source":         "kf",
+			"messageId":      m.MsgID,
+			"openKfId":       m.OpenKfID,
+			"externalUserId": m.ExternalUserID,
+			"servicerUserId": m.ServicerUserID,
+			"msgType":        m.MsgType,
+			"text":           str("content"),
+			"receivedAt":     receivedAt.Format(time.RFC3339),
+			"kfMessage":      detail,
+		}
+		if m.SendTime > 0 {
+			event["sendTime"] = time.Unix(m.SendTime, 0).UTC().Format(time.RFC3339)
+		}
+		if _, err := k.state.broadcastEvent("kf_servicer", event); err == nil {
+			k.state.metrics.Inc("wecom_bridge_kf_messages_total", "msgtype", m.MsgType)
+		}
+		return
+	}
+	msg := &wecomMessage{
+		MsgType:  m.MsgType,
+		FromUser: m.ExternalUserID,
+		ToUser:   m.OpenKfID,
+		MsgID:    m.MsgID,
+		Content:  str("content"),
+		MediaID:  str("media_id"),
+		Event:    str("event_type"),
+	}
+	if m.SendTime > 0 {
+		msg.CreateTime = time.Unix(m.SendTime, 0).UTC()
+	}
+	payload := map[string]any{
+		"messageId":  m.MsgID,
+		"sessionId":  m.ExternalUserID,
+		"fromUser":   msg.FromUser,
+		"toUser":     msg.ToUser,
+		"text":       msg.Content,
+		"msgType":    msg.MsgType,
+		"event":      msg.Event,
+		"mediaId":    msg.MediaID,
+		"receivedAt": receivedAt.Format(time.RFC3339),
+		"channel":    "kf",
+		"openKfId":   m.OpenKfID,
+		"origin":     m.Origin,
+		"kfMessage":  detail,
+	}
+	if publishInbound(cfg, k.state, msg, payload, receivedAt) {
+		k.state.metrics.Inc("wecom_bridge_kf_messages_total", "msgtype", m.MsgType)
+	}
+}
+
+// handleProxyKFSend forwards a customer service reply to kf/send_msg. The
+// body is WeCom's (touser, open_kfid, msgtype and the message object) plus
+// the optional access_token and timeout_ms.
+func handleProxyKFSend(w http.ResponseWriter, r *http.Request, cfg config.Config, state *bridgeState) {
+	if r.Method != http.MethodPost {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	if !checkBridgeAuth(w, r, cfg, config.ScopeProxySend) {
+		return
+	}
+
+	body, err := readBody(r)
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		_, _ = w.Write([]byte("missing body"))
+		return
+	}
+	var payload map[string]any
+	if err := json.Unmarshal(body, &payload); err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		_, _ = w.Write([]byte("invalid json"))
+		return
+	}
+	accessToken, _ := payload["access_token"].(string)
+	timeoutMS, _ := payload["timeout_ms"].(float64)
+	delete(payload, "access_token")
+	delete(payload, "timeout_ms")
+	if accessToken == "" {
+		accessToken = state.managedToken(config.KFSecretKey)
+	}
+	toUser, _ := payload["touser"].(string)
+	openKfID, _ := payload["open_kfid"].(string)
+	msgType, _ := payload["msgtype"].(string)
+	if accessToken == "" || toUser == "" || openKfID == "" || msgType == "" {
+		w.WriteHeader(http.StatusBadRequest)
+		_, _ = w.Write([]byte("missing access_token/touser/open_kfid/msgtype"))
+		return
+	}
+
+	forwardBody, _ := json.Marshal(payload)
+	endpoint := fmt.Sprintf("https://qyapi.weixin.qq.com/cgi-bin/kf/send_msg?access_token=%s", url.QueryEscape(accessToken))
+	forwardWeCom(w, r, endpoint, forwardBody, "kf send", proxyTimeout(r, cfg, "kf", int(timeoutMS)))
+}
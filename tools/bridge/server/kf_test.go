@@ -0,0 +1,45 @@
+package server
+
+import (
+	"encoding/json"
+	"testing"
+	"time"
+
+	"github.com/Tennen/Paimon/tools/bridge/archive"
+	"github.com/Tennen/Paimon/tools/bridge/config"
+	"github.com/Tennen/Paimon/tools/bridge/hub"
+	"github.com/Tennen/Paimon/tools/bridge/metrics"
+)
+
+func TestKFDeliverSeparatesServicerMessages(t *testing.T) {
+	state := &bridgeState{nextEventID: 1, bufferCap: config.DefaultBufferSize, metrics: metrics.New(), archive: archive.New(100)}
+	state.clients = hub.New(streamHubShards, streamHubQueue)
+	defer state.clients.Close()
+	k := &kfSyncer{state: state}
+	k.deliver(json.RawMessage(`{"msgid":"m1","open_kfid":"wk1","external_userid":"wm1","send_time":1700000000,"origin":3,"msgtype":"text","text":{"content":"hi"}}`))
+	k.deliver(json.RawMessage(`{"msgid":"m2","open_kfid":"wk1","external_userid":"wm1","send_time":1700000001,"origin":5,"servicer_userid":"zhangsan","msgtype":"text","text":{"content":"hello"}}`))
+
+	events := state.getMissed(0, streamFilter{})
+	if len(events) != 2 {
+		t.Fatalf("got %d events", len(events))
+	}
+	var inbound, servicer map[string]any
+	if err := json.Unmarshal(events[0].Payload, &inbound); err != nil {
+		t.Fatal(err)
+	}
+	if err := json.Unmarshal(events[1].Payload, &servicer); err != nil {
+		t.Fatal(err)
+	}
+	if events[0].Type != "message" || inbound["fromUser"] != "wm1" || inbound["sessionId"] != "wm1" || inbound["text"] != "hi" || inbound["channel"] != "kf" {
+		t.Fatalf("inbound %s %v", events[0].Type, inbound)
+	}
+	if events[1].Type != "kf_servicer" || servicer["servicerUserId"] != "zhangsan" || servicer["externalUserId"] != "wm1" || servicer["text"] != "hello" {
+		t.Fatalf("servicer %s %v", events[1].Type, servicer)
+	}
+	if _, ok := servicer["sessionId"]; ok {
+		t.Fatal("servicer message carries sessionId")
+	}
+	if servicer["sendTime"] != time.Unix(1700000001, 0).UTC().Format(time.RFC3339) {
+		t.Fatal(servicer["sendTime"])
+	}
+}
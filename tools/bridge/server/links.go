@@ -0,0 +1,212 @@
+package server
+
+import (
+	"errors"
+	"fmt"
+	"html"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/Tennen/Paimon/tools/bridge/config"
+	"github.com/Tennen/Paimon/tools/bridge/metrics"
+)
+
+// addTimeFields records when WeCom says the message was sent (CreateTime) and
+// when the bridge received it, as epoch values and, with BRIDGE_TIMEZONE,
+// in local time.
+func addTimeFields(cfg config.Config, payload map[string]any, createTime, receivedAt time.Time) {
+	payload["receivedAtMs"] = receivedAt.UnixMilli()
+	if !createTime.IsZero() {
+		payload["createTime"] = createTime.Unix()
+		payload["createdAt"] = createTime.Format(time.RFC3339)
+	}
+	if cfg.Timezone == nil {
+		return
+	}
+	payload["timezone"] = cfg.Timezone.String()
+	payload["receivedAtLocal"] = receivedAt.In(cfg.Timezone).Format(time.RFC3339)
+	if !createTime.IsZero() {
+		payload["createdAtLocal"] = createTime.In(cfg.Timezone).Format(time.RFC3339)
+	}
+}
+
+// linkUnfurler fetches title/description previews for links on allowlisted
+// hosts and caches them.
+type linkUnfurler struct {
+	allowlist []string
+	client    *http.Client
+
+	mu    sync.Mutex
+	cache map[string]linkPreview
+}
+
+// linkPreview is one entry of the payload's links array.
+type linkPreview struct {
+	URL         string `json:"url"`
+	Title       string `json:"title,omitempty"`
+	Description string `json:"description,omitempty"`
+	SiteName    string `json:"siteName,omitempty"`
+}
+
+var (
+	linkPattern     = regexp.MustCompile(`https?://[^\s<>"'，。；！？、）】」]+`)
+	titlePattern    = regexp.MustCompile(`(?is)<title[^>]*>(.*?)</title>`)
+	metaTagPattern  = regexp.MustCompile(`(?is)<meta\s[^>]*>`)
+	metaAttrPattern = regexp.MustCompile(`(?is)([a-z:-]+)\s*=\s*(?:"([^"]*)"|'([^']*)')`)
+)
+
+func newLinkUnfurler(cfg config.Config) *linkUnfurler {
+	u := &linkUnfurler{
+		allowlist: cfg.LinkAllowlist,
+		cache:     make(map[string]linkPreview),
+	}
+	u.client = &http.Client{
+		Timeout:   cfg.LinkTimeout,
+		Transport: outboundTransport,
+		CheckRedirect: func(req *http.Request, via []*http.Request) error {
+			if len(via) >= 3 || !u.allowed(req.URL) {
+				return errors.New("redirect not allowed")
+			}
+			return nil
+		},
+	}
+	return u
+}
+
+// extractLinks returns the distinct http(s) URLs in text, in order.
+func extractLinks(text string) []string {
+	out := make([]string, 0)
+	seen := make(map[string]bool)
+	for _, link := range linkPattern.FindAllString(text, maxLinksPerMessage) {
+		link = strings.TrimRight(link, ".,;:!?)]}'\"")
+		if _, err := url.Parse(link); err != nil || seen[link] {
+			continue
+		}
+		seen[link] = true
+		out = append(out, link)
+	}
+	return out
+}
+
+// collect extracts the links in text and, when unfurl is set, fetches
+// previews for allowlisted ones concurrently.
+func (u *linkUnfurler) collect(text string, unfurl bool, metrics *metrics.Registry) []linkPreview {
+	links := extractLinks(text)
+	previews := make([]linkPreview, len(links))
+	var wg sync.WaitGroup
+	for i, link := range links {
+		previews[i] = linkPreview{URL: link}
+		parsed, _ := url.Parse(link)
+		if !unfurl || !u.allowed(parsed) {
+			continue
+		}
+		wg.Add(1)
+		go func(i int, link string) {
+			defer wg.Done()
+			preview, err := u.unfurl(link)
+			if err != nil {
+				metrics.Inc("wecom_bridge_link_unfurls_total", "result", "error")
+				slog.Warn("link unfurl failed", "url", link, "err", err)
+				return
+			}
+			metrics.Inc("wecom_bridge_link_unfurls_total", "result", "ok")
+			previews[i] = preview
+		}(i, link)
+	}
+	wg.Wait()
+	return previews
+}
+
+func (u *linkUnfurler) allowed(target *url.URL) bool {
+	return hostAllowed(u.allowlist, target)
+}
+
+// hostAllowed reports whether target is an http(s) URL whose host is on the
+// allowlist; an entry like ".example.com" also matches subdomains.
+func hostAllowed(allowlist []string, target *url.URL) bool {
+	if target == nil || (target.Scheme != "http" && target.Scheme != "https") {
+		return false
+	}
+	host := strings.ToLower(target.Hostname())
+	for _, entry := range allowlist {
+		entry = strings.ToLower(entry)
+		if host == strings.TrimPrefix(entry, ".") || (strings.HasPrefix(entry, ".") && strings.HasSuffix(host, entry)) {
+			return true
+		}
+	}
+	return false
+}
+
+func (u *linkUnfurler) unfurl(link string) (linkPreview, error) {
+	u.mu.Lock()
+	cached, ok := u.cache[link]
+	u.mu.Unlock()
+	if ok {
+		return cached, nil
+	}
+
+	req, err := http.NewRequest(http.MethodGet, link, nil)
+	if err != nil {
+		return linkPreview{}, err
+	}
+	req.Header.Set("Accept", "text/html")
+	req.Header.Set("User-Agent", "wecom-bridge-unfurl/1.0")
+	resp, err := u.client.Do(req)
+	if err != nil {
+		return linkPreview{}, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return linkPreview{}, fmt.Errorf("status %d", resp.StatusCode)
+	}
+	if ct := resp.Header.Get("Content-Type"); ct != "" && !strings.Contains(ct, "html") {
+		return linkPreview{}, fmt.Errorf("content type %s", ct)
+	}
+	page, err := io.ReadAll(io.LimitReader(resp.Body, maxUnfurlBytes))
+	if err != nil {
+		return linkPreview{}, err
+	}
+
+	preview := parseLinkPreview(link, string(page))
+	u.mu.Lock()
+	if len(u.cache) >= maxUnfurlCache {
+		u.cache = make(map[string]linkPreview)
+	}
+	u.cache[link] = preview
+	u.mu.Unlock()
+	return preview, nil
+}
+
+// parseLinkPreview reads the title, description and site name from a page,
+// preferring Open Graph tags.
+func parseLinkPreview(link, page string) linkPreview {
+	preview := linkPreview{URL: link}
+	meta := make(map[string]string)
+	for _, tag := range metaTagPattern.FindAllString(page, -1) {
+		attrs := make(map[string]string)
+		for _, m := range metaAttrPattern.FindAllStringSubmatch(tag, -1) {
+			attrs[strings.ToLower(m[1])] = m[2] + m[3]
+		}
+		key := strings.ToLower(firstNonEmpty(attrs["property"], attrs["name"]))
+		if key != "" && attrs["content"] != "" && meta[key] == "" {
+			meta[key] = attrs["content"]
+		}
+	}
+	var title string
+	if m := titlePattern.FindStringSubmatch(page); m != nil {
+		title = m[1]
+	}
+	clean := func(v string, limit int) string {
+		return truncateRunes(strings.Join(strings.Fields(html.UnescapeString(v)), " "), limit)
+	}
+	preview.Title = clean(firstNonEmpty(meta["og:title"], title), 200)
+	preview.Description = clean(firstNonEmpty(meta["og:description"], meta["description"]), 300)
+	preview.SiteName = clean(meta["og:site_name"], 100)
+	return preview
+}
@@ -0,0 +1,268 @@
+package server
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/slog"
+	"mime"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/Tennen/Paimon/tools/bridge/config"
+	"github.com/Tennen/Paimon/tools/bridge/mediacache"
+	"github.com/Tennen/Paimon/tools/bridge/proxy"
+)
+
+// handleProxyMediaRaw streams a media file to the client with WeCom's
+// Content-Type and Content-Disposition, without buffering or base64:
+// GET /proxy/media/raw?media_id=...[&access_token=...][&timeout_ms=...].
+// Cached files are served with Range support. With &format=mp3|wav voice
+// media is transcoded first and served from memory instead.
+func handleProxyMediaRaw(w http.ResponseWriter, r *http.Request, cfg config.Config, state *bridgeState) {
+	if r.Method != http.MethodGet {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	if !checkBridgeAuth(w, r, cfg, config.ScopeProxyMedia) {
+		return
+	}
+
+	q := r.URL.Query()
+	mediaID := strings.TrimSpace(q.Get("media_id"))
+	if mediaID == "" {
+		w.WriteHeader(http.StatusBadRequest)
+		_, _ = w.Write([]byte("missing media_id"))
+		return
+	}
+	identity := requesterIdentity(r, cfg)
+	if format := q.Get("format"); format != "" {
+		timeoutMS, _ := strconv.Atoi(q.Get("timeout_ms"))
+		meta, data, ok := transcodedMedia(w, r, cfg, state, q.Get("access_token"), mediaID, format, timeoutMS)
+		if !ok {
+			return
+		}
+		state.usage.record(identity, func(c *usageCounters) { c.MediaBytes += int64(len(data)) })
+		w.Header().Set("Content-Type", meta.ContentType)
+		w.Header().Set("Content-Disposition", mime.FormatMediaType("attachment", map[string]string{"filename": meta.Filename}))
+		http.ServeContent(w, r, "", time.Time{}, bytes.NewReader(data))
+		return
+	}
+	if meta, f, ok := state.media.Open(mediaID); ok {
+		defer f.Close()
+		state.metrics.Inc("wecom_bridge_media_cache_total", "result", "hit")
+		info, err := f.Stat()
+		if err != nil {
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		state.usage.record(identity, func(c *usageCounters) { c.MediaBytes += info.Size() })
+		w.Header().Set("Content-Type", meta.ContentType)
+		w.Header().Set("Content-Disposition", mime.FormatMediaType("attachment", map[string]string{"filename": meta.Filename}))
+		http.ServeContent(w, r, "", info.ModTime(), f)
+		return
+	}
+	accessToken := strings.TrimSpace(q.Get("access_token"))
+	if accessToken == "" {
+		accessToken = state.managedToken("")
+	}
+	if accessToken == "" {
+		w.WriteHeader(http.StatusBadRequest)
+		_, _ = w.Write([]byte("missing access_token"))
+		return
+	}
+
+	query := url.Values{}
+	query.Set("access_token", accessToken)
+	query.Set("media_id", mediaID)
+	endpoint := fmt.Sprintf("https://qyapi.weixin.qq.com/cgi-bin/media/get?%s", query.Encode())
+	timeoutMS, _ := strconv.Atoi(q.Get("timeout_ms"))
+	resp, err := proxy.Do(r.Context(), qyapiClient(proxyTimeout(r, cfg, "media_get", timeoutMS)), endpoint, nil)
+	if err != nil {
+		w.WriteHeader(http.StatusBadGateway)
+		_, _ = w.Write([]byte("media get failed"))
+		return
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		w.WriteHeader(http.StatusBadGateway)
+		_, _ = w.Write([]byte(fmt.Sprintf("media get http %d", resp.StatusCode)))
+		return
+	}
+	contentType := strings.TrimSpace(resp.Header.Get("Content-Type"))
+	if strings.Contains(strings.ToLower(contentType), "application/json") {
+		respData, _ := io.ReadAll(io.LimitReader(resp.Body, 64*1024))
+		writeWeComError(w, http.StatusBadGateway, respData, "media get")
+		return
+	}
+
+	disposition := resp.Header.Get("Content-Disposition")
+	filename := firstNonEmpty(parseFilenameFromDisposition(disposition), fmt.Sprintf("%s.dat", mediaID))
+	meta := mediacache.Media{MediaID: mediaID, Filename: filename, ContentType: firstNonEmpty(contentType, "application/octet-stream")}
+	w.Header().Set("Content-Type", meta.ContentType)
+	w.Header().Set("Content-Disposition", firstNonEmpty(disposition, mime.FormatMediaType("attachment", map[string]string{"filename": filename})))
+	if resp.ContentLength >= 0 {
+		w.Header().Set("Content-Length", strconv.FormatInt(resp.ContentLength, 10))
+	}
+
+	var out io.Writer = w
+	cache, err := state.media.Create(meta)
+	if err != nil {
+		slog.WarnContext(r.Context(), "media cache write failed", "err", err)
+	}
+	if cache != nil {
+		out = io.MultiWriter(w, cache)
+	}
+	n, err := io.Copy(out, resp.Body)
+	state.usage.record(identity, func(c *usageCounters) { c.MediaBytes += n })
+	if err != nil {
+		// Headers are gone; the client sees a truncated body.
+		slog.WarnContext(r.Context(), "media raw aborted", "media_id", mediaID, "bytes", n, "err", err)
+		if cache != nil {
+			cache.Abort()
+		}
+		return
+	}
+	if cache != nil {
+		state.metrics.Inc("wecom_bridge_media_cache_total", "result", "miss")
+		if err := cache.Commit(); err != nil {
+			slog.WarnContext(r.Context(), "media cache write failed", "err", err)
+		}
+		state.trimMediaCache()
+	}
+}
+
+// trimMediaCache enforces BRIDGE_MEDIA_CACHE_TTL and BRIDGE_MEDIA_CACHE_MAX_MB
+// after a download was cached.
+func (s *bridgeState) trimMediaCache() {
+	removed, _, err := s.media.Trim(time.Now())
+	if err != nil {
+		slog.Warn("media cache trim failed", "err", err)
+		return
+	}
+	if removed > 0 {
+		s.metrics.Add("wecom_bridge_media_cache_evictions_total", int64(removed))
+	}
+}
+
+func handleProxyMediaGet(w http.ResponseWriter, r *http.Request, cfg config.Config, state *bridgeState) {
+	if r.Method != http.MethodPost {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	if !checkBridgeAuth(w, r, cfg, config.ScopeProxyMedia) {
+		return
+	}
+
+	body, err := readBody(r)
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		_, _ = w.Write([]byte("missing body"))
+		return
+	}
+	var payload struct {
+		AccessToken string `json:"access_token"`
+		MediaID     string `json:"media_id"`
+		Format      string `json:"format"`
+		TimeoutMS   int    `json:"timeout_ms"`
+	}
+	if err := json.Unmarshal(body, &payload); err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		_, _ = w.Write([]byte("invalid json"))
+		return
+	}
+	if payload.AccessToken == "" {
+		payload.AccessToken = state.managedToken("")
+	}
+	if payload.AccessToken == "" || payload.MediaID == "" {
+		w.WriteHeader(http.StatusBadRequest)
+		_, _ = w.Write([]byte("missing access_token/media_id"))
+		return
+	}
+
+	if payload.Format != "" {
+		meta, data, ok := transcodedMedia(w, r, cfg, state, payload.AccessToken, payload.MediaID, payload.Format, payload.TimeoutMS)
+		if !ok {
+			return
+		}
+		state.usage.record(requesterIdentity(r, cfg), func(c *usageCounters) { c.MediaBytes += int64(len(data)) })
+		w.Header().Set("Content-Type", "application/json")
+		_ = json.NewEncoder(w).Encode(map[string]any{
+			"base64":       base64.StdEncoding.EncodeToString(data),
+			"filename":     meta.Filename,
+			"content_type": meta.ContentType,
+		})
+		return
+	}
+
+	if meta, data, ok := state.media.Get(payload.MediaID); ok {
+		state.metrics.Inc("wecom_bridge_media_cache_total", "result", "hit")
+		state.usage.record(requesterIdentity(r, cfg), func(c *usageCounters) { c.MediaBytes += int64(len(data)) })
+		w.Header().Set("Content-Type", "application/json")
+		_ = json.NewEncoder(w).Encode(map[string]any{
+			"base64":       base64.StdEncoding.EncodeToString(data),
+			"filename":     meta.Filename,
+			"content_type": meta.ContentType,
+		})
+		return
+	}
+
+	query := url.Values{}
+	query.Set("access_token", payload.AccessToken)
+	query.Set("media_id", payload.MediaID)
+	endpoint := fmt.Sprintf("https://qyapi.weixin.qq.com/cgi-bin/media/get?%s", query.Encode())
+
+	client := qyapiClient(proxyTimeout(r, cfg, "media_get", payload.TimeoutMS))
+	resp, err := proxy.Do(r.Context(), client, endpoint, nil)
+	if err != nil {
+		w.WriteHeader(http.StatusBadGateway)
+		_, _ = w.Write([]byte("media get failed"))
+		return
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		w.WriteHeader(http.StatusBadGateway)
+		_, _ = w.Write([]byte(fmt.Sprintf("media get http %d", resp.StatusCode)))
+		return
+	}
+
+	contentType := strings.TrimSpace(resp.Header.Get("Content-Type"))
+	respData, err := io.ReadAll(resp.Body)
+	if err != nil {
+		w.WriteHeader(http.StatusBadGateway)
+		_, _ = w.Write([]byte("media get read failed"))
+		return
+	}
+
+	if strings.Contains(strings.ToLower(contentType), "application/json") {
+		writeWeComError(w, http.StatusBadGateway, respData, "media get")
+		return
+	}
+
+	state.usage.record(requesterIdentity(r, cfg), func(c *usageCounters) { c.MediaBytes += int64(len(respData)) })
+
+	filename := parseFilenameFromDisposition(resp.Header.Get("Content-Disposition"))
+	if filename == "" {
+		filename = fmt.Sprintf("%s.dat", payload.MediaID)
+	}
+	meta := mediacache.Media{MediaID: payload.MediaID, Filename: filename, ContentType: firstNonEmpty(contentType, "application/octet-stream")}
+	if state.media != nil {
+		state.metrics.Inc("wecom_bridge_media_cache_total", "result", "miss")
+		if err := state.media.Put(meta, respData); err != nil {
+			slog.WarnContext(r.Context(), "media cache write failed", "err", err)
+		}
+		state.trimMediaCache()
+	}
+	result := map[string]any{
+		"base64":       base64.StdEncoding.EncodeToString(respData),
+		"filename":     meta.Filename,
+		"content_type": meta.ContentType,
+	}
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(result)
+}
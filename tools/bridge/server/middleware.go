@@ -0,0 +1,207 @@
+package server
+
+import (
+	"context"
+	"log/slog"
+	"net/http"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/Tennen/Paimon/tools/bridge/config"
+)
+
+// loggingMiddleware gives every request an ID, taken from X-Request-Id when
+// the caller sends a sane one, echoes it in the response and attaches it to
+// the request context so log records written on its behalf carry it.
+func loggingMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/health" || r.URL.Path == "/ready" {
+			next.ServeHTTP(w, r)
+			return
+		}
+		id := r.Header.Get("X-Request-Id")
+		if !requestIDPattern.MatchString(id) {
+			id = randomNonce()
+		}
+		w.Header().Set("X-Request-Id", id)
+		r = r.WithContext(context.WithValue(r.Context(), requestIDKey{}, id))
+		start := time.Now()
+		next.ServeHTTP(w, r)
+		slog.InfoContext(r.Context(), "request", "method", r.Method, "path", r.URL.Path, "duration_ms", time.Since(start).Milliseconds())
+	})
+}
+
+type requestIDKey struct{}
+
+var requestIDPattern = regexp.MustCompile(`^[A-Za-z0-9._:-]{1,64}$`)
+
+// requestID returns the ID loggingMiddleware attached to ctx, if any.
+func requestID(ctx context.Context) string {
+	id, _ := ctx.Value(requestIDKey{}).(string)
+	return id
+}
+
+// logLevel is the minimum level logged; /admin/config can change it.
+var logLevel slog.LevelVar
+
+// setupLogging routes log records, including the standard logger's (used
+// for fatal startup errors), through slog at cfg's level and format.
+func setupLogging(cfg config.Config) {
+	logLevel.Set(cfg.LogLevel)
+	opts := &slog.HandlerOptions{Level: &logLevel, ReplaceAttr: redactLogAttr}
+	var handler slog.Handler = slog.NewTextHandler(os.Stderr, opts)
+	if cfg.LogFormat == "json" {
+		handler = slog.NewJSONHandler(os.Stderr, opts)
+	}
+	slog.SetDefault(slog.New(contextLogHandler{handler}))
+	slog.SetLogLoggerLevel(slog.LevelError)
+	setLogSecrets(cfg)
+}
+
+// contextLogHandler adds the request ID carried by a record's context.
+type contextLogHandler struct {
+	slog.Handler
+}
+
+func (h contextLogHandler) Handle(ctx context.Context, rec slog.Record) error {
+	if id := requestID(ctx); id != "" {
+		rec.AddAttrs(slog.String("request_id", id))
+	}
+	return h.Handler.Handle(ctx, rec)
+}
+
+func (h contextLogHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	return contextLogHandler{h.Handler.WithAttrs(attrs)}
+}
+
+func (h contextLogHandler) WithGroup(name string) slog.Handler {
+	return contextLogHandler{h.Handler.WithGroup(name)}
+}
+
+// logSecrets holds the configured credentials that must never reach a log
+// record; setLogSecrets refreshes it when the config changes.
+var logSecrets struct {
+	sync.RWMutex
+	values []string
+}
+
+// secretPattern matches credentials in URLs, JSON and headers, whether or
+// not they are configured: access tokens, corp secrets, AES keys, robot
+// keys and bearer tokens.
+var secretPattern = regexp.MustCompile(`(?i)((?:access_token|corpsecret|corp_secret|secret|encodingaeskey|aes_?key)["']?\s*[=:]\s*["']?|[?&]key=|bearer\s+)[^&\s"',;}]+`)
+
+func setLogSecrets(cfg config.Config) {
+	var values []string
+	add := func(v string) {
+		// Very short values would blank out ordinary words.
+		if len(v) >= 6 {
+			values = append(values, v)
+		}
+	}
+	for _, v := range []string{cfg.WeComToken, cfg.WeComAESKey, cfg.WeComCorpSecret, cfg.BridgeToken, cfg.AdminToken, cfg.PublishToken, cfg.ReplicationToken, cfg.QuotaOverrideToken, cfg.SigningSecret} {
+		add(v)
+	}
+	for _, v := range cfg.AgentSecrets {
+		add(v)
+	}
+	for _, agent := range cfg.Agents {
+		add(agent.Token)
+		add(agent.AESKey)
+		add(agent.CorpSecret)
+	}
+	for _, up := range cfg.Upstreams {
+		add(up.Token)
+	}
+	for _, t := range cfg.Tokens {
+		add(t.Token)
+	}
+	for _, ch := range cfg.Channels {
+		add(ch.AppSecret)
+		add(ch.VerificationToken)
+		add(ch.EncryptKey)
+	}
+	logSecrets.Lock()
+	logSecrets.values = values
+	logSecrets.Unlock()
+}
+
+// redactSecrets replaces configured secrets and anything secretPattern
+// matches with REDACTED.
+func redactSecrets(s string) string {
+	logSecrets.RLock()
+	for _, v := range logSecrets.values {
+		s = strings.ReplaceAll(s, v, "REDACTED")
+	}
+	logSecrets.RUnlock()
+	return secretPattern.ReplaceAllString(s, "${1}REDACTED")
+}
+
+// redactLogAttr is the ReplaceAttr hook that redacts the message and every
+// string or error attribute.
+func redactLogAttr(_ []string, a slog.Attr) slog.Attr {
+	switch a.Value.Kind() {
+	case slog.KindString:
+		a.Value = slog.StringValue(redactSecrets(a.Value.String()))
+	case slog.KindAny:
+		if err, ok := a.Value.Any().(error); ok {
+			a.Value = slog.StringValue(redactSecrets(err.Error()))
+		}
+	}
+	return a
+}
+
+// corsMiddleware lets browser pages on the configured origins call the
+// bridge: it answers preflights itself, before auth, and marks responses
+// for allowed origins readable. Other origins get no CORS headers, so the
+// browser blocks them.
+func corsMiddleware(cfg config.Config, next http.Handler) http.Handler {
+	if len(cfg.CORSOrigins) == 0 {
+		return next
+	}
+	allowHeaders := strings.Join(cfg.CORSHeaders, ", ")
+	maxAge := strconv.Itoa(int(cfg.CORSMaxAge.Seconds()))
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		origin := r.Header.Get("Origin")
+		w.Header().Add("Vary", "Origin")
+		preflight := r.Method == http.MethodOptions && r.Header.Get("Access-Control-Request-Method") != ""
+		if origin == "" || !corsOriginAllowed(cfg.CORSOrigins, origin) {
+			if preflight && origin != "" {
+				w.WriteHeader(http.StatusForbidden)
+				_, _ = w.Write([]byte("origin not allowed"))
+				return
+			}
+			next.ServeHTTP(w, r)
+			return
+		}
+		w.Header().Set("Access-Control-Allow-Origin", origin)
+		if !preflight {
+			w.Header().Set("Access-Control-Expose-Headers", "X-Request-Id, Retry-After, Content-Disposition")
+			next.ServeHTTP(w, r)
+			return
+		}
+		w.Header().Set("Access-Control-Allow-Methods", "GET, POST, PATCH, DELETE")
+		w.Header().Set("Access-Control-Allow-Headers", allowHeaders)
+		w.Header().Set("Access-Control-Max-Age", maxAge)
+		w.WriteHeader(http.StatusNoContent)
+	})
+}
+
+// corsOriginAllowed matches origin against "*", exact origins and patterns
+// with one "*" such as "https://*.example.com".
+func corsOriginAllowed(patterns []string, origin string) bool {
+	for _, pattern := range patterns {
+		if pattern == "*" || strings.EqualFold(pattern, origin) {
+			return true
+		}
+		prefix, suffix, ok := strings.Cut(pattern, "*")
+		if ok && len(origin) > len(prefix)+len(suffix) && strings.HasPrefix(origin, prefix) && strings.HasSuffix(origin, suffix) &&
+			!strings.ContainsAny(origin[len(prefix):len(origin)-len(suffix)], "/:") {
+			return true
+		}
+	}
+	return false
+}
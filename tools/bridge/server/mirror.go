@@ -0,0 +1,181 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"log/slog"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/Tennen/Paimon/tools/bridge/archive"
+	"github.com/Tennen/Paimon/tools/bridge/config"
+	"github.com/Tennen/Paimon/tools/bridge/sendqueue"
+	"github.com/Tennen/Paimon/tools/bridge/sse"
+)
+
+// mirror replicates a primary bridge's event buffer and archive until ctx is
+// cancelled.
+type mirror struct {
+	cfg   config.Config
+	state *bridgeState
+	ctx   context.Context
+}
+
+func (m *mirror) followStream() {
+	for m.ctx.Err() == nil {
+		err := m.consumeStream()
+		if m.ctx.Err() != nil {
+			return
+		}
+		slog.Warn("mirror stream disconnected", "err", err)
+		time.Sleep(2 * time.Second)
+	}
+}
+
+func (m *mirror) consumeStream() error {
+	req, err := http.NewRequestWithContext(m.ctx, http.MethodGet, m.cfg.PrimaryURL+"/replication/stream", nil)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Authorization", "Bearer "+m.cfg.ReplicationToken)
+	m.state.mu.Lock()
+	last := m.state.nextEventID - 1
+	m.state.mu.Unlock()
+	if last > 0 {
+		req.Header.Set("Last-Event-ID", strconv.FormatInt(last, 10))
+	}
+	resp, err := outboundClient(0).Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("http %d", resp.StatusCode)
+	}
+	slog.Info("mirror stream connected", "since_event_id", last)
+	return sse.Read(resp.Body, func(id int64, eventType string, data []byte) {
+		if id <= 0 {
+			return
+		}
+		var meta struct {
+			Topics   []string `json:"topics"`
+			Agent    string   `json:"agent"`
+			FromUser string   `json:"fromUser"`
+			MsgType  string   `json:"msgType"`
+		}
+		_ = json.Unmarshal(data, &meta)
+		m.state.IngestReplicated(sseEvent{ID: id, Type: eventType, Payload: append([]byte(nil), data...), Topics: meta.Topics, Agent: meta.Agent, FromUser: meta.FromUser, MsgType: meta.MsgType})
+		m.state.metrics.Inc("wecom_bridge_mirror_events_total")
+	})
+}
+
+// followArchive polls the primary for archive records newer than the local
+// tail.
+func (m *mirror) followArchive() {
+	for m.ctx.Err() == nil {
+		if err := m.pullArchive(); err != nil && m.ctx.Err() == nil {
+			slog.Warn("mirror archive pull failed", "err", err)
+		}
+		time.Sleep(5 * time.Second)
+	}
+}
+
+func (m *mirror) pullArchive() error {
+	for {
+		after := m.state.archive.LastID()
+		req, err := http.NewRequestWithContext(m.ctx, http.MethodGet, fmt.Sprintf("%s/replication/archive?after=%d&limit=500", m.cfg.PrimaryURL, after), nil)
+		if err != nil {
+			return err
+		}
+		req.Header.Set("Authorization", "Bearer "+m.cfg.ReplicationToken)
+		resp, err := outboundClient(0).Do(req)
+		if err != nil {
+			return err
+		}
+		var result struct {
+			Records []archive.Record `json:"records"`
+		}
+		err = json.NewDecoder(resp.Body).Decode(&result)
+		resp.Body.Close()
+		if err != nil {
+			return err
+		}
+		for _, rec := range result.Records {
+			m.state.archive.Insert(rec)
+		}
+		if len(result.Records) < 500 {
+			return nil
+		}
+	}
+}
+
+// readOnlyMiddleware rejects every write path while running as a mirror or
+// as a standby that has not been promoted.
+func readOnlyMiddleware(cfg config.Config, state *bridgeState, next http.Handler) http.Handler {
+	if cfg.Mode == "primary" {
+		return next
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !state.readOnly(cfg) {
+			next.ServeHTTP(w, r)
+			return
+		}
+		path := r.URL.Path
+		writes := path == "/wecom" || path == "/publish" || strings.HasPrefix(path, "/proxy/") ||
+			strings.HasPrefix(path, "/wecom/") || strings.HasPrefix(path, "/reply/") || strings.HasPrefix(path, "/channels/") ||
+			(path == "/admin/config" && r.Method != http.MethodGet)
+		if writes {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			_, _ = w.Write([]byte("read-only " + cfg.Mode))
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// readOnly reports whether writes are refused: always on a mirror, and on a
+// standby until it is promoted.
+func (s *bridgeState) readOnly(cfg config.Config) bool {
+	return cfg.Mode == "mirror" || (cfg.Mode == "standby" && !s.promoted.Load())
+}
+
+// startPrimary starts the duties only the writing bridge performs: webhook
+// delivery, the inbound outbox with crash recovery, queued sends, token
+// prefetching, and federation for a promoted standby.
+func startPrimary(cfg config.Config, state *bridgeState) {
+	deadLetters, err := openDeadLetterLog(cfg.WebhookDeadLetterFile)
+	if err != nil {
+		log.Fatalf("webhook dead letter error: %v", err)
+	}
+	for _, target := range cfg.WebhookURLs {
+		sink := newWebhookSink(cfg, target, state.metrics)
+		sink.deadLetters = deadLetters
+		state.sinks = append(state.sinks, sink)
+		go sink.run()
+	}
+	if err := state.outbox.Open(cfg.OutboxFile); err != nil {
+		log.Fatalf("outbox error: %v", err)
+	}
+	recoverOutbox(state)
+	if err := state.sends.Open(cfg.SendQueueFile); err != nil {
+		log.Fatalf("send queue error: %v", err)
+	}
+	go state.sends.Run(state.closing, func(job sendqueue.Job) sendqueue.Outcome { return attemptQueuedSend(state, job) }, state.metrics)
+	for _, m := range state.tokenManagers() {
+		if m.corpID != "" && m.secret != "" {
+			go m.keepFresh()
+		}
+	}
+	if cfg.Mode == "standby" && state.fed != nil {
+		state.fed.Start(cfg.Upstreams)
+	}
+	state.kf = newKFSyncer(cfg, state)
+	go state.kf.run()
+	if cfg.CallbackAllowlistAuto {
+		go state.refreshCallbackIPs(cfg)
+	}
+}
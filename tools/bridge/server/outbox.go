@@ -0,0 +1,19 @@
+package server
+
+import (
+	"log/slog"
+)
+
+// recoverOutbox re-broadcasts inbound events that were persisted but never
+// flushed, e.g. because the previous process crashed mid-request.
+func recoverOutbox(state *bridgeState) {
+	entries := state.outbox.Unflushed()
+	for _, entry := range entries {
+		_ = deliverInbound(state, entry.Payload)
+		state.outbox.Flush(entry.Seq)
+		state.metrics.Inc("wecom_bridge_outbox_recovered_total")
+	}
+	if len(entries) > 0 {
+		slog.Info("wecom outbox recovered unflushed messages", "messages", len(entries))
+	}
+}
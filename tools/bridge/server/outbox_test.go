@@ -0,0 +1,61 @@
+package server
+
+import (
+	"net/http"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/Tennen/Paimon/tools/bridge/archive"
+	"github.com/Tennen/Paimon/tools/bridge/outbox"
+)
+
+func TestOutboxReplayAfterRestart(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "outbox.jsonl")
+	cfg := callbackConfig()
+	state := callbackState(cfg)
+	defer state.clients.Close()
+	if err := state.outbox.Open(path); err != nil {
+		t.Fatal(err)
+	}
+	state.callbacks = newCallbackPool(cfg, state)
+	if w := postCallback(t, cfg, state, textCallback("m1", "delivered"), ""); w.Code != http.StatusOK {
+		t.Fatal(w.Code, w.Body.String())
+	}
+	// The process dies after persisting the next callback and answering
+	// WeCom, before it is broadcast.
+	if _, err := state.outbox.Add(map[string]any{"messageId": "m2", "fromUser": "alice", "msgType": "text", "text": "lost"}); err != nil {
+		t.Fatal(err)
+	}
+	_ = state.outbox.Close()
+
+	restarted := callbackState(cfg)
+	defer restarted.clients.Close()
+	if err := restarted.outbox.Open(path); err != nil {
+		t.Fatal(err)
+	}
+	recoverOutbox(restarted)
+	if got := strings.Join(streamTexts(restarted), ","); got != "lost" {
+		t.Fatalf("replayed %q", got)
+	}
+	if records := restarted.archive.Search(archive.Filter{}); len(records) != 1 || records[0].MsgID != "m2" {
+		t.Fatalf("archived %+v", records)
+	}
+	var metrics strings.Builder
+	restarted.metrics.WriteText(&metrics)
+	if !strings.Contains(metrics.String(), "wecom_bridge_outbox_recovered_total 1") {
+		t.Fatal(metrics.String())
+	}
+	_ = restarted.outbox.Close()
+
+	// Once replayed the entry is flushed and a further restart has nothing
+	// to recover.
+	again := outbox.New()
+	if err := again.Open(path); err != nil {
+		t.Fatal(err)
+	}
+	defer again.Close()
+	if pending := again.Unflushed(); len(pending) != 0 {
+		t.Fatalf("pending %+v", pending)
+	}
+}
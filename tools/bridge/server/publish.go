@@ -0,0 +1,171 @@
+package server
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/Tennen/Paimon/tools/bridge/config"
+)
+
+var publishTypePattern = regexp.MustCompile(`^[A-Za-z0-9][A-Za-z0-9._:-]{0,63}$`)
+
+// handlePublish lets internal producers inject application events onto the
+// stream: {"type":"ticket.closed","topics":["support"],"data":{...}}. The
+// event is delivered with its type as the SSE event name.
+func handlePublish(w http.ResponseWriter, r *http.Request, cfg config.Config, state *bridgeState) {
+	if r.Method != http.MethodPost {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	if !hasBearer(r, cfg.PublishToken) {
+		w.WriteHeader(http.StatusUnauthorized)
+		_, _ = w.Write([]byte("unauthorized"))
+		return
+	}
+
+	body, err := readBody(r)
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		_, _ = w.Write([]byte("missing body"))
+		return
+	}
+	var payload struct {
+		Type      string          `json:"type"`
+		Topics    []string        `json:"topics"`
+		SessionID string          `json:"sessionId"`
+		Data      json.RawMessage `json:"data"`
+	}
+	if err := json.Unmarshal(body, &payload); err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		_, _ = w.Write([]byte("invalid json"))
+		return
+	}
+	if !publishTypePattern.MatchString(payload.Type) || payload.Type == "message" || payload.Type == "transcript" || payload.Type == "send_status" || payload.Type == "kf_servicer" {
+		w.WriteHeader(http.StatusBadRequest)
+		_, _ = w.Write([]byte("invalid type"))
+		return
+	}
+
+	event := map[string]any{
+		"type":        payload.Type,
+		"source":      "publish",
+		"publisher":   requesterIdentity(r, cfg),
+		"publishedAt": time.Now().UTC().Format(time.RFC3339),
+	}
+	if len(payload.Topics) > 0 {
+		event["topics"] = payload.Topics
+	}
+	if payload.SessionID != "" {
+		event["sessionId"] = payload.SessionID
+	}
+	if len(payload.Data) > 0 {
+		event["data"] = payload.Data
+	}
+	id, _ := state.broadcastEvent(payload.Type, event)
+	state.sessions.closeOn(payload.Type, payload.SessionID)
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(map[string]any{"ok": true, "eventId": id})
+}
+
+// parseStreamFilter reads ?topics=a,b, ?agent=, ?fromUser= and ?msgType=
+// from a stream request; each takes a comma-separated list.
+func parseStreamFilter(r *http.Request) streamFilter {
+	q := r.URL.Query()
+	return streamFilter{
+		Topics:    splitList(q.Get("topics")),
+		Agents:    splitList(q.Get("agent")),
+		FromUsers: splitList(q.Get("fromUser")),
+		MsgTypes:  splitList(q.Get("msgType")),
+	}
+}
+
+// splitList splits a comma-separated value, dropping empty entries.
+func splitList(value string) []string {
+	var items []string
+	for _, item := range strings.Split(value, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			items = append(items, item)
+		}
+	}
+	return items
+}
+
+// lookupSchema resolves a ?schema= value. An empty name selects the
+// "default" schema if one is configured, else no adaptation.
+func lookupSchema(schemas []config.Schema, name string) (*config.Schema, bool) {
+	name = strings.TrimSpace(name)
+	for i := range schemas {
+		if schemas[i].Name == firstNonEmpty(name, "default") {
+			return &schemas[i], true
+		}
+	}
+	return nil, name == ""
+}
+
+// webhookSchema returns the schema that lists target, else the default one.
+func webhookSchema(schemas []config.Schema, target string) *config.Schema {
+	for i := range schemas {
+		for _, url := range schemas[i].Webhooks {
+			if url == target {
+				return &schemas[i]
+			}
+		}
+	}
+	schema, _ := lookupSchema(schemas, "")
+	return schema
+}
+
+// adaptPayload returns ev with its payload rewritten by the schema. A nil
+// schema, or a payload that is not a JSON object, leaves it unchanged.
+func adaptPayload(s *config.Schema, ev sseEvent) sseEvent {
+	if s == nil {
+		return ev
+	}
+	var fields map[string]any
+	dec := json.NewDecoder(bytes.NewReader(ev.Payload))
+	dec.UseNumber()
+	if err := dec.Decode(&fields); err != nil || fields == nil {
+		return ev
+	}
+	for _, name := range s.Drop {
+		delete(fields, name)
+	}
+	renamed := make(map[string]any, len(s.Rename))
+	for from, to := range s.Rename {
+		if v, ok := fields[from]; ok {
+			renamed[to] = v
+			delete(fields, from)
+		}
+	}
+	for name, v := range renamed {
+		fields[name] = v
+	}
+	for name, v := range s.Add {
+		fields[name] = v
+	}
+	data, err := json.Marshal(fields)
+	if err != nil {
+		return ev
+	}
+	ev.Payload = data
+	return ev
+}
+
+func parseLastEventID(r *http.Request) int64 {
+	if v := strings.TrimSpace(r.Header.Get("Last-Event-ID")); v != "" {
+		if id, err := strconv.ParseInt(v, 10, 64); err == nil {
+			return id
+		}
+	}
+	if v := strings.TrimSpace(r.URL.Query().Get("lastEventId")); v != "" {
+		if id, err := strconv.ParseInt(v, 10, 64); err == nil {
+			return id
+		}
+	}
+	return 0
+}
@@ -0,0 +1,108 @@
+package server
+
+import (
+	"sync"
+	"time"
+)
+
+// sendQuota tracks recent sends per touser so the bridge can enforce
+// hourly/daily messaging limits centrally.
+type sendQuota struct {
+	mu        sync.Mutex
+	hourly    int
+	daily     int
+	history   map[string][]time.Time
+	lastSweep time.Time
+}
+
+func newSendQuota(hourly, daily int) *sendQuota {
+	return &sendQuota{
+		hourly:  hourly,
+		daily:   daily,
+		history: make(map[string][]time.Time),
+	}
+}
+
+// enabled reports whether an hourly or daily quota is set.
+func (q *sendQuota) enabled() bool {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	return q.hourly > 0 || q.daily > 0
+}
+
+// reserve records a send to every user at the given time, unless that would
+// exceed a quota for any of them. It returns the users over quota, in which
+// case nothing is recorded. users must not repeat.
+func (q *sendQuota) reserve(users []string, at time.Time) []string {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if q.hourly <= 0 && q.daily <= 0 {
+		return nil
+	}
+	if at.Sub(q.lastSweep) > 10*time.Minute {
+		q.sweep(at)
+	}
+
+	exceeded := make([]string, 0)
+	for _, u := range users {
+		q.history[u] = pruneBefore(q.history[u], at.Add(-24*time.Hour))
+		hourCount := 0
+		for _, t := range q.history[u] {
+			if at.Sub(t) < time.Hour {
+				hourCount++
+			}
+		}
+		if (q.hourly > 0 && hourCount >= q.hourly) || (q.daily > 0 && len(q.history[u]) >= q.daily) {
+			exceeded = append(exceeded, u)
+		}
+	}
+	if len(exceeded) > 0 {
+		return exceeded
+	}
+	for _, u := range users {
+		q.history[u] = append(q.history[u], at)
+	}
+	return nil
+}
+
+// release undoes a reservation made at the given time.
+func (q *sendQuota) release(users []string, at time.Time) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	for _, u := range users {
+		times := q.history[u]
+		for i := len(times) - 1; i >= 0; i-- {
+			if times[i].Equal(at) {
+				q.history[u] = append(times[:i], times[i+1:]...)
+				break
+			}
+		}
+	}
+}
+
+func (q *sendQuota) sweep(now time.Time) {
+	q.lastSweep = now
+	for u, times := range q.history {
+		times = pruneBefore(times, now.Add(-24*time.Hour))
+		if len(times) == 0 {
+			delete(q.history, u)
+			continue
+		}
+		q.history[u] = times
+	}
+}
+
+func pruneBefore(times []time.Time, cutoff time.Time) []time.Time {
+	idx := 0
+	for idx < len(times) && !times[idx].After(cutoff) {
+		idx++
+	}
+	return times[idx:]
+}
+
+func (q *sendQuota) setLimits(hourly, daily int) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	q.hourly = hourly
+	q.daily = daily
+}
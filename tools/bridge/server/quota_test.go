@@ -0,0 +1,91 @@
+package server
+
+import (
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/Tennen/Paimon/tools/bridge/config"
+)
+
+func TestParseToUsers(t *testing.T) {
+	for _, tc := range []struct {
+		message   string
+		users     []string
+		broadcast bool
+	}{
+		{`{"touser":"a|b"}`, []string{"a", "b"}, false},
+		{`{"touser":"a|a| a |b|a"}`, []string{"a", "b"}, false},
+		{`{"touser":"a|@all"}`, []string{"a"}, true},
+		{`{"touser":"a","toparty":"2"}`, []string{"a"}, true},
+		{`{"totag":"1|2"}`, []string{}, true},
+		{`{"touser":"","toparty":" "}`, []string{}, false},
+		{`not json`, nil, false},
+	} {
+		users, broadcast := parseToUsers([]byte(tc.message))
+		if !reflect.DeepEqual(users, tc.users) || broadcast != tc.broadcast {
+			t.Errorf("%s: %q %v", tc.message, users, broadcast)
+		}
+	}
+}
+
+func TestSendQuotaRecipients(t *testing.T) {
+	state := channelTestState()
+	defer state.clients.Close()
+	state.quotas = newSendQuota(1, 0)
+	state.cfg = config.Config{ProxyTimeouts: map[string]time.Duration{"send": time.Second}}
+	sends := 0
+	previous := outboundTransport
+	defer func() { outboundTransport = previous }()
+	outboundTransport = roundTripFunc(func(*http.Request) (*http.Response, error) {
+		sends++
+		return &http.Response{StatusCode: http.StatusOK, Header: make(http.Header), Body: io.NopCloser(strings.NewReader(`{"errcode":0,"errmsg":"ok","msgid":"m1"}`))}, nil
+	})
+	send := func(message string, skipQuota bool) (*httptest.ResponseRecorder, error) {
+		w := httptest.NewRecorder()
+		r := httptest.NewRequest(http.MethodPost, "/proxy/send", nil)
+		_, err := sendAppMessageAs(w, r, state.cfg, state, "test", "token", []byte(message), 0, skipQuota)
+		return w, err
+	}
+
+	// A repeated user is one recipient, so the hourly quota of 1 allows it.
+	if w, err := send(`{"touser":"a|a|a","msgtype":"text","text":{"content":"hi"}}`, false); err != nil {
+		t.Fatal(w.Code, w.Body.String())
+	}
+	w, err := send(`{"touser":"a","msgtype":"text","text":{"content":"hi"}}`, false)
+	if w.Code != http.StatusTooManyRequests || !errors.Is(err, errNotSent) || !strings.Contains(w.Body.String(), `"users":["a"]`) {
+		t.Fatal(w.Code, w.Body.String(), err)
+	}
+
+	// Departments, tags and @all cannot be counted per user.
+	for _, message := range []string{
+		`{"touser":"b","toparty":"2","msgtype":"text","text":{"content":"hi"}}`,
+		`{"totag":"1","msgtype":"text","text":{"content":"hi"}}`,
+		`{"touser":"@all","msgtype":"text","text":{"content":"hi"}}`,
+	} {
+		if w, err := send(message, false); w.Code != http.StatusForbidden || !errors.Is(err, errNotSent) {
+			t.Fatal(message, w.Code, w.Body.String(), err)
+		}
+		if w, err := send(message, true); err != nil {
+			t.Fatal(message, w.Code, w.Body.String())
+		}
+	}
+	if sends != 4 {
+		t.Fatalf("%d sends reached wecom", sends)
+	}
+	// b was never charged by the refused broadcast.
+	if w, err := send(`{"touser":"b","msgtype":"text","text":{"content":"hi"}}`, false); err != nil {
+		t.Fatal(w.Code, w.Body.String())
+	}
+
+	// Without quotas broadcasts pass.
+	state.quotas.setLimits(0, 0)
+	if w, err := send(`{"touser":"@all","msgtype":"text","text":{"content":"hi"}}`, false); err != nil {
+		t.Fatal(w.Code, w.Body.String())
+	}
+}
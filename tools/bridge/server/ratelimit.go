@@ -0,0 +1,107 @@
+package server
+
+import (
+	"log/slog"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/Tennen/Paimon/tools/bridge/config"
+)
+
+// grpcRateClasses maps a gRPC method's scope to its endpoint class.
+var grpcRateClasses = map[string]string{
+	config.ScopeProxySend:  "send",
+	config.ScopeProxyMedia: "media",
+	config.ScopeStreamRead: "stream",
+}
+
+// rateClass returns the endpoint class of path, or "" for endpoints that are
+// never rate limited.
+func rateClass(path string) string {
+	switch {
+	case path == "/stream" || path == "/poll":
+		return "stream"
+	case strings.HasPrefix(path, "/proxy/media/"):
+		return "media"
+	case strings.HasPrefix(path, "/reply/"):
+		return "send"
+	}
+	switch path {
+	case "/proxy/send", "/proxy/send/typed", "/proxy/robot/send", "/proxy/kf/send", "/proxy/appchat/send", "/proxy/message/recall":
+		return "send"
+	}
+	return ""
+}
+
+// rateLimiter keeps one token bucket per identity and endpoint class. The
+// zero value is ready to use.
+type rateLimiter struct {
+	mu      sync.Mutex
+	buckets map[string]*rateBucket
+}
+
+type rateBucket struct {
+	tokens float64
+	last   time.Time
+}
+
+// allow takes a token from key's bucket. When the bucket is empty it takes
+// nothing and returns how long until the next token.
+func (l *rateLimiter) allow(key string, limit config.RateLimit, now time.Time) (time.Duration, bool) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.buckets == nil {
+		l.buckets = make(map[string]*rateBucket)
+	}
+	b, ok := l.buckets[key]
+	if !ok {
+		b = &rateBucket{tokens: float64(limit.Burst), last: now}
+		l.buckets[key] = b
+	}
+	b.tokens = min(float64(limit.Burst), b.tokens+now.Sub(b.last).Seconds()*limit.Rate)
+	b.last = now
+	if b.tokens < 1 {
+		return time.Duration((1 - b.tokens) / limit.Rate * float64(time.Second)), false
+	}
+	b.tokens--
+	return 0, true
+}
+
+// allowRate applies the class's limit to identity and counts the outcome.
+// The quota override token is exempt, like it is from send quotas.
+func (s *bridgeState) allowRate(class, identity string) (time.Duration, bool) {
+	limit, ok := s.config().RateLimits[class]
+	if !ok || identity == "quota-override" {
+		return 0, true
+	}
+	wait, allowed := s.rateLimits.allow(class+"\x00"+identity, limit, time.Now())
+	result := "allowed"
+	if !allowed {
+		result = "limited"
+		slog.Debug("rate limit exceeded", "class", class, "identity", identity)
+	}
+	s.metrics.Inc("wecom_bridge_rate_limit_total", "class", class, "identity", identity, "result", result)
+	return wait, allowed
+}
+
+// rateLimitMiddleware answers 429 with Retry-After when the caller's token
+// has used up its BRIDGE_RATE_LIMITS budget for the endpoint's class.
+func rateLimitMiddleware(cfg config.Config, state *bridgeState, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		class := rateClass(r.URL.Path)
+		if class == "" {
+			next.ServeHTTP(w, r)
+			return
+		}
+		if wait, ok := state.allowRate(class, streamIdentity(r, cfg, state)); !ok {
+			w.Header().Set("Retry-After", strconv.Itoa(int(wait.Seconds())+1))
+			w.WriteHeader(http.StatusTooManyRequests)
+			_, _ = w.Write([]byte("rate limit exceeded"))
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
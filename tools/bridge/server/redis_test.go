@@ -0,0 +1,50 @@
+package server
+
+import (
+	"slices"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/Tennen/Paimon/tools/bridge/metrics"
+	"github.com/Tennen/Paimon/tools/bridge/redis"
+	"github.com/Tennen/Paimon/tools/bridge/redis/redistest"
+)
+
+func TestRedisDedupSharedByReplicas(t *testing.T) {
+	f := redistest.NewServer(t)
+	metrics := metrics.New()
+	replica := func() *callbackDeduper {
+		client, err := redis.New(f.URL("", ""))
+		if err != nil {
+			t.Fatal(err)
+		}
+		return &callbackDeduper{ttl: time.Minute, redis: client, seen: make(map[string]time.Time)}
+	}
+	a, b := replica(), replica()
+	const key = "wecom-bridge:dedup:corp:msg:alice:m1"
+	// A retry reaching the other replica is a duplicate.
+	if !a.claim(key, metrics) || b.claim(key, metrics) || a.claim(key, metrics) {
+		t.Fatal("claimed twice")
+	}
+	// Released after a failed delivery, the next retry goes through once,
+	// wherever it lands.
+	a.release(key)
+	if !b.claim(key, metrics) || a.claim(key, metrics) {
+		t.Fatal("release not shared")
+	}
+	if got := f.Seen("SET"); len(got) != 5 || !slices.Equal(got[0], []string{"SET", key, "1", "NX", "PX", "60000"}) {
+		t.Fatalf("%q", got)
+	}
+
+	// Without Redis each replica falls back to its own window.
+	f.Close()
+	if !a.claim(key, metrics) || a.claim(key, metrics) || !b.claim(key, metrics) {
+		t.Fatal("local fallback")
+	}
+	var out strings.Builder
+	metrics.WriteText(&out)
+	if !strings.Contains(out.String(), `wecom_bridge_redis_errors_total{op="dedup"} 3`) {
+		t.Fatal(out.String())
+	}
+}
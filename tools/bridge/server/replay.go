@@ -0,0 +1,86 @@
+package server
+
+import (
+	"log/slog"
+	"sort"
+
+	"github.com/Tennen/Paimon/tools/bridge/eventstore"
+)
+
+// getMissed returns the events after lastEventID that match filter. Only the
+// slice header of the buffer's newer part is taken under s.mu: buffered
+// events are never modified in place, only appended and trimmed from the
+// front, so the filtering can run unlocked.
+func (s *bridgeState) getMissed(lastEventID int64, filter streamFilter) []sseEvent {
+	s.mu.Lock()
+	var first int64
+	if len(s.buffer) > 0 {
+		first = s.buffer[0].ID
+	}
+	newer := s.buffer[sort.Search(len(s.buffer), func(i int) bool { return s.buffer[i].ID > lastEventID }):]
+	s.mu.Unlock()
+	missed := make([]sseEvent, 0)
+	for _, ev := range newer {
+		if filter.Matches(ev) {
+			missed = append(missed, ev)
+		}
+	}
+
+	// Events older than the in-memory buffer come from the persistent store.
+	if s.store == nil || (first != 0 && lastEventID >= first-1) {
+		return missed
+	}
+	stored, err := s.store.After(lastEventID, filter)
+	if err != nil {
+		slog.Error("event store replay failed", "err", err)
+		s.metrics.Inc("wecom_bridge_event_store_errors_total", "op", "replay")
+		return missed
+	}
+	older := make([]sseEvent, 0, len(stored)+len(missed))
+	for _, ev := range stored {
+		if first == 0 || ev.ID < first {
+			older = append(older, ev)
+		}
+	}
+	return append(older, missed...)
+}
+
+// eventsBefore calls fn for the events with ID < id, newest first, until fn
+// returns false. The persistent store is read when there is one, since it
+// holds everything in the buffer and more.
+func (s *bridgeState) eventsBefore(id int64, fn func(ev sseEvent) bool) error {
+	if s.store != nil {
+		return s.store.Before(id, fn)
+	}
+	s.mu.Lock()
+	buffered := append([]sseEvent(nil), s.buffer...)
+	s.mu.Unlock()
+	for i := len(buffered) - 1; i >= 0; i-- {
+		if buffered[i].ID < id && !fn(buffered[i]) {
+			break
+		}
+	}
+	return nil
+}
+
+// restoreEvents refills the replay buffer from store and continues the event
+// ID sequence after the newest stored event.
+func (s *bridgeState) restoreEvents(store eventstore.Store) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	events, err := store.Tail(s.bufferCap)
+	if err != nil {
+		return err
+	}
+	s.buffer = events
+	if n := len(events); n > 0 && events[n-1].ID >= s.nextEventID {
+		s.nextEventID = events[n-1].ID + 1
+		slog.Info("event store restored", "events", n, "next_event_id", s.nextEventID)
+	}
+	// The redis store is written by publish, before s.mu is taken.
+	if _, shared := store.(*eventstore.RedisStore); !shared {
+		store = eventstore.NewWriter(store, s.metrics, s.config().EventStoreMaxEvents)
+	}
+	s.store = store
+	return nil
+}
@@ -0,0 +1,194 @@
+package server
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/Tennen/Paimon/tools/bridge/archive"
+	"github.com/Tennen/Paimon/tools/bridge/config"
+	"github.com/Tennen/Paimon/tools/bridge/sendqueue"
+)
+
+// replicationPrimary serves a primary's replication and health endpoints;
+// /health answers with *health.
+func replicationPrimary(t *testing.T, health *atomic.Int32) (*httptest.Server, *bridgeState) {
+	cfg := config.Config{Mode: "primary", ReplicationToken: "repl", StreamClientBuffer: 16}
+	state := callbackState(cfg)
+	mux := http.NewServeMux()
+	for path, handle := range map[string]func(http.ResponseWriter, *http.Request, config.Config, *bridgeState){
+		"/replication/stream":  handleReplicationStream,
+		"/replication/archive": handleReplicationArchive,
+		"/replication/state":   handleReplicationState,
+	} {
+		mux.HandleFunc(path, func(w http.ResponseWriter, r *http.Request) { handle(w, r, cfg, state) })
+	}
+	mux.HandleFunc("/health", func(w http.ResponseWriter, r *http.Request) { w.WriteHeader(int(health.Load())) })
+	srv := httptest.NewServer(mux)
+	t.Cleanup(func() {
+		close(state.closing)
+		srv.Close()
+		state.clients.Close()
+	})
+	return srv, state
+}
+
+// waitUntil polls cond for up to five seconds.
+func waitUntil(t *testing.T, what string, cond func() bool) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatal("timed out waiting for " + what)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+// writeStatus runs r through readOnlyMiddleware in front of a handler that
+// accepts everything.
+func writeStatus(cfg config.Config, state *bridgeState, method, path string) (int, string) {
+	ok := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) { _, _ = w.Write([]byte("ok")) })
+	w := httptest.NewRecorder()
+	readOnlyMiddleware(cfg, state, ok).ServeHTTP(w, httptest.NewRequest(method, path, nil))
+	return w.Code, w.Body.String()
+}
+
+func TestMirrorReplicatesAndRejectsWrites(t *testing.T) {
+	var health atomic.Int32
+	health.Store(http.StatusOK)
+	srv, primary := replicationPrimary(t, &health)
+	for _, text := range []string{"a", "b"} {
+		if _, err := primary.broadcastEvent("message", map[string]any{"text": text}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	_ = primary.archive.Append(archive.Record{Kind: "inbound", MsgID: "m1", Text: "a"})
+
+	cfg := config.Config{Mode: "mirror", PrimaryURL: srv.URL, ReplicationToken: "repl"}
+	state := callbackState(cfg)
+	defer state.clients.Close()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	m := &mirror{cfg: cfg, state: state, ctx: ctx}
+	go m.followStream()
+	if err := m.pullArchive(); err != nil {
+		t.Fatal(err)
+	}
+	waitUntil(t, "replicated events", func() bool { return len(state.getMissed(0, streamFilter{})) == 2 })
+	// Live events keep their IDs.
+	if _, err := primary.broadcastEvent("message", map[string]any{"text": "c"}); err != nil {
+		t.Fatal(err)
+	}
+	waitUntil(t, "live event", func() bool { return strings.Join(streamTexts(state), ",") == "a,b,c" })
+	for i, ev := range state.getMissed(0, streamFilter{}) {
+		if ev.ID != int64(i+1) {
+			t.Fatalf("event %d has ID %d", i, ev.ID)
+		}
+	}
+	if records := state.archive.After(0, 10); len(records) != 1 || records[0].MsgID != "m1" {
+		t.Fatalf("archive %+v", records)
+	}
+
+	for _, write := range [][2]string{
+		{http.MethodPost, "/wecom"},
+		{http.MethodPost, "/wecom/sales"},
+		{http.MethodPost, "/publish"},
+		{http.MethodPost, "/proxy/send"},
+		{http.MethodGet, "/proxy/media/get"},
+		{http.MethodPost, "/reply/m1"},
+		{http.MethodPost, "/channels/lark"},
+		{http.MethodPatch, "/admin/config"},
+	} {
+		if code, body := writeStatus(cfg, state, write[0], write[1]); code != http.StatusServiceUnavailable || body != "read-only mirror" {
+			t.Errorf("%s %s: %d %s", write[0], write[1], code, body)
+		}
+	}
+	for _, read := range []string{"/stream", "/poll", "/messages", "/admin/config", "/health"} {
+		if code, _ := writeStatus(cfg, state, http.MethodGet, read); code != http.StatusOK {
+			t.Errorf("GET %s: %d", read, code)
+		}
+	}
+
+	// Replication needs the replication token.
+	req, _ := http.NewRequest(http.MethodGet, srv.URL+"/replication/archive", nil)
+	req.Header.Set("Authorization", "Bearer bridge")
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusUnauthorized {
+		t.Fatal(resp.StatusCode)
+	}
+}
+
+func TestStandbyPromotesAfterFailover(t *testing.T) {
+	var health atomic.Int32
+	health.Store(http.StatusOK)
+	srv, primary := replicationPrimary(t, &health)
+	if _, err := primary.broadcastEvent("message", map[string]any{"text": "a"}); err != nil {
+		t.Fatal(err)
+	}
+	primary.tokens = &tokenManager{token: "shared", expiresAt: time.Now().Add(time.Hour)}
+
+	cfg := config.Config{Mode: "standby", PrimaryURL: srv.URL, ReplicationToken: "repl", FailoverAfter: time.Second}
+	state := callbackState(cfg)
+	defer state.clients.Close()
+	state.tokens = &tokenManager{}
+	state.sends = sendqueue.New(cfg)
+	state.standby = newStandby(cfg, state)
+	state.standby.start()
+	defer state.standby.cancel()
+
+	waitUntil(t, "replicated event and token", func() bool {
+		token, _ := state.tokens.snapshot()
+		return strings.Join(streamTexts(state), ",") == "a" && token == "shared"
+	})
+	// A healthy primary keeps the standby read-only past FailoverAfter.
+	time.Sleep(1500 * time.Millisecond)
+	if state.promoted.Load() || !state.readOnly(cfg) {
+		t.Fatal("promoted while the primary is healthy")
+	}
+	if code, _ := writeStatus(cfg, state, http.MethodPost, "/publish"); code != http.StatusServiceUnavailable {
+		t.Fatal(code)
+	}
+
+	health.Store(http.StatusServiceUnavailable)
+	waitUntil(t, "promotion", state.promoted.Load)
+	if code, body := writeStatus(cfg, state, http.MethodPost, "/publish"); code != http.StatusOK {
+		t.Fatal(code, body)
+	}
+	// New IDs skip past anything the old primary may have published, so a
+	// consumer resuming with its Last-Event-ID misses nothing.
+	id, err := state.broadcastEvent("message", map[string]any{"text": "b"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := int64(2 + promotionIDGap); id != want {
+		t.Fatalf("first ID after promotion %d, want %d", id, want)
+	}
+	if got := state.getMissed(1, streamFilter{}); len(got) != 1 || got[0].ID != id {
+		t.Fatalf("resume from 1: %+v", got)
+	}
+	// Replication has stopped.
+	if _, err := primary.broadcastEvent("message", map[string]any{"text": "stale"}); err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(100 * time.Millisecond)
+	if got := strings.Join(streamTexts(state), ","); got != "a,b" {
+		t.Fatal(got)
+	}
+	var metrics strings.Builder
+	state.metrics.WriteText(&metrics)
+	if !strings.Contains(metrics.String(), `wecom_bridge_promotions_total{reason="health"} 1`) {
+		t.Fatal(metrics.String())
+	}
+	if state.standby.promote("manual") {
+		t.Fatal("promoted twice")
+	}
+}
@@ -0,0 +1,256 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/Tennen/Paimon/tools/bridge/config"
+	"github.com/Tennen/Paimon/tools/bridge/metrics"
+	"github.com/Tennen/Paimon/tools/bridge/redis"
+	wxcrypto "github.com/Tennen/Paimon/tools/wecom/crypto"
+)
+
+// callbackDeduper remembers recently seen callbacks so WeCom retries are not
+// broadcast twice. With Redis the window is shared by every replica; if Redis
+// is unreachable it falls back to this process's memory.
+type callbackDeduper struct {
+	ttl   time.Duration
+	redis *redis.Client
+
+	mu        sync.Mutex
+	seen      map[string]time.Time
+	lastSweep time.Time
+}
+
+// callbackDedupKey identifies a callback across retries: sender and MsgId
+// when WeCom sends one (MsgIds are only unique per app, and apps may share a
+// receive ID), else sender, CreateTime and event. Callbacks with neither are
+// never deduplicated.
+func callbackDedupKey(cfg config.Config, msg *wecomMessage) string {
+	if msg.MsgID != "" {
+		return fmt.Sprintf("wecom-bridge:dedup:%s:msg:%s:%s", cfg.WeComReceiveID, msg.FromUser, msg.MsgID)
+	}
+	if msg.CreateTime.IsZero() {
+		return ""
+	}
+	eventKey := msg.EventKey
+	if token, ok := msg.Detail["token"].(string); ok && msg.Event == "kf_msg_or_event" {
+		// Customer service callbacks have no sender; their sync token
+		// tells them apart.
+		eventKey = token
+	}
+	return fmt.Sprintf("wecom-bridge:dedup:%s:evt:%s:%d:%s:%s:%s", cfg.WeComReceiveID, msg.FromUser, msg.CreateTime.Unix(), msg.AgentID, msg.Event, eventKey)
+}
+
+// claim records key and reports whether this is its first sighting within
+// the TTL.
+func (d *callbackDeduper) claim(key string, metrics *metrics.Registry) bool {
+	if d.ttl <= 0 {
+		return true
+	}
+	if d.redis != nil {
+		reply, err := d.redis.Do("SET", key, "1", "NX", "PX", strconv.FormatInt(d.ttl.Milliseconds(), 10))
+		if err == nil {
+			return reply != nil
+		}
+		metrics.Inc("wecom_bridge_redis_errors_total", "op", "dedup")
+		slog.Warn("redis dedup failed, using local window", "err", err)
+	}
+
+	now := time.Now()
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if now.Sub(d.lastSweep) > d.ttl {
+		for k, expires := range d.seen {
+			if now.After(expires) {
+				delete(d.seen, k)
+			}
+		}
+		d.lastSweep = now
+	}
+	if expires, ok := d.seen[key]; ok && now.Before(expires) {
+		return false
+	}
+	d.seen[key] = now.Add(d.ttl)
+	return true
+}
+
+// release forgets key so a redelivery is processed again.
+func (d *callbackDeduper) release(key string) {
+	if key == "" {
+		return
+	}
+	if d.redis != nil {
+		if _, err := d.redis.Do("DEL", key); err != nil {
+			slog.Warn("redis dedup release failed", "err", err)
+		}
+	}
+	d.mu.Lock()
+	delete(d.seen, key)
+	d.mu.Unlock()
+}
+
+// replySlots holds the passive reply slots of callbacks that are waiting for
+// a consumer, keyed by MsgId. A slot accepts one reply.
+type replySlots struct {
+	mu    sync.Mutex
+	slots map[string]*replySlot
+}
+
+type replySlot struct {
+	text   chan string
+	filled bool
+}
+
+func (s *replySlots) open(msgID string) chan string {
+	slot := &replySlot{text: make(chan string, 1)}
+	s.mu.Lock()
+	s.slots[msgID] = slot
+	s.mu.Unlock()
+	return slot.text
+}
+
+func (s *replySlots) close(msgID string) {
+	s.mu.Lock()
+	delete(s.slots, msgID)
+	s.mu.Unlock()
+}
+
+// fill hands text to the waiting callback. It reports whether a slot was
+// open and whether it was still free.
+func (s *replySlots) fill(msgID, text string) (found, accepted bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	slot, ok := s.slots[msgID]
+	if !ok {
+		return false, false
+	}
+	if slot.filled {
+		return true, false
+	}
+	slot.filled = true
+	slot.text <- text
+	return true, true
+}
+
+// awaitPassiveReply waits until ReplyWait after the callback arrived for a
+// consumer's reply and renders it; without one fallback is returned.
+func awaitPassiveReply(ctx context.Context, cfg config.Config, state *bridgeState, msg *wecomMessage, slot chan string, receivedAt time.Time, fallback callbackReply) callbackReply {
+	timer := time.NewTimer(time.Until(receivedAt.Add(cfg.ReplyWait)))
+	defer timer.Stop()
+	select {
+	case text := <-slot:
+		xmlReply, err := buildTextReply(cfg, msg, text)
+		if err != nil {
+			slog.WarnContext(ctx, "wecom passive reply failed", "message_id", msg.MsgID, "err", err)
+			state.metrics.Inc("wecom_bridge_passive_replies_total", "result", "error")
+			return fallback
+		}
+		state.metrics.Inc("wecom_bridge_passive_replies_total", "result", "sent")
+		return callbackReply{status: http.StatusOK, contentType: "application/xml", body: xmlReply}
+	case <-timer.C:
+		state.metrics.Inc("wecom_bridge_passive_replies_total", "result", "expired")
+		return fallback
+	}
+}
+
+// handleReply fills the passive reply slot of a callback that is still
+// waiting, so WeCom receives the text as the synchronous answer.
+func handleReply(w http.ResponseWriter, r *http.Request, cfg config.Config, state *bridgeState) {
+	if r.Method != http.MethodPost {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	if !checkBridgeAuth(w, r, cfg, config.ScopeProxySend) {
+		return
+	}
+
+	msgID := strings.TrimPrefix(r.URL.Path, "/reply/")
+	if msgID == "" || strings.Contains(msgID, "/") {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	body, err := readBody(r)
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		_, _ = w.Write([]byte("missing body"))
+		return
+	}
+	var payload struct {
+		Text string `json:"text"`
+	}
+	if err := json.Unmarshal(body, &payload); err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		_, _ = w.Write([]byte("invalid json"))
+		return
+	}
+	if strings.TrimSpace(payload.Text) == "" {
+		w.WriteHeader(http.StatusBadRequest)
+		_, _ = w.Write([]byte("missing text"))
+		return
+	}
+
+	found, accepted := state.replies.fill(msgID, payload.Text)
+	if !found {
+		w.WriteHeader(http.StatusNotFound)
+		_, _ = w.Write([]byte("no reply slot (expired or unknown msgId)"))
+		return
+	}
+	if !accepted {
+		w.WriteHeader(http.StatusConflict)
+		_, _ = w.Write([]byte("already replied"))
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(map[string]any{"ok": true, "msgId": msgID})
+}
+
+func shouldAutoAck(cfg config.Config, ackText string, msg *wecomMessage) bool {
+	if ackText == "" || msg.MsgType == "event" {
+		return false
+	}
+	if !containsFold(cfg.AutoAckMsgTypes, msg.MsgType) {
+		return false
+	}
+	if len(cfg.AutoAckSessions) > 0 && !containsFold(cfg.AutoAckSessions, msg.FromUser) {
+		return false
+	}
+	return true
+}
+
+// buildTextReply renders a passive text reply addressed to the sender of
+// msg, encrypted unless cfg is in plaintext mode.
+func buildTextReply(cfg config.Config, msg *wecomMessage, text string) ([]byte, error) {
+	now := time.Now().Unix()
+	plain := fmt.Sprintf(
+		"<xml><ToUserName>%s</ToUserName><FromUserName>%s</FromUserName><CreateTime>%d</CreateTime><MsgType>%s</MsgType><Content>%s</Content></xml>",
+		cdata(msg.FromUser), cdata(msg.ToUser), now, cdata("text"), cdata(text),
+	)
+	if cfg.CallbackMode == config.CallbackPlaintext {
+		return []byte(plain), nil
+	}
+	receiveID := firstNonEmpty(cfg.WeComReceiveID, msg.ToUser)
+	encrypted, err := wxcrypto.Encrypt(plain, cfg.WeComAESKey, receiveID)
+	if err != nil {
+		return nil, err
+	}
+	timestamp := strconv.FormatInt(now, 10)
+	nonce := randomNonce()
+	signature := wxcrypto.Signature(cfg.WeComToken, timestamp, nonce, encrypted)
+	reply := fmt.Sprintf(
+		"<xml><Encrypt>%s</Encrypt><MsgSignature>%s</MsgSignature><TimeStamp>%s</TimeStamp><Nonce>%s</Nonce></xml>",
+		cdata(encrypted), cdata(signature), timestamp, cdata(nonce),
+	)
+	return []byte(reply), nil
+}
+
+func cdata(value string) string {
+	return "<![CDATA[" + strings.ReplaceAll(value, "]]>", "]]]]><![CDATA[>") + "]]>"
+}
@@ -0,0 +1,42 @@
+package server
+
+import (
+	"log/slog"
+	"time"
+
+	"github.com/Tennen/Paimon/tools/bridge/config"
+)
+
+// runRetention applies cfg.Retention at startup and then every interval.
+func runRetention(cfg config.Config, state *bridgeState) {
+	for {
+		applyRetention(cfg.Retention, state, time.Now())
+		time.Sleep(cfg.Retention.IntervalPeriod)
+	}
+}
+
+// applyRetention compacts each configured target, counting removed entries
+// and reclaimed bytes on /metrics.
+func applyRetention(rc *config.Retention, state *bridgeState, now time.Time) {
+	record := func(target string, removed int, reclaimed int64, err error) {
+		if err != nil {
+			slog.Error("retention failed", "target", target, "err", err)
+			state.metrics.Inc("wecom_bridge_retention_runs_total", "target", target, "result", "error")
+			return
+		}
+		state.metrics.Inc("wecom_bridge_retention_runs_total", "target", target, "result", "ok")
+		state.metrics.Add("wecom_bridge_retention_removed_total", int64(removed), "target", target)
+		state.metrics.Add("wecom_bridge_retention_reclaimed_bytes_total", reclaimed, "target", target)
+		if removed > 0 {
+			slog.Info("retention applied", "target", target, "removed", removed, "reclaimed_bytes", reclaimed)
+		}
+	}
+	if rc.Archive != nil {
+		removed, reclaimed, err := state.archive.Compact(rc.Archive, now)
+		record("archive", removed, reclaimed, err)
+	}
+	if rc.Media != nil && state.media != nil {
+		removed, reclaimed, err := state.media.Prune(rc.Media, now)
+		record("media", removed, reclaimed, err)
+	}
+}
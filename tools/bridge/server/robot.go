@@ -0,0 +1,129 @@
+package server
+
+import (
+	"crypto/md5"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/Tennen/Paimon/tools/bridge/config"
+)
+
+// maxRobotImageBytes is the group robot's limit for an image message.
+const maxRobotImageBytes = 2 << 20
+
+// robotLimiter schedules group robot sends so no key exceeds its per-minute
+// limit: a send over the limit is given the time the oldest send in the
+// window leaves it and waits until then. The zero value is ready to use.
+type robotLimiter struct {
+	mu    sync.Mutex
+	slots map[string][]time.Time
+}
+
+// reserve books a send for key and returns how long the caller must wait
+// before sending. It books nothing and reports false when the wait would
+// exceed maxWait.
+func (l *robotLimiter) reserve(key string, perMinute int, maxWait time.Duration, now time.Time) (time.Duration, bool) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.slots == nil {
+		l.slots = make(map[string][]time.Time)
+	}
+	slots := l.slots[key]
+	for len(slots) > 0 && !slots[0].After(now.Add(-time.Minute)) {
+		slots = slots[1:]
+	}
+	at := now
+	if len(slots) >= perMinute {
+		at = slots[len(slots)-perMinute].Add(time.Minute)
+	}
+	if wait := at.Sub(now); wait > maxWait {
+		l.slots[key] = slots
+		return wait, false
+	}
+	l.slots[key] = append(slots, at)
+	return at.Sub(now), true
+}
+
+// handleProxyRobotSend posts a message through a group robot webhook
+// (webhook/send). The body is the robot's message ({"msgtype","text"|
+// "markdown"|"image"|"news"|...}) plus "key" and optional timeout_ms. An
+// image may be given as base64 alone; its md5 is filled in. Sends beyond
+// BRIDGE_ROBOT_RATE per key and minute queue for up to
+// BRIDGE_ROBOT_QUEUE_MAX, then get 429.
+func handleProxyRobotSend(w http.ResponseWriter, r *http.Request, cfg config.Config, state *bridgeState) {
+	if r.Method != http.MethodPost {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	if !checkBridgeAuth(w, r, cfg, config.ScopeProxySend) {
+		return
+	}
+
+	body, err := readBody(r)
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		_, _ = w.Write([]byte("missing body"))
+		return
+	}
+	var payload map[string]any
+	if err := json.Unmarshal(body, &payload); err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		_, _ = w.Write([]byte("invalid json"))
+		return
+	}
+	key, _ := payload["key"].(string)
+	timeoutMS, _ := payload["timeout_ms"].(float64)
+	delete(payload, "key")
+	delete(payload, "timeout_ms")
+	msgType, _ := payload["msgtype"].(string)
+	if key == "" || msgType == "" || payload[msgType] == nil {
+		w.WriteHeader(http.StatusBadRequest)
+		_, _ = w.Write([]byte("missing key/msgtype/message"))
+		return
+	}
+	if msgType == "image" {
+		image, _ := payload["image"].(map[string]any)
+		encoded, _ := image["base64"].(string)
+		data, err := base64.StdEncoding.DecodeString(encoded)
+		if err != nil || len(data) == 0 {
+			w.WriteHeader(http.StatusBadRequest)
+			_, _ = w.Write([]byte("invalid image base64"))
+			return
+		}
+		if len(data) > maxRobotImageBytes {
+			w.WriteHeader(http.StatusBadRequest)
+			_, _ = w.Write([]byte("image exceeds 2 MB"))
+			return
+		}
+		image["md5"] = fmt.Sprintf("%x", md5.Sum(data))
+	}
+
+	wait, ok := state.robots.reserve(key, cfg.RobotRatePerMinute, cfg.RobotQueueMax, time.Now())
+	if !ok {
+		state.metrics.Inc("wecom_bridge_robot_sends_total", "result", "rate_limited")
+		w.Header().Set("Retry-After", strconv.Itoa(int(wait.Seconds())+1))
+		w.WriteHeader(http.StatusTooManyRequests)
+		_, _ = w.Write([]byte("robot rate limit exceeded"))
+		return
+	}
+	if wait > 0 {
+		state.metrics.Inc("wecom_bridge_robot_sends_total", "result", "queued")
+		timer := time.NewTimer(wait)
+		select {
+		case <-timer.C:
+		case <-r.Context().Done():
+			timer.Stop()
+			return
+		}
+	}
+	state.metrics.Inc("wecom_bridge_robot_sends_total", "result", "sent")
+	forwardBody, _ := json.Marshal(payload)
+	endpoint := fmt.Sprintf("https://qyapi.weixin.qq.com/cgi-bin/webhook/send?key=%s", url.QueryEscape(key))
+	forwardWeCom(w, r, endpoint, forwardBody, "robot send", proxyTimeout(r, cfg, "robot", int(timeoutMS)))
+}
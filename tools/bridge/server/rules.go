@@ -0,0 +1,157 @@
+package server
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+
+	"github.com/Tennen/Paimon/tools/bridge/config"
+	"github.com/Tennen/Paimon/tools/bridge/metrics"
+)
+
+// applyEventRules runs the configured rules in order against an inbound
+// message and its payload, returning the collected labels and whether a drop
+// rule matched. Set and rewrite rules change the payload, and the message
+// for text, msgType and eventKey, before later rules, routes and consumers
+// see it.
+func applyEventRules(rules []config.Rule, msg *wecomMessage, payload map[string]any, metrics *metrics.Registry) ([]string, bool) {
+	labels := make([]string, 0)
+	seen := make(map[string]bool)
+	field := func(name string) string {
+		switch v := payload[name].(type) {
+		case nil:
+			return ""
+		case string:
+			return v
+		default:
+			return fmt.Sprint(v)
+		}
+	}
+	for _, rule := range rules {
+		if !ruleMatches(rule, msg, field, labels) {
+			continue
+		}
+		metrics.Inc("wecom_bridge_rule_matches_total", "rule", rule.Name, "action", rule.Action)
+		switch rule.Action {
+		case "drop":
+			return nil, true
+		case "rewrite":
+			setRuleField(msg, payload, "text", rule.Regexp.ReplaceAllString(field("text"), rule.Replace))
+		case "set":
+			// Values see the payload as it was before this rule.
+			values := make(map[string]string, len(rule.Set))
+			for name, value := range rule.Set {
+				values[name] = expandRuleTemplate(value, field)
+			}
+			for name, value := range values {
+				setRuleField(msg, payload, name, value)
+			}
+		}
+		for _, label := range rule.Labels {
+			if !seen[label] {
+				seen[label] = true
+				labels = append(labels, label)
+			}
+		}
+	}
+	return labels, false
+}
+
+// ruleTemplatePattern matches a {{field}} placeholder in a set value.
+var ruleTemplatePattern = regexp.MustCompile(`\{\{\s*([A-Za-z_][A-Za-z0-9_.]*)\s*\}\}`)
+
+// expandRuleTemplate replaces {{field}} placeholders, as in the welcome
+// templates, with payload fields; a missing field becomes "". Everything
+// else, including "$", is kept as written.
+func expandRuleTemplate(value string, field func(string) string) string {
+	return ruleTemplatePattern.ReplaceAllStringFunc(value, func(m string) string {
+		return field(ruleTemplatePattern.FindStringSubmatch(m)[1])
+	})
+}
+
+// setRuleField assigns a payload field, keeping the message fields rules
+// and routes match on in step.
+func setRuleField(msg *wecomMessage, payload map[string]any, name, value string) {
+	payload[name] = value
+	switch name {
+	case "text":
+		msg.Content = value
+	case "msgType":
+		msg.MsgType = value
+	case "eventKey":
+		msg.EventKey = value
+	}
+}
+
+// routeTopics returns the topics of every route matching the message.
+func routeTopics(routes []config.Route, msg *wecomMessage, labels []string) []string {
+	topics := make([]string, 0)
+	for _, route := range routes {
+		if routeMatches(route, msg, labels) && !containsFold(topics, route.Topic) {
+			topics = append(topics, route.Topic)
+		}
+	}
+	return topics
+}
+
+func routeMatches(route config.Route, msg *wecomMessage, labels []string) bool {
+	if len(route.MsgTypes) > 0 && !containsFold(route.MsgTypes, msg.MsgType) {
+		return false
+	}
+	if len(route.Events) > 0 && !containsFold(route.Events, msg.Event) {
+		return false
+	}
+	if len(route.FromUsers) > 0 && !containsFold(route.FromUsers, msg.FromUser) {
+		return false
+	}
+	if len(route.AgentIDs) > 0 && !containsFold(route.AgentIDs, msg.AgentID) {
+		return false
+	}
+	if len(route.Labels) > 0 {
+		found := false
+		for _, label := range labels {
+			if containsFold(route.Labels, label) {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return false
+		}
+	}
+	if route.Regexp != nil && !route.Regexp.MatchString(msg.Content) {
+		return false
+	}
+	return true
+}
+
+func ruleMatches(rule config.Rule, msg *wecomMessage, field func(string) string, labels []string) bool {
+	if len(rule.MsgTypes) > 0 && !containsFold(rule.MsgTypes, msg.MsgType) {
+		return false
+	}
+	if rule.Cond != nil && !rule.Cond(field, labels) {
+		return false
+	}
+	if rule.Regexp == nil && len(rule.Keywords) == 0 {
+		return rule.Cond != nil
+	}
+	if rule.Regexp != nil && rule.Regexp.MatchString(msg.Content) {
+		return true
+	}
+	content := strings.ToLower(msg.Content)
+	for _, kw := range rule.Keywords {
+		if kw != "" && strings.Contains(content, strings.ToLower(kw)) {
+			return true
+		}
+	}
+	return false
+}
+
+func containsFold(values []string, target string) bool {
+	for _, v := range values {
+		if strings.EqualFold(strings.TrimSpace(v), target) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,41 @@
+package server
+
+import (
+	"testing"
+
+	"github.com/Tennen/Paimon/tools/bridge/config"
+	"github.com/Tennen/Paimon/tools/bridge/metrics"
+	"github.com/Tennen/Paimon/tools/bridge/ruleexpr"
+)
+
+func TestApplyEventRulesSet(t *testing.T) {
+	when, err := ruleexpr.Compile(`msgType in ["image", "voice"]`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rules := []config.Rule{{
+		Name:   "media",
+		When:   `msgType in ["image", "voice"]`,
+		Cond:   when,
+		Action: "set",
+		Set: map[string]string{
+			"text":    "[{{msgType}} from {{ fromUser }}] costs $5 ${fromUser}{{missing}}",
+			"msgType": "note",
+			"origin":  "{{msgType}}",
+		},
+		Labels: []string{"media"},
+	}}
+	msg := &wecomMessage{MsgType: "image", FromUser: "alice"}
+	payload := map[string]any{"msgType": "image", "fromUser": "alice", "text": ""}
+	labels, drop := applyEventRules(rules, msg, payload, metrics.New())
+	if drop || len(labels) != 1 || labels[0] != "media" {
+		t.Fatal(labels, drop)
+	}
+	if got := payload["text"]; got != "[image from alice] costs $5 ${fromUser}" {
+		t.Fatalf("text %q", got)
+	}
+	// Values see the payload as it was before the rule.
+	if payload["origin"] != "image" || payload["msgType"] != "note" || msg.MsgType != "note" || msg.Content != payload["text"] {
+		t.Fatalf("payload %v, message %+v", payload, msg)
+	}
+}
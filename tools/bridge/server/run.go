@@ -0,0 +1,53 @@
+// Package server is the wecom-bridge itself: the WeCom callback endpoint,
+// the /stream, /poll and gRPC fan-out to consumers, the /proxy/* API and
+// the admin and replication endpoints. The stores and protocols behind
+// them live in the sibling bridge/* packages, and the wecom-bridge binary
+// is a thin wrapper around Main.
+package server
+
+import (
+	"fmt"
+	"os"
+	"strings"
+)
+
+// Main runs the wecom-bridge command line with args (without the program
+// name) and returns the process exit status.
+func Main(args []string) int {
+	if len(args) > 0 && !strings.HasPrefix(args[0], "-") {
+		return runCommand(args[0], args[1:])
+	}
+	serve(args)
+	return 0
+}
+
+const cliUsage = `usage: wecom-bridge [command] [flags]
+
+commands:
+  serve       run the bridge (the default when no command is given)
+  send        send a one-off app message with the configured credentials
+  decrypt     decrypt a callback payload offline
+  verify-url  run WeCom's URL verification against a running bridge
+
+Run "wecom-bridge <command> -h" for a command's flags.
+`
+
+// runCommand runs a CLI subcommand and returns the process exit status.
+func runCommand(name string, args []string) int {
+	switch name {
+	case "serve":
+		serve(args)
+		return 0
+	case "send":
+		return cmdSend(args)
+	case "decrypt":
+		return cmdDecrypt(args)
+	case "verify-url":
+		return cmdVerifyURL(args)
+	case "help":
+		fmt.Print(cliUsage)
+		return 0
+	}
+	fmt.Fprintf(os.Stderr, "unknown command %q\n\n%s", name, cliUsage)
+	return 2
+}
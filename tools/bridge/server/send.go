@@ -0,0 +1,391 @@
+package server
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/Tennen/Paimon/tools/bridge/archive"
+	"github.com/Tennen/Paimon/tools/bridge/config"
+	"github.com/Tennen/Paimon/tools/bridge/proxy"
+	"github.com/Tennen/Paimon/tools/bridge/sendqueue"
+)
+
+func handleProxyGetToken(w http.ResponseWriter, r *http.Request, cfg config.Config) {
+	if r.Method != http.MethodPost {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	if !checkBridgeAuth(w, r, cfg, config.ScopeProxyApp) {
+		return
+	}
+
+	body, err := readBody(r)
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		_, _ = w.Write([]byte("missing body"))
+		return
+	}
+	var payload struct {
+		CorpID     string `json:"corpid"`
+		CorpSecret string `json:"corpsecret"`
+		TimeoutMS  int    `json:"timeout_ms"`
+	}
+	if err := json.Unmarshal(body, &payload); err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		_, _ = w.Write([]byte("invalid json"))
+		return
+	}
+	if payload.CorpID == "" || payload.CorpSecret == "" {
+		w.WriteHeader(http.StatusBadRequest)
+		_, _ = w.Write([]byte("missing corpid/corpsecret"))
+		return
+	}
+
+	qs := url.Values{}
+	qs.Set("corpid", payload.CorpID)
+	qs.Set("corpsecret", payload.CorpSecret)
+	endpoint := fmt.Sprintf("https://qyapi.weixin.qq.com/cgi-bin/gettoken?%s", qs.Encode())
+
+	client := qyapiClient(proxyTimeout(r, cfg, "gettoken", payload.TimeoutMS))
+	resp, err := proxy.Do(r.Context(), client, endpoint, nil)
+	if err != nil {
+		w.WriteHeader(http.StatusBadGateway)
+		_, _ = w.Write([]byte("gettoken failed"))
+		return
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		w.WriteHeader(http.StatusBadGateway)
+		_, _ = w.Write([]byte(fmt.Sprintf("token http %d", resp.StatusCode)))
+		return
+	}
+	data, err := io.ReadAll(resp.Body)
+	if err != nil {
+		w.WriteHeader(http.StatusBadGateway)
+		_, _ = w.Write([]byte("token read failed"))
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	_, _ = w.Write(proxy.EnrichError(data, "gettoken"))
+}
+
+func handleProxySend(w http.ResponseWriter, r *http.Request, cfg config.Config, state *bridgeState) {
+	if r.Method != http.MethodPost {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	// The override token bypasses per-recipient quotas for critical alerts.
+	override := hasBearer(r, cfg.QuotaOverrideToken)
+	if !override && !checkBridgeAuth(w, r, cfg, config.ScopeProxySend) {
+		return
+	}
+
+	body, err := readBody(r)
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		_, _ = w.Write([]byte("missing body"))
+		return
+	}
+	var payload struct {
+		AccessToken    string          `json:"access_token"`
+		Message        json.RawMessage `json:"message"`
+		TimeoutMS      int             `json:"timeout_ms"`
+		Async          bool            `json:"async"`
+		IdempotencyKey string          `json:"idempotency_key"`
+	}
+	if err := json.Unmarshal(body, &payload); err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		_, _ = w.Write([]byte("invalid json"))
+		return
+	}
+	if payload.Async || r.URL.Query().Get("async") == "true" {
+		if len(payload.Message) == 0 || !json.Valid(payload.Message) {
+			w.WriteHeader(http.StatusBadRequest)
+			_, _ = w.Write([]byte("missing message"))
+			return
+		}
+		now := time.Now().UTC()
+		enqueueSend(w, r, state, &sendqueue.Job{
+			ID:             randomNonce(),
+			IdempotencyKey: firstNonEmpty(r.Header.Get("Idempotency-Key"), payload.IdempotencyKey),
+			Requester:      requesterIdentity(r, cfg),
+			AccessToken:    payload.AccessToken,
+			Message:        payload.Message,
+			TimeoutMS:      payload.TimeoutMS,
+			SkipQuota:      override,
+			Status:         sendqueue.Queued,
+			CreatedAt:      now,
+			UpdatedAt:      now,
+		})
+		return
+	}
+	if payload.AccessToken == "" && len(payload.Message) > 0 {
+		var target struct {
+			AgentID any `json:"agentid"`
+		}
+		_ = json.Unmarshal(payload.Message, &target)
+		payload.AccessToken = state.managedToken(jsonID(target.AgentID))
+	}
+	if payload.AccessToken == "" || len(payload.Message) == 0 {
+		w.WriteHeader(http.StatusBadRequest)
+		_, _ = w.Write([]byte("missing access_token/message"))
+		return
+	}
+
+	msgID, err := sendAppMessage(w, r, cfg, state, payload.AccessToken, payload.Message, payload.TimeoutMS, override)
+	if err != nil {
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(map[string]any{"errcode": 0, "errmsg": "ok", "msgid": msgID})
+}
+
+// Errors of sendAppMessage, telling whether WeCom may have delivered the
+// message.
+var (
+	// errNotSent: the message never reached WeCom, because a quota
+	// refused it or the connection could not be made.
+	errNotSent = errors.New("not sent")
+	// errNoAnswer: the message went out but WeCom's answer was lost to a
+	// timeout, a dropped connection or an HTTP error, so it may have been
+	// delivered.
+	errNoAnswer = errors.New("no answer from wecom")
+	// errRejected: WeCom answered with a nonzero errcode.
+	errRejected = errors.New("rejected by wecom")
+)
+
+// sendAppMessage posts one message/send body, recording it in the archive,
+// sessions, quotas and usage. Failures are written to w and returned as
+// errNotSent, errNoAnswer or errRejected; on success the WeCom msgid is
+// returned and the caller writes the response.
+func sendAppMessage(w http.ResponseWriter, r *http.Request, cfg config.Config, state *bridgeState, accessToken string, message []byte, timeoutMS int, skipQuota bool) (string, error) {
+	return sendAppMessageAs(w, r, cfg, state, requesterIdentity(r, cfg), accessToken, message, timeoutMS, skipQuota)
+}
+
+// sendAppMessageAs is sendAppMessage on behalf of requester, for sends that
+// no longer have the caller's request.
+func sendAppMessageAs(w http.ResponseWriter, r *http.Request, cfg config.Config, state *bridgeState, requester, accessToken string, message []byte, timeoutMS int, skipQuota bool) (string, error) {
+	record := outboundRecord(message, requester)
+	defer func() {
+		state.archive.Append(record)
+		state.sessions.observe(record, time.Now().UTC())
+	}()
+
+	sent := false
+	if !skipQuota {
+		recipients, broadcast := parseToUsers(message)
+		if broadcast && state.quotas.enabled() {
+			record.Error = "send quota cannot count broadcast recipients"
+			w.Header().Set("Content-Type", "application/json")
+			w.WriteHeader(http.StatusForbidden)
+			_ = json.NewEncoder(w).Encode(map[string]any{
+				"error": "send quotas are enabled: toparty, totag and @all need the quota override token",
+			})
+			return "", errNotSent
+		}
+		sentAt := time.Now()
+		if exceeded := state.quotas.reserve(recipients, sentAt); len(exceeded) > 0 {
+			slog.WarnContext(r.Context(), "wecom send quota exceeded", "recipients", strings.Join(exceeded, ","))
+			record.Error = "send quota exceeded"
+			w.Header().Set("Content-Type", "application/json")
+			w.WriteHeader(http.StatusTooManyRequests)
+			_ = json.NewEncoder(w).Encode(map[string]any{
+				"error": "send quota exceeded",
+				"users": exceeded,
+			})
+			return "", errNotSent
+		}
+		// Failed sends do not count against the recipients' quota.
+		defer func() {
+			if !sent {
+				state.quotas.release(recipients, sentAt)
+			}
+		}()
+	}
+
+	endpoint := fmt.Sprintf("https://qyapi.weixin.qq.com/cgi-bin/message/send?access_token=%s", accessToken)
+	client := qyapiClient(proxyTimeout(r, cfg, "send", timeoutMS))
+	resp, err := proxy.Do(r.Context(), client, endpoint, message)
+	if err != nil {
+		// A failed dial means WeCom never saw the message; any other
+		// failure may have come after it was delivered.
+		outcome := errNoAnswer
+		record.Error = "send failed"
+		var opErr *net.OpError
+		if errors.As(err, &opErr) && opErr.Op == "dial" {
+			outcome = errNotSent
+			record.Error = "send connect failed"
+		}
+		w.WriteHeader(http.StatusBadGateway)
+		_, _ = w.Write([]byte(record.Error))
+		return "", outcome
+	}
+	defer resp.Body.Close()
+	data, err := io.ReadAll(resp.Body)
+	if err != nil {
+		record.Error = "send read failed"
+		w.WriteHeader(http.StatusBadGateway)
+		_, _ = w.Write([]byte("send read failed"))
+		return "", errNoAnswer
+	}
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		record.Error = fmt.Sprintf("send http %d", resp.StatusCode)
+		w.WriteHeader(http.StatusBadGateway)
+		_, _ = w.Write([]byte(fmt.Sprintf("send http %d", resp.StatusCode)))
+		return "", errNoAnswer
+	}
+
+	var result sendResult
+	_ = json.Unmarshal(data, &result)
+	record.ErrCode = result.ErrCode
+	record.MsgID = result.MsgID
+	publishSendStatus(state, record, result)
+	if result.ErrCode != 0 {
+		record.Error = result.ErrMsg
+		writeWeComError(w, http.StatusBadGateway, data, "send")
+		return "", errRejected
+	}
+	sent = true
+	state.usage.record(record.Requester, func(c *usageCounters) { c.Sends++ })
+	return result.MsgID, nil
+}
+
+// sendResult is WeCom's answer to message/send. The invalid lists name
+// recipients, separated by |, that the message could not reach.
+type sendResult struct {
+	ErrCode        int    `json:"errcode"`
+	ErrMsg         string `json:"errmsg"`
+	MsgID          string `json:"msgid"`
+	InvalidUser    string `json:"invaliduser"`
+	InvalidParty   string `json:"invalidparty"`
+	InvalidTag     string `json:"invalidtag"`
+	UnlicensedUser string `json:"unlicenseduser"`
+}
+
+// publishSendStatus adds a send_status event for a message WeCom answered:
+// status is sent, partial when some recipients were invalid, or failed.
+func publishSendStatus(state *bridgeState, rec archive.Record, result sendResult) {
+	event := map[string]any{
+		"type":      "send_status",
+		"source":    "send",
+		"status":    "sent",
+		"toUser":    rec.ToUser,
+		"requester": rec.Requester,
+		"time":      time.Now().UTC().Format(time.RFC3339),
+	}
+	if result.MsgID != "" {
+		event["msgId"] = result.MsgID
+	}
+	if rec.AgentID != "" {
+		event["agentId"] = rec.AgentID
+	}
+	for key, value := range map[string]string{
+		"invalidUsers":    result.InvalidUser,
+		"invalidParties":  result.InvalidParty,
+		"invalidTags":     result.InvalidTag,
+		"unlicensedUsers": result.UnlicensedUser,
+	} {
+		if value != "" {
+			event[key] = strings.Split(value, "|")
+			event["status"] = "partial"
+		}
+	}
+	if result.ErrCode != 0 {
+		event["status"] = "failed"
+		event["errcode"] = result.ErrCode
+		event["error"] = result.ErrMsg
+	}
+	_, _ = state.broadcastEvent("send_status", event)
+}
+
+// messageRecallWindow is how long after sending WeCom lets an app recall a
+// message.
+const messageRecallWindow = 24 * time.Hour
+
+// handleProxyMessageRecall recalls an app message through message/recall.
+// The body is {"msgid","agentid","access_token","timeout_ms"}; agentid
+// defaults to the one the archive recorded for msgid. Archived messages
+// older than messageRecallWindow are refused without asking WeCom.
+func handleProxyMessageRecall(w http.ResponseWriter, r *http.Request, cfg config.Config, state *bridgeState) {
+	if r.Method != http.MethodPost {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	if !checkBridgeAuth(w, r, cfg, config.ScopeProxySend) {
+		return
+	}
+
+	body, err := readBody(r)
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		_, _ = w.Write([]byte("missing body"))
+		return
+	}
+	var payload struct {
+		AccessToken string `json:"access_token"`
+		AgentID     any    `json:"agentid"`
+		MsgID       string `json:"msgid"`
+		TimeoutMS   int    `json:"timeout_ms"`
+	}
+	if err := json.Unmarshal(body, &payload); err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		_, _ = w.Write([]byte("invalid json"))
+		return
+	}
+	if payload.MsgID == "" {
+		w.WriteHeader(http.StatusBadRequest)
+		_, _ = w.Write([]byte("missing msgid"))
+		return
+	}
+	rec, archived := state.archive.FindMsgID(payload.MsgID)
+	if archived && time.Since(rec.Time) > messageRecallWindow {
+		state.metrics.Inc("wecom_bridge_message_recall_total", "result", "expired")
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusConflict)
+		_ = json.NewEncoder(w).Encode(map[string]any{
+			"error":  "recall window expired",
+			"sentAt": rec.Time.Format(time.RFC3339),
+		})
+		return
+	}
+	agentID := firstNonEmpty(jsonID(payload.AgentID), rec.AgentID)
+	accessToken := firstNonEmpty(payload.AccessToken, state.managedToken(agentID))
+	if accessToken == "" {
+		w.WriteHeader(http.StatusBadRequest)
+		_, _ = w.Write([]byte("missing access_token"))
+		return
+	}
+
+	data, _ := json.Marshal(map[string]string{"msgid": payload.MsgID})
+	endpoint := "https://qyapi.weixin.qq.com/cgi-bin/message/recall?access_token=" + url.QueryEscape(accessToken)
+	if _, ok := callWeCom(w, r, qyapiClient(proxyTimeout(r, cfg, "send", payload.TimeoutMS)), endpoint, data, "recall"); !ok {
+		state.metrics.Inc("wecom_bridge_message_recall_total", "result", "error")
+		return
+	}
+	state.metrics.Inc("wecom_bridge_message_recall_total", "result", "ok")
+	event := map[string]any{
+		"type":      "send_status",
+		"source":    "recall",
+		"status":    "recalled",
+		"msgId":     payload.MsgID,
+		"requester": requesterIdentity(r, cfg),
+		"time":      time.Now().UTC().Format(time.RFC3339),
+	}
+	if agentID != "" {
+		event["agentId"] = agentID
+	}
+	if archived {
+		event["toUser"] = rec.ToUser
+	}
+	_, _ = state.broadcastEvent("send_status", event)
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(map[string]any{"errcode": 0, "errmsg": "ok", "msgid": payload.MsgID})
+}
@@ -0,0 +1,94 @@
+package server
+
+import (
+	"encoding/json"
+	"errors"
+	"log/slog"
+	"net/http"
+	"strings"
+
+	"github.com/Tennen/Paimon/tools/bridge/config"
+	"github.com/Tennen/Paimon/tools/bridge/sendqueue"
+)
+
+// attemptQueuedSend sends job once through sendAppMessage. Connect failures
+// and WeCom's busy and rate limit errcodes are worth retrying; other
+// rejections are final.
+func attemptQueuedSend(state *bridgeState, job sendqueue.Job) sendqueue.Outcome {
+	cfg := state.config()
+	token := job.AccessToken
+	if token == "" {
+		var target struct {
+			AgentID any `json:"agentid"`
+		}
+		_ = json.Unmarshal(job.Message, &target)
+		token = state.managedToken(jsonID(target.AgentID))
+	}
+	if token == "" {
+		return sendqueue.Outcome{Err: "no managed access token"}
+	}
+	r, _ := http.NewRequest(http.MethodPost, "/proxy/send", nil)
+	capture := &responseCapture{}
+	msgID, err := sendAppMessageAs(capture, r, cfg, state, job.Requester, token, job.Message, job.TimeoutMS, job.SkipQuota)
+	if err == nil {
+		return sendqueue.Outcome{Sent: true, MsgID: msgID}
+	}
+	out := sendqueue.Outcome{Err: strings.TrimSpace(capture.body.String()), NoAnswer: errors.Is(err, errNoAnswer)}
+	var result struct {
+		ErrCode int `json:"errcode"`
+	}
+	if json.Unmarshal(capture.body.Bytes(), &result) == nil {
+		out.ErrCode = result.ErrCode
+		out.Final = !sendRetryable(result.ErrCode)
+	}
+	if capture.status == http.StatusTooManyRequests || capture.status == http.StatusBadRequest || capture.status == http.StatusForbidden {
+		out.Final = true
+	}
+	return out
+}
+
+// sendRetryable reports whether a message/send errcode is worth retrying
+// later: system busy and the frequency and concurrency limits. Expired
+// managed tokens are already retried by tokenRetryInterceptor.
+func sendRetryable(errcode int) bool {
+	return errcode == -1 || errcode == 45009 || errcode == 45033
+}
+
+// enqueueSend answers an asynchronous /proxy/send: 202 with the new job, or
+// 200 with the existing one when the idempotency key was used before.
+func enqueueSend(w http.ResponseWriter, r *http.Request, state *bridgeState, job *sendqueue.Job) {
+	stored, created, err := state.sends.Enqueue(job)
+	if err != nil {
+		slog.ErrorContext(r.Context(), "send queue failed", "err", err)
+		w.WriteHeader(http.StatusServiceUnavailable)
+		_, _ = w.Write([]byte(err.Error()))
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	if created {
+		state.metrics.Inc("wecom_bridge_send_queue_total", "result", "queued")
+		w.WriteHeader(http.StatusAccepted)
+	}
+	_ = json.NewEncoder(w).Encode(stored.Report())
+}
+
+// handleProxySendStatus reports the delivery state of a queued send. Jobs
+// are only visible to the requester that queued them.
+func handleProxySendStatus(w http.ResponseWriter, r *http.Request, cfg config.Config, state *bridgeState) {
+	if r.Method != http.MethodGet {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	override := hasBearer(r, cfg.QuotaOverrideToken)
+	if !override && !checkBridgeAuth(w, r, cfg, config.ScopeProxySend) {
+		return
+	}
+	job, ok := state.sends.Get(strings.TrimPrefix(r.URL.Path, "/proxy/send/status/"))
+	if !ok || job.Requester != requesterIdentity(r, cfg) {
+		w.WriteHeader(http.StatusNotFound)
+		_, _ = w.Write([]byte("unknown send id"))
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(job.Report())
+}
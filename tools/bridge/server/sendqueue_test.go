@@ -0,0 +1,81 @@
+package server
+
+import (
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/Tennen/Paimon/tools/bridge/archive"
+	"github.com/Tennen/Paimon/tools/bridge/config"
+	"github.com/Tennen/Paimon/tools/bridge/hub"
+	"github.com/Tennen/Paimon/tools/bridge/metrics"
+	"github.com/Tennen/Paimon/tools/bridge/sendqueue"
+)
+
+func TestAttemptQueuedSend(t *testing.T) {
+	state := &bridgeState{
+		nextEventID: 1,
+		bufferCap:   config.DefaultBufferSize,
+		metrics:     metrics.New(),
+		archive:     archive.New(100),
+		usage:       &usageTracker{buckets: make(map[usageKey]*usageCounters)},
+		tokens:      &tokenManager{},
+		cfg:         config.Config{ProxyTimeouts: map[string]time.Duration{"send": time.Second}},
+	}
+	state.clients = hub.New(streamHubShards, streamHubQueue)
+	defer state.clients.Close()
+
+	previous := outboundTransport
+	defer func() { outboundTransport = previous }()
+	respond := func(status int, body string) roundTripFunc {
+		return func(*http.Request) (*http.Response, error) {
+			return &http.Response{StatusCode: status, Header: make(http.Header), Body: io.NopCloser(strings.NewReader(body))}, nil
+		}
+	}
+	fail := func(err error) roundTripFunc {
+		return func(*http.Request) (*http.Response, error) { return nil, err }
+	}
+	message := []byte(`{"touser":"alice","msgtype":"text","agentid":1,"text":{"content":"hi"}}`)
+	for _, tc := range []struct {
+		name      string
+		transport roundTripFunc
+		outcome   error
+		want      sendqueue.Outcome
+	}{
+		{"sent", respond(http.StatusOK, `{"errcode":0,"errmsg":"ok","msgid":"m1"}`), nil, sendqueue.Outcome{Sent: true, MsgID: "m1"}},
+		{"rate limited", respond(http.StatusOK, `{"errcode":45009,"errmsg":"api freq out of limit"}`), errRejected, sendqueue.Outcome{ErrCode: 45009}},
+		{"invalid", respond(http.StatusOK, `{"errcode":40003,"errmsg":"invalid userid"}`), errRejected, sendqueue.Outcome{ErrCode: 40003, Final: true}},
+		{"connect failed", fail(&net.OpError{Op: "dial", Net: "tcp", Err: errors.New("connection refused")}), errNotSent, sendqueue.Outcome{Err: "send connect failed"}},
+		{"dropped connection", fail(io.ErrUnexpectedEOF), errNoAnswer, sendqueue.Outcome{Err: "send failed", NoAnswer: true}},
+		{"timeout", fail(&net.OpError{Op: "read", Net: "tcp", Err: os.ErrDeadlineExceeded}), errNoAnswer, sendqueue.Outcome{Err: "send failed", NoAnswer: true}},
+		{"gateway error", respond(http.StatusGatewayTimeout, "upstream timed out"), errNoAnswer, sendqueue.Outcome{Err: "send http 504", NoAnswer: true}},
+	} {
+		outboundTransport = tc.transport
+		r, _ := http.NewRequest(http.MethodPost, "/proxy/send", nil)
+		if _, err := sendAppMessageAs(&responseCapture{}, r, state.cfg, state, "test", "token", message, 0, true); !errors.Is(err, tc.outcome) {
+			t.Errorf("%s: outcome %v, want %v", tc.name, err, tc.outcome)
+		}
+		job := sendqueue.Job{ID: tc.name, Requester: "test", AccessToken: "token", Message: message, SkipQuota: true, Status: sendqueue.Sending}
+		got := attemptQueuedSend(state, job)
+		if tc.want.Err == "" && !tc.want.Sent {
+			// Rejections carry WeCom's explained error body.
+			if !strings.Contains(got.Err, `"errmsg"`) {
+				t.Errorf("%s: error %q", tc.name, got.Err)
+			}
+			got.Err = ""
+		}
+		if got != tc.want {
+			t.Errorf("%s: outcome %+v, want %+v", tc.name, got, tc.want)
+		}
+	}
+	// Without a token nothing is sent, and the next attempt may have one.
+	job := sendqueue.Job{ID: "no token", Requester: "test", Message: message}
+	if got := attemptQueuedSend(state, job); got != (sendqueue.Outcome{Err: "no managed access token"}) {
+		t.Errorf("no token: outcome %+v", got)
+	}
+}
@@ -0,0 +1,397 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"log"
+	"log/slog"
+	"net/http"
+	"os"
+	"os/signal"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/Tennen/Paimon/tools/bridge/archive"
+	"github.com/Tennen/Paimon/tools/bridge/auditlog"
+	"github.com/Tennen/Paimon/tools/bridge/config"
+	"github.com/Tennen/Paimon/tools/bridge/eventstore"
+	"github.com/Tennen/Paimon/tools/bridge/federation"
+	"github.com/Tennen/Paimon/tools/bridge/hub"
+	"github.com/Tennen/Paimon/tools/bridge/mediacache"
+	"github.com/Tennen/Paimon/tools/bridge/metrics"
+	"github.com/Tennen/Paimon/tools/bridge/outbox"
+	"github.com/Tennen/Paimon/tools/bridge/redis"
+	"github.com/Tennen/Paimon/tools/bridge/sendqueue"
+)
+
+// serve runs the bridge until SIGINT/SIGTERM.
+func serve(args []string) {
+	flags := flag.NewFlagSet("serve", flag.ExitOnError)
+	configFile := flags.String("config", os.Getenv("BRIDGE_CONFIG_FILE"), "JSON or YAML config file (BRIDGE_CONFIG_FILE)")
+	validate := flags.Bool("validate", false, "check the configuration and exit")
+	_ = flags.Parse(args)
+	if *configFile != "" {
+		_ = os.Setenv("BRIDGE_CONFIG_FILE", *configFile)
+		if err := config.ApplyFileSettings(*configFile); err != nil {
+			log.Fatalf("config file error: %v", err)
+		}
+	}
+	cfg := config.Load()
+	setupLogging(cfg)
+	if *validate {
+		os.Exit(validateConfig(cfg))
+	}
+	transport, err := newOutboundTransport(cfg)
+	if err != nil {
+		log.Fatalf("outbound http: %v", err)
+	}
+	outboundTransport = transport
+	state := &bridgeState{
+		nextEventID:    1,
+		bufferCap:      cfg.MessageBufferCap,
+		cfg:            cfg,
+		closing:        make(chan struct{}),
+		quotas:         newSendQuota(cfg.SendQuotaHourly, cfg.SendQuotaDaily),
+		metrics:        metrics.New(),
+		tokens:         &tokenManager{corpID: cfg.WeComCorpID, secret: cfg.WeComCorpSecret, timeout: cfg.ProxyTimeouts["gettoken"]},
+		welcomeSent:    make(map[string]time.Time),
+		welcomeSending: make(map[string]bool),
+		archive:        archive.New(cfg.ArchiveMaxRecords),
+		audit:          auditlog.New(cfg.AuditRecent),
+		outbox:         outbox.New(),
+		sends:          sendqueue.New(cfg),
+		tickets:        make(map[string]streamTicket),
+		usage:          &usageTracker{buckets: make(map[usageKey]*usageCounters)},
+		links:          newLinkUnfurler(cfg),
+		contacts:       newContactEnricher(cfg.ContactEnrichTTL),
+		media:          mediacache.New(cfg.MediaCacheDir, cfg.MediaCacheTTL, cfg.MediaCacheMaxMB),
+		tunables:       tunablesFromConfig(cfg),
+	}
+	state.clients = hub.New(streamHubShards, streamHubQueue)
+	state.agentTokens = make(map[string]*tokenManager)
+	state.channels = make(map[string]channelAdapter)
+	for _, ch := range cfg.Channels {
+		state.channels[ch.Name] = newFeishuAdapter(ch, cfg.ProxyTimeouts)
+	}
+	for agentID, secret := range cfg.AgentSecrets {
+		state.agentTokens[agentID] = &tokenManager{corpID: cfg.WeComCorpID, secret: secret, timeout: cfg.ProxyTimeouts["gettoken"]}
+	}
+	for _, agent := range cfg.Agents {
+		if m, ok := state.agentTokens[agent.AgentID]; ok && agent.CorpID != "" {
+			m.corpID = agent.CorpID
+		}
+	}
+	qyapiInterceptors = append(qyapiInterceptors, tokenRetryInterceptor(state))
+	qyapiInterceptors = append(qyapiInterceptors, configInterceptors(cfg.QyAPI, state.metrics)...)
+	state.dedup = &callbackDeduper{ttl: cfg.DedupTTL, seen: make(map[string]time.Time)}
+	state.replies = &replySlots{slots: make(map[string]*replySlot)}
+	if cfg.RedisURL != "" {
+		client, err := redis.New(cfg.RedisURL)
+		if err != nil {
+			log.Fatalf("redis error: %v", err)
+		}
+		state.dedup.redis = client
+	}
+	if err := state.loadTunables(cfg.TunablesFile); err != nil {
+		log.Fatalf("tunables error: %v", err)
+	}
+	if err := state.archive.Open(cfg.ArchiveFile); err != nil {
+		log.Fatalf("archive error: %v", err)
+	}
+	if err := state.audit.Open(cfg.AuditFile); err != nil {
+		log.Fatalf("audit log error: %v", err)
+	}
+	store, err := eventstore.Open(cfg)
+	if err != nil {
+		log.Fatalf("event store error: %v", err)
+	}
+	if store != nil {
+		if err := state.restoreEvents(store); err != nil {
+			log.Fatalf("event store error: %v", err)
+		}
+		go eventstore.RunTrim(state.store, state.metrics)
+		if shared, ok := store.(*eventstore.RedisStore); ok {
+			go shared.Follow(state, state.metrics)
+		}
+	}
+	if len(cfg.Upstreams) > 0 {
+		state.fed = federation.New(cfg, outboundClient(0), state.metrics, func(eventType string, payload map[string]any) {
+			_, _ = state.broadcastEvent(eventType, payload)
+		})
+		// A standby resumes the primary's federation cursors once promoted.
+		if cfg.Mode != "standby" {
+			state.fed.Start(cfg.Upstreams)
+		}
+	}
+	switch cfg.Mode {
+	case "mirror":
+		m := &mirror{cfg: cfg, state: state, ctx: context.Background()}
+		go m.followStream()
+		go m.followArchive()
+		slog.Info("wecom-bridge running as read-only mirror", "primary", cfg.PrimaryURL)
+	case "standby":
+		state.standby = newStandby(cfg, state)
+		state.standby.start()
+		slog.Info("wecom-bridge running as standby", "primary", cfg.PrimaryURL)
+	default:
+		// A mirror never pushes: the primary already delivers to webhooks.
+		startPrimary(cfg, state)
+	}
+	state.callbacks = newCallbackPool(cfg, state)
+	state.sessions = newSessionTracker(cfg, state)
+	if state.sessions != nil {
+		go state.sessions.run()
+	}
+	if cfg.Retention != nil {
+		go runRetention(cfg, state)
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/health", handleHealth)
+	mux.HandleFunc("/ready", func(w http.ResponseWriter, r *http.Request) {
+		handleReady(w, r, state.config(), state)
+	})
+	mux.HandleFunc("/metrics", func(w http.ResponseWriter, r *http.Request) {
+		handleMetrics(w, r, state.config(), state)
+	})
+	mux.HandleFunc("/admin/config", func(w http.ResponseWriter, r *http.Request) {
+		handleAdminConfig(w, r, state.config(), state)
+	})
+	mux.HandleFunc("/messages", func(w http.ResponseWriter, r *http.Request) {
+		handleMessages(w, r, state.config(), state)
+	})
+	mux.HandleFunc("/sends", func(w http.ResponseWriter, r *http.Request) {
+		handleSends(w, r, state.config(), state)
+	})
+	mux.HandleFunc("/archive/search", func(w http.ResponseWriter, r *http.Request) {
+		handleArchiveSearch(w, r, state.config(), state)
+	})
+	mux.HandleFunc("/admin/promote", func(w http.ResponseWriter, r *http.Request) {
+		handleAdminPromote(w, r, state.config(), state)
+	})
+	mux.HandleFunc("/admin/webhooks", func(w http.ResponseWriter, r *http.Request) {
+		handleAdminWebhooks(w, r, state.config(), state)
+	})
+	mux.HandleFunc("/admin/usage", func(w http.ResponseWriter, r *http.Request) {
+		handleAdminUsage(w, r, state.config(), state)
+	})
+	mux.HandleFunc("/admin/clients", func(w http.ResponseWriter, r *http.Request) {
+		handleAdminClients(w, r, state.config(), state)
+	})
+	mux.HandleFunc("/admin/clients/", func(w http.ResponseWriter, r *http.Request) {
+		handleAdminClients(w, r, state.config(), state)
+	})
+	mux.HandleFunc("/admin/buffer", func(w http.ResponseWriter, r *http.Request) {
+		handleAdminBuffer(w, r, state.config(), state)
+	})
+	mux.HandleFunc("/admin/failures", func(w http.ResponseWriter, r *http.Request) {
+		handleAdminFailures(w, r, state.config(), state)
+	})
+	mux.HandleFunc("/admin/audit", func(w http.ResponseWriter, r *http.Request) {
+		handleAdminAudit(w, r, state.config(), state)
+	})
+	mux.HandleFunc("/stream", func(w http.ResponseWriter, r *http.Request) {
+		handleStream(w, r, state.config(), state)
+	})
+	mux.HandleFunc("/poll", func(w http.ResponseWriter, r *http.Request) {
+		handlePoll(w, r, state.config(), state)
+	})
+	mux.HandleFunc("/stream/ticket", func(w http.ResponseWriter, r *http.Request) {
+		handleStreamTicket(w, r, state.config(), state)
+	})
+	mux.HandleFunc("/publish", func(w http.ResponseWriter, r *http.Request) {
+		handlePublish(w, r, state.config(), state)
+	})
+	mux.HandleFunc("/replication/stream", func(w http.ResponseWriter, r *http.Request) {
+		handleReplicationStream(w, r, state.config(), state)
+	})
+	mux.HandleFunc("/replication/archive", func(w http.ResponseWriter, r *http.Request) {
+		handleReplicationArchive(w, r, state.config(), state)
+	})
+	mux.HandleFunc("/replication/state", func(w http.ResponseWriter, r *http.Request) {
+		handleReplicationState(w, r, state.config(), state)
+	})
+	mux.HandleFunc("/wecom", func(w http.ResponseWriter, r *http.Request) {
+		handleWeCom(w, r, state.config(), state)
+	})
+	mux.HandleFunc("/wecom/", func(w http.ResponseWriter, r *http.Request) {
+		agentCfg, ok := state.config().ForAgent(strings.TrimPrefix(r.URL.Path, "/wecom/"))
+		if !ok {
+			w.WriteHeader(http.StatusNotFound)
+			_, _ = w.Write([]byte("unknown agent"))
+			return
+		}
+		handleWeCom(w, r, agentCfg, state)
+	})
+	mux.HandleFunc("/channels/", func(w http.ResponseWriter, r *http.Request) {
+		handleChannelCallback(w, r, state.config(), state)
+	})
+	mux.HandleFunc("/proxy/channels/", func(w http.ResponseWriter, r *http.Request) {
+		handleProxyChannel(w, r, state.config(), state)
+	})
+	mux.HandleFunc("/reply/", func(w http.ResponseWriter, r *http.Request) {
+		handleReply(w, r, state.config(), state)
+	})
+	mux.HandleFunc("/proxy/gettoken", func(w http.ResponseWriter, r *http.Request) {
+		handleProxyGetToken(w, r, state.config())
+	})
+	mux.HandleFunc("/proxy/send", func(w http.ResponseWriter, r *http.Request) {
+		handleProxySend(w, r, state.config(), state)
+	})
+	mux.HandleFunc("/proxy/send/status/", func(w http.ResponseWriter, r *http.Request) {
+		handleProxySendStatus(w, r, state.config(), state)
+	})
+	mux.HandleFunc("/proxy/send/typed", func(w http.ResponseWriter, r *http.Request) {
+		handleProxySendTyped(w, r, state.config(), state)
+	})
+	mux.HandleFunc("/proxy/menu/create", func(w http.ResponseWriter, r *http.Request) {
+		handleProxyMenuCreate(w, r, state.config(), state)
+	})
+	mux.HandleFunc("/proxy/menu/get", func(w http.ResponseWriter, r *http.Request) {
+		handleProxyMenuQuery(w, r, state.config(), state, "get")
+	})
+	mux.HandleFunc("/proxy/menu/delete", func(w http.ResponseWriter, r *http.Request) {
+		handleProxyMenuQuery(w, r, state.config(), state, "delete")
+	})
+	mux.HandleFunc("/proxy/agent/get", func(w http.ResponseWriter, r *http.Request) {
+		handleProxyAgentGet(w, r, state.config(), state)
+	})
+	mux.HandleFunc("/proxy/agent/set", func(w http.ResponseWriter, r *http.Request) {
+		handleProxyAgentSet(w, r, state.config(), state)
+	})
+	mux.HandleFunc("/proxy/message/recall", func(w http.ResponseWriter, r *http.Request) {
+		handleProxyMessageRecall(w, r, state.config(), state)
+	})
+	mux.HandleFunc("/proxy/appchat/create", func(w http.ResponseWriter, r *http.Request) {
+		handleProxyAppChatCreate(w, r, state.config(), state)
+	})
+	mux.HandleFunc("/proxy/appchat/update", func(w http.ResponseWriter, r *http.Request) {
+		handleProxyAppChatUpdate(w, r, state.config(), state)
+	})
+	mux.HandleFunc("/proxy/appchat/send", func(w http.ResponseWriter, r *http.Request) {
+		handleProxyAppChatSend(w, r, state.config(), state)
+	})
+	mux.HandleFunc("/proxy/auth/userinfo", func(w http.ResponseWriter, r *http.Request) {
+		handleProxyAuthUserInfo(w, r, state.config(), state)
+	})
+	mux.HandleFunc("/proxy/api/", func(w http.ResponseWriter, r *http.Request) {
+		handleProxyAPI(w, r, state.config(), state)
+	})
+	mux.HandleFunc("/proxy/media/forward", func(w http.ResponseWriter, r *http.Request) {
+		handleProxyMediaForward(w, r, state.config(), state)
+	})
+	mux.HandleFunc("/proxy/media/upload/batch", func(w http.ResponseWriter, r *http.Request) {
+		handleProxyUploadBatch(w, r, state.config(), state)
+	})
+	mux.HandleFunc("/proxy/robot/send", func(w http.ResponseWriter, r *http.Request) {
+		handleProxyRobotSend(w, r, state.config(), state)
+	})
+	mux.HandleFunc("/proxy/kf/send", func(w http.ResponseWriter, r *http.Request) {
+		handleProxyKFSend(w, r, state.config(), state)
+	})
+	mux.HandleFunc("/proxy/media/uploadimg", func(w http.ResponseWriter, r *http.Request) {
+		handleProxyUploadImage(w, r, state.config(), state)
+	})
+	mux.HandleFunc("/proxy/media/upload", func(w http.ResponseWriter, r *http.Request) {
+		handleProxyUpload(w, r, state.config(), state)
+	})
+	mux.HandleFunc("/proxy/media/raw", func(w http.ResponseWriter, r *http.Request) {
+		handleProxyMediaRaw(w, r, state.config(), state)
+	})
+	mux.HandleFunc("/proxy/media/get", func(w http.ResponseWriter, r *http.Request) {
+		handleProxyMediaGet(w, r, state.config(), state)
+	})
+
+	addr := fmt.Sprintf(":%d", cfg.Port)
+	server := &http.Server{
+		Addr:              addr,
+		Handler:           loggingMiddleware(corsMiddleware(cfg, usageMiddleware(cfg, state, auditMiddleware(cfg, state, rateLimitMiddleware(cfg, state, readOnlyMiddleware(cfg, state, mux)))))),
+		ReadHeaderTimeout: 10 * time.Second,
+	}
+
+	if cfg.TLSCertFile != "" {
+		state.certs = &certReloader{certFile: cfg.TLSCertFile, keyFile: cfg.TLSKeyFile}
+		if _, err := state.certs.getCertificate(nil); err != nil {
+			log.Fatalf("tls error: %v", err)
+		}
+		server.TLSConfig = state.certs.tlsConfig()
+	}
+	go func() {
+		var err error
+		if state.certs != nil {
+			slog.Info("wecom-bridge listening", "addr", addr, "tls", true)
+			err = server.ListenAndServeTLS("", "")
+		} else {
+			slog.Info("wecom-bridge listening", "addr", addr)
+			err = server.ListenAndServe()
+		}
+		if err != nil && !errors.Is(err, http.ErrServerClosed) {
+			log.Fatalf("server error: %v", err)
+		}
+	}()
+	if cfg.GRPCPort > 0 {
+		state.grpc = newGRPCServer(cfg, state)
+		go func() {
+			var err error
+			slog.Info("wecom-bridge grpc listening", "addr", state.grpc.Addr, "tls", state.certs != nil)
+			if state.certs != nil {
+				err = state.grpc.ListenAndServeTLS("", "")
+			} else {
+				err = state.grpc.ListenAndServe()
+			}
+			if err != nil && !errors.Is(err, http.ErrServerClosed) {
+				log.Fatalf("grpc server error: %v", err)
+			}
+		}()
+	}
+
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGINT, syscall.SIGTERM, syscall.SIGHUP)
+	for sig := range signals {
+		if sig != syscall.SIGHUP {
+			break
+		}
+		if cfg.ConfigFile == "" {
+			slog.Warn("SIGHUP ignored: BRIDGE_CONFIG_FILE not set")
+			continue
+		}
+		if err := state.reloadConfigFile(cfg.ConfigFile); err != nil {
+			state.metrics.Inc("wecom_bridge_config_reloads_total", "result", "error")
+			slog.Error("config reload failed, keeping previous config", "err", err)
+			continue
+		}
+		state.metrics.Inc("wecom_bridge_config_reloads_total", "result", "ok")
+		slog.Info("config reloaded", "file", cfg.ConfigFile)
+	}
+	shutdown(server, state, cfg.ShutdownTimeout)
+}
+
+// shutdown ends SSE streams with a shutdown event, lets in-flight requests
+// finish and drains the callback queue, all within timeout.
+func shutdown(server *http.Server, state *bridgeState, timeout time.Duration) {
+	slog.Info("wecom-bridge shutting down")
+	close(state.closing)
+	// Streams end with the closing channel, so nothing is left to deliver.
+	state.clients.Close()
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	if state.grpc != nil {
+		// Subscribe streams end with the closing channel.
+		if err := state.grpc.Shutdown(ctx); err != nil {
+			slog.Error("grpc shutdown failed", "err", err)
+		}
+	}
+	if err := server.Shutdown(ctx); err != nil {
+		// Handlers may still be enqueueing, so the pool cannot be closed.
+		slog.Error("shutdown failed", "err", err)
+		return
+	}
+	state.callbacks.drain(ctx)
+	if w, ok := state.store.(*eventstore.Writer); ok {
+		w.Flush()
+	}
+	slog.Info("wecom-bridge stopped")
+}
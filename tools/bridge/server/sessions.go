@@ -0,0 +1,173 @@
+package server
+
+import (
+	"fmt"
+	"log/slog"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/Tennen/Paimon/tools/bridge/archive"
+	"github.com/Tennen/Paimon/tools/bridge/config"
+)
+
+// sessionTracker collects each session's inbound and outbound messages and
+// emits them as one transcript when the session ends. A nil tracker is
+// disabled.
+type sessionTracker struct {
+	state       *bridgeState
+	idle        time.Duration
+	closeEvents []string
+	maxMessages int
+	archive     bool
+
+	mu       sync.Mutex
+	sessions map[string]*sessionTranscript
+}
+
+type sessionTranscript struct {
+	SessionID    string
+	StartedAt    time.Time
+	LastActivity time.Time
+	Messages     []transcriptEntry
+}
+
+// transcriptEntry is one message of a transcript, with untruncated text.
+type transcriptEntry struct {
+	Kind      string    `json:"kind"`
+	Time      time.Time `json:"time"`
+	FromUser  string    `json:"fromUser,omitempty"`
+	ToUser    string    `json:"toUser,omitempty"`
+	MsgType   string    `json:"msgType,omitempty"`
+	Text      string    `json:"text,omitempty"`
+	MsgID     string    `json:"msgId,omitempty"`
+	Requester string    `json:"requester,omitempty"`
+	Error     string    `json:"error,omitempty"`
+}
+
+func newSessionTracker(cfg config.Config, state *bridgeState) *sessionTracker {
+	if cfg.SessionIdle <= 0 {
+		return nil
+	}
+	return &sessionTracker{
+		state:       state,
+		idle:        cfg.SessionIdle,
+		closeEvents: cfg.SessionCloseEvents,
+		maxMessages: cfg.SessionMaxMessages,
+		archive:     cfg.SessionArchive,
+		sessions:    make(map[string]*sessionTranscript),
+	}
+}
+
+// observe adds an archived message to its session, emitting the transcript
+// early when it reaches maxMessages.
+func (t *sessionTracker) observe(rec archive.Record, now time.Time) {
+	if t == nil || rec.SessionID == "" {
+		return
+	}
+	t.mu.Lock()
+	sess := t.sessions[rec.SessionID]
+	if sess == nil {
+		sess = &sessionTranscript{SessionID: rec.SessionID, StartedAt: now}
+		t.sessions[rec.SessionID] = sess
+	}
+	sess.LastActivity = now
+	sess.Messages = append(sess.Messages, transcriptEntry{
+		Kind:      rec.Kind,
+		Time:      now,
+		FromUser:  rec.FromUser,
+		ToUser:    rec.ToUser,
+		MsgType:   rec.MsgType,
+		Text:      firstNonEmpty(rec.FullText, rec.Text),
+		MsgID:     rec.MsgID,
+		Requester: rec.Requester,
+		Error:     rec.Error,
+	})
+	full := len(sess.Messages) >= t.maxMessages
+	if full {
+		delete(t.sessions, rec.SessionID)
+	}
+	t.mu.Unlock()
+	if full {
+		t.emit(sess, "limit", now)
+	}
+}
+
+// closeOn ends sessionID when event is one of the configured close events.
+func (t *sessionTracker) closeOn(event, sessionID string) {
+	if t == nil || sessionID == "" || !containsFold(t.closeEvents, event) {
+		return
+	}
+	t.mu.Lock()
+	sess := t.sessions[sessionID]
+	delete(t.sessions, sessionID)
+	t.mu.Unlock()
+	if sess != nil {
+		t.emit(sess, "closed", time.Now().UTC())
+	}
+}
+
+// run ends sessions that have been idle for t.idle.
+func (t *sessionTracker) run() {
+	interval := t.idle / 4
+	if interval < time.Second {
+		interval = time.Second
+	}
+	for range time.Tick(interval) {
+		t.sweep(time.Now().UTC())
+	}
+}
+
+func (t *sessionTracker) sweep(now time.Time) {
+	t.mu.Lock()
+	ended := make([]*sessionTranscript, 0)
+	for id, sess := range t.sessions {
+		if now.Sub(sess.LastActivity) >= t.idle {
+			ended = append(ended, sess)
+			delete(t.sessions, id)
+		}
+	}
+	t.mu.Unlock()
+	sort.Slice(ended, func(i, j int) bool { return ended[i].StartedAt.Before(ended[j].StartedAt) })
+	for _, sess := range ended {
+		t.emit(sess, "idle", now)
+	}
+}
+
+// emit broadcasts the transcript (reaching /stream and webhooks) and, when
+// configured, archives it as a single record.
+func (t *sessionTracker) emit(sess *sessionTranscript, reason string, now time.Time) {
+	payload := map[string]any{
+		"type":         "transcript",
+		"sessionId":    sess.SessionID,
+		"reason":       reason,
+		"startedAt":    sess.StartedAt.Format(time.RFC3339),
+		"endedAt":      now.Format(time.RFC3339),
+		"messageCount": len(sess.Messages),
+		"messages":     sess.Messages,
+	}
+	if _, err := t.state.broadcastEvent("transcript", payload); err != nil {
+		slog.Error("transcript broadcast failed", "session_id", sess.SessionID, "err", err)
+	}
+	t.state.metrics.Inc("wecom_bridge_transcripts_total", "reason", reason)
+	if !t.archive {
+		return
+	}
+	var b strings.Builder
+	for _, m := range sess.Messages {
+		who := m.FromUser
+		if m.Kind == "outbound" {
+			who = firstNonEmpty(m.Requester, "bridge")
+		}
+		fmt.Fprintf(&b, "[%s] %s: %s\n", m.Time.Format(time.RFC3339), who, m.Text)
+	}
+	if err := t.state.archive.Append(archive.Record{
+		Kind:      "transcript",
+		SessionID: sess.SessionID,
+		MsgType:   "transcript",
+		Text:      strings.TrimSuffix(b.String(), "\n"),
+	}); err != nil {
+		slog.Error("transcript archive failed", "session_id", sess.SessionID, "err", err)
+	}
+}
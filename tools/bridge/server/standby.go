@@ -0,0 +1,249 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/Tennen/Paimon/tools/bridge/config"
+)
+
+// promotionIDGap is skipped in the event ID sequence on promotion, so events
+// the primary published but the standby had not yet received are never
+// reused for different events and Last-Event-ID resumes stay correct.
+const promotionIDGap = 1000
+
+// standby is a mirror that also copies the primary's token cache and
+// federation cursors, and turns into the primary when promoted.
+type standby struct {
+	mirror
+	cancel        context.CancelFunc
+	once          sync.Once
+	primaryNextID atomic.Int64
+}
+
+func newStandby(cfg config.Config, state *bridgeState) *standby {
+	ctx, cancel := context.WithCancel(context.Background())
+	return &standby{mirror: mirror{cfg: cfg, state: state, ctx: ctx}, cancel: cancel}
+}
+
+func (s *standby) start() {
+	go s.followStream()
+	go s.followArchive()
+	go s.followState()
+	if s.cfg.FailoverAfter > 0 {
+		go s.watchPrimary()
+	}
+}
+
+// followState polls the primary's token cache, federation cursors and event
+// sequence.
+func (s *standby) followState() {
+	for s.ctx.Err() == nil {
+		if err := s.pullState(); err != nil && s.ctx.Err() == nil {
+			slog.Warn("standby state pull failed", "err", err)
+		}
+		time.Sleep(5 * time.Second)
+	}
+}
+
+func (s *standby) pullState() error {
+	req, err := http.NewRequestWithContext(s.ctx, http.MethodGet, s.cfg.PrimaryURL+"/replication/state", nil)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Authorization", "Bearer "+s.cfg.ReplicationToken)
+	resp, err := outboundClient(0).Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("http %d", resp.StatusCode)
+	}
+	var result replicationState
+	if err := json.NewDecoder(resp.Body).Decode(&result); err != nil {
+		return err
+	}
+	s.primaryNextID.Store(result.NextEventID)
+	managers := s.state.tokenManagers()
+	for key, tok := range result.Tokens {
+		if m := managers[key]; m != nil {
+			m.seed(tok.Token, tok.ExpiresAt)
+		}
+	}
+	if s.state.fed != nil {
+		s.state.fed.Resume(result.FederationCursors)
+	}
+	return nil
+}
+
+// watchPrimary promotes the standby once the primary's /health has failed
+// for cfg.FailoverAfter without interruption.
+func (s *standby) watchPrimary() {
+	interval := s.cfg.FailoverAfter / 5
+	if interval < time.Second {
+		interval = time.Second
+	}
+	client := outboundClient(interval)
+	lastOK := time.Now()
+	for s.ctx.Err() == nil {
+		resp, err := client.Get(s.cfg.PrimaryURL + "/health")
+		if err == nil {
+			resp.Body.Close()
+		}
+		switch {
+		case err == nil && resp.StatusCode == http.StatusOK:
+			lastOK = time.Now()
+		case time.Since(lastOK) >= s.cfg.FailoverAfter:
+			slog.Warn("primary unhealthy", "primary", s.cfg.PrimaryURL, "for", time.Since(lastOK).Round(time.Second).String())
+			s.promote("health")
+			return
+		}
+		time.Sleep(interval)
+	}
+}
+
+// promote stops replication, moves the event sequence past anything the
+// primary may have published, and starts serving as primary. It reports
+// false when the standby was already promoted.
+func (s *standby) promote(reason string) bool {
+	promoted := false
+	s.once.Do(func() {
+		s.cancel()
+		s.state.mu.Lock()
+		next := max(s.state.nextEventID, s.primaryNextID.Load()) + promotionIDGap
+		s.state.nextEventID = next
+		s.state.mu.Unlock()
+		startPrimary(s.cfg, s.state)
+		s.state.promoted.Store(true)
+		s.state.metrics.Inc("wecom_bridge_promotions_total", "reason", reason)
+		slog.Info("standby promoted to primary", "reason", reason, "next_event_id", next)
+		promoted = true
+	})
+	return promoted
+}
+
+// handleAdminPromote promotes a standby by hand, e.g. for planned
+// maintenance of the primary.
+func handleAdminPromote(w http.ResponseWriter, r *http.Request, cfg config.Config, state *bridgeState) {
+	if r.Method != http.MethodPost {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	if !checkAdminAuth(w, r, cfg) {
+		return
+	}
+	if state.standby == nil {
+		w.WriteHeader(http.StatusConflict)
+		_, _ = w.Write([]byte("not a standby"))
+		return
+	}
+	if !state.standby.promote("manual") {
+		w.WriteHeader(http.StatusConflict)
+		_, _ = w.Write([]byte("already promoted"))
+		return
+	}
+	state.mu.Lock()
+	next := state.nextEventID
+	state.mu.Unlock()
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(map[string]any{"promoted": true, "nextEventId": next})
+}
+
+// replicationState is the primary's state a standby copies besides events
+// and archive records.
+type replicationState struct {
+	Role              string                     `json:"role"`
+	NextEventID       int64                      `json:"nextEventId"`
+	Tokens            map[string]replicatedToken `json:"tokens,omitempty"`
+	FederationCursors map[string]int64           `json:"federationCursors,omitempty"`
+}
+
+// replicatedToken is a cached access token with its refresh deadline.
+type replicatedToken struct {
+	Token     string    `json:"token"`
+	ExpiresAt time.Time `json:"expiresAt"`
+}
+
+func handleReplicationState(w http.ResponseWriter, r *http.Request, cfg config.Config, state *bridgeState) {
+	if r.Method != http.MethodGet {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	if !checkReplicationAuth(w, r, cfg) {
+		return
+	}
+	result := replicationState{Role: cfg.Mode}
+	if state.promoted.Load() {
+		result.Role = "primary"
+	}
+	state.mu.Lock()
+	result.NextEventID = state.nextEventID
+	state.mu.Unlock()
+	result.Tokens = make(map[string]replicatedToken)
+	for key, m := range state.tokenManagers() {
+		if token, expiresAt := m.snapshot(); token != "" {
+			result.Tokens[key] = replicatedToken{Token: token, ExpiresAt: expiresAt}
+		}
+	}
+	if state.fed != nil {
+		result.FederationCursors = state.fed.Snapshot()
+	}
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(result)
+}
+
+func checkReplicationAuth(w http.ResponseWriter, r *http.Request, cfg config.Config) bool {
+	if !hasBearer(r, cfg.ReplicationToken) {
+		w.WriteHeader(http.StatusUnauthorized)
+		_, _ = w.Write([]byte("unauthorized"))
+		return false
+	}
+	return true
+}
+
+// handleReplicationStream serves the unfiltered stream, with original event
+// IDs, to mirrors.
+func handleReplicationStream(w http.ResponseWriter, r *http.Request, cfg config.Config, state *bridgeState) {
+	if r.Method != http.MethodGet {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	if !checkReplicationAuth(w, r, cfg) {
+		return
+	}
+	// Mirrors always replay: a fresh mirror (cursor 0) gets the whole buffer.
+	r.URL.RawQuery = ""
+	after := parseLastEventID(r)
+	if after == 0 {
+		after = -1
+	}
+	// Mirrors store the payloads, so replication events stay unsigned.
+	serveStream(w, r, state, "replication", after, nil, "")
+}
+
+// handleReplicationArchive returns archive records with id > after, oldest
+// first.
+func handleReplicationArchive(w http.ResponseWriter, r *http.Request, cfg config.Config, state *bridgeState) {
+	if r.Method != http.MethodGet {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	if !checkReplicationAuth(w, r, cfg) {
+		return
+	}
+	after, _ := strconv.ParseInt(r.URL.Query().Get("after"), 10, 64)
+	limit, err := strconv.Atoi(r.URL.Query().Get("limit"))
+	if err != nil || limit <= 0 || limit > 1000 {
+		limit = 500
+	}
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(map[string]any{"records": state.archive.After(after, limit)})
+}
@@ -0,0 +1,119 @@
+package server
+
+import (
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/Tennen/Paimon/tools/bridge/archive"
+	"github.com/Tennen/Paimon/tools/bridge/auditlog"
+	"github.com/Tennen/Paimon/tools/bridge/config"
+	"github.com/Tennen/Paimon/tools/bridge/eventstore"
+	"github.com/Tennen/Paimon/tools/bridge/federation"
+	"github.com/Tennen/Paimon/tools/bridge/hub"
+	"github.com/Tennen/Paimon/tools/bridge/mediacache"
+	"github.com/Tennen/Paimon/tools/bridge/metrics"
+	"github.com/Tennen/Paimon/tools/bridge/outbox"
+	"github.com/Tennen/Paimon/tools/bridge/sendqueue"
+)
+
+type bridgeState struct {
+	// cfg is the active configuration; SIGHUP swaps in reloaded file
+	// sections.
+	cfgMu sync.RWMutex
+	cfg   config.Config
+
+	// closing is closed once shutdown starts.
+	closing chan struct{}
+
+	mu          sync.Mutex
+	nextEventID int64
+	buffer      []sseEvent
+	bufferCap   int
+	clients     *hub.Hub
+	store       eventstore.Store
+
+	quotas  *sendQuota
+	metrics *metrics.Registry
+	tokens  *tokenManager
+
+	// agentTokens holds a token manager per app in BRIDGE_AGENT_SECRETS.
+	agentTokens map[string]*tokenManager
+
+	// welcomeSent holds when each user last received a welcome, for the
+	// cooldown; welcomeSending the users with a welcome in flight.
+	welcomeMu      sync.Mutex
+	welcomeSent    map[string]time.Time
+	welcomeSending map[string]bool
+	welcomeSweep   time.Time
+
+	tunablesMu sync.RWMutex
+	tunables   runtimeTunables
+	// tunablesUpdateMu serializes /admin/config updates from read to persist.
+	tunablesUpdateMu sync.Mutex
+
+	archive   *archive.Archive
+	audit     *auditlog.Log
+	outbox    *outbox.Outbox
+	sends     *sendqueue.Queue
+	sinks     []*webhookSink
+	callbacks *callbackPool
+
+	ticketsMu sync.Mutex
+	tickets   map[string]streamTicket
+
+	usage    *usageTracker
+	links    *linkUnfurler
+	contacts *contactEnricher
+	dedup    *callbackDeduper
+	replies  *replySlots
+	media    *mediacache.Cache
+
+	sessions *sessionTracker
+
+	fed      *federation.Federation
+	standby  *standby
+	promoted atomic.Bool
+
+	certs *certReloader
+	kf    *kfSyncer
+
+	// failures keeps recently rejected callbacks for /admin/failures.
+	failures callbackFailures
+
+	// robots paces /proxy/robot/send per robot key.
+	robots robotLimiter
+	// apiLimits paces /proxy/api calls per allowlisted route.
+	apiLimits robotLimiter
+	// rateLimits holds the BRIDGE_RATE_LIMITS buckets.
+	rateLimits rateLimiter
+
+	// ready caches the last /ready result.
+	ready readiness
+
+	// callbackIPs holds WeCom's published callback IPs and the rejected
+	// sources seen so far.
+	callbackIPs callbackAllowlist
+
+	// channels holds the adapters of the configured channels by name.
+	channels map[string]channelAdapter
+
+	// grpc serves the gRPC API when BRIDGE_GRPC_PORT is set.
+	grpc *http.Server
+}
+
+const (
+	archiveTextLimit          = 200
+	usageRetentionHours       = 24 * 31
+	maxLinksPerMessage        = 5
+	maxUnfurlBytes            = 512 * 1024
+	maxUnfurlCache            = 500
+	maxContactCache           = 10000
+	streamHubShards           = 16
+	streamHubQueue            = 1024
+	tokenPrefetchMargin       = 5 * time.Minute
+	maxMediaBatchFiles        = 20
+	auditPeekBytes            = 64 * 1024
+	maxBodyBytes        int64 = 10 * 1024 * 1024
+)
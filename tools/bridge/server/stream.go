@@ -0,0 +1,346 @@
+package server
+
+import (
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/json"
+	"io"
+	"log/slog"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/Tennen/Paimon/tools/bridge/config"
+	"github.com/Tennen/Paimon/tools/bridge/hub"
+)
+
+// streamTicket remembers who issued a ticket so usage stays attributable.
+type streamTicket struct {
+	identity  string
+	expiresAt time.Time
+}
+
+// streamIdentity resolves the requester, looking through /stream tickets to
+// the token that issued them.
+func streamIdentity(r *http.Request, cfg config.Config, state *bridgeState) string {
+	if ticket := r.URL.Query().Get("ticket"); ticket != "" {
+		state.ticketsMu.Lock()
+		defer state.ticketsMu.Unlock()
+		if t, ok := state.tickets[ticket]; ok {
+			return t.identity
+		}
+	}
+	return requesterIdentity(r, cfg)
+}
+
+func handleStream(w http.ResponseWriter, r *http.Request, cfg config.Config, state *bridgeState) {
+	if r.Method != http.MethodGet {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	identity, schema, ok := authorizeStream(w, r, cfg, state)
+	if !ok {
+		return
+	}
+	serveStream(w, r, state, identity, parseLastEventID(r), schema, cfg.SigningSecret)
+}
+
+// authorizeStream checks a /stream or /poll request's bearer token or
+// ticket and resolves its ?schema=. It writes the error response itself.
+func authorizeStream(w http.ResponseWriter, r *http.Request, cfg config.Config, state *bridgeState) (string, *config.Schema, bool) {
+	identity := requesterIdentity(r, cfg)
+	if ticket := r.URL.Query().Get("ticket"); ticket != "" {
+		var ok bool
+		if identity, ok = state.redeemTicket(ticket); !ok {
+			w.WriteHeader(http.StatusUnauthorized)
+			_, _ = w.Write([]byte("invalid ticket"))
+			return "", nil, false
+		}
+	} else if !checkBridgeAuth(w, r, cfg, config.ScopeStreamRead) {
+		return "", nil, false
+	}
+	schema, ok := lookupSchema(cfg.Schemas, r.URL.Query().Get("schema"))
+	if !ok {
+		w.WriteHeader(http.StatusBadRequest)
+		_, _ = w.Write([]byte("unknown schema"))
+		return "", nil, false
+	}
+	return identity, schema, true
+}
+
+const (
+	defaultPollWait  = 30 * time.Second
+	maxPollWait      = 60 * time.Second
+	defaultPollLimit = 100
+	maxPollLimit     = 1000
+)
+
+// pollEvent is one event in a /poll response.
+type pollEvent struct {
+	ID   int64           `json:"id"`
+	Type string          `json:"type"`
+	Data json.RawMessage `json:"data"`
+}
+
+// handlePoll is the long-polling fallback for clients that cannot hold an
+// SSE connection. It returns the buffered events after ?since= at once, or
+// waits up to ?wait= for the next one. Without since it waits for events
+// newer than the latest. The same filters and schemas as /stream apply.
+func handlePoll(w http.ResponseWriter, r *http.Request, cfg config.Config, state *bridgeState) {
+	if r.Method != http.MethodGet {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	identity, schema, ok := authorizeStream(w, r, cfg, state)
+	if !ok {
+		return
+	}
+	q := r.URL.Query()
+	wait := defaultPollWait
+	if v := strings.TrimSpace(q.Get("wait")); v != "" {
+		d, err := time.ParseDuration(v)
+		if err != nil {
+			secs, serr := strconv.Atoi(v)
+			if serr != nil || secs < 0 {
+				w.WriteHeader(http.StatusBadRequest)
+				_, _ = w.Write([]byte("invalid wait"))
+				return
+			}
+			d = time.Duration(secs) * time.Second
+		}
+		wait = min(max(d, 0), maxPollWait)
+	}
+	limit := defaultPollLimit
+	if v := strings.TrimSpace(q.Get("limit")); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n <= 0 {
+			w.WriteHeader(http.StatusBadRequest)
+			_, _ = w.Write([]byte("invalid limit"))
+			return
+		}
+		limit = min(n, maxPollLimit)
+	}
+
+	client := newSSEClient(r, state.config(), identity, parseStreamFilter(r))
+	// Registering before reading the buffer means no event falls between
+	// the replay and the wait.
+	since := state.addClient(client)
+	defer state.removeClient(client)
+
+	if v := strings.TrimSpace(q.Get("since")); v != "" {
+		id, err := strconv.ParseInt(v, 10, 64)
+		if err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			_, _ = w.Write([]byte("invalid since"))
+			return
+		}
+		since = id
+	}
+
+	events := state.getMissed(since, client.filter)
+	if len(events) == 0 && wait > 0 {
+		timer := time.NewTimer(wait)
+		defer timer.Stop()
+	waitLoop:
+		for {
+			select {
+			case <-r.Context().Done():
+				return
+			case <-state.closing:
+				break waitLoop
+			case <-client.kick:
+				break waitLoop
+			case <-timer.C:
+				break waitLoop
+			case ev := <-client.ch:
+				if ev.ID > since {
+					events = append(events, ev)
+					break waitLoop
+				}
+			}
+		}
+		// Take whatever else arrived with it.
+	drain:
+		for len(events) > 0 && len(events) < limit {
+			select {
+			case ev := <-client.ch:
+				events = append(events, ev)
+			default:
+				break drain
+			}
+		}
+	}
+	if len(events) > limit {
+		events = events[:limit]
+	}
+
+	resp := struct {
+		Events      []pollEvent `json:"events"`
+		LastEventID int64       `json:"lastEventId"`
+	}{Events: make([]pollEvent, 0, len(events)), LastEventID: since}
+	for _, ev := range events {
+		ev = adaptPayload(schema, ev)
+		if cfg.SigningSecret != "" {
+			ev.Payload = withSignature(cfg.SigningSecret, ev.Payload, time.Now())
+		}
+		resp.Events = append(resp.Events, pollEvent{ID: ev.ID, Type: firstNonEmpty(ev.Type, "message"), Data: ev.Payload})
+		resp.LastEventID = ev.ID
+	}
+	client.lastEventID.Store(resp.LastEventID)
+	client.delivered.Add(int64(len(events)))
+
+	out := &countingWriter{w: w}
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-cache")
+	_ = json.NewEncoder(out).Encode(resp)
+	state.usage.record(identity, func(c *usageCounters) { c.StreamBytes += out.n })
+}
+
+// serveStream writes the SSE stream for an already authorized request:
+// buffered events after lastEventID first (none when it is 0, the whole
+// buffer when it is negative), then live events until the client
+// disconnects. Payloads are adapted to schema when it is not nil and signed
+// when signingSecret is set.
+func serveStream(w http.ResponseWriter, r *http.Request, state *bridgeState, identity string, lastEventID int64, schema *config.Schema, signingSecret string) {
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		w.WriteHeader(http.StatusInternalServerError)
+		_, _ = w.Write([]byte("stream unsupported"))
+		return
+	}
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("Connection", "keep-alive")
+	_, _ = w.Write([]byte("\n"))
+	flusher.Flush()
+
+	out := &countingWriter{w: w}
+	defer func() {
+		state.usage.record(identity, func(c *usageCounters) { c.StreamBytes += out.n })
+	}()
+
+	cfg := state.config()
+	client := newSSEClient(r, cfg, identity, parseStreamFilter(r))
+	send := func(ev sseEvent) bool {
+		ev = adaptPayload(schema, ev)
+		if signingSecret != "" {
+			ev.Payload = withSignature(signingSecret, ev.Payload, time.Now())
+		}
+		if err := hub.WriteSSE(out, ev); err != nil {
+			return false
+		}
+		flusher.Flush()
+		client.lastEventID.Store(ev.ID)
+		client.delivered.Add(1)
+		return true
+	}
+	if lastEventID != 0 {
+		missed := state.getMissed(lastEventID, client.filter)
+		for _, ev := range missed {
+			if !send(ev) {
+				return
+			}
+		}
+		slog.InfoContext(r.Context(), "wecom stream replay", "events", len(missed), "since_event_id", lastEventID)
+	}
+
+	state.addClient(client)
+	defer state.removeClient(client)
+
+	// Heartbeat comments keep idle-timeout proxies from closing the
+	// connection; clients ignore them.
+	var heartbeat <-chan time.Time
+	if cfg.StreamHeartbeat > 0 {
+		ticker := time.NewTicker(cfg.StreamHeartbeat)
+		defer ticker.Stop()
+		heartbeat = ticker.C
+	}
+	ctx := r.Context()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-state.closing:
+			// No id: reconnecting clients resume from their last event.
+			_, _ = io.WriteString(out, "event: shutdown\ndata: {\"reason\":\"server shutting down\"}\n\n")
+			flusher.Flush()
+			return
+		case <-client.kick:
+			if client.overflowed.Load() {
+				_ = writeDropped(out, client.unreported.Swap(0), client.lastEventID.Load(), true)
+				flusher.Flush()
+				slog.WarnContext(ctx, "stream client disconnected, queue full", "client_id", client.id, "last_event_id", client.lastEventID.Load())
+				return
+			}
+			slog.InfoContext(ctx, "stream client disconnected by admin", "client_id", client.id)
+			return
+		case <-client.notify:
+			if n := client.unreported.Swap(0); n > 0 {
+				if err := writeDropped(out, n, client.lastEventID.Load(), false); err != nil {
+					return
+				}
+				flusher.Flush()
+			}
+		case <-heartbeat:
+			if _, err := io.WriteString(out, ": heartbeat\n\n"); err != nil {
+				return
+			}
+			flusher.Flush()
+		case ev := <-client.ch:
+			if !send(ev) {
+				return
+			}
+		}
+	}
+}
+
+// handleStreamTicket exchanges the bearer token for a short-lived, single-use
+// ticket that browser EventSource clients pass as /stream?ticket=...
+func handleStreamTicket(w http.ResponseWriter, r *http.Request, cfg config.Config, state *bridgeState) {
+	if r.Method != http.MethodPost {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	if !checkBridgeAuth(w, r, cfg, config.ScopeStreamRead) {
+		return
+	}
+	ticket, expiresAt := state.issueTicket(requesterIdentity(r, cfg), cfg.TicketTTL)
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	_ = json.NewEncoder(w).Encode(map[string]any{
+		"ticket":    ticket,
+		"expiresAt": expiresAt.UTC().Format(time.RFC3339),
+	})
+}
+
+func (s *bridgeState) issueTicket(identity string, ttl time.Duration) (string, time.Time) {
+	buf := make([]byte, 24)
+	_, _ = rand.Read(buf)
+	ticket := base64.RawURLEncoding.EncodeToString(buf)
+	now := time.Now()
+	expiresAt := now.Add(ttl)
+
+	s.ticketsMu.Lock()
+	defer s.ticketsMu.Unlock()
+	for t, info := range s.tickets {
+		if now.After(info.expiresAt) {
+			delete(s.tickets, t)
+		}
+	}
+	s.tickets[ticket] = streamTicket{identity: identity, expiresAt: expiresAt}
+	return ticket, expiresAt
+}
+
+// redeemTicket consumes a ticket and returns the identity that issued it; it
+// succeeds at most once and only before the ticket expires.
+func (s *bridgeState) redeemTicket(ticket string) (string, bool) {
+	s.ticketsMu.Lock()
+	defer s.ticketsMu.Unlock()
+	info, ok := s.tickets[ticket]
+	if !ok {
+		return "", false
+	}
+	delete(s.tickets, ticket)
+	return info.identity, time.Now().Before(info.expiresAt)
+}
@@ -0,0 +1,249 @@
+package server
+
+import (
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/Tennen/Paimon/tools/bridge/config"
+	"github.com/Tennen/Paimon/tools/bridge/hub"
+	"github.com/Tennen/Paimon/tools/bridge/metrics"
+)
+
+// fanout is a bridge state with stream clients, each drained by a consumer
+// that checks the events arrive in order.
+type fanout struct {
+	state      *bridgeState
+	clients    []*sseClient
+	outOfOrder atomic.Int64
+	stop       chan struct{}
+}
+
+// newFanout registers n clients whose queues hold queue events each, on a
+// hub whose shards queue hubQueue events.
+func newFanout(n, queue, hubQueue int) *fanout {
+	f := &fanout{
+		state: &bridgeState{nextEventID: 1, bufferCap: config.DefaultBufferSize, metrics: metrics.New()},
+		stop:  make(chan struct{}),
+	}
+	f.state.clients = hub.New(streamHubShards, hubQueue)
+	f.clients = make([]*sseClient, n)
+	for i := range f.clients {
+		c := &sseClient{ch: make(chan sseEvent, queue), dropPolicy: "drop-oldest", notify: make(chan struct{}, 1), kick: make(chan struct{})}
+		f.clients[i] = c
+		f.state.addClient(c)
+		go func() {
+			for {
+				select {
+				case ev := <-c.ch:
+					if ev.ID <= c.lastEventID.Load() {
+						f.outOfOrder.Add(1)
+					}
+					c.lastEventID.Store(ev.ID)
+					c.delivered.Add(1)
+				case <-f.stop:
+					return
+				}
+			}
+		}()
+	}
+	return f
+}
+
+// wait blocks until every client has received or dropped each of the events
+// broadcast so far, and returns the totals.
+func (f *fanout) wait(timeout time.Duration) (delivered, dropped int64, ok bool) {
+	f.state.mu.Lock()
+	events := f.state.nextEventID - 1
+	f.state.mu.Unlock()
+	deadline := time.Now().Add(timeout)
+	for _, c := range f.clients {
+		for c.delivered.Load()+c.dropped.Load() < events {
+			if time.Now().After(deadline) {
+				return 0, 0, false
+			}
+			time.Sleep(time.Millisecond)
+		}
+		delivered += c.delivered.Load()
+		dropped += c.dropped.Load()
+	}
+	return delivered, dropped, true
+}
+
+func (f *fanout) close() {
+	f.state.clients.Close()
+	close(f.stop)
+}
+
+func TestStreamFanoutDeliversEveryEvent(t *testing.T) {
+	const clients, events = 1000, 2000
+	// Queues that hold every event leave nothing to drop.
+	f := newFanout(clients, events, events)
+	defer f.close()
+	for i := 0; i < events; i++ {
+		if _, err := f.state.broadcastEvent("message", map[string]any{"text": "x"}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	delivered, dropped, ok := f.wait(30 * time.Second)
+	if !ok || delivered != clients*events || dropped != 0 || f.outOfOrder.Load() != 0 {
+		t.Fatalf("delivered %d, dropped %d, out of order %d", delivered, dropped, f.outOfOrder.Load())
+	}
+	var metrics strings.Builder
+	f.state.metrics.WriteText(&metrics)
+	if strings.Contains(metrics.String(), "wecom_bridge_stream_dropped_total") || strings.Contains(metrics.String(), "wecom_bridge_stream_hub_overflow_total") {
+		t.Fatal(metrics.String())
+	}
+}
+
+func TestSSEClientMissed(t *testing.T) {
+	metrics := metrics.New()
+	c := &sseClient{ch: make(chan sseEvent, 1), dropPolicy: "drop-newest", notify: make(chan struct{}, 1), kick: make(chan struct{}), metrics: metrics}
+	c.Missed(3)
+	if c.dropped.Load() != 3 || c.unreported.Load() != 3 || len(c.notify) != 1 || c.overflowed.Load() {
+		t.Fatalf("dropped %d, unreported %d", c.dropped.Load(), c.unreported.Load())
+	}
+
+	d := &sseClient{ch: make(chan sseEvent, 1), dropPolicy: "disconnect", notify: make(chan struct{}, 1), kick: make(chan struct{}), metrics: metrics}
+	d.Missed(2)
+	d.Missed(5)
+	select {
+	case <-d.kick:
+	default:
+		t.Fatal("disconnect policy did not kick")
+	}
+	if d.dropped.Load() != 2 {
+		t.Fatalf("dropped %d after the kick", d.dropped.Load())
+	}
+	var out strings.Builder
+	metrics.WriteText(&out)
+	if !strings.Contains(out.String(), "wecom_bridge_stream_dropped_total 5") || !strings.Contains(out.String(), "wecom_bridge_stream_overflow_disconnects_total 1") {
+		t.Fatal(out.String())
+	}
+}
+
+// gatedStore is an event store whose appends wait for gate to close.
+type gatedStore struct {
+	gate chan struct{}
+
+	mu     sync.Mutex
+	events []sseEvent
+}
+
+func (st *gatedStore) Append(ev sseEvent) error {
+	<-st.gate
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	st.events = append(st.events, ev)
+	return nil
+}
+
+func (st *gatedStore) After(id int64, filter streamFilter) ([]sseEvent, error) {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	out := make([]sseEvent, 0)
+	for _, ev := range st.events {
+		if ev.ID > id && filter.Matches(ev) {
+			out = append(out, ev)
+		}
+	}
+	return out, nil
+}
+
+func (st *gatedStore) Tail(int) ([]sseEvent, error)            { return nil, nil }
+func (st *gatedStore) Before(int64, func(sseEvent) bool) error { return nil }
+func (st *gatedStore) Trim(time.Time) (int, error)             { return 0, nil }
+
+func TestEventStoreWriteOutsideLock(t *testing.T) {
+	state := &bridgeState{nextEventID: 1, bufferCap: 2, metrics: metrics.New()}
+	state.clients = hub.New(streamHubShards, streamHubQueue)
+	defer state.clients.Close()
+	store := &gatedStore{gate: make(chan struct{})}
+	if err := state.restoreEvents(store); err != nil {
+		t.Fatal(err)
+	}
+	// Broadcasts and buffer reads go on while the store cannot write.
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for range 5 {
+			state.broadcastEvent("message", map[string]any{"text": "x"})
+		}
+		state.getMissed(3, streamFilter{})
+	}()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("broadcast waited for the store")
+	}
+	// Replay from before the buffer waits for the queued writes.
+	close(store.gate)
+	var ids []int64
+	for _, ev := range state.getMissed(0, streamFilter{}) {
+		ids = append(ids, ev.ID)
+	}
+	if !slices.Equal(ids, []int64{1, 2, 3, 4, 5}) {
+		t.Fatalf("replayed %v", ids)
+	}
+	store.mu.Lock()
+	defer store.mu.Unlock()
+	for i, ev := range store.events {
+		if ev.ID != int64(i+1) {
+			t.Fatalf("stored %d at %d", ev.ID, i)
+		}
+	}
+}
+
+// BenchmarkStreamFanout broadcasts b.N events to every client, each with
+// the default queue of 16 and a consumer draining it, and reports how many
+// deliveries were dropped because consumers fell behind.
+func BenchmarkStreamFanout(b *testing.B) {
+	for _, clients := range []int{100, 1000, 5000} {
+		b.Run("clients="+strconv.Itoa(clients), func(b *testing.B) {
+			f := newFanout(clients, 16, streamHubQueue)
+			defer f.close()
+			payload := map[string]any{"msgType": "text", "fromUser": "bench", "text": strings.Repeat("x", 200)}
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				payload["messageId"] = strconv.Itoa(i)
+				if _, err := f.state.broadcastEvent("message", payload); err != nil {
+					b.Fatal(err)
+				}
+			}
+			delivered, dropped, ok := f.wait(time.Minute)
+			b.StopTimer()
+			if !ok {
+				b.Fatal("deliveries did not settle")
+			}
+			if n := f.outOfOrder.Load(); n > 0 {
+				b.Fatalf("%d events out of order", n)
+			}
+			b.ReportMetric(float64(delivered)/b.Elapsed().Seconds(), "deliveries/s")
+			b.ReportMetric(float64(dropped)/float64(int64(b.N)*int64(clients)), "dropped/delivery")
+		})
+	}
+}
+
+// BenchmarkStreamReplay replays a full buffer concurrently, as reconnecting
+// clients do.
+func BenchmarkStreamReplay(b *testing.B) {
+	state := &bridgeState{nextEventID: 1, bufferCap: config.DefaultBufferSize, metrics: metrics.New()}
+	state.clients = hub.New(streamHubShards, streamHubQueue)
+	defer state.clients.Close()
+	for i := 0; i < config.DefaultBufferSize; i++ {
+		state.broadcastEvent("message", map[string]any{"fromUser": "u" + strconv.Itoa(i%10), "msgType": "text"})
+	}
+	filter := streamFilter{FromUsers: []string{"u1"}}
+	var replayed atomic.Int64
+	b.ResetTimer()
+	b.RunParallel(func(pb *testing.PB) {
+		for pb.Next() {
+			replayed.Add(int64(len(state.getMissed(0, filter))))
+		}
+	})
+	b.ReportMetric(float64(replayed.Load())/b.Elapsed().Seconds(), "events/s")
+}
@@ -0,0 +1,69 @@
+package server
+
+import (
+	"crypto/tls"
+	"log/slog"
+	"os"
+	"sync"
+	"time"
+)
+
+// certReloader serves the configured certificate and picks up a renewed one
+// (e.g. written by certbot) within a minute, without a restart.
+type certReloader struct {
+	certFile string
+	keyFile  string
+
+	mu       sync.Mutex
+	cert     *tls.Certificate
+	modTime  time.Time
+	checked  time.Time
+	notAfter time.Time
+}
+
+// tlsConfig returns the server TLS settings.
+func (c *certReloader) tlsConfig() *tls.Config {
+	return &tls.Config{MinVersion: tls.VersionTLS12, GetCertificate: c.getCertificate}
+}
+
+func (c *certReloader) getCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	now := time.Now()
+	if c.cert != nil && now.Sub(c.checked) < time.Minute {
+		return c.cert, nil
+	}
+	c.checked = now
+	var modTime time.Time
+	for _, path := range []string{c.certFile, c.keyFile} {
+		if info, err := os.Stat(path); err == nil && info.ModTime().After(modTime) {
+			modTime = info.ModTime()
+		}
+	}
+	if c.cert != nil && !modTime.After(c.modTime) {
+		return c.cert, nil
+	}
+	cert, err := tls.LoadX509KeyPair(c.certFile, c.keyFile)
+	if err != nil {
+		if c.cert != nil {
+			// Mid-renewal the pair may not match yet; keep serving the old one.
+			slog.Error("tls reload failed, keeping current certificate", "err", err)
+			return c.cert, nil
+		}
+		return nil, err
+	}
+	c.cert, c.modTime = &cert, modTime
+	if cert.Leaf != nil {
+		c.notAfter = cert.Leaf.NotAfter
+	}
+	slog.Info("tls certificate loaded", "file", c.certFile, "expires", c.notAfter.Format(time.RFC3339))
+	return c.cert, nil
+}
+
+// expiry returns when the served certificate expires. It is zero until a
+// certificate was loaded.
+func (c *certReloader) expiry() time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.notAfter
+}
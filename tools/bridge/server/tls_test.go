@@ -0,0 +1,47 @@
+package server
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"encoding/pem"
+	"math/big"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestCertReloaderPicksUpRenewedFiles(t *testing.T) {
+	dir := t.TempDir()
+	c := &certReloader{certFile: filepath.Join(dir, "tls.crt"), keyFile: filepath.Join(dir, "tls.key")}
+	write := func(notAfter time.Time) {
+		key, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+		template := &x509.Certificate{SerialNumber: big.NewInt(1), DNSNames: []string{"localhost"}, NotBefore: time.Now().Add(-time.Hour), NotAfter: notAfter}
+		der, _ := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+		keyDER, _ := x509.MarshalECPrivateKey(key)
+		_ = os.WriteFile(c.certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0o600)
+		_ = os.WriteFile(c.keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}), 0o600)
+	}
+	first := time.Now().Add(24 * time.Hour).Truncate(time.Second)
+	write(first)
+	if _, err := c.getCertificate(nil); err != nil {
+		t.Fatal(err)
+	}
+	if !c.expiry().Equal(first) {
+		t.Fatal(c.expiry())
+	}
+	second := first.Add(24 * time.Hour)
+	write(second)
+	future := time.Now().Add(time.Minute)
+	_ = os.Chtimes(c.certFile, future, future)
+	_ = os.Chtimes(c.keyFile, future, future)
+	c.checked = time.Time{}
+	if _, err := c.getCertificate(nil); err != nil {
+		t.Fatal(err)
+	}
+	if !c.expiry().Equal(second) {
+		t.Fatalf("expiry %v, want %v", c.expiry(), second)
+	}
+}
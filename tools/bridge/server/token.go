@@ -0,0 +1,144 @@
+package server
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/url"
+	"sync"
+	"time"
+)
+
+// tokenManager caches the app access token obtained with the configured
+// corp credentials.
+type tokenManager struct {
+	mu        sync.Mutex
+	corpID    string
+	secret    string
+	timeout   time.Duration
+	token     string
+	expiresAt time.Time
+}
+
+// snapshot returns the cached token and its refresh deadline.
+func (m *tokenManager) snapshot() (string, time.Time) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.token, m.expiresAt
+}
+
+// seed adopts a token fetched elsewhere (by the primary) when it outlives
+// the cached one, so a promoted standby does not start with a gettoken call.
+func (m *tokenManager) seed(token string, expiresAt time.Time) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if token != "" && expiresAt.After(m.expiresAt) {
+		m.token = token
+		m.expiresAt = expiresAt
+	}
+}
+
+// get returns a cached access token, fetching a new one when it is missing or
+// about to expire.
+func (m *tokenManager) get() (string, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.token != "" && time.Now().Before(m.expiresAt) {
+		return m.token, nil
+	}
+	return m.fetchLocked()
+}
+
+// invalidate drops token if it is still the cached one, so the next get
+// fetches a new token.
+func (m *tokenManager) invalidate(token string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.token == token {
+		m.token = ""
+		m.expiresAt = time.Time{}
+	}
+}
+
+// keepFresh refreshes the token tokenPrefetchMargin before it expires, so
+// proxy calls never wait for gettoken. Failures are retried every 30s.
+func (m *tokenManager) keepFresh() {
+	for {
+		m.mu.Lock()
+		wait := time.Until(m.expiresAt) - tokenPrefetchMargin
+		if wait <= 0 {
+			if _, err := m.fetchLocked(); err != nil {
+				slog.Warn("wecom token refresh failed", "err", err)
+				wait = 30 * time.Second
+			} else {
+				wait = time.Until(m.expiresAt) - tokenPrefetchMargin
+			}
+		}
+		m.mu.Unlock()
+		time.Sleep(max(wait, time.Second))
+	}
+}
+
+// fetchLocked calls gettoken and caches the result. The caller holds m.mu.
+func (m *tokenManager) fetchLocked() (string, error) {
+	if m.corpID == "" || m.secret == "" {
+		return "", errors.New("missing WECOM_CORP_ID/WECOM_CORP_SECRET")
+	}
+
+	qs := url.Values{}
+	qs.Set("corpid", m.corpID)
+	qs.Set("corpsecret", m.secret)
+	client := qyapiClient(m.timeout)
+	resp, err := client.Get(fmt.Sprintf("https://qyapi.weixin.qq.com/cgi-bin/gettoken?%s", qs.Encode()))
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	var result struct {
+		ErrCode     int    `json:"errcode"`
+		ErrMsg      string `json:"errmsg"`
+		AccessToken string `json:"access_token"`
+		ExpiresIn   int    `json:"expires_in"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&result); err != nil {
+		return "", fmt.Errorf("gettoken decode: %w", err)
+	}
+	if result.ErrCode != 0 || result.AccessToken == "" {
+		return "", fmt.Errorf("gettoken errcode %d %s", result.ErrCode, result.ErrMsg)
+	}
+	m.token = result.AccessToken
+	// Refresh a minute early so callers never hand out an expiring token.
+	m.expiresAt = time.Now().Add(time.Duration(result.ExpiresIn)*time.Second - time.Minute)
+	return m.token, nil
+}
+
+// tokenFor returns the token manager for agentID's app, falling back to the
+// WECOM_CORP_SECRET app.
+func (s *bridgeState) tokenFor(agentID string) *tokenManager {
+	if m, ok := s.agentTokens[agentID]; ok {
+		return m
+	}
+	return s.tokens
+}
+
+// managedToken returns the bridge's token for agentID's app, or "" when the
+// bridge has no credentials for it or gettoken fails.
+func (s *bridgeState) managedToken(agentID string) string {
+	m := s.tokenFor(agentID)
+	token, err := m.get()
+	if err != nil && m.secret != "" {
+		slog.Warn("wecom token failed", "agent_id", agentID, "err", err)
+	}
+	return token
+}
+
+// tokenManagers returns every configured token manager keyed by agent ID,
+// with the WECOM_CORP_SECRET app under "default".
+func (s *bridgeState) tokenManagers() map[string]*tokenManager {
+	out := map[string]*tokenManager{"default": s.tokens}
+	for agentID, m := range s.agentTokens {
+		out[agentID] = m
+	}
+	return out
+}
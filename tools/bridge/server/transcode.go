@@ -0,0 +1,157 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"os/exec"
+	"path/filepath"
+	"strings"
+
+	"github.com/Tennen/Paimon/tools/bridge/config"
+	"github.com/Tennen/Paimon/tools/bridge/mediacache"
+	"github.com/Tennen/Paimon/tools/bridge/proxy"
+)
+
+// transcodeFormats maps the supported format values to their content type.
+var transcodeFormats = map[string]string{
+	"mp3": "audio/mpeg",
+	"wav": "audio/wav",
+}
+
+// transcodedMedia returns voice media mediaID converted to format. Results
+// are cached under "<media_id>.<format>" next to the original download, so
+// ffmpeg runs once per file and format. On failure the response is written
+// and ok is false.
+func transcodedMedia(w http.ResponseWriter, r *http.Request, cfg config.Config, state *bridgeState, accessToken, mediaID, format string, timeoutMS int) (mediacache.Media, []byte, bool) {
+	format = strings.ToLower(strings.TrimSpace(format))
+	contentType, supported := transcodeFormats[format]
+	if !supported {
+		w.WriteHeader(http.StatusBadRequest)
+		_, _ = w.Write([]byte("format must be mp3 or wav"))
+		return mediacache.Media{}, nil, false
+	}
+	if cfg.FFmpegPath == "" {
+		w.WriteHeader(http.StatusNotImplemented)
+		_, _ = w.Write([]byte("transcoding disabled (BRIDGE_FFMPEG_PATH)"))
+		return mediacache.Media{}, nil, false
+	}
+	if meta, data, ok := state.media.Get(mediaID + "." + format); ok {
+		state.metrics.Inc("wecom_bridge_media_transcode_total", "format", format, "result", "cached")
+		return meta, data, true
+	}
+
+	meta, data, ok := state.media.Get(mediaID)
+	if !ok {
+		if accessToken == "" {
+			accessToken = state.managedToken("")
+		}
+		if accessToken == "" {
+			w.WriteHeader(http.StatusBadRequest)
+			_, _ = w.Write([]byte("missing access_token"))
+			return mediacache.Media{}, nil, false
+		}
+		query := url.Values{}
+		query.Set("access_token", accessToken)
+		query.Set("media_id", mediaID)
+		resp, err := proxy.Do(r.Context(), qyapiClient(proxyTimeout(r, cfg, "media_get", timeoutMS)), "https://qyapi.weixin.qq.com/cgi-bin/media/get?"+query.Encode(), nil)
+		if err != nil {
+			w.WriteHeader(http.StatusBadGateway)
+			_, _ = w.Write([]byte("media get failed"))
+			return mediacache.Media{}, nil, false
+		}
+		defer resp.Body.Close()
+		if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+			w.WriteHeader(http.StatusBadGateway)
+			_, _ = w.Write([]byte(fmt.Sprintf("media get http %d", resp.StatusCode)))
+			return mediacache.Media{}, nil, false
+		}
+		if data, err = io.ReadAll(resp.Body); err != nil {
+			w.WriteHeader(http.StatusBadGateway)
+			_, _ = w.Write([]byte("media get read failed"))
+			return mediacache.Media{}, nil, false
+		}
+		contentType := strings.TrimSpace(resp.Header.Get("Content-Type"))
+		if strings.Contains(strings.ToLower(contentType), "application/json") {
+			writeWeComError(w, http.StatusBadGateway, data, "media get")
+			return mediacache.Media{}, nil, false
+		}
+		filename := firstNonEmpty(parseFilenameFromDisposition(resp.Header.Get("Content-Disposition")), mediaID+".dat")
+		meta = mediacache.Media{MediaID: mediaID, Filename: filename, ContentType: firstNonEmpty(contentType, "application/octet-stream")}
+		if state.media != nil {
+			state.metrics.Inc("wecom_bridge_media_cache_total", "result", "miss")
+			if err := state.media.Put(meta, data); err != nil {
+				slog.WarnContext(r.Context(), "media cache write failed", "err", err)
+			}
+		}
+	}
+	if !isVoiceMedia(meta) {
+		w.WriteHeader(http.StatusUnsupportedMediaType)
+		_, _ = w.Write([]byte("only voice media can be transcoded, got " + meta.ContentType))
+		return mediacache.Media{}, nil, false
+	}
+
+	ctx, cancel := context.WithTimeout(r.Context(), cfg.TranscodeTimeout)
+	defer cancel()
+	out, err := transcodeAudio(ctx, cfg.FFmpegPath, data, format)
+	if err != nil {
+		state.metrics.Inc("wecom_bridge_media_transcode_total", "format", format, "result", "error")
+		slog.WarnContext(r.Context(), "media transcode failed", "media_id", mediaID, "format", format, "err", err)
+		w.WriteHeader(http.StatusUnprocessableEntity)
+		_, _ = w.Write([]byte("transcode failed: " + err.Error()))
+		return mediacache.Media{}, nil, false
+	}
+	state.metrics.Inc("wecom_bridge_media_transcode_total", "format", format, "result", "ok")
+	converted := mediacache.Media{
+		MediaID:     mediaID + "." + format,
+		Filename:    strings.TrimSuffix(meta.Filename, filepath.Ext(meta.Filename)) + "." + format,
+		ContentType: contentType,
+	}
+	if state.media != nil {
+		if err := state.media.Put(converted, out); err != nil {
+			slog.WarnContext(r.Context(), "media cache write failed", "err", err)
+		}
+		state.trimMediaCache()
+	}
+	return converted, out, true
+}
+
+// isVoiceMedia reports whether a download is a voice clip: WeCom serves voice
+// messages as AMR (audio/amr) and JS-SDK recordings as speex.
+func isVoiceMedia(meta mediacache.Media) bool {
+	contentType := strings.ToLower(meta.ContentType)
+	if strings.HasPrefix(contentType, "audio/") || strings.HasPrefix(contentType, "voice/") {
+		return true
+	}
+	switch strings.ToLower(filepath.Ext(meta.Filename)) {
+	case ".amr", ".speex", ".spx", ".silk":
+		return true
+	}
+	return false
+}
+
+// transcodeAudio pipes data through ffmpeg, producing mono audio in format.
+// ffmpeg picks the decoder from the input, so speex needs a build with
+// libspeex.
+func transcodeAudio(ctx context.Context, ffmpeg string, data []byte, format string) ([]byte, error) {
+	cmd := exec.CommandContext(ctx, ffmpeg, "-hide_banner", "-loglevel", "error", "-i", "pipe:0", "-vn", "-ac", "1", "-f", format, "pipe:1")
+	cmd.Stdin = bytes.NewReader(data)
+	var stdout, stderr bytes.Buffer
+	cmd.Stdout = &stdout
+	cmd.Stderr = &stderr
+	if err := cmd.Run(); err != nil {
+		if ctx.Err() != nil {
+			return nil, fmt.Errorf("ffmpeg: %w", ctx.Err())
+		}
+		return nil, fmt.Errorf("ffmpeg: %v: %s", err, truncateRunes(strings.TrimSpace(stderr.String()), archiveTextLimit))
+	}
+	if stdout.Len() == 0 {
+		return nil, errors.New("ffmpeg produced no output")
+	}
+	return stdout.Bytes(), nil
+}
@@ -0,0 +1,225 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"crypto/x509"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/Tennen/Paimon/tools/bridge/config"
+	"github.com/Tennen/Paimon/tools/bridge/metrics"
+	"github.com/Tennen/Paimon/tools/bridge/proxy"
+)
+
+// tokenRetryInterceptor retries a qyapi call once with a new token when
+// WeCom rejects a bridge-managed token as invalid or expired (errcode
+// 40014/42001), e.g. after it was refreshed elsewhere. Tokens supplied by
+// callers are passed through untouched.
+func tokenRetryInterceptor(state *bridgeState) qyapiInterceptor {
+	return func(req *http.Request, next http.RoundTripper) (*http.Response, error) {
+		// gettoken carries no access_token; it runs while its manager is
+		// locked, so it must not be looked up.
+		token := req.URL.Query().Get("access_token")
+		var owner *tokenManager
+		if token != "" {
+			for _, m := range state.tokenManagers() {
+				if current, _ := m.snapshot(); current == token {
+					owner = m
+					break
+				}
+			}
+		}
+		resp, err := next.RoundTrip(req)
+		if owner == nil || err != nil || !strings.Contains(resp.Header.Get("Content-Type"), "json") {
+			return resp, err
+		}
+		if req.Body != nil && req.Body != http.NoBody && req.GetBody == nil {
+			return resp, err
+		}
+		data, readErr := io.ReadAll(io.LimitReader(resp.Body, 1<<20))
+		resp.Body.Close()
+		resp.Body = io.NopCloser(bytes.NewReader(data))
+		if readErr != nil {
+			return resp, nil
+		}
+		var result struct {
+			ErrCode int `json:"errcode"`
+		}
+		if json.Unmarshal(data, &result) != nil || (result.ErrCode != 40014 && result.ErrCode != 42001) {
+			return resp, nil
+		}
+		owner.invalidate(token)
+		fresh, tokenErr := owner.get()
+		if tokenErr != nil {
+			return resp, nil
+		}
+		retry := req.Clone(req.Context())
+		query := retry.URL.Query()
+		query.Set("access_token", fresh)
+		retry.URL.RawQuery = query.Encode()
+		if req.GetBody != nil {
+			if retry.Body, err = req.GetBody(); err != nil {
+				return resp, nil
+			}
+		}
+		state.metrics.Inc("wecom_bridge_token_retries_total", "errcode", strconv.Itoa(result.ErrCode))
+		return next.RoundTrip(retry)
+	}
+}
+
+// qyapiInterceptor wraps one outgoing qyapi request (see proxy.Interceptor).
+type qyapiInterceptor = proxy.Interceptor
+
+// qyapiInterceptors run, outermost first, around every outgoing qyapi
+// request. A file built together with this one can append to it from an
+// init function; interceptors from BRIDGE_CONFIG_FILE are appended in main.
+var qyapiInterceptors []qyapiInterceptor
+
+// outboundTransport carries every outgoing HTTP request so that proxy
+// settings, trusted CAs and pooled connections are shared. main replaces it
+// with one built from the config.
+var outboundTransport http.RoundTripper = http.DefaultTransport
+
+// newOutboundTransport builds the shared transport from the BRIDGE_HTTP_*
+// settings.
+func newOutboundTransport(cfg config.Config) (*http.Transport, error) {
+	opts := proxy.TransportOptions{
+		Proxy:           http.ProxyFromEnvironment,
+		DialTimeout:     cfg.HTTPDialTimeout,
+		MaxIdleConns:    cfg.HTTPMaxIdleConns,
+		MaxConnsPerHost: cfg.HTTPMaxConnsPerHost,
+		IdleTimeout:     cfg.HTTPIdleTimeout,
+	}
+	switch cfg.HTTPProxy {
+	case "":
+	case "off":
+		opts.Proxy = nil
+	default:
+		proxyURL, err := url.Parse(cfg.HTTPProxy)
+		if err != nil {
+			return nil, fmt.Errorf("BRIDGE_HTTP_PROXY: %v", err)
+		}
+		opts.Proxy = http.ProxyURL(proxyURL)
+	}
+	if cfg.HTTPCAFile != "" {
+		pem, err := os.ReadFile(cfg.HTTPCAFile)
+		if err != nil {
+			return nil, fmt.Errorf("BRIDGE_HTTP_CA_FILE: %v", err)
+		}
+		roots, err := x509.SystemCertPool()
+		if err != nil {
+			roots = x509.NewCertPool()
+		}
+		if !roots.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("BRIDGE_HTTP_CA_FILE: no certificates in %s", cfg.HTTPCAFile)
+		}
+		opts.RootCAs = roots
+	}
+	return proxy.NewTransport(opts), nil
+}
+
+// outboundClient returns a client on the shared transport for calls that
+// do not go to qyapi.
+func outboundClient(timeout time.Duration) *http.Client {
+	return &http.Client{Timeout: timeout, Transport: outboundTransport}
+}
+
+// qyapiClient returns an HTTP client for qyapi calls that runs the
+// interceptor chain.
+func qyapiClient(timeout time.Duration) *http.Client {
+	return &http.Client{Timeout: timeout, Transport: proxy.Chain(outboundTransport, qyapiInterceptors...)}
+}
+
+// configInterceptors builds the always-on upstream metrics, keyed by the
+// original qyapi path, followed by the interceptors the qyapi config selects.
+func configInterceptors(qc *config.QyAPI, metrics *metrics.Registry) []qyapiInterceptor {
+	chain := make([]qyapiInterceptor, 0, 4)
+	chain = append(chain, func(req *http.Request, next http.RoundTripper) (*http.Response, error) {
+		start := time.Now()
+		resp, err := next.RoundTrip(req)
+		status := "error"
+		if err == nil {
+			status = strconv.Itoa(resp.StatusCode)
+		}
+		metrics.Inc("wecom_bridge_upstream_requests_total", "path", req.URL.Path, "status", status)
+		metrics.Add("wecom_bridge_upstream_request_ms_total", time.Since(start).Milliseconds(), "path", req.URL.Path)
+		return resp, err
+	})
+	if qc != nil && qc.Base != nil {
+		chain = append(chain, func(req *http.Request, next http.RoundTripper) (*http.Response, error) {
+			req = req.Clone(req.Context())
+			req.URL.Scheme = qc.Base.Scheme
+			req.URL.Host = qc.Base.Host
+			req.URL.Path = qc.Base.Path + req.URL.Path
+			req.Host = qc.Base.Host
+			return next.RoundTrip(req)
+		})
+	}
+	if qc != nil && len(qc.Headers) > 0 {
+		chain = append(chain, func(req *http.Request, next http.RoundTripper) (*http.Response, error) {
+			req = req.Clone(req.Context())
+			for name, value := range qc.Headers {
+				req.Header.Set(name, os.ExpandEnv(value))
+			}
+			return next.RoundTrip(req)
+		})
+	}
+	if qc != nil && qc.Debug {
+		chain = append(chain, debugInterceptor)
+	}
+	return chain
+}
+
+// debugInterceptor logs each qyapi request with credentials redacted and the
+// start of a JSON or text response (the size for anything else).
+func debugInterceptor(req *http.Request, next http.RoundTripper) (*http.Response, error) {
+	target := *req.URL
+	query := target.Query()
+	for _, key := range []string{"access_token", "corpsecret", "key"} {
+		if query.Has(key) {
+			query.Set(key, "REDACTED")
+		}
+	}
+	target.RawQuery = query.Encode()
+	resp, err := next.RoundTrip(req)
+	if err != nil {
+		slog.InfoContext(req.Context(), "qyapi request failed", "method", req.Method, "url", target.String(), "err", err)
+		return resp, err
+	}
+	body, readErr := io.ReadAll(resp.Body)
+	_ = resp.Body.Close()
+	resp.Body = io.NopCloser(bytes.NewReader(body))
+	if readErr != nil {
+		return resp, readErr
+	}
+	preview := fmt.Sprintf("<%d bytes %s>", len(body), resp.Header.Get("Content-Type"))
+	if ct := resp.Header.Get("Content-Type"); strings.Contains(ct, "json") || strings.HasPrefix(ct, "text/") {
+		preview = truncateRunes(string(body), 512)
+	}
+	slog.InfoContext(req.Context(), "qyapi request", "method", req.Method, "url", target.String(), "status", resp.StatusCode, "body", preview)
+	return resp, nil
+}
+
+// postWeComJSON posts a JSON body to a qyapi endpoint and returns the response
+// body, treating a non-zero errcode as an error.
+func postWeComJSON(ctx context.Context, endpoint string, body []byte, timeout time.Duration) ([]byte, error) {
+	return proxy.Call(ctx, qyapiClient(timeout), endpoint, body)
+}
+
+func randomNonce() string {
+	buf := make([]byte, 8)
+	if _, err := rand.Read(buf); err != nil {
+		return strconv.FormatInt(time.Now().UnixNano(), 10)
+	}
+	return fmt.Sprintf("%x", buf)
+}
@@ -0,0 +1,204 @@
+package server
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"maps"
+	"os"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/Tennen/Paimon/tools/bridge/atomicfile"
+	"github.com/Tennen/Paimon/tools/bridge/config"
+)
+
+// runtimeTunables are the settings that can be changed through /admin/config
+// without restarting the bridge.
+type runtimeTunables struct {
+	BufferSize      int    `json:"bufferSize"`
+	SendQuotaHourly int    `json:"sendQuotaHourly"`
+	SendQuotaDaily  int    `json:"sendQuotaDaily"`
+	AutoAckText     string `json:"autoAckText"`
+	// Stream settings apply to streams opened afterwards; the heartbeat
+	// is a Go duration, "0s" disables it.
+	StreamHeartbeat    string `json:"streamHeartbeat"`
+	StreamClientBuffer int    `json:"streamClientBuffer"`
+	StreamDropPolicy   string `json:"streamDropPolicy"`
+	// RateLimits maps an endpoint class to a BRIDGE_RATE_LIMITS value
+	// ("N/s|m|h[:burst]"); an empty value removes the class's limit.
+	RateLimits map[string]string `json:"rateLimits"`
+	LogLevel   string            `json:"logLevel"`
+}
+
+func (s *bridgeState) config() config.Config {
+	s.cfgMu.RLock()
+	defer s.cfgMu.RUnlock()
+	return s.cfg
+}
+
+// reloadConfigFile re-reads the config file. Rules, routes, schemas, the
+// welcome flow and agent callback credentials apply to the next request;
+// the remaining sections and new managed tokens need a restart.
+func (s *bridgeState) reloadConfigFile(path string) error {
+	fileCfg, err := config.LoadFile(path)
+	if err != nil {
+		return err
+	}
+	s.cfgMu.Lock()
+	defer s.cfgMu.Unlock()
+	cfg := s.cfg
+	restart := !sameJSON(cfg.QyAPI, fileCfg.QyAPI) || !sameJSON(cfg.Upstreams, fileCfg.Upstreams) || !sameJSON(cfg.Retention, fileCfg.Retention) || !sameJSON(cfg.Channels, fileCfg.Channels)
+	for _, agent := range fileCfg.Agents {
+		if m, ok := s.agentTokens[agent.AgentID]; agent.CorpSecret != "" && (!ok || m.secret != agent.CorpSecret) {
+			restart = true
+		}
+	}
+	if restart {
+		slog.Warn("config reload: qyapi, upstreams, retention, channels and agent secrets take effect after a restart")
+	}
+	cfg.Rules = fileCfg.Rules
+	cfg.Routes = fileCfg.Routes
+	cfg.Schemas = fileCfg.Schemas
+	cfg.Welcome = fileCfg.Welcome
+	cfg.Agents = fileCfg.Agents
+	cfg.Tokens = fileCfg.Tokens
+	cfg.APIRoutes = fileCfg.API
+	s.cfg = cfg
+	setLogSecrets(cfg)
+	return nil
+}
+
+func sameJSON(a, b any) bool {
+	x, errX := json.Marshal(a)
+	y, errY := json.Marshal(b)
+	return errX == nil && errY == nil && bytes.Equal(x, y)
+}
+
+// tunablesFromConfig returns the tunables as the environment set them.
+func tunablesFromConfig(cfg config.Config) runtimeTunables {
+	t := runtimeTunables{
+		BufferSize:         cfg.MessageBufferCap,
+		SendQuotaHourly:    cfg.SendQuotaHourly,
+		SendQuotaDaily:     cfg.SendQuotaDaily,
+		AutoAckText:        cfg.AutoAckText,
+		StreamHeartbeat:    cfg.StreamHeartbeat.String(),
+		StreamClientBuffer: cfg.StreamClientBuffer,
+		StreamDropPolicy:   cfg.StreamDropPolicy,
+		RateLimits:         make(map[string]string),
+		LogLevel:           strings.ToLower(cfg.LogLevel.String()),
+	}
+	for class, limit := range cfg.RateLimits {
+		t.RateLimits[class] = limit.String()
+	}
+	return t
+}
+
+// currentTunables returns a copy of the tunables that callers may modify.
+func (s *bridgeState) currentTunables() runtimeTunables {
+	s.tunablesMu.RLock()
+	defer s.tunablesMu.RUnlock()
+	t := s.tunables
+	t.RateLimits = maps.Clone(t.RateLimits)
+	return t
+}
+
+// applyTunables validates and activates a new set of tunables. The stream,
+// rate limit and log settings are written through to the live config.
+func (s *bridgeState) applyTunables(t runtimeTunables) error {
+	if t.BufferSize <= 0 {
+		return errors.New("bufferSize must be positive")
+	}
+	if t.SendQuotaHourly < 0 || t.SendQuotaDaily < 0 {
+		return errors.New("send quotas must not be negative")
+	}
+	t.AutoAckText = strings.TrimSpace(t.AutoAckText)
+	heartbeat, err := time.ParseDuration(strings.TrimSpace(t.StreamHeartbeat))
+	if err != nil || heartbeat < 0 {
+		return fmt.Errorf("invalid streamHeartbeat %q", t.StreamHeartbeat)
+	}
+	t.StreamHeartbeat = heartbeat.String()
+	if t.StreamClientBuffer < 1 {
+		return errors.New("streamClientBuffer must be positive")
+	}
+	t.StreamDropPolicy = strings.ToLower(strings.TrimSpace(t.StreamDropPolicy))
+	if !slices.Contains([]string{"drop-newest", "drop-oldest", "disconnect"}, t.StreamDropPolicy) {
+		return fmt.Errorf("invalid streamDropPolicy %q (drop-newest, drop-oldest or disconnect)", t.StreamDropPolicy)
+	}
+	limits := make(map[string]config.RateLimit)
+	for class, value := range t.RateLimits {
+		if strings.TrimSpace(value) == "" {
+			delete(t.RateLimits, class)
+			continue
+		}
+		limit, err := config.ParseRateLimit(value)
+		if !slices.Contains(config.RateClasses, class) || err != nil {
+			return fmt.Errorf("invalid rateLimits entry %s=%q (classes %s, values N/s|m|h[:burst])", class, value, strings.Join(config.RateClasses, ", "))
+		}
+		limits[class] = limit
+		t.RateLimits[class] = limit.String()
+	}
+	var level slog.Level
+	if err := level.UnmarshalText([]byte(strings.TrimSpace(t.LogLevel))); err != nil {
+		return fmt.Errorf("invalid logLevel %q (debug, info, warn or error)", t.LogLevel)
+	}
+	t.LogLevel = strings.ToLower(level.String())
+
+	s.tunablesMu.Lock()
+	s.tunables = t
+	s.tunablesMu.Unlock()
+
+	s.cfgMu.Lock()
+	s.cfg.StreamHeartbeat = heartbeat
+	s.cfg.StreamClientBuffer = t.StreamClientBuffer
+	s.cfg.StreamDropPolicy = t.StreamDropPolicy
+	s.cfg.RateLimits = limits
+	s.cfg.LogLevel = level
+	s.cfgMu.Unlock()
+	logLevel.Set(level)
+
+	s.mu.Lock()
+	s.bufferCap = t.BufferSize
+	if len(s.buffer) > s.bufferCap {
+		s.buffer = s.buffer[len(s.buffer)-s.bufferCap:]
+	}
+	s.mu.Unlock()
+	s.quotas.setLimits(t.SendQuotaHourly, t.SendQuotaDaily)
+	return nil
+}
+
+// loadTunables applies previously persisted tunables on top of the
+// environment configuration. A missing file is not an error.
+func (s *bridgeState) loadTunables(path string) error {
+	if path == "" {
+		return nil
+	}
+	data, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	s.tunablesUpdateMu.Lock()
+	defer s.tunablesUpdateMu.Unlock()
+	next := s.currentTunables()
+	if err := json.Unmarshal(data, &next); err != nil {
+		return fmt.Errorf("parse %s: %w", path, err)
+	}
+	return s.applyTunables(next)
+}
+
+func (s *bridgeState) saveTunables(path string) error {
+	if path == "" {
+		return errors.New("BRIDGE_TUNABLES_FILE or BRIDGE_DATA_DIR not set")
+	}
+	data, err := json.MarshalIndent(s.currentTunables(), "", "  ")
+	if err != nil {
+		return err
+	}
+	return atomicfile.Write(path, data)
+}
@@ -0,0 +1,352 @@
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+
+	"github.com/Tennen/Paimon/tools/bridge/config"
+)
+
+// WeCom's documented limits for message/send. Byte limits are enforced
+// exactly; template_card limits are in characters.
+const (
+	maxTextBytes         = 2048
+	maxTextParts         = 10
+	maxCardTitleBytes    = 128
+	maxCardDescBytes     = 512
+	maxCardURLBytes      = 2048
+	maxCardButtonRunes   = 4
+	maxNewsArticles      = 8
+	maxTemplateTitle     = 36
+	maxTemplateDesc      = 44
+	maxTemplateSubTitle  = 160
+	maxTemplateTaskBytes = 128
+)
+
+type typedArticle struct {
+	Title       string `json:"title"`
+	Description string `json:"description,omitempty"`
+	URL         string `json:"url,omitempty"`
+	PicURL      string `json:"picurl,omitempty"`
+	AppID       string `json:"appid,omitempty"`
+	PagePath    string `json:"pagepath,omitempty"`
+}
+
+type typedTextCard struct {
+	Title       string `json:"title"`
+	Description string `json:"description"`
+	URL         string `json:"url"`
+	ButtonText  string `json:"btntxt,omitempty"`
+}
+
+// typedSend is the request schema of /proxy/send/typed: the recipients and
+// exactly the message object named by msgtype.
+type typedSend struct {
+	AccessToken            string `json:"access_token"`
+	TimeoutMS              int    `json:"timeout_ms"`
+	ToUser                 string `json:"touser"`
+	ToParty                string `json:"toparty"`
+	ToTag                  string `json:"totag"`
+	AgentID                any    `json:"agentid"`
+	Safe                   int    `json:"safe"`
+	EnableDuplicateCheck   int    `json:"enable_duplicate_check"`
+	DuplicateCheckInterval int    `json:"duplicate_check_interval"`
+	typedContent
+}
+
+// typedContent is msgtype and its message object, shared by message/send
+// and appchat/send.
+type typedContent struct {
+	MsgType string `json:"msgtype"`
+	Text    *struct {
+		Content string `json:"content"`
+	} `json:"text"`
+	Markdown *struct {
+		Content string `json:"content"`
+	} `json:"markdown"`
+	TextCard *typedTextCard `json:"textcard"`
+	News     *struct {
+		Articles []typedArticle `json:"articles"`
+	} `json:"news"`
+	TemplateCard json.RawMessage `json:"template_card"`
+	Image        *typedMedia     `json:"image"`
+	Voice        *typedMedia     `json:"voice"`
+	File         *typedMedia     `json:"file"`
+	Video        *typedMedia     `json:"video"`
+}
+
+// typedMedia references an uploaded file; Title and Description only apply
+// to video.
+type typedMedia struct {
+	MediaID     string `json:"media_id"`
+	Title       string `json:"title,omitempty"`
+	Description string `json:"description,omitempty"`
+}
+
+// The msgtypes each typed endpoint accepts.
+var (
+	typedSendTypes    = []string{"text", "markdown", "textcard", "news", "template_card"}
+	typedAppChatTypes = []string{"text", "markdown", "textcard", "news", "image", "voice", "file", "video"}
+)
+
+// validate checks the recipients and message against WeCom's field limits
+// and returns one entry per problem.
+func (t typedSend) validate() []string {
+	var problems []string
+	if t.ToUser == "" && t.ToParty == "" && t.ToTag == "" {
+		problems = append(problems, "touser, toparty or totag is required")
+	}
+	return append(problems, t.validateContent(typedSendTypes)...)
+}
+
+// validateContent checks that msgtype is one of msgTypes and its message
+// object is within WeCom's field limits.
+func (t typedContent) validateContent(msgTypes []string) []string {
+	var problems []string
+	if !slices.Contains(msgTypes, t.MsgType) {
+		last := len(msgTypes) - 1
+		return append(problems, "msgtype must be "+strings.Join(msgTypes[:last], ", ")+" or "+msgTypes[last])
+	}
+	check := func(field, value string, limit int, required bool) {
+		switch {
+		case value == "" && required:
+			problems = append(problems, field+" is required")
+		case len(value) > limit:
+			problems = append(problems, fmt.Sprintf("%s exceeds %d bytes", field, limit))
+		}
+	}
+	checkRunes := func(field, value string, limit int) {
+		if utf8.RuneCountInString(value) > limit {
+			problems = append(problems, fmt.Sprintf("%s exceeds %d characters", field, limit))
+		}
+	}
+	switch t.MsgType {
+	case "text":
+		if t.Text == nil || t.Text.Content == "" {
+			problems = append(problems, "text.content is required")
+		} else if len(splitText(t.Text.Content, maxTextBytes)) > maxTextParts {
+			problems = append(problems, fmt.Sprintf("text.content needs more than %d messages", maxTextParts))
+		}
+	case "markdown":
+		if t.Markdown == nil {
+			problems = append(problems, "markdown.content is required")
+			break
+		}
+		check("markdown.content", t.Markdown.Content, maxTextBytes, true)
+	case "textcard":
+		if t.TextCard == nil {
+			problems = append(problems, "textcard is required")
+			break
+		}
+		check("textcard.title", t.TextCard.Title, maxCardTitleBytes, true)
+		check("textcard.description", t.TextCard.Description, maxCardDescBytes, true)
+		check("textcard.url", t.TextCard.URL, maxCardURLBytes, true)
+		checkRunes("textcard.btntxt", t.TextCard.ButtonText, maxCardButtonRunes)
+	case "news":
+		if t.News == nil || len(t.News.Articles) == 0 {
+			problems = append(problems, "news.articles is required")
+			break
+		}
+		if len(t.News.Articles) > maxNewsArticles {
+			problems = append(problems, fmt.Sprintf("news.articles exceeds %d articles", maxNewsArticles))
+		}
+		for i, article := range t.News.Articles {
+			prefix := fmt.Sprintf("news.articles[%d].", i)
+			check(prefix+"title", article.Title, maxCardTitleBytes, true)
+			check(prefix+"description", article.Description, maxCardDescBytes, false)
+			// Mini program articles link through appid/pagepath instead.
+			check(prefix+"url", article.URL, maxCardURLBytes, article.AppID == "")
+			check(prefix+"picurl", article.PicURL, maxCardURLBytes, false)
+		}
+	case "template_card":
+		var card struct {
+			CardType  string `json:"card_type"`
+			TaskID    string `json:"task_id"`
+			MainTitle struct {
+				Title string `json:"title"`
+				Desc  string `json:"desc"`
+			} `json:"main_title"`
+			SubTitleText string `json:"sub_title_text"`
+		}
+		if len(t.TemplateCard) == 0 || json.Unmarshal(t.TemplateCard, &card) != nil {
+			problems = append(problems, "template_card is required")
+			break
+		}
+		switch card.CardType {
+		case "text_notice", "news_notice":
+		case "button_interaction", "vote_interaction", "multiple_interaction":
+			check("template_card.task_id", card.TaskID, maxTemplateTaskBytes, true)
+		default:
+			problems = append(problems, "template_card.card_type is invalid")
+		}
+		if card.MainTitle.Title == "" && card.SubTitleText == "" {
+			problems = append(problems, "template_card.main_title.title or sub_title_text is required")
+		}
+		checkRunes("template_card.main_title.title", card.MainTitle.Title, maxTemplateTitle)
+		checkRunes("template_card.main_title.desc", card.MainTitle.Desc, maxTemplateDesc)
+		checkRunes("template_card.sub_title_text", card.SubTitleText, maxTemplateSubTitle)
+	case "image", "voice", "file", "video":
+		media := map[string]*typedMedia{"image": t.Image, "voice": t.Voice, "file": t.File, "video": t.Video}[t.MsgType]
+		if media == nil || media.MediaID == "" {
+			problems = append(problems, t.MsgType+".media_id is required")
+			break
+		}
+		if t.MsgType == "video" {
+			check("video.title", media.Title, maxCardTitleBytes, false)
+			check("video.description", media.Description, maxCardDescBytes, false)
+		}
+	}
+	return problems
+}
+
+// messages renders the message/send bodies, one per text part.
+func (t typedSend) messages(agentID int) [][]byte {
+	base := map[string]any{
+		"msgtype": t.MsgType,
+		"agentid": agentID,
+	}
+	for key, value := range map[string]string{"touser": t.ToUser, "toparty": t.ToParty, "totag": t.ToTag} {
+		if value != "" {
+			base[key] = value
+		}
+	}
+	for key, value := range map[string]int{
+		"safe":                     t.Safe,
+		"enable_duplicate_check":   t.EnableDuplicateCheck,
+		"duplicate_check_interval": t.DuplicateCheckInterval,
+	} {
+		if value != 0 {
+			base[key] = value
+		}
+	}
+	contents := t.contents()
+	out := make([][]byte, 0, len(contents))
+	for _, content := range contents {
+		base[t.MsgType] = content
+		data, _ := json.Marshal(base)
+		out = append(out, data)
+	}
+	return out
+}
+
+// contents returns the message object to send under msgtype, one per text
+// part.
+func (t typedContent) contents() []any {
+	var contents []any
+	switch t.MsgType {
+	case "text":
+		for _, part := range splitText(t.Text.Content, maxTextBytes) {
+			contents = append(contents, map[string]string{"content": part})
+		}
+	case "markdown":
+		contents = append(contents, map[string]string{"content": t.Markdown.Content})
+	case "textcard":
+		contents = append(contents, t.TextCard)
+	case "news":
+		contents = append(contents, t.News)
+	case "template_card":
+		contents = append(contents, t.TemplateCard)
+	case "image":
+		contents = append(contents, map[string]string{"media_id": t.Image.MediaID})
+	case "voice":
+		contents = append(contents, map[string]string{"media_id": t.Voice.MediaID})
+	case "file":
+		contents = append(contents, map[string]string{"media_id": t.File.MediaID})
+	case "video":
+		contents = append(contents, t.Video)
+	}
+	return contents
+}
+
+// splitText cuts content into parts of at most limit bytes, preferring line
+// breaks, then spaces, and never splitting a UTF-8 sequence.
+func splitText(content string, limit int) []string {
+	var parts []string
+	for len(content) > limit {
+		cut := limit
+		for cut > 0 && !utf8.RuneStart(content[cut]) {
+			cut--
+		}
+		if i := strings.LastIndexByte(content[:cut], '\n'); i > limit/2 {
+			cut = i + 1
+		} else if i := strings.LastIndexByte(content[:cut], ' '); i > limit/2 {
+			cut = i + 1
+		}
+		parts = append(parts, content[:cut])
+		content = content[cut:]
+	}
+	if content != "" {
+		parts = append(parts, content)
+	}
+	return parts
+}
+
+// handleProxySendTyped builds message/send bodies from a typed schema,
+// validates WeCom's field limits up front and splits long text messages into
+// consecutive sends. A split message counts once against the quota.
+func handleProxySendTyped(w http.ResponseWriter, r *http.Request, cfg config.Config, state *bridgeState) {
+	if r.Method != http.MethodPost {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	override := hasBearer(r, cfg.QuotaOverrideToken)
+	if !override && !checkBridgeAuth(w, r, cfg, config.ScopeProxySend) {
+		return
+	}
+
+	body, err := readBody(r)
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		_, _ = w.Write([]byte("missing body"))
+		return
+	}
+	var payload typedSend
+	if err := json.Unmarshal(body, &payload); err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		_, _ = w.Write([]byte("invalid json"))
+		return
+	}
+	agentID, err := strconv.Atoi(firstNonEmpty(jsonID(payload.AgentID), cfg.WeComAgentID))
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		_, _ = w.Write([]byte("missing agentid"))
+		return
+	}
+	if problems := payload.validate(); len(problems) > 0 {
+		writeFieldProblems(w, "message", problems)
+		return
+	}
+	if payload.AccessToken == "" {
+		payload.AccessToken = state.managedToken(strconv.Itoa(agentID))
+	}
+	if payload.AccessToken == "" {
+		w.WriteHeader(http.StatusBadRequest)
+		_, _ = w.Write([]byte("missing access_token"))
+		return
+	}
+
+	messages := payload.messages(agentID)
+	msgIDs := make([]string, 0, len(messages))
+	for i, message := range messages {
+		// Callers can tell how much of a split message went out if a later
+		// part fails.
+		w.Header().Set("X-Bridge-Parts-Sent", strconv.Itoa(i))
+		msgID, err := sendAppMessage(w, r, cfg, state, payload.AccessToken, message, payload.TimeoutMS, override || i > 0)
+		if err != nil {
+			return
+		}
+		msgIDs = append(msgIDs, msgID)
+	}
+	w.Header().Set("X-Bridge-Parts-Sent", strconv.Itoa(len(messages)))
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(map[string]any{
+		"errcode": 0,
+		"errmsg":  "ok",
+		"msgids":  msgIDs,
+	})
+}
@@ -0,0 +1,418 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"mime/multipart"
+	"net/http"
+	"net/textproto"
+	"net/url"
+	"strconv"
+	"strings"
+
+	"github.com/Tennen/Paimon/tools/bridge/config"
+	"github.com/Tennen/Paimon/tools/bridge/proxy"
+)
+
+func handleProxyUpload(w http.ResponseWriter, r *http.Request, cfg config.Config, state *bridgeState) {
+	if r.Method != http.MethodPost {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	if !checkBridgeAuth(w, r, cfg, config.ScopeProxyMedia) {
+		return
+	}
+	if strings.HasPrefix(r.Header.Get("Content-Type"), "multipart/form-data") {
+		streamProxyUpload(w, r, cfg, state, "upload")
+		return
+	}
+
+	body, err := readBody(r)
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		_, _ = w.Write([]byte("missing body"))
+		return
+	}
+	var payload struct {
+		AccessToken string `json:"access_token"`
+		Type        string `json:"type"`
+		Media       struct {
+			Base64      string `json:"base64"`
+			Filename    string `json:"filename"`
+			ContentType string `json:"content_type"`
+		} `json:"media"`
+		TimeoutMS int `json:"timeout_ms"`
+	}
+	if err := json.Unmarshal(body, &payload); err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		_, _ = w.Write([]byte("invalid json"))
+		return
+	}
+	if payload.AccessToken == "" {
+		payload.AccessToken = state.managedToken("")
+	}
+	if payload.AccessToken == "" || payload.Media.Base64 == "" {
+		w.WriteHeader(http.StatusBadRequest)
+		_, _ = w.Write([]byte("missing access_token/media"))
+		return
+	}
+
+	typeName := payload.Type
+	if typeName == "" {
+		typeName = "image"
+	}
+	filename := payload.Media.Filename
+	if filename == "" {
+		if typeName == "image" {
+			filename = "upload.jpg"
+		} else {
+			filename = "upload.dat"
+		}
+	}
+	data, err := base64.StdEncoding.DecodeString(payload.Media.Base64)
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		_, _ = w.Write([]byte("invalid base64"))
+		return
+	}
+
+	client := qyapiClient(proxyTimeout(r, cfg, "media_upload", payload.TimeoutMS))
+	respData, err := uploadWeComMedia(r.Context(), client, payload.AccessToken, typeName, filename, data)
+	if err != nil {
+		w.WriteHeader(http.StatusBadGateway)
+		_, _ = w.Write([]byte(err.Error()))
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	_, _ = w.Write(proxy.EnrichError(respData, "upload"))
+}
+
+// handleProxyUploadImage uploads an image to media/uploadimg, which returns a
+// permanent URL for news articles instead of a 3-day media_id. It accepts the
+// same JSON and multipart forms as /proxy/media/upload.
+func handleProxyUploadImage(w http.ResponseWriter, r *http.Request, cfg config.Config, state *bridgeState) {
+	if r.Method != http.MethodPost {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	if !checkBridgeAuth(w, r, cfg, config.ScopeProxyMedia) {
+		return
+	}
+	if strings.HasPrefix(r.Header.Get("Content-Type"), "multipart/form-data") {
+		streamProxyUpload(w, r, cfg, state, "uploadimg")
+		return
+	}
+
+	body, err := readBody(r)
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		_, _ = w.Write([]byte("missing body"))
+		return
+	}
+	var payload struct {
+		AccessToken string `json:"access_token"`
+		Media       struct {
+			Base64      string `json:"base64"`
+			Filename    string `json:"filename"`
+			ContentType string `json:"content_type"`
+		} `json:"media"`
+		TimeoutMS int `json:"timeout_ms"`
+	}
+	if err := json.Unmarshal(body, &payload); err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		_, _ = w.Write([]byte("invalid json"))
+		return
+	}
+	if payload.AccessToken == "" {
+		payload.AccessToken = state.managedToken("")
+	}
+	if payload.AccessToken == "" || payload.Media.Base64 == "" {
+		w.WriteHeader(http.StatusBadRequest)
+		_, _ = w.Write([]byte("missing access_token/media"))
+		return
+	}
+	data, err := base64.StdEncoding.DecodeString(payload.Media.Base64)
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		_, _ = w.Write([]byte("invalid base64"))
+		return
+	}
+
+	endpoint := fmt.Sprintf("https://qyapi.weixin.qq.com/cgi-bin/media/uploadimg?access_token=%s", url.QueryEscape(payload.AccessToken))
+	client := qyapiClient(proxyTimeout(r, cfg, "media_upload", payload.TimeoutMS))
+	respData, _, err := postWeComMultipart(r.Context(), client, endpoint, firstNonEmpty(payload.Media.Filename, "upload.jpg"), payload.Media.ContentType, bytes.NewReader(data))
+	if err != nil {
+		w.WriteHeader(http.StatusBadGateway)
+		_, _ = w.Write([]byte(err.Error()))
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	_, _ = w.Write(proxy.EnrichError(respData, "uploadimg"))
+}
+
+// streamProxyUpload pipes the first file of a multipart request straight to
+// WeCom's media/upload or media/uploadimg without holding it in memory, so
+// files up to BRIDGE_MEDIA_UPLOAD_MAX_MB pass through. access_token, type and
+// timeout_ms come from the query string or from form fields sent before the
+// file part.
+func streamProxyUpload(w http.ResponseWriter, r *http.Request, cfg config.Config, state *bridgeState, api string) {
+	r.Body = http.MaxBytesReader(w, r.Body, cfg.MediaUploadMaxBytes)
+	query := r.URL.Query()
+	accessToken := query.Get("access_token")
+	typeName := query.Get("type")
+	timeoutMS, _ := strconv.Atoi(query.Get("timeout_ms"))
+	reader, err := r.MultipartReader()
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		_, _ = w.Write([]byte("invalid multipart form"))
+		return
+	}
+	var file *multipart.Part
+	for file == nil {
+		part, err := reader.NextPart()
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		if err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			_, _ = w.Write([]byte("invalid multipart form"))
+			return
+		}
+		if part.FileName() != "" {
+			file = part
+			break
+		}
+		data, _ := io.ReadAll(io.LimitReader(part, 4096))
+		switch part.FormName() {
+		case "access_token":
+			accessToken = strings.TrimSpace(string(data))
+		case "type":
+			typeName = strings.TrimSpace(string(data))
+		case "timeout_ms":
+			timeoutMS, _ = strconv.Atoi(strings.TrimSpace(string(data)))
+		}
+	}
+	if accessToken == "" {
+		accessToken = state.managedToken("")
+	}
+	if accessToken == "" || file == nil {
+		w.WriteHeader(http.StatusBadRequest)
+		_, _ = w.Write([]byte("missing access_token/media"))
+		return
+	}
+
+	endpoint := fmt.Sprintf("https://qyapi.weixin.qq.com/cgi-bin/media/uploadimg?access_token=%s", url.QueryEscape(accessToken))
+	if api == "upload" {
+		// A file part named image/voice/video/file selects its media type.
+		switch file.FormName() {
+		case "image", "voice", "video", "file":
+			typeName = firstNonEmpty(typeName, file.FormName())
+		}
+		endpoint = fmt.Sprintf("https://qyapi.weixin.qq.com/cgi-bin/media/upload?access_token=%s&type=%s", url.QueryEscape(accessToken), url.QueryEscape(firstNonEmpty(typeName, "file")))
+	}
+	client := qyapiClient(proxyTimeout(r, cfg, "media_upload", timeoutMS))
+	respData, n, err := postWeComMultipart(r.Context(), client, endpoint, file.FileName(), file.Header.Get("Content-Type"), file)
+	state.usage.record(requesterIdentity(r, cfg), func(c *usageCounters) { c.MediaBytes += n })
+	if err != nil {
+		var tooLarge *http.MaxBytesError
+		if errors.As(err, &tooLarge) {
+			w.WriteHeader(http.StatusRequestEntityTooLarge)
+			_, _ = w.Write([]byte(fmt.Sprintf("upload exceeds %d MB", cfg.MediaUploadMaxBytes>>20)))
+			return
+		}
+		w.WriteHeader(http.StatusBadGateway)
+		_, _ = w.Write([]byte(err.Error()))
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	_, _ = w.Write(proxy.EnrichError(respData, api))
+}
+
+// postWeComMultipart posts body as the single "media" file of a multipart
+// form, encoding it through a pipe while the request is sent, and returns
+// WeCom's JSON response and the number of file bytes read. Running into a
+// http.MaxBytesReader limit is returned as is so callers can answer 413.
+func postWeComMultipart(ctx context.Context, client *http.Client, endpoint, filename, contentType string, body io.Reader) ([]byte, int64, error) {
+	pr, pw := io.Pipe()
+	writer := multipart.NewWriter(pw)
+	counter := &countingReader{r: body}
+	copied := make(chan error, 1)
+	go func() {
+		header := textproto.MIMEHeader{}
+		header.Set("Content-Disposition", fmt.Sprintf(`form-data; name="media"; filename="%s"`, strings.NewReplacer(`\`, `\\`, `"`, `\"`).Replace(filename)))
+		header.Set("Content-Type", firstNonEmpty(contentType, "application/octet-stream"))
+		part, err := writer.CreatePart(header)
+		if err == nil {
+			_, err = io.Copy(part, counter)
+		}
+		if err == nil {
+			err = writer.Close()
+		}
+		_ = pw.CloseWithError(err)
+		copied <- err
+	}()
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, endpoint, pr)
+	if err != nil {
+		_ = pr.Close()
+		<-copied
+		return nil, 0, errors.New("upload failed")
+	}
+	req.Header.Set("Content-Type", writer.FormDataContentType())
+	resp, err := client.Do(req)
+	if err != nil {
+		_ = pr.CloseWithError(err)
+		var tooLarge *http.MaxBytesError
+		if copyErr := <-copied; errors.As(copyErr, &tooLarge) {
+			return nil, counter.n, copyErr
+		}
+		return nil, counter.n, errors.New("upload failed")
+	}
+	defer resp.Body.Close()
+	respData, err := io.ReadAll(resp.Body)
+	// Unblock the writer if WeCom answered before reading the whole form.
+	_ = pr.Close()
+	<-copied
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return nil, counter.n, fmt.Errorf("upload http %d", resp.StatusCode)
+	}
+	if err != nil {
+		return nil, counter.n, errors.New("upload read failed")
+	}
+	return respData, counter.n, nil
+}
+
+// handleProxyMediaForward downloads a media_id from WeCom and streams it to
+// a destination URL on BRIDGE_MEDIA_FORWARD_ALLOWLIST without buffering it.
+func handleProxyMediaForward(w http.ResponseWriter, r *http.Request, cfg config.Config, state *bridgeState) {
+	if r.Method != http.MethodPost {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	if !checkBridgeAuth(w, r, cfg, config.ScopeProxyMedia) {
+		return
+	}
+
+	body, err := readBody(r)
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		_, _ = w.Write([]byte("missing body"))
+		return
+	}
+	var payload struct {
+		AccessToken string `json:"access_token"`
+		MediaID     string `json:"media_id"`
+		Destination struct {
+			URL     string            `json:"url"`
+			Method  string            `json:"method"`
+			Headers map[string]string `json:"headers"`
+		} `json:"destination"`
+		TimeoutMS int `json:"timeout_ms"`
+	}
+	if err := json.Unmarshal(body, &payload); err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		_, _ = w.Write([]byte("invalid json"))
+		return
+	}
+	if payload.AccessToken == "" {
+		payload.AccessToken = state.managedToken("")
+	}
+	if payload.AccessToken == "" || payload.MediaID == "" || payload.Destination.URL == "" {
+		w.WriteHeader(http.StatusBadRequest)
+		_, _ = w.Write([]byte("missing access_token/media_id/destination"))
+		return
+	}
+	method := strings.ToUpper(firstNonEmpty(payload.Destination.Method, http.MethodPut))
+	if method != http.MethodPut && method != http.MethodPost {
+		w.WriteHeader(http.StatusBadRequest)
+		_, _ = w.Write([]byte("destination method must be PUT or POST"))
+		return
+	}
+	destURL := strings.NewReplacer("{media_id}", url.PathEscape(payload.MediaID)).Replace(payload.Destination.URL)
+	dest, err := url.Parse(destURL)
+	if err != nil || !hostAllowed(cfg.MediaForwardAllowlist, dest) {
+		w.WriteHeader(http.StatusForbidden)
+		_, _ = w.Write([]byte("destination not allowed"))
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(r.Context(), proxyTimeout(r, cfg, "media_forward", payload.TimeoutMS))
+	defer cancel()
+	query := url.Values{}
+	query.Set("access_token", payload.AccessToken)
+	query.Set("media_id", payload.MediaID)
+	getReq, err := http.NewRequestWithContext(ctx, http.MethodGet, fmt.Sprintf("https://qyapi.weixin.qq.com/cgi-bin/media/get?%s", query.Encode()), nil)
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		_, _ = w.Write([]byte("media get failed"))
+		return
+	}
+	resp, err := qyapiClient(0).Do(getReq)
+	if err != nil {
+		w.WriteHeader(http.StatusBadGateway)
+		_, _ = w.Write([]byte("media get failed"))
+		return
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		w.WriteHeader(http.StatusBadGateway)
+		_, _ = w.Write([]byte(fmt.Sprintf("media get http %d", resp.StatusCode)))
+		return
+	}
+	contentType := firstNonEmpty(strings.TrimSpace(resp.Header.Get("Content-Type")), "application/octet-stream")
+	if strings.Contains(strings.ToLower(contentType), "application/json") {
+		respData, _ := io.ReadAll(io.LimitReader(resp.Body, 64*1024))
+		writeWeComError(w, http.StatusBadGateway, respData, "media get")
+		return
+	}
+	filename := parseFilenameFromDisposition(resp.Header.Get("Content-Disposition"))
+	if filename == "" {
+		filename = fmt.Sprintf("%s.dat", payload.MediaID)
+	}
+
+	counter := &countingReader{r: resp.Body}
+	putReq, err := http.NewRequestWithContext(ctx, method, dest.String(), counter)
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		_, _ = w.Write([]byte("forward failed"))
+		return
+	}
+	putReq.ContentLength = resp.ContentLength
+	putReq.Header.Set("Content-Type", contentType)
+	putReq.Header.Set("X-Media-Filename", url.PathEscape(filename))
+	for name, value := range payload.Destination.Headers {
+		putReq.Header.Set(name, value)
+	}
+	client := http.Client{Transport: outboundTransport, CheckRedirect: func(*http.Request, []*http.Request) error { return http.ErrUseLastResponse }}
+	destResp, err := client.Do(putReq)
+	state.usage.record(requesterIdentity(r, cfg), func(c *usageCounters) { c.MediaBytes += counter.n })
+	if err != nil {
+		state.metrics.Inc("wecom_bridge_media_forward_total", "result", "error")
+		w.WriteHeader(http.StatusBadGateway)
+		_, _ = w.Write([]byte(fmt.Sprintf("forward failed: %v", err)))
+		return
+	}
+	defer destResp.Body.Close()
+	destBody, _ := io.ReadAll(io.LimitReader(destResp.Body, 4096))
+	if destResp.StatusCode < 200 || destResp.StatusCode >= 300 {
+		state.metrics.Inc("wecom_bridge_media_forward_total", "result", "error")
+		w.WriteHeader(http.StatusBadGateway)
+		_, _ = w.Write([]byte(fmt.Sprintf("destination http %d: %s", destResp.StatusCode, truncateRunes(string(destBody), 200))))
+		return
+	}
+	state.metrics.Inc("wecom_bridge_media_forward_total", "result", "ok")
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(map[string]any{
+		"ok":                 true,
+		"media_id":           payload.MediaID,
+		"filename":           filename,
+		"content_type":       contentType,
+		"bytes":              counter.n,
+		"destination_status": destResp.StatusCode,
+	})
+}
@@ -0,0 +1,148 @@
+package server
+
+import (
+	"encoding/json"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/Tennen/Paimon/tools/bridge/config"
+)
+
+// usageTracker aggregates per-token usage in hourly buckets for chargeback.
+type usageTracker struct {
+	mu      sync.Mutex
+	buckets map[usageKey]*usageCounters
+}
+
+type usageKey struct {
+	identity string
+	hour     int64
+}
+
+type usageCounters struct {
+	Requests    int64 `json:"requests"`
+	Sends       int64 `json:"sends"`
+	StreamBytes int64 `json:"streamBytes"`
+	MediaBytes  int64 `json:"mediaBytes"`
+}
+
+// usageMiddleware counts requests per bridge token. WeCom callbacks and health
+// probes are not attributed to any token.
+func usageMiddleware(cfg config.Config, state *bridgeState, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/health" && r.URL.Path != "/ready" && r.URL.Path != "/wecom" {
+			state.usage.record(streamIdentity(r, cfg, state), func(c *usageCounters) { c.Requests++ })
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// handleAdminUsage reports per-token usage. Query: bucket=hour|day (default
+// hour), since (RFC3339, default 24h ago), token.
+func handleAdminUsage(w http.ResponseWriter, r *http.Request, cfg config.Config, state *bridgeState) {
+	if r.Method != http.MethodGet {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	if !checkAdminAuth(w, r, cfg) {
+		return
+	}
+	q := r.URL.Query()
+	bucketHours := int64(1)
+	switch q.Get("bucket") {
+	case "", "hour":
+	case "day":
+		bucketHours = 24
+	default:
+		w.WriteHeader(http.StatusBadRequest)
+		_, _ = w.Write([]byte("bucket must be hour or day"))
+		return
+	}
+	since, err := parseTimeParam(q.Get("since"))
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		_, _ = w.Write([]byte("invalid since"))
+		return
+	}
+	if since.IsZero() {
+		since = time.Now().Add(-24 * time.Hour)
+	}
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(map[string]any{
+		"bucket": firstNonEmpty(q.Get("bucket"), "hour"),
+		"since":  since.UTC().Format(time.RFC3339),
+		"usage":  state.usage.report(bucketHours, since, q.Get("token")),
+	})
+}
+
+// record applies update to the identity's counters for the current hour and
+// drops buckets older than the retention window.
+func (u *usageTracker) record(identity string, update func(*usageCounters)) {
+	hour := time.Now().Unix() / 3600
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	key := usageKey{identity: identity, hour: hour}
+	c, ok := u.buckets[key]
+	if !ok {
+		c = &usageCounters{}
+		u.buckets[key] = c
+		for k := range u.buckets {
+			if hour-k.hour > usageRetentionHours {
+				delete(u.buckets, k)
+			}
+		}
+	}
+	update(c)
+}
+
+// report sums counters per identity into buckets of the given size (hours),
+// newest bucket first.
+func (u *usageTracker) report(bucketHours int64, since time.Time, identity string) []map[string]any {
+	u.mu.Lock()
+	type reportKey struct {
+		identity string
+		start    int64
+	}
+	sums := make(map[reportKey]*usageCounters)
+	for k, c := range u.buckets {
+		if identity != "" && k.identity != identity {
+			continue
+		}
+		if k.hour*3600 < since.Unix()-3599 {
+			continue
+		}
+		rk := reportKey{identity: k.identity, start: k.hour - k.hour%bucketHours}
+		sum, ok := sums[rk]
+		if !ok {
+			sum = &usageCounters{}
+			sums[rk] = sum
+		}
+		sum.Requests += c.Requests
+		sum.Sends += c.Sends
+		sum.StreamBytes += c.StreamBytes
+		sum.MediaBytes += c.MediaBytes
+	}
+	u.mu.Unlock()
+
+	keys := make([]reportKey, 0, len(sums))
+	for k := range sums {
+		keys = append(keys, k)
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		if keys[i].start != keys[j].start {
+			return keys[i].start > keys[j].start
+		}
+		return keys[i].identity < keys[j].identity
+	})
+	rows := make([]map[string]any, 0, len(keys))
+	for _, k := range keys {
+		rows = append(rows, map[string]any{
+			"token":       k.identity,
+			"bucketStart": time.Unix(k.start*3600, 0).UTC().Format(time.RFC3339),
+			"usage":       sums[k],
+		})
+	}
+	return rows
+}
@@ -0,0 +1,99 @@
+package server
+
+import (
+	"crypto/tls"
+	"encoding/base64"
+	"fmt"
+	"net"
+	"os/exec"
+	"strconv"
+
+	"github.com/Tennen/Paimon/tools/bridge/config"
+)
+
+// validateConfig reports problems that would only surface once WeCom calls
+// or clients connect, printing one line per finding. It returns the exit
+// status for -validate: 1 if any error was found.
+func validateConfig(cfg config.Config) int {
+	errs, warnings := configProblems(cfg)
+	// A busy port is only a warning: -validate often runs next to the
+	// bridge it checks, before a restart.
+	if cfg.Port > 0 && cfg.Port <= 65535 {
+		if ln, err := net.Listen("tcp", fmt.Sprintf(":%d", cfg.Port)); err != nil {
+			warnings = append(warnings, fmt.Sprintf("port %d unavailable: %v", cfg.Port, err))
+		} else {
+			_ = ln.Close()
+		}
+	}
+	for _, w := range warnings {
+		fmt.Println("warning:", w)
+	}
+	for _, e := range errs {
+		fmt.Println("error:", e)
+	}
+	if len(errs) > 0 {
+		return 1
+	}
+	fmt.Println("configuration ok")
+	return 0
+}
+
+// configProblems checks the configuration without touching the network or
+// the listen port, so /ready can run it against the live config.
+func configProblems(cfg config.Config) (errs, warnings []string) {
+	checkApp := func(name, token, aesKey, mode string) {
+		switch {
+		case token == "" && aesKey == "":
+			return
+		case token == "":
+			errs = append(errs, name+": token missing")
+		case aesKey == "" && mode != config.CallbackPlaintext:
+			errs = append(errs, name+": AES key missing")
+		}
+		if aesKey != "" {
+			if key, err := base64.StdEncoding.DecodeString(aesKey + "="); len(aesKey) != 43 || err != nil || len(key) != 32 {
+				errs = append(errs, fmt.Sprintf("%s: AES key must be 43 base64 characters (got %d)", name, len(aesKey)))
+			}
+		}
+	}
+	checkAgentID := func(name, id string) {
+		if _, err := strconv.Atoi(id); id != "" && err != nil {
+			errs = append(errs, fmt.Sprintf("%s: agent ID %q is not a number", name, id))
+		}
+	}
+	checkApp("wecom", cfg.WeComToken, cfg.WeComAESKey, cfg.CallbackMode)
+	checkAgentID("WECOM_AGENT_ID", cfg.WeComAgentID)
+	for _, agent := range cfg.Agents {
+		checkApp("agent "+agent.Name, agent.Token, agent.AESKey, agent.CallbackMode)
+		checkAgentID("agent "+agent.Name, agent.AgentID)
+	}
+	if cfg.Mode == "primary" && cfg.WeComToken == "" && len(cfg.Agents) == 0 {
+		errs = append(errs, "no WeCom app configured: set WECOM_TOKEN/WECOM_AES_KEY or agents")
+	}
+	if cfg.WeComCorpSecret != "" && cfg.WeComCorpID == "" {
+		errs = append(errs, "WECOM_CORP_SECRET requires WECOM_CORP_ID")
+	}
+	if cfg.CallbackAllowlistAuto && cfg.WeComCorpSecret == "" && len(cfg.AgentSecrets) == 0 {
+		errs = append(errs, "BRIDGE_CALLBACK_ALLOWLIST_AUTO requires WECOM_CORP_SECRET or BRIDGE_AGENT_SECRETS")
+	}
+	if cfg.BridgeToken == "" && len(cfg.Tokens) == 0 {
+		warnings = append(warnings, "WECOM_BRIDGE_TOKEN not set: /stream and /proxy/* accept unauthenticated requests")
+	}
+	if cfg.TLSCertFile != "" {
+		if _, err := tls.LoadX509KeyPair(cfg.TLSCertFile, cfg.TLSKeyFile); err != nil {
+			errs = append(errs, fmt.Sprintf("tls: %v", err))
+		}
+	}
+	if _, err := newOutboundTransport(cfg); err != nil {
+		errs = append(errs, err.Error())
+	}
+	if cfg.FFmpegPath != "" {
+		if _, err := exec.LookPath(cfg.FFmpegPath); err != nil {
+			errs = append(errs, fmt.Sprintf("BRIDGE_FFMPEG_PATH: %v", err))
+		}
+	}
+	if cfg.Port <= 0 || cfg.Port > 65535 {
+		errs = append(errs, fmt.Sprintf("port %d out of range", cfg.Port))
+	}
+	return errs, warnings
+}
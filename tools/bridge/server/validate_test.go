@@ -0,0 +1,27 @@
+package server
+
+import (
+	"net"
+	"strings"
+	"testing"
+
+	"github.com/Tennen/Paimon/tools/bridge/config"
+)
+
+func TestValidateConfigBusyPortIsWarning(t *testing.T) {
+	ln, err := net.Listen("tcp", ":0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	cfg := config.Config{
+		Mode:        "primary",
+		Port:        ln.Addr().(*net.TCPAddr).Port,
+		WeComToken:  "token",
+		WeComAESKey: strings.Repeat("a", 43),
+		BridgeToken: "bridge",
+	}
+	if code := validateConfig(cfg); code != 0 {
+		t.Fatalf("exit code %d for a busy port", code)
+	}
+}
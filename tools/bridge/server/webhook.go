@@ -0,0 +1,304 @@
+package server
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/Tennen/Paimon/tools/bridge/config"
+	"github.com/Tennen/Paimon/tools/bridge/metrics"
+	wxcrypto "github.com/Tennen/Paimon/tools/wecom/crypto"
+)
+
+// webhookSink pushes broadcast events to one downstream URL, either one
+// request per event or in batches bounded by size and age.
+type webhookSink struct {
+	url         string
+	batchSize   int
+	batchWindow time.Duration
+	queue       chan sseEvent
+	schema      *config.Schema
+	metrics     *metrics.Registry
+
+	maxAttempts int
+	retryBase   time.Duration
+	retryMax    time.Duration
+	deadLetters *deadLetterLog
+
+	signingSecret string
+
+	mu     sync.Mutex
+	status webhookStatus
+}
+
+// webhookStatus is the delivery state of one target, shown on
+// /admin/webhooks.
+type webhookStatus struct {
+	Target              string    `json:"target"`
+	State               string    `json:"state"`
+	Queued              int       `json:"queued"`
+	LastEventID         int64     `json:"lastDeliveredEventId,omitempty"`
+	LastDeliveredAt     time.Time `json:"lastDeliveredAt,omitzero"`
+	ConsecutiveFailures int       `json:"consecutiveFailures"`
+	LastError           string    `json:"lastError,omitempty"`
+	LastErrorAt         time.Time `json:"lastErrorAt,omitzero"`
+	DeadLettered        int64     `json:"deadLetteredEvents"`
+}
+
+// deadLetterLog appends webhook batches that exhausted their retries to a
+// JSON lines file. A nil log only counts them.
+type deadLetterLog struct {
+	mu   sync.Mutex
+	file *os.File
+}
+
+// deadLetter is one line of the dead-letter file.
+type deadLetter struct {
+	Target   string           `json:"target"`
+	FailedAt time.Time        `json:"failedAt"`
+	Attempts int              `json:"attempts"`
+	Error    string           `json:"error"`
+	Events   []map[string]any `json:"events"`
+}
+
+func newWebhookSink(cfg config.Config, target string, metrics *metrics.Registry) *webhookSink {
+	sink := &webhookSink{
+		url:           target,
+		batchSize:     1,
+		batchWindow:   0,
+		queue:         make(chan sseEvent, 1000),
+		schema:        webhookSchema(cfg.Schemas, target),
+		metrics:       metrics,
+		maxAttempts:   max(cfg.WebhookMaxAttempts, 1),
+		retryBase:     cfg.WebhookRetryBase,
+		retryMax:      cfg.WebhookRetryMax,
+		signingSecret: cfg.SigningSecret,
+		status:        webhookStatus{Target: target, State: "ok"},
+	}
+	if cfg.WebhookMode == "batch" {
+		sink.batchSize = cfg.WebhookBatchSize
+		if sink.batchSize <= 0 {
+			sink.batchSize = 50
+		}
+		sink.batchWindow = cfg.WebhookBatchWindow
+	}
+	return sink
+}
+
+func (k *webhookSink) enqueue(ev sseEvent) bool {
+	select {
+	case k.queue <- ev:
+		return true
+	default:
+		k.metrics.Inc("wecom_bridge_webhook_dropped_total", "target", k.url)
+		slog.Error("webhook queue full, event dropped", "url", k.url, "event_id", ev.ID)
+		return false
+	}
+}
+
+// run collects events into batches and delivers them until the process exits.
+func (k *webhookSink) run() {
+	batch := make([]sseEvent, 0, k.batchSize)
+	var timer <-chan time.Time
+	for {
+		select {
+		case ev := <-k.queue:
+			batch = append(batch, ev)
+			if len(batch) == 1 && k.batchSize > 1 {
+				timer = time.After(k.batchWindow)
+			}
+			if len(batch) < k.batchSize {
+				continue
+			}
+		case <-timer:
+		}
+		timer = nil
+		if len(batch) > 0 {
+			k.deliver(batch)
+			batch = make([]sseEvent, 0, k.batchSize)
+		}
+	}
+}
+
+// deliver posts a single event as its payload, or a batch as
+// {"batchId","count","events":[{"id","data"}]}. The target acknowledges the
+// whole batch with a 2xx response; a JSON body of {"ack":false} rejects it.
+// Failures are retried with exponential backoff unless the target answered
+// with a 4xx other than 408/429; a batch that still fails is dead-lettered.
+// Retrying blocks the sink, so each target sees events in order.
+func (k *webhookSink) deliver(batch []sseEvent) {
+	for i := range batch {
+		batch[i] = adaptPayload(k.schema, batch[i])
+	}
+	events := make([]map[string]any, 0, len(batch))
+	for _, ev := range batch {
+		events = append(events, map[string]any{"id": ev.ID, "type": firstNonEmpty(ev.Type, "message"), "data": json.RawMessage(ev.Payload)})
+	}
+	var body []byte
+	var batchID string
+	if k.batchSize == 1 {
+		body = batch[0].Payload
+	} else {
+		batchID = fmt.Sprintf("%d-%d", batch[0].ID, batch[len(batch)-1].ID)
+		body, _ = json.Marshal(map[string]any{"batchId": batchID, "count": len(batch), "events": events})
+	}
+
+	backoff := k.retryBase
+	var err error
+	attempt := 1
+	for ; ; attempt++ {
+		var retryable bool
+		retryable, err = k.post(body, batch, batchID, attempt)
+		if err == nil {
+			break
+		}
+		k.setStatus(func(st *webhookStatus) {
+			st.State = "retrying"
+			st.ConsecutiveFailures++
+			st.LastError = err.Error()
+			st.LastErrorAt = time.Now().UTC()
+		})
+		if !retryable || attempt >= k.maxAttempts {
+			break
+		}
+		k.metrics.Inc("wecom_bridge_webhook_retries_total", "target", k.url)
+		slog.Warn("webhook delivery failed, retrying", "url", k.url, "first_event_id", batch[0].ID, "events", len(batch), "attempt", attempt, "max_attempts", k.maxAttempts, "backoff", backoff.String(), "err", err)
+		time.Sleep(backoff)
+		backoff = min(backoff*2, k.retryMax)
+	}
+	if err != nil {
+		k.metrics.Add("wecom_bridge_webhook_failed_events_total", int64(len(batch)), "target", k.url)
+		slog.Error("webhook delivery failed", "url", k.url, "first_event_id", batch[0].ID, "events", len(batch), "attempts", attempt, "err", err)
+		k.setStatus(func(st *webhookStatus) {
+			st.State = "failing"
+			st.DeadLettered += int64(len(batch))
+		})
+		k.metrics.Add("wecom_bridge_webhook_dead_lettered_events_total", int64(len(batch)), "target", k.url)
+		k.deadLetters.add(deadLetter{Target: k.url, FailedAt: time.Now().UTC(), Attempts: attempt, Error: err.Error(), Events: events})
+		return
+	}
+	k.metrics.Inc("wecom_bridge_webhook_requests_total", "target", k.url)
+	k.metrics.Add("wecom_bridge_webhook_delivered_events_total", int64(len(batch)), "target", k.url)
+	k.setStatus(func(st *webhookStatus) {
+		st.State = "ok"
+		st.ConsecutiveFailures = 0
+		st.LastEventID = batch[len(batch)-1].ID
+		st.LastDeliveredAt = time.Now().UTC()
+	})
+}
+
+// post makes one delivery attempt, reporting whether a failure is worth
+// retrying.
+func (k *webhookSink) post(body []byte, batch []sseEvent, batchID string, attempt int) (bool, error) {
+	req, err := http.NewRequest(http.MethodPost, k.url, bytes.NewReader(body))
+	if err != nil {
+		return false, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("X-Bridge-Event-Id", strconv.FormatInt(batch[len(batch)-1].ID, 10))
+	req.Header.Set("X-Bridge-Attempt", strconv.Itoa(attempt))
+	if k.signingSecret != "" {
+		// Signed per attempt, so the timestamp reflects the delivery.
+		req.Header.Set("X-Bridge-Signature", wxcrypto.SignPayload(k.signingSecret, body, time.Now()))
+	}
+	if batchID != "" {
+		req.Header.Set("X-Bridge-Batch-Id", batchID)
+	} else {
+		req.Header.Set("X-Bridge-Event-Type", firstNonEmpty(batch[0].Type, "message"))
+	}
+	resp, err := outboundClient(10 * time.Second).Do(req)
+	if err != nil {
+		return true, err
+	}
+	defer resp.Body.Close()
+	if err := checkWebhookAck(resp); err != nil {
+		permanent := resp.StatusCode >= 400 && resp.StatusCode < 500 &&
+			resp.StatusCode != http.StatusRequestTimeout && resp.StatusCode != http.StatusTooManyRequests
+		return !permanent, err
+	}
+	return false, nil
+}
+
+func (k *webhookSink) setStatus(update func(*webhookStatus)) {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	update(&k.status)
+}
+
+func (k *webhookSink) snapshot() webhookStatus {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	st := k.status
+	st.Queued = len(k.queue)
+	return st
+}
+
+func openDeadLetterLog(path string) (*deadLetterLog, error) {
+	if path == "" {
+		return nil, nil
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+		return nil, err
+	}
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0o600)
+	if err != nil {
+		return nil, err
+	}
+	return &deadLetterLog{file: f}, nil
+}
+
+func (d *deadLetterLog) add(entry deadLetter) {
+	if d == nil {
+		return
+	}
+	line, err := json.Marshal(entry)
+	if err != nil {
+		slog.Error("dead letter encode failed", "err", err)
+		return
+	}
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if _, err := d.file.Write(append(line, '\n')); err != nil {
+		slog.Error("dead letter write failed", "err", err)
+	}
+}
+
+// handleAdminWebhooks reports the delivery state of every webhook target.
+func handleAdminWebhooks(w http.ResponseWriter, r *http.Request, cfg config.Config, state *bridgeState) {
+	if r.Method != http.MethodGet {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	if !checkAdminAuth(w, r, cfg) {
+		return
+	}
+	targets := make([]webhookStatus, 0, len(state.sinks))
+	for _, sink := range state.sinks {
+		targets = append(targets, sink.snapshot())
+	}
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(map[string]any{"targets": targets})
+}
+
+func checkWebhookAck(resp *http.Response) error {
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return fmt.Errorf("http %d", resp.StatusCode)
+	}
+	data, _ := io.ReadAll(io.LimitReader(resp.Body, 4096))
+	var ack struct {
+		Ack *bool `json:"ack"`
+	}
+	if json.Unmarshal(data, &ack) == nil && ack.Ack != nil && !*ack.Ack {
+		return errors.New("batch rejected by target")
+	}
+	return nil
+}
@@ -0,0 +1,105 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/Tennen/Paimon/tools/bridge/config"
+)
+
+// sendWelcome delivers the configured welcome text and card to the user who
+// triggered a subscribe/enter_agent event through the app that received it,
+// at most once per cooldown. The cooldown starts once a message reached the
+// user, so a failed welcome is tried again on their next event.
+func sendWelcome(cfg config.Config, state *bridgeState, msg *wecomMessage) {
+	wc := cfg.Welcome
+	now := time.Now()
+	state.welcomeMu.Lock()
+	if now.Sub(state.welcomeSweep) > wc.CooldownPeriod {
+		for user, last := range state.welcomeSent {
+			if now.Sub(last) >= wc.CooldownPeriod {
+				delete(state.welcomeSent, user)
+			}
+		}
+		state.welcomeSweep = now
+	}
+	if last, ok := state.welcomeSent[msg.FromUser]; state.welcomeSending[msg.FromUser] || ok && now.Sub(last) < wc.CooldownPeriod {
+		state.welcomeMu.Unlock()
+		return
+	}
+	state.welcomeSending[msg.FromUser] = true
+	state.welcomeMu.Unlock()
+	sent := false
+	defer func() {
+		state.welcomeMu.Lock()
+		defer state.welcomeMu.Unlock()
+		delete(state.welcomeSending, msg.FromUser)
+		if sent && wc.CooldownPeriod > 0 {
+			state.welcomeSent[msg.FromUser] = now
+		}
+	}()
+
+	agentID, err := strconv.Atoi(firstNonEmpty(msg.AgentID, cfg.WeComAgentID))
+	if err != nil {
+		slog.Warn("wecom welcome skipped: missing agent id")
+		return
+	}
+	render := strings.NewReplacer(
+		"{{user}}", msg.FromUser,
+		"{{agentId}}", strconv.Itoa(agentID),
+		"{{event}}", msg.Event,
+		"{{corpId}}", msg.ToUser,
+		"{{date}}", now.Format("2006-01-02"),
+	).Replace
+
+	messages := make([]map[string]any, 0, 2)
+	if wc.Text != "" {
+		messages = append(messages, map[string]any{
+			"touser":  msg.FromUser,
+			"msgtype": "text",
+			"agentid": agentID,
+			"text":    map[string]any{"content": render(wc.Text)},
+		})
+	}
+	if wc.Card != nil {
+		messages = append(messages, map[string]any{
+			"touser":  msg.FromUser,
+			"msgtype": "textcard",
+			"agentid": agentID,
+			"textcard": map[string]any{
+				"title":       render(wc.Card.Title),
+				"description": render(wc.Card.Description),
+				"url":         render(wc.Card.URL),
+				"btntxt":      firstNonEmpty(render(wc.Card.ButtonText), "详情"),
+			},
+		})
+	}
+
+	token, err := state.tokenFor(strconv.Itoa(agentID)).get()
+	if err != nil {
+		slog.Warn("wecom welcome token failed", "err", err)
+		return
+	}
+	for _, m := range messages {
+		body, _ := json.Marshal(m)
+		record := outboundRecord(body, "bridge:welcome")
+		_, err := postWeComJSON(context.Background(), fmt.Sprintf("https://qyapi.weixin.qq.com/cgi-bin/message/send?access_token=%s", url.QueryEscape(token)), body, cfg.ProxyTimeouts["send"])
+		if err != nil {
+			record.Error = err.Error()
+		}
+		state.archive.Append(record)
+		state.sessions.observe(record, time.Now().UTC())
+		if err != nil {
+			slog.Warn("wecom welcome send failed", "user", msg.FromUser, "err", err)
+			return
+		}
+		sent = true
+	}
+	slog.Info("wecom welcome sent", "user", msg.FromUser, "event", msg.Event)
+}
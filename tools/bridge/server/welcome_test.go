@@ -0,0 +1,100 @@
+package server
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/Tennen/Paimon/tools/bridge/archive"
+	"github.com/Tennen/Paimon/tools/bridge/config"
+	"github.com/Tennen/Paimon/tools/bridge/metrics"
+)
+
+type roundTripFunc func(*http.Request) (*http.Response, error)
+
+func (f roundTripFunc) RoundTrip(r *http.Request) (*http.Response, error) { return f(r) }
+
+// welcomeSends replaces outboundTransport with one answering message/send
+// with errcode, and returns the access token and agent of each send.
+func welcomeSends(t *testing.T, errcode *int) func() []string {
+	var mu sync.Mutex
+	var sends []string
+	previous := outboundTransport
+	outboundTransport = roundTripFunc(func(r *http.Request) (*http.Response, error) {
+		var body struct {
+			AgentID int `json:"agentid"`
+		}
+		_ = json.NewDecoder(r.Body).Decode(&body)
+		mu.Lock()
+		sends = append(sends, r.URL.Query().Get("access_token")+"/"+strconv.Itoa(body.AgentID))
+		code := *errcode
+		mu.Unlock()
+		return &http.Response{StatusCode: http.StatusOK, Header: make(http.Header), Body: io.NopCloser(strings.NewReader(`{"errcode":` + strconv.Itoa(code) + `,"errmsg":"x"}`))}, nil
+	})
+	t.Cleanup(func() { outboundTransport = previous })
+	return func() []string {
+		mu.Lock()
+		defer mu.Unlock()
+		return append([]string(nil), sends...)
+	}
+}
+
+func TestSendWelcome(t *testing.T) {
+	errcode := 0
+	sends := welcomeSends(t, &errcode)
+	fresh := time.Now().Add(time.Hour)
+	state := &bridgeState{
+		metrics:        metrics.New(),
+		archive:        archive.New(100),
+		tokens:         &tokenManager{token: "default", expiresAt: fresh},
+		agentTokens:    map[string]*tokenManager{"1000002": {token: "app2", expiresAt: fresh}},
+		welcomeSent:    make(map[string]time.Time),
+		welcomeSending: make(map[string]bool),
+	}
+	cfg := config.Config{WeComAgentID: "1000001", Welcome: &config.Welcome{Text: "hi {{user}}", CooldownPeriod: 24 * time.Hour}}
+
+	// The app that received the event sends, with its own token.
+	sendWelcome(cfg, state, &wecomMessage{FromUser: "alice", AgentID: "1000002", Event: "enter_agent"})
+	sendWelcome(cfg, state, &wecomMessage{FromUser: "bob", Event: "subscribe"})
+	if got := strings.Join(sends(), " "); got != "app2/1000002 default/1000001" {
+		t.Fatal(got)
+	}
+	// Within the cooldown nothing more is sent.
+	sendWelcome(cfg, state, &wecomMessage{FromUser: "alice", AgentID: "1000002", Event: "enter_agent"})
+	if n := len(sends()); n != 2 {
+		t.Fatalf("%d sends", n)
+	}
+
+	// A failed send does not start the cooldown.
+	errcode = 45009
+	sendWelcome(cfg, state, &wecomMessage{FromUser: "carol", Event: "subscribe"})
+	errcode = 0
+	sendWelcome(cfg, state, &wecomMessage{FromUser: "carol", Event: "subscribe"})
+	if n := len(sends()); n != 4 {
+		t.Fatalf("%d sends", n)
+	}
+	if _, ok := state.welcomeSent["carol"]; !ok || len(state.welcomeSending) != 0 {
+		t.Fatal(state.welcomeSent, state.welcomeSending)
+	}
+
+	// Users whose cooldown has passed are forgotten on the next sweep.
+	state.welcomeSent["alice"] = time.Now().Add(-25 * time.Hour)
+	state.welcomeSweep = time.Now().Add(-25 * time.Hour)
+	sendWelcome(cfg, state, &wecomMessage{FromUser: "dave", Event: "subscribe"})
+	if _, ok := state.welcomeSent["alice"]; ok || len(state.welcomeSent) != 3 {
+		t.Fatal(state.welcomeSent)
+	}
+
+	// Without a cooldown nobody is remembered.
+	cfg.Welcome.CooldownPeriod = 0
+	sendWelcome(cfg, state, &wecomMessage{FromUser: "bob", Event: "subscribe"})
+	sendWelcome(cfg, state, &wecomMessage{FromUser: "bob", Event: "subscribe"})
+	if n := len(sends()); n != 7 || len(state.welcomeSent) != 0 {
+		t.Fatalf("%d sends, remembered %v", n, state.welcomeSent)
+	}
+}
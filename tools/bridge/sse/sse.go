@@ -0,0 +1,48 @@
+// Package sse reads server-sent event streams, as served by a bridge's
+// /stream and /replication/stream endpoints.
+package sse
+
+import (
+	"bufio"
+	"io"
+	"strconv"
+	"strings"
+)
+
+// maxLineBytes bounds a single data line; it matches the bridge's request
+// body limit, so any payload a bridge accepted can be read back.
+const maxLineBytes = 10 * 1024 * 1024
+
+// Read parses an event stream, calling fn for every event with data. It
+// returns io.EOF when the stream ends cleanly.
+func Read(body io.Reader, fn func(id int64, eventType string, data []byte)) error {
+	scanner := bufio.NewScanner(body)
+	scanner.Buffer(make([]byte, 64*1024), maxLineBytes)
+	var id int64
+	var eventType string
+	var data []byte
+	for scanner.Scan() {
+		line := scanner.Text()
+		switch {
+		case line == "":
+			if len(data) > 0 {
+				fn(id, eventType, data)
+			}
+			id, eventType, data = 0, "", nil
+		case strings.HasPrefix(line, ":"):
+		case strings.HasPrefix(line, "id:"):
+			id, _ = strconv.ParseInt(strings.TrimSpace(line[3:]), 10, 64)
+		case strings.HasPrefix(line, "event:"):
+			eventType = strings.TrimSpace(line[6:])
+		case strings.HasPrefix(line, "data:"):
+			if len(data) > 0 {
+				data = append(data, '\n')
+			}
+			data = append(data, strings.TrimPrefix(line[5:], " ")...)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return err
+	}
+	return io.EOF
+}
@@ -0,0 +1,24 @@
+package sse
+
+import (
+	"io"
+	"strings"
+	"testing"
+)
+
+func TestRead(t *testing.T) {
+	stream := ": keepalive\n\nid: 3\nevent: message\ndata: {\"a\":1}\n\nid: 4\ndata: line1\ndata:line2\n\nevent: ping\n\n"
+	var got []string
+	err := Read(strings.NewReader(stream), func(id int64, eventType string, data []byte) {
+		got = append(got, strings.Join([]string{eventType, string(data)}, "|"))
+		if id != int64(2+len(got)) {
+			t.Errorf("event %d: id %d", len(got), id)
+		}
+	})
+	if err != io.EOF {
+		t.Fatal(err)
+	}
+	if strings.Join(got, ",") != `message|{"a":1},|line1`+"\n"+`line2` {
+		t.Fatalf("%q", got)
+	}
+}
@@ -0,0 +1,114 @@
+package yamlconf
+
+import (
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"strings"
+)
+
+// convert turns a parsed node into a JSON-ready value, typing scalars by the
+// Go field they decode into; path names the node in errors.
+func convert(node any, t reflect.Type, path string) (any, error) {
+	for t != nil && t.Kind() == reflect.Pointer {
+		t = t.Elem()
+	}
+	switch v := node.(type) {
+	case map[string]any:
+		out := make(map[string]any, len(v))
+		for key, child := range v {
+			var childType reflect.Type
+			if t != nil {
+				switch t.Kind() {
+				case reflect.Map:
+					childType = t.Elem()
+				case reflect.Struct:
+					childType = fieldType(t, key)
+				}
+			}
+			converted, err := convert(child, childType, strings.TrimPrefix(path+"."+key, "."))
+			if err != nil {
+				return nil, err
+			}
+			out[key] = converted
+		}
+		return out, nil
+	case []any:
+		var elem reflect.Type
+		if t != nil && t.Kind() == reflect.Slice {
+			elem = t.Elem()
+		}
+		out := make([]any, len(v))
+		for i, child := range v {
+			converted, err := convert(child, elem, fmt.Sprintf("%s[%d]", path, i))
+			if err != nil {
+				return nil, err
+			}
+			out[i] = converted
+		}
+		return out, nil
+	case scalarNode:
+		if _, null := nulls[v.text]; null && v.plain {
+			return nil, nil
+		}
+		kind := reflect.Interface
+		if t != nil {
+			kind = t.Kind()
+		}
+		switch kind {
+		case reflect.String:
+			return v.text, nil
+		case reflect.Bool:
+			if b, ok := bools[v.text]; ok && v.plain {
+				return b, nil
+			}
+			return nil, fmt.Errorf("%s: expected true or false, got %q", path, v.text)
+		case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+			reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64,
+			reflect.Float32, reflect.Float64:
+			if !isNumber(v.text) || !v.plain {
+				return nil, fmt.Errorf("%s: expected a number, got %q", path, v.text)
+			}
+			return json.Number(v.text), nil
+		case reflect.Interface:
+			if !v.plain {
+				return v.text, nil
+			}
+			if b, ok := bools[v.text]; ok {
+				return b, nil
+			}
+			if isNumber(v.text) {
+				return json.Number(v.text), nil
+			}
+			return v.text, nil
+		}
+		return nil, fmt.Errorf("%s: expected %s, got %q", path, kind, v.text)
+	}
+	return nil, nil
+}
+
+// nulls are YAML 1.2's null scalars.
+var nulls = map[string]struct{}{"": {}, "~": {}, "null": {}, "Null": {}, "NULL": {}}
+
+// bools are YAML 1.2's booleans; YAML 1.1's yes, no, on and off are
+// strings.
+var bools = map[string]bool{"true": true, "True": true, "TRUE": true, "false": false, "False": false, "FALSE": false}
+
+// isNumber reports whether a plain scalar is a JSON number; YAML-only forms
+// such as 0x1F, +1 or .inf are not.
+func isNumber(text string) bool {
+	return text != "" && strings.ContainsRune("-0123456789", rune(text[0])) && json.Valid([]byte(text))
+}
+
+// fieldType returns the type of t's field whose JSON name is key, or nil
+// for unknown keys (which JSON decoding ignores).
+func fieldType(t reflect.Type, key string) reflect.Type {
+	for i := 0; i < t.NumField(); i++ {
+		field := t.Field(i)
+		name, _, _ := strings.Cut(field.Tag.Get("json"), ",")
+		if field.IsExported() && name == key {
+			return field.Type
+		}
+	}
+	return nil
+}
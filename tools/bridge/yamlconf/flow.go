@@ -0,0 +1,215 @@
+package yamlconf
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+)
+
+// scalarNode is a scalar before its type is known; only plain scalars may
+// become numbers, booleans or null.
+type scalarNode struct {
+	text  string
+	plain bool
+}
+
+// parseFlow parses a scalar or flow collection starting at s[*i]. Plain
+// scalars end at a comment or, inside a flow collection, at , ] or } (and :
+// for keys).
+func parseFlow(s string, i *int, inFlow bool) (any, error) {
+	skipSpace(s, i)
+	if *i >= len(s) {
+		return scalarNode{plain: true}, nil
+	}
+	switch s[*i] {
+	case '[':
+		*i++
+		items := make([]any, 0)
+		for {
+			skipSpace(s, i)
+			if *i < len(s) && s[*i] == ']' {
+				*i++
+				return items, nil
+			}
+			item, err := parseFlow(s, i, true)
+			if err != nil {
+				return nil, err
+			}
+			items = append(items, item)
+			if err := flowSeparator(s, i, ']'); err != nil {
+				return nil, err
+			}
+			if s[*i-1] == ']' {
+				return items, nil
+			}
+		}
+	case '{':
+		*i++
+		m := make(map[string]any)
+		for {
+			skipSpace(s, i)
+			if *i < len(s) && s[*i] == '}' {
+				*i++
+				return m, nil
+			}
+			if *i >= len(s) {
+				return nil, unterminated('}')
+			}
+			key, err := parseFlowKey(s, i)
+			if err != nil {
+				return nil, err
+			}
+			if _, dup := m[key]; dup {
+				return nil, fmt.Errorf("duplicate key %q", key)
+			}
+			value, err := parseFlow(s, i, true)
+			if err != nil {
+				return nil, err
+			}
+			m[key] = value
+			if err := flowSeparator(s, i, '}'); err != nil {
+				return nil, err
+			}
+			if s[*i-1] == '}' {
+				return m, nil
+			}
+		}
+	case '"', '\'':
+		text, err := quoted(s, i)
+		return scalarNode{text: text}, err
+	case '&', '*', '!':
+		return nil, unsupported("anchors, aliases and tags are")
+	case '@', '`':
+		return nil, fmt.Errorf("plain scalars cannot start with %q, quote the value", s[*i])
+	}
+	start := *i
+	for *i < len(s) {
+		c := s[*i]
+		if inFlow && (c == ',' || c == ']' || c == '}') {
+			break
+		}
+		if c == '#' && *i > start && s[*i-1] == ' ' {
+			break
+		}
+		*i++
+	}
+	text := strings.TrimSpace(s[start:*i])
+	if strings.Contains(text, ": ") || strings.HasSuffix(text, ":") {
+		// YAML reads this as a nested mapping (or rejects it).
+		return nil, fmt.Errorf("plain scalar %q contains \": \", quote the value", text)
+	}
+	return scalarNode{text: text, plain: true}, nil
+}
+
+func parseFlowKey(s string, i *int) (string, error) {
+	skipSpace(s, i)
+	var key string
+	plain := *i >= len(s) || (s[*i] != '"' && s[*i] != '\'')
+	if !plain {
+		var err error
+		if key, err = quoted(s, i); err != nil {
+			return "", err
+		}
+	} else {
+		start := *i
+		for *i < len(s) && s[*i] != ':' && s[*i] != ',' && s[*i] != '}' {
+			*i++
+		}
+		key = strings.TrimSpace(s[start:*i])
+		if key != "" && strings.ContainsRune("&*!?", rune(key[0])) {
+			return "", unsupported("anchors, aliases, tags and complex keys are")
+		}
+	}
+	skipSpace(s, i)
+	if key == "" || *i >= len(s) || s[*i] != ':' {
+		return "", errors.New("expected key: value in flow mapping")
+	}
+	*i++
+	if plain && *i < len(s) && !strings.ContainsRune(" ,}", rune(s[*i])) {
+		// A plain key runs on to the next ": ", so YAML reads a:b as one key.
+		return "", fmt.Errorf("expected a space after %q in flow mapping", key+":")
+	}
+	return key, nil
+}
+
+func flowSeparator(s string, i *int, closing byte) error {
+	skipSpace(s, i)
+	if *i >= len(s) {
+		return unterminated(closing)
+	}
+	if s[*i] != ',' && s[*i] != closing {
+		return fmt.Errorf("unexpected %q in flow collection", s[*i])
+	}
+	*i++
+	return nil
+}
+
+func unterminated(closing byte) error {
+	return fmt.Errorf("unterminated flow collection, expected %q (multi-line flow collections are %w)", closing, ErrUnsupported)
+}
+
+func skipSpace(s string, i *int) {
+	for *i < len(s) && s[*i] == ' ' {
+		*i++
+	}
+}
+
+// quoted reads a single- or double-quoted scalar starting at s[*i].
+func quoted(s string, i *int) (string, error) {
+	quote := s[*i]
+	for j := *i + 1; j < len(s); j++ {
+		switch {
+		case quote == '"' && s[j] == '\\':
+			j++
+		case quote == '\'' && s[j] == '\'' && j+1 < len(s) && s[j+1] == '\'':
+			j++
+		case s[j] == quote:
+			raw := s[*i : j+1]
+			*i = j + 1
+			if quote == '\'' {
+				return strings.ReplaceAll(raw[1:len(raw)-1], "''", "'"), nil
+			}
+			return unescape(raw[1 : len(raw)-1])
+		}
+	}
+	return "", fmt.Errorf("unterminated quoted string (multi-line quoted scalars are %w)", ErrUnsupported)
+}
+
+// escapes maps YAML's single-character escapes to their values.
+var escapes = map[byte]string{
+	'0': "\x00", 'a': "\a", 'b': "\b", 't': "\t", '\t': "\t", 'n': "\n",
+	'v': "\v", 'f': "\f", 'r': "\r", 'e': "\x1b", ' ': " ", '"': `"`,
+	'/': "/", '\\': `\`, 'N': "\u0085", '_': "\u00a0", 'L': "\u2028", 'P': "\u2029",
+}
+
+// unescape resolves the escape sequences of a double-quoted scalar.
+func unescape(s string) (string, error) {
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		if s[i] != '\\' {
+			b.WriteByte(s[i])
+			continue
+		}
+		if i+1 == len(s) {
+			return "", errors.New(`invalid escape "\" at end of double-quoted string`)
+		}
+		i++
+		if v, ok := escapes[s[i]]; ok {
+			b.WriteString(v)
+			continue
+		}
+		digits := map[byte]int{'x': 2, 'u': 4, 'U': 8}[s[i]]
+		if digits == 0 || i+1+digits > len(s) {
+			return "", fmt.Errorf(`invalid escape "\%c" in double-quoted string`, s[i])
+		}
+		code, err := strconv.ParseUint(s[i+1:i+1+digits], 16, 32)
+		if err != nil || !utf8.ValidRune(rune(code)) {
+			return "", fmt.Errorf(`invalid escape "\%s" in double-quoted string`, s[i:i+1+digits])
+		}
+		b.WriteRune(rune(code))
+		i += digits
+	}
+	return b.String(), nil
+}
@@ -0,0 +1,397 @@
+// Package yamlconf decodes the YAML subset used for bridge config files into
+// JSON, so a YAML file is validated by the same json.Unmarshal as a JSON one.
+//
+// Supported: block mappings and sequences, flow collections on one line,
+// plain, single- and double-quoted scalars, literal (|) and folded (>) block
+// scalars with chomping indicators, and comments. Everything else returns an
+// error wrapping ErrUnsupported rather than being misread: anchors, aliases,
+// tags, merge keys, complex keys, directives, multiple documents, and plain,
+// quoted or flow values continued on the next line.
+package yamlconf
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"reflect"
+	"strings"
+)
+
+// ErrUnsupported is wrapped by errors for valid YAML outside the subset.
+var ErrUnsupported = errors.New("not supported")
+
+// Error is a syntax error or unsupported construct at a line of the input.
+type Error struct {
+	Line int
+	Err  error
+}
+
+func (e *Error) Error() string { return fmt.Sprintf("yaml line %d: %v", e.Line, e.Err) }
+
+func (e *Error) Unwrap() error { return e.Err }
+
+func unsupported(what string) error {
+	return fmt.Errorf("%s %w", what, ErrUnsupported)
+}
+
+// Decode converts data to JSON shaped for target, the Go type the JSON will
+// be decoded into: a plain scalar becomes a number or boolean only where
+// target has one, and the wrong kind is an error naming the field. A nil
+// target types plain scalars by their look.
+func Decode(data []byte, target reflect.Type) ([]byte, error) {
+	p := &parser{lines: strings.Split(strings.ReplaceAll(string(data), "\r\n", "\n"), "\n")}
+	doc, err := p.parseDocument()
+	if err != nil {
+		return nil, err
+	}
+	value, err := convert(doc, target, "")
+	if err != nil {
+		return nil, err
+	}
+	return json.Marshal(value)
+}
+
+type parser struct {
+	lines []string
+	pos   int
+	// started is set once the document has content; a later "---" starts
+	// a second document.
+	started bool
+	// stop is the error for the line at pos where peek stopped early.
+	stop error
+}
+
+func (p *parser) errorf(format string, args ...any) error {
+	return &Error{Line: p.pos + 1, Err: fmt.Errorf(format, args...)}
+}
+
+// peek returns the indentation and content of the next line that is not
+// blank or a comment, without consuming it. It reports false at the end of
+// the document, setting p.stop if the document ended on an error.
+func (p *parser) peek() (int, string, bool) {
+	if p.stop != nil {
+		return 0, "", false
+	}
+	for ; p.pos < len(p.lines); p.pos++ {
+		line := p.lines[p.pos]
+		text := strings.TrimLeft(line, " ")
+		indent := len(line) - len(text)
+		if strings.TrimSpace(text) == "" {
+			continue
+		}
+		if strings.HasPrefix(text, "\t") {
+			p.stop = p.errorf("tabs are not allowed for indentation")
+			return 0, "", false
+		}
+		if text = stripComment(text); text == "" {
+			continue
+		}
+		if indent == 0 {
+			// Directives and document markers only count in column 0.
+			switch {
+			case text[0] == '%':
+				p.stop = p.errorf("directives are %w", ErrUnsupported)
+				return 0, "", false
+			case text == "---" && !p.started:
+				continue
+			case text == "...":
+				// A document end marker is fine if nothing follows it.
+				for _, rest := range p.lines[p.pos+1:] {
+					if stripComment(strings.TrimSpace(rest)) != "" {
+						p.stop = p.errorf("multiple documents are %w", ErrUnsupported)
+						return 0, "", false
+					}
+				}
+				p.pos = len(p.lines)
+				return 0, "", false
+			case strings.HasPrefix(text, "--- ") && !p.started:
+				p.stop = p.errorf("content on the \"---\" line is %w", ErrUnsupported)
+				return 0, "", false
+			case text == "---" || strings.HasPrefix(text, "--- "):
+				p.stop = p.errorf("multiple documents are %w", ErrUnsupported)
+				return 0, "", false
+			}
+		}
+		p.started = true
+		return indent, text, true
+	}
+	return 0, "", false
+}
+
+func (p *parser) parseDocument() (any, error) {
+	indent, _, ok := p.peek()
+	if !ok {
+		if p.stop != nil {
+			return nil, p.stop
+		}
+		return map[string]any{}, nil
+	}
+	doc, err := p.parseBlock(indent)
+	if err != nil {
+		return nil, err
+	}
+	if _, text, ok := p.peek(); ok {
+		return nil, p.errorf("unexpected %q", text)
+	}
+	if p.stop != nil {
+		return nil, p.stop
+	}
+	return doc, nil
+}
+
+func (p *parser) parseBlock(indent int) (any, error) {
+	_, text, _ := p.peek()
+	if isSeqItem(text) {
+		return p.parseSeq(indent)
+	}
+	return p.parseMap(indent)
+}
+
+func isSeqItem(text string) bool {
+	return text == "-" || strings.HasPrefix(text, "- ")
+}
+
+// misindented returns the error for a line indented deeper than its block.
+// After a scalar it would continue that scalar, which the subset does not
+// allow.
+func (p *parser) misindented(text string, afterScalar bool) error {
+	if afterScalar && !isSeqItem(text) && keyEnd(text) < 0 {
+		return p.errorf("multi-line plain scalars are %w, use a | or > block scalar", ErrUnsupported)
+	}
+	return p.errorf("unexpected indentation")
+}
+
+func (p *parser) parseSeq(indent int) (any, error) {
+	items := make([]any, 0)
+	afterScalar := false
+	for {
+		ind, text, ok := p.peek()
+		if !ok || ind < indent || (ind == indent && !isSeqItem(text)) {
+			return items, nil
+		}
+		if ind > indent {
+			return nil, p.misindented(text, afterScalar)
+		}
+		rest := strings.TrimLeft(text[1:], " ")
+		var item any
+		var err error
+		afterScalar = false
+		switch {
+		case rest == "":
+			p.pos++
+			if next, _, ok := p.peek(); ok && next > indent {
+				item, err = p.parseBlock(next)
+			}
+		case keyEnd(rest) >= 0 || isSeqItem(rest):
+			// "- key: value" opens a mapping (or nested sequence) whose
+			// lines are indented to the column of "key".
+			col := ind + len(text) - len(rest)
+			p.lines[p.pos] = strings.Repeat(" ", col) + rest
+			item, err = p.parseBlock(col)
+		default:
+			p.pos++
+			item, afterScalar, err = p.parseInline(rest, indent)
+		}
+		if err != nil {
+			return nil, err
+		}
+		items = append(items, item)
+	}
+}
+
+func (p *parser) parseMap(indent int) (any, error) {
+	m := make(map[string]any)
+	afterScalar := false
+	for {
+		ind, text, ok := p.peek()
+		if !ok || ind < indent || (ind == indent && isSeqItem(text)) {
+			return m, nil
+		}
+		if ind > indent {
+			return nil, p.misindented(text, afterScalar)
+		}
+		if text == "?" || strings.HasPrefix(text, "? ") {
+			return nil, p.errorf("complex keys (?) are %w", ErrUnsupported)
+		}
+		end := keyEnd(text)
+		if end < 0 {
+			return nil, p.errorf("expected \"key: value\", got %q", text)
+		}
+		key, err := parseKey(text[:end])
+		if err != nil {
+			return nil, p.errorf("%w", err)
+		}
+		if _, dup := m[key]; dup {
+			return nil, p.errorf("duplicate key %q", key)
+		}
+		rest := strings.TrimSpace(text[end+1:])
+		p.pos++
+		var value any
+		afterScalar = false
+		if rest == "" {
+			next, nextText, ok := p.peek()
+			switch {
+			case ok && next > indent:
+				value, err = p.parseBlock(next)
+			case ok && next == indent && isSeqItem(nextText):
+				value, err = p.parseSeq(indent)
+			}
+		} else {
+			value, afterScalar, err = p.parseInline(rest, indent)
+		}
+		if err != nil {
+			return nil, err
+		}
+		m[key] = value
+	}
+}
+
+// keyEnd returns the index of the colon ending a mapping key, or -1.
+func keyEnd(text string) int {
+	if text == "" || strings.ContainsRune("[{", rune(text[0])) {
+		return -1
+	}
+	var quote byte
+	for i := 0; i < len(text); i++ {
+		c := text[i]
+		switch {
+		case quote != 0:
+			if c == quote {
+				quote = 0
+			}
+		case (c == '"' || c == '\'') && i == 0:
+			quote = c
+		case c == ':' && (i+1 == len(text) || text[i+1] == ' '):
+			return i
+		}
+	}
+	return -1
+}
+
+func parseKey(raw string) (string, error) {
+	raw = strings.TrimSpace(raw)
+	switch {
+	case raw == "":
+		return "", errors.New("empty key")
+	case raw == "<<":
+		return "", unsupported("merge keys (<<) are")
+	case raw[0] == '&' || raw[0] == '*' || raw[0] == '!':
+		return "", unsupported("anchors, aliases and tags are")
+	case raw[0] == '"' || raw[0] == '\'':
+		i := 0
+		s, err := quoted(raw, &i)
+		if err != nil || i != len(raw) {
+			return "", fmt.Errorf("invalid key %s", raw)
+		}
+		return s, nil
+	}
+	return raw, nil
+}
+
+// parseInline parses the value after "key:" or "- ": a block scalar
+// indicator, a flow collection or a scalar. scalar reports a one-line
+// scalar, which a deeper indented next line would continue.
+func (p *parser) parseInline(rest string, indent int) (value any, scalar bool, err error) {
+	if rest[0] == '|' || rest[0] == '>' {
+		value, err = p.parseBlockScalar(rest, indent)
+		return value, false, err
+	}
+	i := 0
+	value, err = parseFlow(rest, &i, false)
+	if err == nil && strings.TrimSpace(rest[i:]) != "" {
+		err = fmt.Errorf("unexpected %q", rest[i:])
+	}
+	if err != nil {
+		p.pos--
+		return nil, false, p.errorf("%w", err)
+	}
+	_, scalar = value.(scalarNode)
+	return value, scalar, nil
+}
+
+// parseBlockScalar reads a literal (|) or folded (>) scalar, with optional
+// "-" (strip) or "+" (keep) chomping.
+func (p *parser) parseBlockScalar(header string, indent int) (any, error) {
+	chomp := strings.TrimLeft(header[1:], " ")
+	if chomp != "" && chomp != "-" && chomp != "+" {
+		p.pos--
+		if strings.ContainsAny(chomp, "123456789") {
+			return nil, p.errorf("block scalar indentation indicators are %w", ErrUnsupported)
+		}
+		return nil, p.errorf("unsupported block scalar header %q", header)
+	}
+	var lines []string
+	contentIndent := -1
+	for ; p.pos < len(p.lines); p.pos++ {
+		line := p.lines[p.pos]
+		trimmed := strings.TrimLeft(line, " ")
+		ind := len(line) - len(trimmed)
+		if trimmed == "" {
+			lines = append(lines, "")
+			continue
+		}
+		if ind <= indent {
+			break
+		}
+		if contentIndent < 0 {
+			contentIndent = ind
+		}
+		if ind < contentIndent {
+			break
+		}
+		lines = append(lines, line[contentIndent:])
+	}
+	joined := strings.Join(lines, "\n")
+	body := strings.TrimRight(joined, "\n")
+	trailing := len(joined) - len(body)
+	if header[0] == '>' {
+		var b strings.Builder
+		for i, line := range strings.Split(body, "\n") {
+			switch {
+			case i == 0:
+			case line == "":
+				b.WriteByte('\n')
+				continue
+			case !strings.HasSuffix(b.String(), "\n"):
+				b.WriteByte(' ')
+			}
+			b.WriteString(line)
+		}
+		body = b.String()
+	}
+	switch chomp {
+	case "":
+		if body != "" {
+			body += "\n"
+		}
+	case "+":
+		body += strings.Repeat("\n", trailing+1)
+	}
+	return scalarNode{text: body}, nil
+}
+
+// stripComment removes a trailing " # comment" outside quotes.
+func stripComment(text string) string {
+	if strings.HasPrefix(text, "#") {
+		return ""
+	}
+	var quote byte
+	for i := 0; i < len(text); i++ {
+		c := text[i]
+		switch {
+		case quote != 0:
+			if c == '\\' && quote == '"' {
+				i++
+			} else if c == quote {
+				quote = 0
+			}
+		case c == '"' || c == '\'':
+			if i == 0 || strings.ContainsRune(" [{,:-", rune(text[i-1])) {
+				quote = c
+			}
+		case c == '#' && text[i-1] == ' ':
+			return strings.TrimRight(text[:i], " ")
+		}
+	}
+	return strings.TrimRight(text, " ")
+}
@@ -0,0 +1,198 @@
+package yamlconf
+
+import (
+	"errors"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestDecode(t *testing.T) {
+	for _, tc := range []struct {
+		name string
+		in   string
+		want string
+	}{
+		{"empty", "", `{}`},
+		{"document marker", "---\na: 1\n", `{"a":1}`},
+		{"document end", "a: 1\n...\n# done\n", `{"a":1}`},
+		{"block maps", "a:\n  b: 1\n  c:\n    d: x\ne: y\n", `{"a":{"b":1,"c":{"d":"x"}},"e":"y"}`},
+		{"block sequences", "items:\n  - a\n  - 2\n  -\n    k: v\n  - name: n\n    value: 1\n  - - x\n    - y\n", `{"items":["a",2,{"k":"v"},{"name":"n","value":1},["x","y"]]}`},
+		{"sequence at key indent", "items:\n- a\n- b\nnext: 1\n", `{"items":["a","b"],"next":1}`},
+		{"top-level sequence", "- a\n- b: 1\n", `["a",{"b":1}]`},
+		{"flow collections", "a: [1, \"two\", {b: c}, []]\nm: {x: 1, 'y': \"z\", e: {}}\n", `{"a":[1,"two",{"b":"c"},[]],"m":{"e":{},"x":1,"y":"z"}}`},
+		{"nested flow mappings", "m: {a: {b: [1, {c: d}]}, e: }\n", `{"m":{"a":{"b":[1,{"c":"d"}]},"e":null}}`},
+		{"json-style flow mapping", `m: {"a":1, "b":[true]}` + "\n", `{"m":{"a":1,"b":[true]}}`},
+		{"flow plain scalar with space", "a: [1 2]\n", `{"a":["1 2"]}`},
+		{"double quotes", `d: "a\"b\n\u00e9"` + "\n", `{"d":"a\"b\né"}`},
+		{"yaml escapes", `d: "\x41\/\e\_\U0001F600"` + "\n", `{"d":"A/\u001b` + "\u00a0\U0001F600" + `"}`},
+		{"single quotes", "s: 'it''s'\n", `{"s":"it's"}`},
+		{"backslash in single quotes", `s: 'C:\path'` + "\n", `{"s":"C:\\path"}`},
+		{"quoted colon and hash", "a: \"x: y\"\nb: 'k # v'\n", `{"a":"x: y","b":"k # v"}`},
+		{"quoted keys", "\"q k\": 1\n'k2': v\n", `{"k2":"v","q k":1}`},
+		{"hash inside quotes", "h: \"a # b\"\n", `{"h":"a # b"}`},
+		{"comments", "# top\na: 1 # trailing\nb: a#b\nc: \"x\" # c\n  # indented\nd: [1, 2] # e\n", `{"a":1,"b":"a#b","c":"x","d":[1,2]}`},
+		{"colon in value", "url: http://x.y/z\n", `{"url":"http://x.y/z"}`},
+		{"literal block", "lit: |\n  l1\n  l2\n\n  l3\nend: 1\n", `{"end":1,"lit":"l1\nl2\n\nl3\n"}`},
+		{"chomping", "strip: |-\n  x\n\nkeep: |+\n  y\n\nend: 1\n", `{"end":1,"keep":"y\n\n","strip":"x"}`},
+		{"folded block", "fold: >\n  a\n  b\n\n  c\n", `{"fold":"a b\nc\n"}`},
+		{"plain scalar types", "n1:\nn2: ~\nn3: null\nn4: NULL\nb: true\nB: False\nq: \"true\"\nf: 1.5\ns: yes\nh: 0x1F\n", `{"B":false,"b":true,"f":1.5,"h":"0x1F","n1":null,"n2":null,"n3":null,"n4":null,"q":"true","s":"yes"}`},
+		{"crlf", "a: 1\r\nb: 2\r\n", `{"a":1,"b":2}`},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			got, err := Decode([]byte(tc.in), nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if string(got) != tc.want {
+				t.Fatalf("got %s, want %s", got, tc.want)
+			}
+		})
+	}
+}
+
+func TestDecodeErrors(t *testing.T) {
+	for _, tc := range []struct {
+		in   string
+		want string
+	}{
+		{"a:\n\tb: 1\n", "yaml line 2: tabs are not allowed for indentation"},
+		{"a: 1\n  b: 2\n", "yaml line 2: unexpected indentation"},
+		{"a:\n  - x\n   - y\n", "yaml line 3: unexpected indentation"},
+		{"a: 1\nb: 2\na: 3\n", `yaml line 3: duplicate key "a"`},
+		{"a: {b: 1, b: 2}\n", `yaml line 1: duplicate key "b"`},
+		{"a: 1\njust text\n", `yaml line 2: expected "key: value", got "just text"`},
+		{"- a\nb: 1\n", `yaml line 2: unexpected "b: 1"`},
+		{"a: {b}\n", "yaml line 1: expected key: value in flow mapping"},
+		{"a: {b:c}\n", `yaml line 1: expected a space after "b:" in flow mapping`},
+		{"a: [1] x\n", `yaml line 1: unexpected " x"`},
+		{"a: [\"x\" y]\n", `yaml line 1: unexpected 'y' in flow collection`},
+		{"a: b: c\n", `yaml line 1: plain scalar "b: c" contains ": ", quote the value`},
+		{"a: [b: c]\n", `yaml line 1: plain scalar "b: c" contains ": ", quote the value`},
+		{"a: @x\n", `yaml line 1: plain scalars cannot start with '@', quote the value`},
+		{"a: 1\nb: \"\\q\"\n", `yaml line 2: invalid escape "\q" in double-quoted string`},
+		{`a: "\u00g1"` + "\n", `yaml line 1: invalid escape "\u00g1" in double-quoted string`},
+		{`a: "\x4"` + "\n", `yaml line 1: invalid escape "\x" in double-quoted string`},
+		{"a: |x\n  y\n", `yaml line 1: unsupported block scalar header "|x"`},
+	} {
+		_, err := Decode([]byte(tc.in), nil)
+		if err == nil || err.Error() != tc.want {
+			t.Errorf("%q: got %v, want %s", tc.in, err, tc.want)
+		}
+		if errors.Is(err, ErrUnsupported) {
+			t.Errorf("%q: syntax error wraps ErrUnsupported", tc.in)
+		}
+	}
+}
+
+func TestDecodeUnsupported(t *testing.T) {
+	for _, tc := range []struct {
+		name string
+		in   string
+		want string
+	}{
+		{"anchor", "a: &x 1\n", "yaml line 1: anchors, aliases and tags are not supported"},
+		{"alias", "a: 1\nb: *x\n", "yaml line 2: anchors, aliases and tags are not supported"},
+		{"alias in flow", "a: [1, *x]\n", "yaml line 1: anchors, aliases and tags are not supported"},
+		{"anchored block", "a: &x\n  b: 1\n", "yaml line 1: anchors, aliases and tags are not supported"},
+		{"anchored key", "&x a: 1\n", "yaml line 1: anchors, aliases and tags are not supported"},
+		{"flow alias key", "a: {*x : 1}\n", "yaml line 1: anchors, aliases, tags and complex keys are not supported"},
+		{"tag", "a: !tag x\n", "yaml line 1: anchors, aliases and tags are not supported"},
+		{"core tag", "a: !!str 1\n", "yaml line 1: anchors, aliases and tags are not supported"},
+		{"merge key", "base: 1\nb:\n  <<: 1\n", "yaml line 3: merge keys (<<) are not supported"},
+		{"complex key", "? a\n: 1\n", "yaml line 1: complex keys (?) are not supported"},
+		{"directive", "%YAML 1.2\n---\na: 1\n", "yaml line 1: directives are not supported"},
+		{"second document", "a: 1\n---\nb: 2\n", "yaml line 2: multiple documents are not supported"},
+		{"content after end", "a: 1\n...\nb: 2\n", "yaml line 2: multiple documents are not supported"},
+		{"content on marker", "--- a\n", `yaml line 1: content on the "---" line is not supported`},
+		{"multi-line plain", "a: one\n  two\n", "yaml line 2: multi-line plain scalars are not supported, use a | or > block scalar"},
+		{"multi-line plain item", "- one\n  two\n", "yaml line 2: multi-line plain scalars are not supported, use a | or > block scalar"},
+		{"multi-line double quotes", "a: \"one\n  two\"\n", "yaml line 1: unterminated quoted string (multi-line quoted scalars are not supported)"},
+		{"multi-line single quotes", "a: 'one\n  two'\n", "yaml line 1: unterminated quoted string (multi-line quoted scalars are not supported)"},
+		{"multi-line flow sequence", "a: [1, 2\n", `yaml line 1: unterminated flow collection, expected ']' (multi-line flow collections are not supported)`},
+		{"multi-line flow mapping", "a:\n  b: {c: 1,\n    d: 2}\n", `yaml line 2: unterminated flow collection, expected '}' (multi-line flow collections are not supported)`},
+		{"indentation indicator", "a: |2\n   x\n", "yaml line 1: block scalar indentation indicators are not supported"},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			_, err := Decode([]byte(tc.in), nil)
+			if err == nil || err.Error() != tc.want {
+				t.Fatalf("got %v, want %s", err, tc.want)
+			}
+			var yamlErr *Error
+			if !errors.Is(err, ErrUnsupported) || !errors.As(err, &yamlErr) {
+				t.Fatalf("%v does not wrap ErrUnsupported in an *Error", err)
+			}
+		})
+	}
+}
+
+func TestDecodeTypes(t *testing.T) {
+	type tls struct {
+		Domains []string `json:"domains"`
+	}
+	type config struct {
+		Port    int            `json:"port"`
+		DataDir string         `json:"dataDir"`
+		Debug   bool           `json:"debug"`
+		Ratio   float64        `json:"ratio"`
+		TLS     *tls           `json:"tls"`
+		Limits  map[string]int `json:"limits"`
+		Extra   any            `json:"extra"`
+	}
+	target := reflect.TypeOf(config{})
+	got, err := Decode([]byte("port: 8443\ndataDir: 123\ndebug: TRUE\nratio: -0.5\ntls:\n  domains: [a.example.com, 42]\nlimits: {send: 10}\nextra: [1, x]\nunknown: 1\n"), target)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := `{"dataDir":"123","debug":true,"extra":[1,"x"],"limits":{"send":10},"port":8443,"ratio":-0.5,"tls":{"domains":["a.example.com","42"]},"unknown":1}`; string(got) != want {
+		t.Fatalf("got %s, want %s", got, want)
+	}
+	for in, want := range map[string]string{
+		"port: abc\n":            `port: expected a number, got "abc"`,
+		"port: \"8080\"\n":       `port: expected a number, got "8080"`,
+		"port: 0x1F\n":           `port: expected a number, got "0x1F"`,
+		"port: .inf\n":           `port: expected a number, got ".inf"`,
+		"debug: yes\n":           `debug: expected true or false, got "yes"`,
+		"debug: 'true'\n":        `debug: expected true or false, got "true"`,
+		"limits: {send: many}\n": `limits.send: expected a number, got "many"`,
+	} {
+		_, err := Decode([]byte(in), target)
+		if err == nil || err.Error() != want {
+			t.Errorf("%q: got %v, want %s", in, err, want)
+		}
+	}
+}
+
+func TestParseFlow(t *testing.T) {
+	for _, tc := range []struct {
+		in     string
+		inFlow bool
+		want   any
+		end    int
+	}{
+		{"[a, b] # c", false, []any{scalarNode{text: "a", plain: true}, scalarNode{text: "b", plain: true}}, 6},
+		{"{k: v}", false, map[string]any{"k": scalarNode{text: "v", plain: true}}, 6},
+		{"a, b", true, scalarNode{text: "a", plain: true}, 1},
+		{"a, b", false, scalarNode{text: "a, b", plain: true}, 4},
+		{"x # y", false, scalarNode{text: "x", plain: true}, 2},
+		{`"q", r`, true, scalarNode{text: "q"}, 3},
+		{"", false, scalarNode{plain: true}, 0},
+	} {
+		i := 0
+		got, err := parseFlow(tc.in, &i, tc.inFlow)
+		if err != nil {
+			t.Fatalf("%q: %v", tc.in, err)
+		}
+		if !reflect.DeepEqual(got, tc.want) || i != tc.end {
+			t.Errorf("%q: got %#v at %d, want %#v at %d", tc.in, got, i, tc.want, tc.end)
+		}
+	}
+}
+
+func TestErrorLine(t *testing.T) {
+	_, err := Decode([]byte("a: 1\nb:\n  c: [1,\n"), nil)
+	var yamlErr *Error
+	if !errors.As(err, &yamlErr) || yamlErr.Line != 3 || !strings.HasPrefix(yamlErr.Err.Error(), "unterminated flow collection") {
+		t.Fatalf("%#v", err)
+	}
+}
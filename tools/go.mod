@@ -0,0 +1,3 @@
+module github.com/Tennen/Paimon/tools
+
+go 1.24
@@ -0,0 +1,197 @@
+// Package callback decodes the XML messages and events WeCom posts to an
+// app's callback URL once they have been decrypted (see package
+// wecom/crypto).
+package callback
+
+import (
+	"encoding/json"
+	"encoding/xml"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Envelope is the XML of a callback, before or after decryption. Before,
+// only Encrypt (and the addressing fields) are set.
+type Envelope struct {
+	XMLName      xml.Name `xml:"xml"`
+	MsgType      string   `xml:"MsgType"`
+	CreateTime   string   `xml:"CreateTime"`
+	Event        string   `xml:"Event"`
+	EventKey     string   `xml:"EventKey"`
+	Content      string   `xml:"Content"`
+	FromUserName string   `xml:"FromUserName"`
+	ToUserName   string   `xml:"ToUserName"`
+	AgentID      string   `xml:"AgentID"`
+	AgentId      string   `xml:"AgentId"`
+	MsgId        string   `xml:"MsgId"`
+	MsgID        string   `xml:"MsgID"`
+	MediaId      string   `xml:"MediaId"`
+	PicUrl       string   `xml:"PicUrl"`
+	ChatId       string   `xml:"ChatId"`
+	Encrypt      string   `xml:"Encrypt"`
+}
+
+// Message is a decoded callback with trimmed fields.
+type Message struct {
+	MsgType    string
+	CreateTime time.Time
+	Event      string
+	EventKey   string
+	Content    string
+	FromUser   string
+	ToUser     string
+	AgentID    string
+	MsgID      string
+	MediaID    string
+	PicURL     string
+	// ChatID names the group chat a callback came from, if any.
+	ChatID string
+
+	// Detail holds every field of an event callback (menu clicks, scans,
+	// location, external contact changes, ...) minus the envelope.
+	Detail map[string]any
+}
+
+// Parse decodes a decrypted callback. It returns nil for malformed XML and
+// for callbacks without MsgType or sender; customer service
+// (kf_msg_or_event) events carry no sender and are accepted.
+func Parse(xmlText string) *Message {
+	var doc Envelope
+	if err := xml.Unmarshal([]byte(xmlText), &doc); err != nil {
+		return nil
+	}
+	msgType := strings.TrimSpace(doc.MsgType)
+	fromUser := strings.TrimSpace(doc.FromUserName)
+	// Customer service callbacks only name the account (OpenKfId).
+	kfEvent := msgType == "event" && strings.TrimSpace(doc.Event) == "kf_msg_or_event"
+	if msgType == "" || (fromUser == "" && !kfEvent) {
+		return nil
+	}
+	msgID := strings.TrimSpace(doc.MsgId)
+	if msgID == "" {
+		msgID = strings.TrimSpace(doc.MsgID)
+	}
+	var createTime time.Time
+	if sec, err := strconv.ParseInt(strings.TrimSpace(doc.CreateTime), 10, 64); err == nil && sec > 0 {
+		createTime = time.Unix(sec, 0).UTC()
+	}
+	var detail map[string]any
+	if msgType == "event" {
+		detail = EventDetail(xmlText)
+	}
+	agentID := strings.TrimSpace(doc.AgentID)
+	if agentID == "" {
+		agentID = strings.TrimSpace(doc.AgentId)
+	}
+	return &Message{
+		MsgType:    msgType,
+		CreateTime: createTime,
+		Event:      strings.TrimSpace(doc.Event),
+		EventKey:   strings.TrimSpace(doc.EventKey),
+		Content:    strings.TrimSpace(doc.Content),
+		FromUser:   fromUser,
+		ToUser:     strings.TrimSpace(doc.ToUserName),
+		AgentID:    agentID,
+		MsgID:      msgID,
+		MediaID:    strings.TrimSpace(doc.MediaId),
+		PicURL:     strings.TrimSpace(doc.PicUrl),
+		ChatID:     strings.TrimSpace(doc.ChatId),
+		Detail:     detail,
+	}
+}
+
+// ExtractEncrypted returns the Encrypt field of an encrypted callback body,
+// XML or JSON ("encrypt" or "Encrypt"), or "" if there is none.
+func ExtractEncrypted(body []byte) string {
+	trimmed := strings.TrimSpace(string(body))
+	if strings.HasPrefix(trimmed, "{") {
+		var obj map[string]any
+		if err := json.Unmarshal([]byte(trimmed), &obj); err != nil {
+			return ""
+		}
+		if v, ok := obj["encrypt"]; ok {
+			return fmt.Sprintf("%v", v)
+		}
+		if v, ok := obj["Encrypt"]; ok {
+			return fmt.Sprintf("%v", v)
+		}
+		return ""
+	}
+	var doc Envelope
+	if err := xml.Unmarshal(body, &doc); err != nil {
+		return ""
+	}
+	return strings.TrimSpace(doc.Encrypt)
+}
+
+// EventDetail returns the fields of an event callback keyed by element name
+// with a lower-case first letter, dropping the envelope shared by all
+// callbacks. Nested elements become objects; <item> and repeated elements
+// become lists.
+func EventDetail(xmlText string) map[string]any {
+	dec := xml.NewDecoder(strings.NewReader(xmlText))
+	for {
+		tok, err := dec.Token()
+		if err != nil {
+			return nil
+		}
+		if _, ok := tok.(xml.StartElement); !ok {
+			continue
+		}
+		v, err := decodeElement(dec)
+		fields, ok := v.(map[string]any)
+		if err != nil || !ok {
+			return nil
+		}
+		for _, key := range []string{"toUserName", "fromUserName", "createTime", "msgType", "agentID", "agentId"} {
+			delete(fields, key)
+		}
+		return fields
+	}
+}
+
+// decodeElement reads the content of the element whose start tag was just
+// consumed, returning its trimmed text or a map of its children.
+func decodeElement(dec *xml.Decoder) (any, error) {
+	var text strings.Builder
+	var fields map[string]any
+	for {
+		tok, err := dec.Token()
+		if err != nil {
+			return nil, err
+		}
+		switch t := tok.(type) {
+		case xml.StartElement:
+			v, err := decodeElement(dec)
+			if err != nil {
+				return nil, err
+			}
+			if fields == nil {
+				fields = make(map[string]any)
+			}
+			name := t.Name.Local
+			key := strings.ToLower(name[:1]) + name[1:]
+			switch prev := fields[key].(type) {
+			case []any:
+				fields[key] = append(prev, v)
+			case nil:
+				if name == "item" {
+					fields[key] = []any{v}
+				} else {
+					fields[key] = v
+				}
+			default:
+				fields[key] = []any{prev, v}
+			}
+		case xml.CharData:
+			text.Write(t)
+		case xml.EndElement:
+			if fields != nil {
+				return fields, nil
+			}
+			return strings.TrimSpace(text.String()), nil
+		}
+	}
+}
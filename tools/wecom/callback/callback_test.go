@@ -0,0 +1,90 @@
+package callback
+
+import (
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestParseText(t *testing.T) {
+	msg := Parse(`<xml><ToUserName><![CDATA[corp]]></ToUserName><FromUserName><![CDATA[zhangsan]]></FromUserName>
+<CreateTime>1348831860</CreateTime><MsgType><![CDATA[text]]></MsgType><Content><![CDATA[ hello ]]></Content>
+<MsgId>1234567890123456</MsgId><AgentID>1000002</AgentID><ChatId>wrchat</ChatId></xml>`)
+	want := &Message{
+		MsgType:    "text",
+		CreateTime: time.Unix(1348831860, 0).UTC(),
+		Content:    "hello",
+		FromUser:   "zhangsan",
+		ToUser:     "corp",
+		AgentID:    "1000002",
+		MsgID:      "1234567890123456",
+		ChatID:     "wrchat",
+	}
+	if !reflect.DeepEqual(msg, want) {
+		t.Fatalf("Parse = %+v", msg)
+	}
+}
+
+func TestParseAlternateSpellings(t *testing.T) {
+	msg := Parse(`<xml><FromUserName>u</FromUserName><MsgType>image</MsgType><MsgID>7</MsgID><AgentId>5</AgentId><MediaId>m</MediaId><PicUrl>http://p</PicUrl></xml>`)
+	if msg == nil || msg.MsgID != "7" || msg.AgentID != "5" || msg.MediaID != "m" || msg.PicURL != "http://p" || msg.Detail != nil {
+		t.Fatalf("Parse = %+v", msg)
+	}
+}
+
+func TestParseRejects(t *testing.T) {
+	for _, doc := range []string{
+		"",
+		"not xml",
+		`<xml><FromUserName>u</FromUserName></xml>`,
+		`<xml><MsgType>text</MsgType><Content>x</Content></xml>`,
+	} {
+		if msg := Parse(doc); msg != nil {
+			t.Errorf("Parse(%q) = %+v", doc, msg)
+		}
+	}
+	// Customer service events name no sender.
+	if msg := Parse(`<xml><MsgType>event</MsgType><Event>kf_msg_or_event</Event><Token>T</Token><OpenKfId>wk1</OpenKfId></xml>`); msg == nil || msg.Detail["openKfId"] != "wk1" {
+		t.Fatalf("kf event = %+v", msg)
+	}
+}
+
+func TestEventDetail(t *testing.T) {
+	msg := Parse(`<xml><ToUserName>corp</ToUserName><FromUserName>sys</FromUserName><CreateTime>1</CreateTime>
+<MsgType>event</MsgType><AgentID>1</AgentID><Event>change_external_contact</Event><ChangeType>add_external_contact</ChangeType>
+<ExternalUserID>wm1</ExternalUserID><ScanCodeInfo><ScanType>qrcode</ScanType><ScanResult>r</ScanResult></ScanCodeInfo>
+<SendPicsInfo><Count>2</Count><PicList><item><PicMd5Sum>a</PicMd5Sum></item><item><PicMd5Sum>b</PicMd5Sum></item></PicList></SendPicsInfo>
+<Tag>x</Tag><Tag>y</Tag></xml>`)
+	want := map[string]any{
+		"event":          "change_external_contact",
+		"changeType":     "add_external_contact",
+		"externalUserID": "wm1",
+		"scanCodeInfo":   map[string]any{"scanType": "qrcode", "scanResult": "r"},
+		"sendPicsInfo": map[string]any{"count": "2", "picList": map[string]any{"item": []any{
+			map[string]any{"picMd5Sum": "a"}, map[string]any{"picMd5Sum": "b"},
+		}}},
+		"tag": []any{"x", "y"},
+	}
+	if msg == nil || !reflect.DeepEqual(msg.Detail, want) {
+		t.Fatalf("Detail = %#v", msg.Detail)
+	}
+	if EventDetail("<xml><a>") != nil {
+		t.Fatal("truncated XML should give nil")
+	}
+}
+
+func TestExtractEncrypted(t *testing.T) {
+	for body, want := range map[string]string{
+		`<xml><ToUserName>c</ToUserName><Encrypt><![CDATA[ abc= ]]></Encrypt></xml>`: "abc=",
+		`{"encrypt":"j1"}`:    "j1",
+		`{"Encrypt":"j2"}`:    "j2",
+		`{"other":1}`:         "",
+		`{bad json`:           "",
+		`<xml><Encrypt>`:      "",
+		`<xml><a>1</a></xml>`: "",
+	} {
+		if got := ExtractEncrypted([]byte(body)); got != want {
+			t.Errorf("ExtractEncrypted(%s) = %q, want %q", body, got, want)
+		}
+	}
+}
@@ -0,0 +1,174 @@
+// Package crypto implements WeCom's callback message encryption and
+// signatures, and the HMAC signature the bridge puts on payloads it
+// delivers.
+//
+// WeCom encrypts a callback as random(16) + big-endian message length(4) +
+// message + receive ID, PKCS7-padded to 32 bytes and AES-256-CBC encrypted
+// with the 43-character EncodingAESKey; the IV is the first 16 key bytes.
+package crypto
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha1"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// ErrInvalidKey is returned for an EncodingAESKey that does not decode to
+// 32 bytes.
+var ErrInvalidKey = errors.New("invalid aes key")
+
+// Decrypt returns the message in an encrypted callback. A non-empty
+// receiveID must match the one in the payload (the corp ID, or the suite
+// ID for third-party apps). ok is false for a wrong key, a receive ID
+// mismatch or a corrupted payload.
+func Decrypt(encrypted, aesKey, receiveID string) (msg string, ok bool) {
+	key, err := base64.StdEncoding.DecodeString(aesKey + "=")
+	if err != nil || len(key) != 32 {
+		return "", false
+	}
+	cipherText, err := base64.StdEncoding.DecodeString(encrypted)
+	if err != nil {
+		return "", false
+	}
+	if len(cipherText) == 0 || len(cipherText)%aes.BlockSize != 0 {
+		return "", false
+	}
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return "", false
+	}
+	mode := cipher.NewCBCDecrypter(block, key[:aes.BlockSize])
+	plain := make([]byte, len(cipherText))
+	mode.CryptBlocks(plain, cipherText)
+	plain = pkcs7Unpad(plain)
+	if len(plain) < 20 {
+		return "", false
+	}
+	msgEnd := 20 + int(binary.BigEndian.Uint32(plain[16:20]))
+	if msgEnd > len(plain) {
+		return "", false
+	}
+	if receiveID != "" && string(plain[msgEnd:]) != receiveID {
+		return "", false
+	}
+	return string(plain[20:msgEnd]), true
+}
+
+// Encrypt is the counterpart of Decrypt, with fresh random bytes each call.
+func Encrypt(plain, aesKey, receiveID string) (string, error) {
+	key, err := base64.StdEncoding.DecodeString(aesKey + "=")
+	if err != nil || len(key) != 32 {
+		return "", ErrInvalidKey
+	}
+	random := make([]byte, 16)
+	if _, err := rand.Read(random); err != nil {
+		return "", err
+	}
+	var buf bytes.Buffer
+	buf.Write(random)
+	lenBytes := make([]byte, 4)
+	binary.BigEndian.PutUint32(lenBytes, uint32(len(plain)))
+	buf.Write(lenBytes)
+	buf.WriteString(plain)
+	buf.WriteString(receiveID)
+	data := pkcs7Pad(buf.Bytes(), 32)
+
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return "", err
+	}
+	mode := cipher.NewCBCEncrypter(block, key[:aes.BlockSize])
+	out := make([]byte, len(data))
+	mode.CryptBlocks(out, data)
+	return base64.StdEncoding.EncodeToString(out), nil
+}
+
+func pkcs7Pad(buf []byte, blockSize int) []byte {
+	pad := blockSize - len(buf)%blockSize
+	return append(buf, bytes.Repeat([]byte{byte(pad)}, pad)...)
+}
+
+func pkcs7Unpad(buf []byte) []byte {
+	if len(buf) == 0 {
+		return buf
+	}
+	pad := int(buf[len(buf)-1])
+	if pad < 1 || pad > 32 || pad > len(buf) {
+		return buf
+	}
+	return buf[:len(buf)-pad]
+}
+
+// Signature returns WeCom's msg_signature (or URL verification signature):
+// the hex SHA-1 of the non-empty parts, sorted and concatenated. The parts
+// are the token, timestamp, nonce and, when present, the encrypted value.
+func Signature(parts ...string) string {
+	filtered := make([]string, 0, len(parts))
+	for _, p := range parts {
+		if p != "" {
+			filtered = append(filtered, p)
+		}
+	}
+	sort.Strings(filtered)
+	sum := sha1.Sum([]byte(strings.Join(filtered, "")))
+	return hex.EncodeToString(sum[:])
+}
+
+// VerifySignature reports whether signature matches Signature(parts...),
+// comparing in constant time.
+func VerifySignature(signature string, parts ...string) bool {
+	return signature != "" && hmac.Equal([]byte(signature), []byte(Signature(parts...)))
+}
+
+// SignPayload returns the X-Bridge-Signature value for body:
+// "t=<unix time>,v1=<hex HMAC-SHA256 of "<unix time>.<body>">".
+func SignPayload(secret string, body []byte, now time.Time) string {
+	ts := strconv.FormatInt(now.Unix(), 10)
+	return fmt.Sprintf("t=%s,v1=%s", ts, payloadMAC(secret, ts, body))
+}
+
+// VerifyPayload checks an X-Bridge-Signature value against body. The
+// signature must be no older (or newer) than tolerance; zero skips the
+// time check.
+func VerifyPayload(secret, header string, body []byte, now time.Time, tolerance time.Duration) bool {
+	var ts, v1 string
+	for _, part := range strings.Split(header, ",") {
+		key, value, _ := strings.Cut(strings.TrimSpace(part), "=")
+		switch key {
+		case "t":
+			ts = value
+		case "v1":
+			v1 = value
+		}
+	}
+	sec, err := strconv.ParseInt(ts, 10, 64)
+	if err != nil || v1 == "" {
+		return false
+	}
+	if tolerance > 0 {
+		if age := now.Sub(time.Unix(sec, 0)); age > tolerance || age < -tolerance {
+			return false
+		}
+	}
+	return hmac.Equal([]byte(v1), []byte(payloadMAC(secret, ts, body)))
+}
+
+func payloadMAC(secret, ts string, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(ts + "."))
+	mac.Write(body)
+	return hex.EncodeToString(mac.Sum(nil))
+}
@@ -0,0 +1,98 @@
+package crypto
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+// The URL verification example from WeCom's callback documentation.
+const (
+	docToken     = "QDG6eK"
+	docAESKey    = "jWmYm7qr5nMoAUwZRjGtBxmz3KA1tkAj3ykkR6q2B2C"
+	docReceiveID = "wx5823bf96d3bd56c7"
+	docTimestamp = "1409659589"
+	docNonce     = "263014780"
+	docEchostr   = "P9nAzCzyDtyTWESHep1vC5X9xho/qYX3Zpb4yKa9SKld1DsH3Iyt3tP3zNdtp+4RPcs8TgAE7OaBO+FZXvnaqQ=="
+	docSignature = "5c45ff5e21c57e6ad56bac8758b79b1d9ac89fd3"
+)
+
+func TestDecryptDocumentationExample(t *testing.T) {
+	msg, ok := Decrypt(docEchostr, docAESKey, docReceiveID)
+	if !ok || msg != "1616140317555161061" {
+		t.Fatalf("Decrypt = %q, %v", msg, ok)
+	}
+	if got := Signature(docToken, docTimestamp, docNonce, docEchostr); got != docSignature {
+		t.Fatalf("Signature = %s", got)
+	}
+	if !VerifySignature(docSignature, docToken, docTimestamp, docNonce, docEchostr) {
+		t.Fatal("VerifySignature rejected the example")
+	}
+	if VerifySignature(docSignature, docToken, docTimestamp, "1", docEchostr) || VerifySignature("", docToken) {
+		t.Fatal("VerifySignature accepted a wrong signature")
+	}
+}
+
+func TestEncryptRoundTrip(t *testing.T) {
+	for _, plain := range []string{"", "hi", "<xml><Content><![CDATA[你好]]></Content></xml>", strings.Repeat("x", 1000)} {
+		enc, err := Encrypt(plain, docAESKey, docReceiveID)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got, ok := Decrypt(enc, docAESKey, docReceiveID); !ok || got != plain {
+			t.Fatalf("round trip of %q = %q, %v", plain, got, ok)
+		}
+		if got, ok := Decrypt(enc, docAESKey, ""); !ok || got != plain {
+			t.Fatalf("empty receive ID should accept any: %q, %v", got, ok)
+		}
+	}
+	a, _ := Encrypt("same", docAESKey, docReceiveID)
+	b, _ := Encrypt("same", docAESKey, docReceiveID)
+	if a == b {
+		t.Fatal("Encrypt is not randomized")
+	}
+}
+
+func TestDecryptRejects(t *testing.T) {
+	enc, _ := Encrypt("hello", docAESKey, docReceiveID)
+	otherKey := "a" + docAESKey[1:]
+	cases := map[string][3]string{
+		"receive id":  {enc, docAESKey, "wrong"},
+		"key":         {enc, otherKey, docReceiveID},
+		"short key":   {enc, "abc", ""},
+		"not base64":  {"%%%", docAESKey, ""},
+		"not a block": {"YWJj", docAESKey, ""},
+		"empty":       {"", docAESKey, ""},
+		"truncated":   {enc[:len(enc)-4], docAESKey, ""},
+	}
+	for name, c := range cases {
+		if msg, ok := Decrypt(c[0], c[1], c[2]); ok {
+			t.Errorf("%s: Decrypt accepted, got %q", name, msg)
+		}
+	}
+	if _, err := Encrypt("x", "short", ""); err != ErrInvalidKey {
+		t.Fatalf("Encrypt with a bad key: %v", err)
+	}
+}
+
+func TestSignPayload(t *testing.T) {
+	now := time.Unix(1700000000, 0)
+	body := []byte(`{"a":1}`)
+	sig := SignPayload("s3cret", body, now)
+	if !strings.HasPrefix(sig, "t=1700000000,v1=") || len(sig) != len("t=1700000000,v1=")+64 {
+		t.Fatalf("SignPayload = %s", sig)
+	}
+	if !VerifyPayload("s3cret", sig, body, now.Add(time.Minute), 5*time.Minute) {
+		t.Fatal("VerifyPayload rejected a fresh signature")
+	}
+	for name, ok := range map[string]bool{
+		"secret":  VerifyPayload("other", sig, body, now, 0),
+		"body":    VerifyPayload("s3cret", sig, []byte(`{"a":2}`), now, 0),
+		"expired": VerifyPayload("s3cret", sig, body, now.Add(10*time.Minute), 5*time.Minute),
+		"garbage": VerifyPayload("s3cret", "v1=abc", body, now, 0),
+	} {
+		if ok {
+			t.Errorf("VerifyPayload accepted a wrong %s", name)
+		}
+	}
+}